@@ -17,15 +17,23 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"time"
 
 	"github.com/spf13/pflag"
+	extensionClient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"k8s.io/component-base/cli/flag"
 	"k8s.io/component-base/logs"
 	"k8s.io/kubernetes/pkg/version/verflag"
+	"tkestack.io/galaxy/pkg/ipam/client/clientset/versioned"
+	"tkestack.io/galaxy/pkg/ipam/migrate"
 	"tkestack.io/galaxy/pkg/ipam/server"
 )
 
@@ -33,6 +41,17 @@ func main() {
 	// initialize rand seed
 	rand.Seed(time.Now().UTC().UnixNano())
 
+	if len(os.Args) > 1 {
+		if run, ok := map[string]func([]string) error{"migrate": runMigrate, "export": runExport,
+			"import": runImport}[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err) // nolint: errcheck
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	s := server.NewServer()
 	// add command line args
 	s.AddFlags(pflag.CommandLine)
@@ -50,3 +69,126 @@ func main() {
 	}
 	//TODO handle signal ?
 }
+
+// subcommand holds the config and clients which subcommands share
+type subcommand struct {
+	configPath, master, kubeConf string
+	conf                         server.JsonConf
+	client                       kubernetes.Interface
+	crdClient                    versioned.Interface
+	extClient                    extensionClient.Interface
+}
+
+func (c *subcommand) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.configPath, "config", "/etc/galaxy/galaxy-ipam.json", "The json config file location of"+
+		" galaxy-ipam")
+	fs.StringVar(&c.master, "master", "", "The address and port of the Kubernetes API server")
+	fs.StringVar(&c.kubeConf, "kubeconfig", "", "The kube config file location of APISwitch, used to support TLS")
+}
+
+// init loads the json config and builds clients after flags are parsed
+func (c *subcommand) init() error {
+	data, err := ioutil.ReadFile(c.configPath)
+	if err != nil {
+		return fmt.Errorf("read json config: %v", err)
+	}
+	if err := json.Unmarshal(data, &c.conf); err != nil {
+		return fmt.Errorf("bad config %s: %v", string(data), err)
+	}
+	cfg, err := clientcmd.BuildConfigFromFlags(c.master, c.kubeConf)
+	if err != nil {
+		return fmt.Errorf("error building kubeconfig: %v", err)
+	}
+	if c.client, err = kubernetes.NewForConfig(cfg); err != nil {
+		return fmt.Errorf("error building kubernetes clientset: %v", err)
+	}
+	if c.crdClient, err = versioned.NewForConfig(cfg); err != nil {
+		return fmt.Errorf("error building float ip clientset: %v", err)
+	}
+	if c.extClient, err = extensionClient.NewForConfig(cfg); err != nil {
+		return fmt.Errorf("error building extension clientset: %v", err)
+	}
+	return nil
+}
+
+// runMigrate runs `galaxy-ipam migrate` subcommand which migrates ips between storage drivers
+func runMigrate(args []string) error {
+	var (
+		c   subcommand
+		opt migrate.Options
+	)
+	fs := pflag.NewFlagSet("migrate", pflag.ExitOnError)
+	c.addFlags(fs)
+	opt.AddFlags(fs)
+	fs.Parse(args) // nolint: errcheck
+	logs.InitLogs()
+	defer logs.FlushLogs()
+
+	if err := c.init(); err != nil {
+		return err
+	}
+	return migrate.Run(&c.conf.SchedulePluginConf, c.client, c.crdClient, c.extClient, &opt)
+}
+
+// runExport runs `galaxy-ipam export` subcommand which writes ipam state to a backup file
+func runExport(args []string) error {
+	var (
+		c    subcommand
+		file string
+	)
+	fs := pflag.NewFlagSet("export", pflag.ExitOnError)
+	c.addFlags(fs)
+	fs.StringVar(&file, "file", "galaxy-ipam-backup.json", "The backup file to write")
+	fs.Parse(args) // nolint: errcheck
+	logs.InitLogs()
+	defer logs.FlushLogs()
+
+	if err := c.init(); err != nil {
+		return err
+	}
+	backup, err := migrate.Export(&c.conf.SchedulePluginConf, c.client, c.crdClient)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal backup: %v", err)
+	}
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		return fmt.Errorf("failed to write backup: %v", err)
+	}
+	return nil
+}
+
+// runImport runs `galaxy-ipam import` subcommand which restores ipam state from a backup file
+func runImport(args []string) error {
+	var (
+		c            subcommand
+		file         string
+		dryRun       bool
+		resourceLock string
+	)
+	fs := pflag.NewFlagSet("import", pflag.ExitOnError)
+	c.addFlags(fs)
+	fs.StringVar(&file, "file", "galaxy-ipam-backup.json", "The backup file to read")
+	fs.BoolVar(&dryRun, "dry-run", false, "Only validate the backup against the current state without importing")
+	fs.StringVar(&resourceLock, "leader-elect-resource-lock", resourcelock.EndpointsResourceLock, "The type of "+
+		"resource object galaxy-ipam uses for leader election, importing is refused if the lease is held")
+	fs.Parse(args) // nolint: errcheck
+	logs.InitLogs()
+	defer logs.FlushLogs()
+
+	if err := c.init(); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %v", err)
+	}
+	var backup migrate.Backup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return fmt.Errorf("bad backup %s: %v", file, err)
+	}
+	return migrate.Import(&c.conf.SchedulePluginConf, c.client, c.crdClient, c.extClient, &backup, dryRun,
+		resourceLock)
+}
@@ -142,7 +142,8 @@ func CmdAdd(cmdArgs *skel.CmdArgs, networkInfos []*NetworkInfo) (types.Result, e
 			glog.Errorf("fail to add network %s: %v, begin to rollback and delete it", networkInfo.Args, err)
 			delErr := CmdDel(cmdArgs, idx)
 			glog.Warningf("fail to delete cni in rollback %v", delErr)
-			return nil, fmt.Errorf("fail to establish network %s:%v", networkInfo.Args, err)
+			return nil, &DelegateError{NetworkTypes: []string{networkInfo.NetworkType},
+				Err: fmt.Errorf("fail to establish network %s:%v", networkInfo.Args, err)}
 		}
 	}
 	if err != nil {
@@ -202,11 +203,26 @@ func CmdDel(cmdArgs *skel.CmdArgs, lastIdx int) error {
 		if err := saveNetworkInfo(cmdArgs.ContainerID, fails); err != nil {
 			glog.Warningf("Error save network info %v for %s: %v", fails, cmdArgs.ContainerID, err)
 		}
-		return fmt.Errorf(strings.Join(errorSet, " / "))
+		var networkTypes []string
+		for i := range fails {
+			networkTypes = append(networkTypes, fails[i].NetworkType)
+		}
+		return &DelegateError{NetworkTypes: networkTypes, Err: fmt.Errorf(strings.Join(errorSet, " / "))}
 	}
 	return nil
 }
 
+// DelegateError is returned by CmdAdd and CmdDel if any delegate cni plugin fails
+type DelegateError struct {
+	// NetworkTypes are network types of the failed delegate cni plugins
+	NetworkTypes []string
+	Err          error
+}
+
+func (e *DelegateError) Error() string {
+	return e.Err.Error()
+}
+
 // IPInfoToResult converts IPInfo to Result
 func IPInfoToResult(ipInfo *constant.IPInfo) *t020.Result {
 	return &t020.Result{
@@ -274,11 +290,14 @@ func saveNetworkInfo(containerID string, infos []*NetworkInfo) error {
 }
 
 func consumeNetworkInfo(containerID string) ([]*NetworkInfo, error) {
-	var infos []*NetworkInfo
-	path := filepath.Join(stateDir, containerID)
-	defer os.Remove(path) // nolint: errcheck
+	defer os.Remove(filepath.Join(stateDir, containerID)) // nolint: errcheck
+	return LoadNetworkInfo(containerID)
+}
 
-	data, err := ioutil.ReadFile(path)
+// LoadNetworkInfo restores networkInfos of the container from disk without removing them
+func LoadNetworkInfo(containerID string) ([]*NetworkInfo, error) {
+	var infos []*NetworkInfo
+	data, err := ioutil.ReadFile(filepath.Join(stateDir, containerID))
 	if err != nil {
 		return infos, err
 	}
@@ -31,6 +31,18 @@ const (
 	MultusCNIAnnotation = "k8s.v1.cni.cncf.io/networks"
 
 	CommonCNIArgsKey = "common"
+
+	// IPAnnotation asks for a specific ip, e.g. 10.0.0.2, or a comma separated ip list for pods of statefulset or
+	// tapp, e.g. 10.0.0.2,10.0.0.3 gives 10.0.0.2 to pod xxx-0 and 10.0.0.3 to pod xxx-1
+	IPAnnotation = "k8s.v1.cni.galaxy.io/ip"
+
+	// NodeRoutableSubnetAnnotation declares the routable subnet of a node, e.g. 10.0.0.0/24, instead of resolving it
+	// by the InternalIP of the node, which may be the wrong address if the node has multiple NICs
+	NodeRoutableSubnetAnnotation = "k8s.v1.cni.galaxy.io/routable-subnet"
+
+	// IPAMsAnnotation selects named ipams which a pod gets an ip from besides the first ipam, a comma separated
+	// list of ipam names, e.g. second,storage. Ipinfos of the pod are in the order of the first ipam and the list.
+	IPAMsAnnotation = "k8s.v1.cni.galaxy.io/ipams"
 )
 
 // ParseExtendedCNIArgs parses extended cni args from pod annotation
@@ -52,6 +64,8 @@ type IPInfo struct {
 	Vlan           uint16      `json:"vlan"`
 	Gateway        net.IP      `json:"gateway"`
 	RoutableSubnet *nets.IPNet `json:"routable_subnet"` //the node subnet
+	// Network is the multus network which the ip is allocated for, empty if the ip is for any network of the pod
+	Network string `json:"network,omitempty"`
 }
 
 // FormatIPInfo formats ipInfos as extended CNI Args annotation value
@@ -93,12 +107,16 @@ const (
 	ReleasePolicyPodDelete ReleasePolicy = iota // release ip as soon as possible
 	ReleasePolicyImmutable
 	ReleasePolicyNever
+	ReleasePolicyTTL // release ip once ttl expires after the pod is gone
 )
 
 const (
 	ReleasePolicyAnnotation = "k8s.v1.cni.galaxy.io/release-policy"
 	Immutable               = "immutable" // Release IP Only when deleting or scale down App
 	Never                   = "never"     // Never Release IP
+	TTL                     = "ttl"       // Release IP once ttl expires after the pod is gone
+	// ReleaseTTLAnnotation is the ttl of ips of ttl release policy, e.g. 24h
+	ReleaseTTLAnnotation = "k8s.v1.cni.galaxy.io/release-ttl"
 )
 
 func ConvertReleasePolicy(policyStr string) ReleasePolicy {
@@ -107,6 +125,8 @@ func ConvertReleasePolicy(policyStr string) ReleasePolicy {
 		return ReleasePolicyNever
 	case Immutable:
 		return ReleasePolicyImmutable
+	case TTL:
+		return ReleasePolicyTTL
 	default:
 		return ReleasePolicyPodDelete
 	}
@@ -22,6 +22,7 @@ const (
 )
 
 var (
-	LabelKeyEnableSecondIP = "galaxy.io/secondip"
-	LabelValueEnabled      = "true"
+	LabelKeyEnableSecondIP  = "galaxy.io/secondip"
+	LabelKeyEnableDualStack = "galaxy.io/dualstack"
+	LabelValueEnabled       = "true"
 )
@@ -138,6 +138,9 @@ type ExtenderBindingResult struct {
 	Error string
 }
 
+// MaxPriority is the max score of HostPriority which an extender should return
+const MaxPriority = 10
+
 // HostPriority represents the priority of scheduling to a particular host, higher priority is better.
 type HostPriority struct {
 	// Name of the host
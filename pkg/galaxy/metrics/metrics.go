@@ -0,0 +1,77 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Namespace is the prometheus namespace of galaxy metrics
+const Namespace = "galaxy"
+
+var (
+	// CNIRequests counts cni requests by command, network types and result
+	CNIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "cni_requests_total",
+		Help:      "Number of cni requests by command, network types and result.",
+	}, []string{"command", "network", "result"})
+	// CNIRequestLatency is the latency of cni requests by command and network types
+	CNIRequestLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "cni_request_duration_seconds",
+		Help:      "Latency of cni requests by command and network types in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 15),
+	}, []string{"command", "network"})
+	// DelegatePluginFailures counts failed executions of delegate cni plugins by command and network type
+	DelegatePluginFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "delegate_plugin_failures_total",
+		Help:      "Number of failed executions of delegate cni plugins by command and network type.",
+	}, []string{"command", "network"})
+	// PortMappingErrors counts port mapping errors by operation, setup or cleanup
+	PortMappingErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "port_mapping_errors_total",
+		Help:      "Number of port mapping errors by operation.",
+	}, []string{"operation"})
+	// PolicySyncLatency is the latency of syncing network policies
+	PolicySyncLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "policy_sync_duration_seconds",
+		Help:      "Latency of syncing network policies, rules and pod chains in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 15),
+	})
+	// GCCleanups counts leaky resources removed by gc by type, ip file, state file or veth
+	GCCleanups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "gc_cleanups_total",
+		Help:      "Number of leaky resources removed by gc by type.",
+	}, []string{"type"})
+)
+
+var registerOnce sync.Once
+
+// Register registers galaxy metrics to the default prometheus registry
+func Register() {
+	registerOnce.Do(func() {
+		prometheus.MustRegister(CNIRequests, CNIRequestLatency, DelegatePluginFailures, PortMappingErrors,
+			PolicySyncLatency, GCCleanups)
+	})
+}
@@ -30,6 +30,7 @@ type ServerRunOptions struct {
 	JsonConfigPath       string
 	NetworkPolicy        bool
 	PProf                bool
+	MetricsAddress       string
 }
 
 func NewServerRunOptions() *ServerRunOptions {
@@ -56,4 +57,6 @@ func (s *ServerRunOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&s.JsonConfigPath, "json-config-path", s.JsonConfigPath, "The json config file location of galaxy")
 	fs.BoolVar(&s.NetworkPolicy, "network-policy", s.NetworkPolicy, "Enable network policy function")
 	fs.BoolVar(&s.PProf, "pprof", s.PProf, "Enable pprof")
+	fs.StringVar(&s.MetricsAddress, "metrics-address", s.MetricsAddress, "The tcp address to serve /metrics and "+
+		"/healthz on, e.g. 0.0.0.0:9102, disabled if empty")
 }
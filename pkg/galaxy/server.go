@@ -25,11 +25,13 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
 	t020 "github.com/containernetworking/cni/pkg/types/020"
 	"github.com/emicklei/go-restful"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -42,6 +44,7 @@ import (
 	"tkestack.io/galaxy/pkg/api/galaxy/private"
 	"tkestack.io/galaxy/pkg/api/k8s"
 	k8sutil "tkestack.io/galaxy/pkg/api/k8s/utils"
+	"tkestack.io/galaxy/pkg/galaxy/metrics"
 )
 
 func (g *Galaxy) StartServer() error {
@@ -50,6 +53,9 @@ func (g *Galaxy) StartServer() error {
 			http.ListenAndServe("127.0.0.1:0", nil)
 		}()
 	}
+	if g.MetricsAddress != "" {
+		g.startMetricsServer()
+	}
 	g.installHandlers()
 	if err := os.MkdirAll(private.GalaxySocketDir, 0755); err != nil {
 		return fmt.Errorf("failed to create %s: %v", private.GalaxySocketDir, err)
@@ -72,6 +78,19 @@ func (g *Galaxy) StartServer() error {
 	return nil
 }
 
+// startMetricsServer serves /metrics and /healthz on a tcp listener
+func (g *Galaxy) startMetricsServer() {
+	metrics.Register()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	go func() {
+		glog.Fatal(http.ListenAndServe(g.MetricsAddress, mux))
+	}()
+}
+
 func (g *Galaxy) installHandlers() {
 	ws := new(restful.WebService)
 	ws.Route(ws.GET("/cni").To(g.cni))
@@ -109,6 +128,10 @@ func (g *Galaxy) cni(r *restful.Request, w *restful.Response) {
 func (g *Galaxy) requestFunc(req *galaxyapi.PodRequest) (data []byte, err error) {
 	start := time.Now()
 	glog.Infof("%v, %s+", req, start.Format(time.StampMicro))
+	var networkTypes []string
+	defer func() {
+		observeCNIRequest(req.Command, networkTypes, start, err)
+	}()
 	if req.Command == cniutil.COMMAND_ADD {
 		defer func() {
 			glog.Infof("%v, data %s, err %v, %s-", req, string(data), err, start.Format(time.StampMicro))
@@ -118,7 +141,8 @@ func (g *Galaxy) requestFunc(req *galaxyapi.PodRequest) (data []byte, err error)
 		if err != nil {
 			return
 		}
-		result, err1 := g.cmdAdd(req, pod)
+		result, networkInfos, err1 := g.cmdAdd(req, pod)
+		networkTypes = getNetworkTypes(networkInfos)
 		if err1 != nil {
 			err = err1
 			return
@@ -133,9 +157,10 @@ func (g *Galaxy) requestFunc(req *galaxyapi.PodRequest) (data []byte, err error)
 				}
 				err = g.setupPortMapping(req, req.ContainerID, result020, pod)
 				if err != nil {
+					metrics.PortMappingErrors.WithLabelValues("setup").Inc()
 					return
 				}
-				pod.Status.PodIP = result020.IP4.IP.IP.String()
+				pod.Status.PodIP = podIP(result020).String()
 				if g.pm != nil {
 					if err := g.pm.SyncPodChains(pod); err != nil {
 						glog.Warning(err)
@@ -146,9 +171,14 @@ func (g *Galaxy) requestFunc(req *galaxyapi.PodRequest) (data []byte, err error)
 		}
 	} else if req.Command == cniutil.COMMAND_DEL {
 		defer glog.Infof("%v err %v, %s-", req, err, start.Format(time.StampMicro))
+		if networkInfos, err1 := cniutil.LoadNetworkInfo(req.ContainerID); err1 == nil {
+			networkTypes = getNetworkTypes(networkInfos)
+		}
 		err = cniutil.CmdDel(req.CmdArgs, -1)
 		if err == nil {
-			err = g.cleanupPortMapping(req)
+			if err = g.cleanupPortMapping(req); err != nil {
+				metrics.PortMappingErrors.WithLabelValues("cleanup").Inc()
+			}
 		}
 	} else {
 		err = fmt.Errorf("unknown command %s", req.Command)
@@ -156,6 +186,29 @@ func (g *Galaxy) requestFunc(req *galaxyapi.PodRequest) (data []byte, err error)
 	return
 }
 
+// observeCNIRequest records the result and latency of a cni request and failures of delegate cni plugins
+func observeCNIRequest(command string, networkTypes []string, start time.Time, err error) {
+	network, result := strings.Join(networkTypes, ","), "success"
+	if err != nil {
+		result = "failure"
+		if delegateErr, ok := err.(*cniutil.DelegateError); ok {
+			for _, networkType := range delegateErr.NetworkTypes {
+				metrics.DelegatePluginFailures.WithLabelValues(command, networkType).Inc()
+			}
+		}
+	}
+	metrics.CNIRequests.WithLabelValues(command, network, result).Inc()
+	metrics.CNIRequestLatency.WithLabelValues(command, network).Observe(time.Since(start).Seconds())
+}
+
+func getNetworkTypes(networkInfos []*cniutil.NetworkInfo) []string {
+	var networkTypes []string
+	for i := range networkInfos {
+		networkTypes = append(networkTypes, networkInfos[i].NetworkType)
+	}
+	return networkTypes
+}
+
 // #lizard forgives
 func (g *Galaxy) resolveNetworks(req *galaxyapi.PodRequest, pod *corev1.Pod) ([]*cniutil.NetworkInfo, error) {
 	var networkInfos []*cniutil.NetworkInfo
@@ -192,20 +245,60 @@ func (g *Galaxy) resolveNetworks(req *galaxyapi.PodRequest, pod *corev1.Pod) ([]
 				networkInfos[i].Args[k] = string([]byte(v))
 			}
 		}
+		if err := assignIPInfos(networkInfos); err != nil {
+			return nil, fmt.Errorf("pod %s_%s: %v", pod.Name, pod.Namespace, err)
+		}
 	}
 	glog.V(4).Infof("pod %s_%s networkInfo %v", pod.Name, pod.Namespace, networkInfos)
 	return networkInfos, nil
 }
 
-func (g *Galaxy) cmdAdd(req *galaxyapi.PodRequest, pod *corev1.Pod) (types.Result, error) {
+// assignIPInfos passes each network only its own ipinfos if galaxy-ipam allocates ips per network, networks which have
+// no ipinfo of their own get none. Galaxy-ipam tags either all or none of ipinfos of a pod.
+func assignIPInfos(networkInfos []*cniutil.NetworkInfo) error {
+	if len(networkInfos) == 0 || networkInfos[0].Args[constant.IPInfosKey] == "" {
+		return nil
+	}
+	var ipInfos []constant.IPInfo
+	if err := json.Unmarshal([]byte(networkInfos[0].Args[constant.IPInfosKey]), &ipInfos); err != nil {
+		return fmt.Errorf("failed to unmarshal ipinfos: %v", err)
+	}
+	byNetwork := map[string][]constant.IPInfo{}
+	for i := range ipInfos {
+		byNetwork[ipInfos[i].Network] = append(byNetwork[ipInfos[i].Network], ipInfos[i])
+	}
+	if len(byNetwork[""]) == len(ipInfos) {
+		return nil
+	}
+	if untagged := byNetwork[""]; len(untagged) > 0 {
+		return fmt.Errorf("ipinfo of ip %s has no network while others have", untagged[0].IP.IP.String())
+	}
+	for i := range networkInfos {
+		own := byNetwork[networkInfos[i].NetworkType]
+		if len(own) == 0 {
+			delete(networkInfos[i].Args, constant.IPInfosKey)
+			continue
+		}
+		data, err := json.Marshal(own)
+		if err != nil {
+			return fmt.Errorf("failed to marshal ipinfos: %v", err)
+		}
+		networkInfos[i].Args[constant.IPInfosKey] = string(data)
+	}
+	return nil
+}
+
+// cmdAdd resolves networks of the pod and sets up them, networkInfos are returned for metrics
+func (g *Galaxy) cmdAdd(req *galaxyapi.PodRequest, pod *corev1.Pod) (types.Result, []*cniutil.NetworkInfo, error) {
 	if err := disableIPv6(req.Netns); err != nil {
 		glog.Warningf("Error disable ipv6 %v", err)
 	}
 	networkInfos, err := g.resolveNetworks(req, pod)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return cniutil.CmdAdd(req.CmdArgs, networkInfos)
+	result, err := cniutil.CmdAdd(req.CmdArgs, networkInfos)
+	return result, networkInfos, err
 }
 
 // parseExtendedCNIArgs parses extended cni args from pod's annotation
@@ -273,6 +366,10 @@ func (g *Galaxy) setupPortMapping(req *galaxyapi.PodRequest, containerID string,
 	if len(req.Ports) == 0 {
 		return nil
 	}
+	if result.IP4 == nil {
+		return fmt.Errorf("port mapping requires an IPv4 address, but pod %s only has an IPv6 address %s",
+			k8s.GetPodFullName(req.PodName, req.PodNamespace), result.IP6.IP.IP.String())
+	}
 	for i := range req.Ports {
 		req.Ports[i].PodIP = result.IP4.IP.IP.To4().String()
 		req.Ports[i].PodName = req.PodName
@@ -382,16 +479,26 @@ func convertResult(result types.Result) (*t020.Result, error) {
 	if !ok {
 		return nil, fmt.Errorf("faild to convert result to 020 result")
 	}
-	if result020.IP4 == nil {
-		return nil, fmt.Errorf("CNI plugin reported no IPv4 address")
+	if result020.IP4 == nil && result020.IP6 == nil {
+		return nil, fmt.Errorf("CNI plugin reported neither IPv4 nor IPv6 address")
 	}
-	ip4 := result020.IP4.IP.IP.To4()
-	if ip4 == nil {
+	if result020.IP4 != nil && result020.IP4.IP.IP.To4() == nil {
 		return nil, fmt.Errorf("CNI plugin reported an invalid IPv4 address: %+v.", result020.IP4)
 	}
+	if result020.IP6 != nil && (result020.IP6.IP.IP.To16() == nil || result020.IP6.IP.IP.To4() != nil) {
+		return nil, fmt.Errorf("CNI plugin reported an invalid IPv6 address: %+v.", result020.IP6)
+	}
 	return result020, nil
 }
 
+// podIP returns the IPv4 address of a dual-stack pod, or the IPv6 address of an IPv6 only pod
+func podIP(result *t020.Result) net.IP {
+	if result.IP4 != nil {
+		return result.IP4.IP.IP
+	}
+	return result.IP6.IP.IP
+}
+
 func setNetInterface(netIf string, idx int, argIf string) string {
 	if idx == 0 {
 		return argIf
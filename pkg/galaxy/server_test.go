@@ -0,0 +1,89 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/utils/nets"
+)
+
+func TestAssignIPInfos(t *testing.T) {
+	ipInfo := func(ip, network string) constant.IPInfo {
+		return constant.IPInfo{IP: nets.NetsIPNet(&net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(24, 32)}),
+			Network: network}
+	}
+	newNetworkInfos := func(ipInfos ...constant.IPInfo) []*cniutil.NetworkInfo {
+		data, err := json.Marshal(ipInfos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var networkInfos []*cniutil.NetworkInfo
+		for _, netType := range []string{"galaxy-flannel", "galaxy-k8s-vlan", "galaxy-k8s-sriov"} {
+			networkInfos = append(networkInfos, cniutil.NewNetworkInfo(netType,
+				map[string]string{constant.IPInfosKey: string(data)}, nil, ""))
+		}
+		return networkInfos
+	}
+	for i, c := range []struct {
+		ipInfos   []constant.IPInfo
+		expect    []string // ips of each network
+		expectErr bool
+	}{
+		// untagged ipinfos are passed to all networks as before
+		{ipInfos: []constant.IPInfo{ipInfo("10.0.0.2", ""), ipInfo("10.0.1.2", "")},
+			expect: []string{"10.0.0.2,10.0.1.2", "10.0.0.2,10.0.1.2", "10.0.0.2,10.0.1.2"}},
+		{ipInfos: []constant.IPInfo{ipInfo("10.0.0.2", "galaxy-k8s-vlan"), ipInfo("10.0.1.2", "galaxy-k8s-sriov")},
+			expect: []string{"", "10.0.0.2", "10.0.1.2"}},
+		// galaxy-flannel which has no ipinfo of its own gets none
+		{ipInfos: []constant.IPInfo{ipInfo("10.0.0.2", "galaxy-k8s-vlan"), ipInfo("10.0.0.3", "galaxy-k8s-vlan"),
+			ipInfo("10.0.1.2", "galaxy-k8s-sriov")}, expect: []string{"", "10.0.0.2,10.0.0.3", "10.0.1.2"}},
+		// an untagged ipinfo must not be passed to unrelated networks
+		{ipInfos: []constant.IPInfo{ipInfo("10.0.0.2", ""), ipInfo("10.0.1.2", "galaxy-k8s-sriov")},
+			expectErr: true},
+	} {
+		networkInfos := newNetworkInfos(c.ipInfos...)
+		if err := assignIPInfos(networkInfos); (err != nil) != c.expectErr {
+			t.Fatalf("case %d: expect error %v, real %v", i, c.expectErr, err)
+		}
+		if c.expectErr {
+			continue
+		}
+		for j := range networkInfos {
+			var ips string
+			if str, ok := networkInfos[j].Args[constant.IPInfosKey]; ok {
+				var ipInfos []constant.IPInfo
+				if err := json.Unmarshal([]byte(str), &ipInfos); err != nil {
+					t.Fatal(err)
+				}
+				for k := range ipInfos {
+					if k > 0 {
+						ips += ","
+					}
+					ips += ipInfos[k].IP.IP.String()
+				}
+			}
+			if ips != c.expect[j] {
+				t.Errorf("case %d: expect ips %q of %s, real %q", i, c.expect[j], networkInfos[j].NetworkType, ips)
+			}
+		}
+	}
+}
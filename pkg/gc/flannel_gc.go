@@ -30,6 +30,7 @@ import (
 	"k8s.io/apimachinery/pkg/util/wait"
 	glog "k8s.io/klog"
 	"tkestack.io/galaxy/pkg/api/docker"
+	"tkestack.io/galaxy/pkg/galaxy/metrics"
 )
 
 const (
@@ -170,7 +171,9 @@ func (gc *flannelGC) cleanupVeth() error {
 		if gc.shouldCleanup(cid) {
 			if err = netlink.LinkDel(link); err != nil {
 				glog.Warningf("failed remove link %s: %v; try next time", link.Attrs().Name, err)
+				continue
 			}
+			metrics.GCCleanups.WithLabelValues("veth").Inc()
 			glog.Infof("removed link %s for container %s", link.Attrs().Name, cid)
 		}
 	}
@@ -199,6 +202,7 @@ func removeLeakyIPFile(ipFile, containerId string) {
 		glog.Warningf("Error deleting leaky ip file %s container %s: %v", ipFile, containerId, err)
 	} else {
 		if err == nil {
+			metrics.GCCleanups.WithLabelValues("ip_file").Inc()
 			glog.Infof("Deleted leaky ip file %s container %s", ipFile, containerId)
 		}
 	}
@@ -212,6 +216,7 @@ func (gc *flannelGC) removeLeakyStateFile(file string) {
 		glog.Warningf("Error deleting file %s: %v", file, err)
 	} else {
 		if err == nil {
+			metrics.GCCleanups.WithLabelValues("state_file").Inc()
 			glog.Infof("Deleted file %s", file)
 		}
 	}
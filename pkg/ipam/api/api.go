@@ -29,28 +29,50 @@ import (
 	"k8s.io/client-go/listers/core/v1"
 	glog "k8s.io/klog"
 	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/metrics"
 	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
 	"tkestack.io/galaxy/pkg/utils/database"
 	"tkestack.io/galaxy/pkg/utils/httputil"
-	"tkestack.io/galaxy/pkg/utils/nets"
 	pageutil "tkestack.io/galaxy/pkg/utils/page"
 )
 
 // Controller is the API controller
 type Controller struct {
-	ipam, secondIpam floatingip.IPAM
-	podLister        v1.PodLister
+	ipam floatingip.IPAM
+	// namedIpams are named ipams of the plugin by their names
+	namedIpams map[string]floatingip.IPAM
+	ipv6Ipam   floatingip.IPAM
+	podLister  v1.PodLister
 }
 
 // NewController construct a controller object
-func NewController(ipam, secondIpam floatingip.IPAM, lister v1.PodLister) *Controller {
+func NewController(ipam floatingip.IPAM, namedIpams map[string]floatingip.IPAM, ipv6Ipam floatingip.IPAM,
+	lister v1.PodLister) *Controller {
 	return &Controller{
 		ipam:       ipam,
-		secondIpam: secondIpam,
+		namedIpams: namedIpams,
+		ipv6Ipam:   ipv6Ipam,
 		podLister:  lister,
 	}
 }
 
+// ipams returns the first ipam, named ipams sorted by their names and the ipv6 ipam
+func (c *Controller) ipams() []floatingip.IPAM {
+	names := make([]string, 0, len(c.namedIpams))
+	for name := range c.namedIpams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ipams := []floatingip.IPAM{c.ipam}
+	for _, name := range names {
+		ipams = append(ipams, c.namedIpams[name])
+	}
+	if c.ipv6Ipam != nil {
+		ipams = append(ipams, c.ipv6Ipam)
+	}
+	return ipams
+}
+
 // FloatingIP is the floating ip info
 type FloatingIP struct {
 	IP        string `json:"ip"`
@@ -65,9 +87,19 @@ type FloatingIP struct {
 	UpdateTime   time.Time `json:"updateTime,omitempty"`
 	Status       string    `json:"status,omitempty"`
 	Releasable   bool      `json:"releasable,omitempty"`
+	Excluded     bool      `json:"excluded,omitempty"`
 	attr         string    `json:"-"`
+	quarantined  bool      `json:"-"`
+	unallocated  bool      `json:"-"`
 }
 
+const (
+	// quarantinedStatus is the status of ips released from pods but in quarantine
+	quarantinedStatus = "Quarantined"
+	// excludedStatus is the status of unallocated ips which are excluded from allocation
+	excludedStatus = "Excluded"
+)
+
 // SwaggerDoc is to generate Swagger docs
 func (FloatingIP) SwaggerDoc() map[string]string {
 	return map[string]string{
@@ -77,10 +109,12 @@ func (FloatingIP) SwaggerDoc() map[string]string {
 		"podName":      "pod name",
 		"policy":       "ip release policy",
 		"isDeployment": "deployment or statefulset, deprecated please set appType",
-		"appType":      "deployment, statefulset or tapp",
+		"appType":      "deployment, statefulset, tapp, daemonset or job",
 		"updateTime":   "last allocate or release time of this ip",
-		"status":       "pod status if exists",
-		"releasable":   "if the ip is releasable. An ip is releasable if it isn't belong to any pod",
+		"status": "pod status if exists, Quarantined if the ip is released but not allocatable yet, or " +
+			"Excluded if the ip is unallocated and excluded from allocation",
+		"releasable": "if the ip is releasable. An ip is releasable if it isn't belong to any pod",
+		"excluded":   "if the ip is excluded from allocation",
 	}
 }
 
@@ -92,6 +126,15 @@ type ListIPResp struct {
 
 // ListIPs lists floating ips
 func (c *Controller) ListIPs(req *restful.Request, resp *restful.Response) {
+	if excluded := req.QueryParameter("excluded"); excluded != "" {
+		if isExcluded, err := strconv.ParseBool(excluded); err != nil {
+			httputil.BadRequest(resp, fmt.Errorf("invalid excluded(bool field): %s", excluded))
+			return
+		} else if isExcluded {
+			c.listExcludedIPs(req, resp)
+			return
+		}
+	}
 	keyword := req.QueryParameter("keyword")
 	key := keyword
 	fuzzyQuery := true
@@ -130,11 +173,32 @@ func (c *Controller) ListIPs(req *restful.Request, resp *restful.Response) {
 		key = util.NewKeyObj(appTypePrefix, namespace, appName, podName, poolName).KeyInDB
 	}
 	glog.V(4).Infof("list ips by %s, fuzzyQuery %v", key, fuzzyQuery)
-	fips, err := listIPs(key, c.ipam, c.secondIpam, fuzzyQuery)
+	fips, err := listIPs(key, fuzzyQuery, c.ipams()...)
 	if err != nil {
 		httputil.InternalError(resp, err)
 		return
 	}
+	c.writeIPs(req, resp, fips)
+}
+
+// listExcludedIPs lists all ips which are excluded from allocation, allocated or not
+func (c *Controller) listExcludedIPs(req *restful.Request, resp *restful.Response) {
+	fips, err := listIPs("", false, c.ipams()...)
+	if err != nil {
+		httputil.InternalError(resp, err)
+		return
+	}
+	var excluded []FloatingIP
+	for i := range fips {
+		if fips[i].Excluded {
+			excluded = append(excluded, fips[i])
+		}
+	}
+	c.writeIPs(req, resp, excluded)
+}
+
+// writeIPs sorts and pages ips by request params and writes them to response
+func (c *Controller) writeIPs(req *restful.Request, resp *restful.Response, fips []FloatingIP) {
 	sortParam, page, size := pageutil.PagingParams(req)
 	sort.Sort(bySortParam{array: fips, lessFunc: sortFunc(sortParam)})
 	start, end, pagin := pageutil.Pagination(page, size, len(fips))
@@ -151,32 +215,37 @@ func toAppTypePrefix(appType string) string {
 	switch appType {
 	case "deployment":
 		return util.DeploymentPrefixKey
-	case "statefulset", "statefulsets":
+	case "statefulsets":
 		return util.StatefulsetPrefixKey
-	case "tapp":
-		return util.TAppPrefixKey
-	default:
-		return ""
 	}
+	if r := util.OwnerResolverByAppType(appType); r != nil {
+		return r.KeyPrefix()
+	}
+	return ""
 }
 
 // toAppType converts app key prefix to app name
 func toAppType(appTypePrefix string) string {
-	switch appTypePrefix {
-	case util.DeploymentPrefixKey:
+	if appTypePrefix == util.DeploymentPrefixKey {
 		return "deployment"
-	case util.StatefulsetPrefixKey:
-		return "statefulset"
-	case util.TAppPrefixKey:
-		return "tapp"
-	default:
-		return ""
 	}
+	if r := util.OwnerResolverByPrefix(appTypePrefix); r != nil {
+		return r.AppType()
+	}
+	return ""
 }
 
 // fillReleasableAndStatus fills status and releasable field
 func fillReleasableAndStatus(lister v1.PodLister, ips []FloatingIP) error {
 	for i := range ips {
+		if ips[i].quarantined {
+			ips[i].Status = quarantinedStatus
+			continue
+		}
+		if ips[i].unallocated && ips[i].Excluded {
+			ips[i].Status = excludedStatus
+			continue
+		}
 		ips[i].Releasable = true
 		if ips[i].PodName == "" {
 			continue
@@ -320,7 +389,8 @@ func (c *Controller) ReleaseIPs(req *restful.Request, resp *restful.Response) {
 			return
 		}
 	}
-	_, unreleased, err := batchReleaseIPs(expectIPtoKey, c.ipam, c.secondIpam)
+	ipams := c.ipams()
+	_, unreleased, err := batchReleaseIPs(expectIPtoKey, ipams[0], ipams[1:]...)
 	var unreleasedIP []string
 	for ip := range unreleased {
 		unreleasedIP = append(unreleasedIP, ip)
@@ -341,30 +411,20 @@ func (c *Controller) ReleaseIPs(req *restful.Request, resp *restful.Response) {
 }
 
 // listIPs lists ips from ipams
-func listIPs(keyword string, ipam, secondIpam floatingip.IPAM, fuzzyQuery bool) ([]FloatingIP, error) {
-	var fips []database.FloatingIP
-	var err error
-	if fuzzyQuery {
-		fips, err = ipam.ByKeyword(keyword)
-	} else {
-		fips, err = ipam.ByPrefix(keyword)
-	}
-	if err != nil {
-		return nil, err
-	}
-	resp := transform(fips)
-	if secondIpam != nil {
-		var secondFips []database.FloatingIP
+func listIPs(keyword string, fuzzyQuery bool, ipams ...floatingip.IPAM) ([]FloatingIP, error) {
+	var resp []FloatingIP
+	for _, ipam := range ipams {
+		var fips []database.FloatingIP
+		var err error
 		if fuzzyQuery {
-			secondFips, err = secondIpam.ByKeyword(keyword)
+			fips, err = ipam.ByKeyword(keyword)
 		} else {
-			secondFips, err = secondIpam.ByPrefix(keyword)
+			fips, err = ipam.ByPrefix(keyword)
 		}
 		if err != nil {
 			return resp, err
 		}
-		resp2 := transform(secondFips)
-		resp = append(resp, resp2...)
+		resp = append(resp, transform(fips)...)
 	}
 	return resp, nil
 }
@@ -373,8 +433,9 @@ func listIPs(keyword string, ipam, secondIpam floatingip.IPAM, fuzzyQuery bool)
 func transform(fips []database.FloatingIP) []FloatingIP {
 	var res []FloatingIP
 	for i := range fips {
-		keyObj := util.ParseKey(fips[i].Key)
-		res = append(res, FloatingIP{IP: nets.IntToIP(fips[i].IP).String(),
+		key, quarantined := util.ParseQuarantineKey(fips[i].Key)
+		keyObj := util.ParseKey(key)
+		res = append(res, FloatingIP{IP: fips[i].IP.String(),
 			Namespace:    keyObj.Namespace,
 			AppName:      keyObj.AppName,
 			PodName:      keyObj.PodName,
@@ -383,25 +444,36 @@ func transform(fips []database.FloatingIP) []FloatingIP {
 			AppType:      toAppType(keyObj.AppTypePrefix),
 			Policy:       fips[i].Policy,
 			UpdateTime:   fips[i].UpdatedAt,
-			attr:         fips[i].Attr})
+			Excluded:     fips[i].Excluded,
+			attr:         fips[i].Attr,
+			quarantined:  quarantined,
+			unallocated:  fips[i].Key == ""})
 	}
 	return res
 }
 
-// batchReleaseIPs release ips from ipams
-func batchReleaseIPs(ipToKey map[string]string,
-	ipam, secondIpam floatingip.IPAM) (map[string]string, map[string]string, error) {
-	released, unreleased, err := ipam.ReleaseIPs(ipToKey)
+// releasedByAPI is the release reason of ips released by users via api
+const releasedByAPI = "releasedByAPI"
+
+// batchReleaseIPs release ips from ipams, ips which are not released by an ipam are released by the next one
+func batchReleaseIPs(ipToKey map[string]string, ipam floatingip.IPAM,
+	extraIpams ...floatingip.IPAM) (map[string]string, map[string]string, error) {
+	released, unreleased, err := floatingip.WithReason(ipam, "", releasedByAPI).ReleaseIPs(ipToKey)
 	if len(released) > 0 {
 		glog.Infof("releaseIPs %v", released)
+		metrics.IPReleases.WithLabelValues(ipam.Name(), releasedByAPI).Add(float64(len(released)))
 	}
 	if err != nil {
 		return released, unreleased, err
 	}
-	if secondIpam != nil {
-		released2, unreleased2, err := secondIpam.ReleaseIPs(unreleased)
+	for _, extraIpam := range extraIpams {
+		if len(unreleased) == 0 {
+			break
+		}
+		released2, unreleased2, err := floatingip.WithReason(extraIpam, "", releasedByAPI).ReleaseIPs(unreleased)
 		if len(released2) > 0 {
-			glog.Infof("releaseIPs in second IPAM %v", released2)
+			glog.Infof("releaseIPs in %s %v", extraIpam.Name(), released2)
+			metrics.IPReleases.WithLabelValues(extraIpam.Name(), releasedByAPI).Add(float64(len(released2)))
 		}
 		for k, v := range released2 {
 			released[k] = v
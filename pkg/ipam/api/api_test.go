@@ -17,11 +17,13 @@
 package api
 
 import (
+	"net"
 	"reflect"
 	"testing"
 
 	"fmt"
 	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/utils/database"
 )
 
 type fakeIPAM struct {
@@ -82,3 +84,33 @@ func TestBatchReleaseIPs(t *testing.T) {
 		t.Fatal(unreleased)
 	}
 }
+
+func (ipam fakeIPAM) ByIP(ip net.IP) (database.FloatingIP, error) {
+	if ipam.err != nil {
+		return database.FloatingIP{}, ipam.err
+	}
+	if k, ok := ipam.allocatedIPs[ip.String()]; ok {
+		return database.FloatingIP{IP: database.IP(ip), Key: k}, nil
+	}
+	if _, ok := ipam.unallocatedIPs[ip.String()]; ok {
+		return database.FloatingIP{IP: database.IP(ip)}, nil
+	}
+	return database.FloatingIP{}, nil
+}
+
+func TestIPAMOf(t *testing.T) {
+	ipam := fakeIPAM{allocatedIPs: map[string]string{"10.0.0.1": "k1"}, unallocatedIPs: map[string]string{}}
+	named := fakeIPAM{allocatedIPs: map[string]string{}, unallocatedIPs: map[string]string{"10.0.1.1": ""}}
+	ipv6 := fakeIPAM{allocatedIPs: map[string]string{"2001:db8::1": "k2"}, unallocatedIPs: map[string]string{}}
+	c := NewController(ipam, map[string]floatingip.IPAM{"second": named}, ipv6, nil)
+	for ip, expect := range map[string]floatingip.IPAM{"10.0.0.1": ipam, "10.0.1.1": named, "2001:db8::1": ipv6,
+		"10.0.2.1": nil} {
+		found, err := c.ipamOf(net.ParseIP(ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expect, found) {
+			t.Fatalf("%s: expect %v, real %v", ip, expect, found)
+		}
+	}
+}
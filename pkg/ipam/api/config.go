@@ -0,0 +1,101 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/emicklei/go-restful"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin"
+	"tkestack.io/galaxy/pkg/utils/httputil"
+)
+
+// ConfigDiffReq is the request to diff a proposed floating ip config with stored ips
+type ConfigDiffReq struct {
+	FloatingIPs []*floatingip.FloatingIP `json:"floatingips"`
+	Second      bool                     `json:"second,omitempty"`
+	IPAM        string                   `json:"ipam,omitempty"`
+}
+
+// SwaggerDoc generates swagger doc for config diff request
+func (ConfigDiffReq) SwaggerDoc() map[string]string {
+	return map[string]string{
+		"floatingips": "proposed floating ip config, same as the value of floatingips key of the configmap",
+		"second":      "diff with ips of the second ipam instead of the first one",
+		"ipam":        "diff with ips of the named ipam instead of the first one",
+	}
+}
+
+// ConfigDiffResp is the response of diffing a proposed floating ip config
+type ConfigDiffResp struct {
+	httputil.Resp
+	Added    []string     `json:"added,omitempty"`
+	Removed  []string     `json:"removed,omitempty"`
+	Orphaned []FloatingIP `json:"orphaned,omitempty"`
+}
+
+// SwaggerDoc generates swagger doc for config diff response
+func (ConfigDiffResp) SwaggerDoc() map[string]string {
+	return map[string]string{
+		"added":    "ips which are added to the pool",
+		"removed":  "unallocated ips which are removed from the pool",
+		"orphaned": "allocated ips which are no longer configured, they are kept until being released",
+	}
+}
+
+// DiffConfig shows ips a proposed floating ip config adds, removes and orphans without applying it
+func (c *Controller) DiffConfig(req *restful.Request, resp *restful.Response) {
+	var diffReq ConfigDiffReq
+	if err := req.ReadEntity(&diffReq); err != nil {
+		httputil.BadRequest(resp, err)
+		return
+	}
+	if diffReq.Second {
+		diffReq.IPAM = schedulerplugin.SecondIPAMName
+	}
+	ipam := c.ipam
+	if diffReq.IPAM != "" {
+		var ok bool
+		if ipam, ok = c.namedIpams[diffReq.IPAM]; !ok {
+			httputil.BadRequest(resp, fmt.Errorf("unknown ipam %s", diffReq.IPAM))
+			return
+		}
+	}
+	diff, err := floatingip.DiffConfig(ipam, diffReq.FloatingIPs)
+	if err != nil {
+		httputil.InternalError(resp, err)
+		return
+	}
+	res := ConfigDiffResp{Resp: httputil.NewResp(http.StatusOK, ""), Added: ipStrings(diff.Added),
+		Removed: ipStrings(diff.Removed), Orphaned: transform(diff.Orphaned)}
+	if err := fillReleasableAndStatus(c.podLister, res.Orphaned); err != nil {
+		httputil.InternalError(resp, err)
+		return
+	}
+	resp.WriteHeaderAndEntity(res.Code, res)
+}
+
+func ipStrings(ips []net.IP) []string {
+	var res []string
+	for _, ip := range ips {
+		res = append(res, ip.String())
+	}
+	return res
+}
@@ -0,0 +1,128 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/emicklei/go-restful"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/utils/database"
+	"tkestack.io/galaxy/pkg/utils/httputil"
+)
+
+// ExcludeIPReq is the request to exclude ips from allocation or include them back
+type ExcludeIPReq struct {
+	IPs []string `json:"ips"`
+}
+
+// ExcludeIPResp is the response of excluding ips
+type ExcludeIPResp struct {
+	httputil.Resp
+	Allocated []FloatingIP `json:"allocated,omitempty"`
+}
+
+// SwaggerDoc generates swagger doc for exclude ip response
+func (ExcludeIPResp) SwaggerDoc() map[string]string {
+	return map[string]string{
+		"allocated": "excluded ips which are still allocated, they won't be allocated again once released",
+	}
+}
+
+// ExcludeIPs excludes ips from allocation
+func (c *Controller) ExcludeIPs(req *restful.Request, resp *restful.Response) {
+	c.setExcluded(req, resp, true)
+}
+
+// IncludeIPs includes excluded ips back to allocation
+func (c *Controller) IncludeIPs(req *restful.Request, resp *restful.Response) {
+	c.setExcluded(req, resp, false)
+}
+
+func (c *Controller) setExcluded(req *restful.Request, resp *restful.Response, excluded bool) {
+	var excludeIPReq ExcludeIPReq
+	if err := req.ReadEntity(&excludeIPReq); err != nil {
+		httputil.BadRequest(resp, err)
+		return
+	}
+	var ips []net.IP
+	for _, ipStr := range excludeIPReq.IPs {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			httputil.BadRequest(resp, fmt.Errorf("%q is not a valid ip", ipStr))
+			return
+		}
+		ips = append(ips, ip)
+	}
+	// resolve ipams of all ips before changing any of them, so that a bad request changes nothing
+	ipams := make([]floatingip.IPAM, len(ips))
+	for j, ip := range ips {
+		ipam, err := c.ipamOf(ip)
+		if err != nil {
+			httputil.InternalError(resp, err)
+			return
+		}
+		if ipam == nil {
+			httputil.BadRequest(resp, fmt.Errorf("%s is not in pool", ip.String()))
+			return
+		}
+		ipams[j] = ipam
+	}
+	var allocated []database.FloatingIP
+	for j, ip := range ips {
+		ipam := ipams[j]
+		if err := ipam.SetExcluded(ip, excluded); err != nil {
+			httputil.InternalError(resp, err)
+			return
+		}
+		glog.Infof("[%s] set ip %s excluded %v by api", ipam.Name(), ip.String(), excluded)
+		if !excluded {
+			continue
+		}
+		fip, err := ipam.ByIP(ip)
+		if err != nil {
+			httputil.InternalError(resp, err)
+			return
+		}
+		if fip.Key != "" {
+			allocated = append(allocated, fip)
+		}
+	}
+	res := ExcludeIPResp{Resp: httputil.NewResp(http.StatusOK, ""), Allocated: transform(allocated)}
+	if err := fillReleasableAndStatus(c.podLister, res.Allocated); err != nil {
+		httputil.InternalError(resp, err)
+		return
+	}
+	resp.WriteHeaderAndEntity(res.Code, res)
+}
+
+// ipamOf returns the ipam which ip belongs to, or nil if ip is not in any pool
+func (c *Controller) ipamOf(ip net.IP) (floatingip.IPAM, error) {
+	for _, ipam := range c.ipams() {
+		fip, err := ipam.ByIP(ip)
+		if err != nil {
+			return nil, err
+		}
+		if fip.IP != nil {
+			return ipam, nil
+		}
+	}
+	return nil, nil
+}
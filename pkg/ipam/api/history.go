@@ -0,0 +1,117 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/utils/httputil"
+)
+
+// HistoryController is the API controller of floating ip history
+type HistoryController struct {
+	// History is nil if recording history is disabled
+	History floatingip.History
+}
+
+// HistoryRecord is a change of a floating ip
+type HistoryRecord struct {
+	IP        string                 `json:"ip"`
+	IPAM      string                 `json:"ipam"`
+	Action    string                 `json:"action"`
+	Key       string                 `json:"key"`
+	Namespace string                 `json:"namespace,omitempty"`
+	AppName   string                 `json:"appName,omitempty"`
+	NodeName  string                 `json:"nodeName,omitempty"`
+	Reason    string                 `json:"reason,omitempty"`
+	Policy    constant.ReleasePolicy `json:"policy"`
+	Time      time.Time              `json:"time"`
+}
+
+// SwaggerDoc is to generate Swagger docs
+func (HistoryRecord) SwaggerDoc() map[string]string {
+	return map[string]string{
+		"ip":        "ip",
+		"ipam":      "name of the ipam which the ip belongs to",
+		"action":    "allocate, reuse, reserve, release or updatePolicy",
+		"key":       "key of the ip after the change, or the key which released the ip",
+		"namespace": "namespace of the app",
+		"appName":   "name of the app",
+		"nodeName":  "node of the pod",
+		"reason":    "why the ip changed",
+		"policy":    "ip release policy",
+		"time":      "when the ip changed",
+	}
+}
+
+// ListHistoryResp is the response of listing history
+type ListHistoryResp struct {
+	httputil.Resp
+	Content []HistoryRecord `json:"content,omitempty"`
+}
+
+// GetIPHistory lists changes of the ip in time order
+func (c *HistoryController) GetIPHistory(req *restful.Request, resp *restful.Response) {
+	ipStr := req.PathParameter("ip")
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		httputil.BadRequest(resp, fmt.Errorf("%s is not a valid ip", ipStr))
+		return
+	}
+	if c.History == nil {
+		httputil.BadRequest(resp, fmt.Errorf("history is disabled"))
+		return
+	}
+	records, err := c.History.ByIP(ip)
+	c.writeHistory(resp, records, err)
+}
+
+// GetAppHistory lists changes of ips of the app in time order
+func (c *HistoryController) GetAppHistory(req *restful.Request, resp *restful.Response) {
+	namespace, name := req.PathParameter("namespace"), req.PathParameter("name")
+	if namespace == "" || name == "" {
+		httputil.BadRequest(resp, fmt.Errorf("namespace or name is empty"))
+		return
+	}
+	if c.History == nil {
+		httputil.BadRequest(resp, fmt.Errorf("history is disabled"))
+		return
+	}
+	records, err := c.History.ByApp(namespace, name)
+	c.writeHistory(resp, records, err)
+}
+
+func (c *HistoryController) writeHistory(resp *restful.Response, records []floatingip.HistoryRecord, err error) {
+	if err != nil {
+		httputil.InternalError(resp, err)
+		return
+	}
+	content := make([]HistoryRecord, len(records))
+	for i := range records {
+		content[i] = HistoryRecord{IP: records[i].IP.String(), IPAM: records[i].IPAM, Action: records[i].Action,
+			Key: records[i].Key, Namespace: records[i].Namespace, AppName: records[i].AppName,
+			NodeName: records[i].NodeName, Reason: records[i].Reason, Policy: records[i].Policy,
+			Time: records[i].Time}
+	}
+	resp.WriteEntity(ListHistoryResp{Resp: httputil.NewResp(http.StatusOK, ""), Content: content}) // nolint: errcheck
+}
@@ -20,19 +20,24 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"reflect"
+	"sort"
 
 	"github.com/emicklei/go-restful"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	glog "k8s.io/klog"
 	"tkestack.io/galaxy/pkg/api/galaxy/constant"
 	"tkestack.io/galaxy/pkg/ipam/apis/galaxy/v1alpha1"
 	"tkestack.io/galaxy/pkg/ipam/client/clientset/versioned"
 	list "tkestack.io/galaxy/pkg/ipam/client/listers/galaxy/v1alpha1"
 	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin"
 	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
 	"tkestack.io/galaxy/pkg/utils/httputil"
 	"tkestack.io/galaxy/pkg/utils/keylock"
+	pageutil "tkestack.io/galaxy/pkg/utils/page"
 )
 
 type PoolController struct {
@@ -40,12 +45,17 @@ type PoolController struct {
 	PoolLister       list.PoolLister
 	LockPool         *keylock.Keylock
 	IPAM, SecondIPAM floatingip.IPAM
+	// Namespace is the namespace of Pool objects
+	Namespace string
 }
 
 type Pool struct {
-	Name          string `json:"name"`
-	Size          int    `json:"size"`
-	PreAllocateIP bool   `json:"preAllocateIP"`
+	Name          string   `json:"name"`
+	Size          int      `json:"size"`
+	PreAllocateIP bool     `json:"preAllocateIP"`
+	Namespaces    []string `json:"namespaces,omitempty"`
+	// Usage is ignored when creating or updating pool
+	Usage *PoolUsage `json:"usage,omitempty"`
 }
 
 func (Pool) SwaggerDoc() map[string]string {
@@ -53,9 +63,69 @@ func (Pool) SwaggerDoc() map[string]string {
 		"name":          "pool name",
 		"size":          "pool size",
 		"preAllocateIP": "Set to true to allocate IPs when creating or updating pool",
+		"namespaces":    "namespaces whose pods can use the pool, all namespaces if empty",
+		"usage":         "IPs held by the pool",
 	}
 }
 
+// PoolUsage is the usage of IPs held by a pool
+type PoolUsage struct {
+	Size    int      `json:"size"`
+	Bound   int      `json:"bound"`
+	Free    int      `json:"free"`
+	Subnets []string `json:"subnets,omitempty"`
+}
+
+func (PoolUsage) SwaggerDoc() map[string]string {
+	return map[string]string{
+		"size":    "number of IPs held by the pool",
+		"bound":   "number of IPs bound to pods",
+		"free":    "number of IPs not bound to any pod",
+		"subnets": "routable subnets of IPs held by the pool",
+	}
+}
+
+// toPool converts Pool object to api Pool with its usage
+func (c *PoolController) toPool(pool *v1alpha1.Pool) (Pool, error) {
+	status, err := schedulerplugin.PoolUsage(c.IPAM, pool.Name)
+	if err != nil {
+		return Pool{}, err
+	}
+	return Pool{Name: pool.Name, Size: pool.Size, PreAllocateIP: pool.PreAllocateIP, Namespaces: pool.Namespaces,
+		Usage: &PoolUsage{Size: status.Size, Bound: status.Bound, Free: status.Size - status.Bound,
+			Subnets: status.Subnets}}, nil
+}
+
+// ListPoolResp is the List response
+type ListPoolResp struct {
+	pageutil.Page
+	Content []Pool `json:"content,omitempty"`
+}
+
+// List lists pools sorted by name with their usage
+func (c *PoolController) List(req *restful.Request, resp *restful.Response) {
+	pools, err := c.PoolLister.Pools(c.Namespace).List(labels.Everything())
+	if err != nil {
+		httputil.InternalError(resp, err)
+		return
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+	_, page, size := pageutil.PagingParams(req)
+	start, end, pagin := pageutil.Pagination(page, size, len(pools))
+	content := make([]Pool, 0, end-start)
+	for _, pool := range pools[start:end] {
+		p, err := c.toPool(pool)
+		if err != nil {
+			httputil.InternalError(resp, err)
+			return
+		}
+		content = append(content, p)
+	}
+	resp.WriteEntity(ListPoolResp{Page: *pagin, Content: content}) // nolint: errcheck
+}
+
 type GetPoolResp struct {
 	httputil.Resp
 	Pool Pool `json:"pool"`
@@ -67,7 +137,7 @@ func (c *PoolController) Get(req *restful.Request, resp *restful.Response) {
 		httputil.BadRequest(resp, fmt.Errorf("pool name is empty"))
 		return
 	}
-	pool, err := c.Client.GalaxyV1alpha1().Pools("kube-system").Get(name, v1.GetOptions{})
+	pool, err := c.Client.GalaxyV1alpha1().Pools(c.Namespace).Get(name, v1.GetOptions{})
 	if err != nil {
 		if errors.IsNotFound(err) {
 			httputil.ItemNotFound(resp, fmt.Errorf("pool %s", name))
@@ -76,8 +146,12 @@ func (c *PoolController) Get(req *restful.Request, resp *restful.Response) {
 		httputil.InternalError(resp, err)
 		return
 	}
-	resp.WriteEntity(GetPoolResp{Resp: httputil.NewResp(http.StatusOK, ""), Pool: Pool{
-		Name: pool.Name, Size: pool.Size, PreAllocateIP: pool.PreAllocateIP}})
+	p, err := c.toPool(pool)
+	if err != nil {
+		httputil.InternalError(resp, err)
+		return
+	}
+	resp.WriteEntity(GetPoolResp{Resp: httputil.NewResp(http.StatusOK, ""), Pool: p})
 }
 
 type UpdatePoolResp struct {
@@ -101,28 +175,31 @@ func (c *PoolController) CreateOrUpdate(req *restful.Request, resp *restful.Resp
 		httputil.BadRequest(resp, fmt.Errorf("pool name is empty"))
 		return
 	}
-	p, err := c.Client.GalaxyV1alpha1().Pools("kube-system").Get(pool.Name, v1.GetOptions{})
+	p, err := c.Client.GalaxyV1alpha1().Pools(c.Namespace).Get(pool.Name, v1.GetOptions{})
 	if err != nil {
 		if !errors.IsNotFound(err) {
 			httputil.InternalError(resp, err)
 			return
 		}
 		// create Pool
-		if _, err := c.Client.GalaxyV1alpha1().Pools("kube-system").Create(&v1alpha1.Pool{
+		if _, err := c.Client.GalaxyV1alpha1().Pools(c.Namespace).Create(&v1alpha1.Pool{
 			TypeMeta:      v1.TypeMeta{Kind: "Pool", APIVersion: "v1alpha1"},
 			ObjectMeta:    v1.ObjectMeta{Name: pool.Name},
 			Size:          pool.Size,
 			PreAllocateIP: pool.PreAllocateIP,
+			Namespaces:    pool.Namespaces,
 		}); err != nil {
 			httputil.InternalError(resp, fmt.Errorf("failed to create Pool: %v", err))
 			return
 		}
 		glog.Infof("created pool: %v", pool)
 	} else {
-		if pool.Size != p.Size || p.PreAllocateIP != pool.PreAllocateIP {
+		if pool.Size != p.Size || p.PreAllocateIP != pool.PreAllocateIP ||
+			!reflect.DeepEqual(p.Namespaces, pool.Namespaces) {
 			p.Size = pool.Size
 			p.PreAllocateIP = pool.PreAllocateIP
-			if _, err := c.Client.GalaxyV1alpha1().Pools("kube-system").Update(p); err != nil {
+			p.Namespaces = pool.Namespaces
+			if _, err := c.Client.GalaxyV1alpha1().Pools(c.Namespace).Update(p); err != nil {
 				httputil.InternalError(resp, err)
 				return
 			}
@@ -165,7 +242,8 @@ func (c *PoolController) preAllocateIP(req *restful.Request, resp *restful.Respo
 	}
 	needAllocateIPs := pool.Size - len(fips)
 	for i := 0; i < needAllocateIPs; i++ {
-		ip, err := c.IPAM.AllocateInSubnet(poolPrefix, subnetIPNet, constant.ReleasePolicyNever, "")
+		ip, err := floatingip.WithReason(c.IPAM, "", "pool api").AllocateInSubnet(poolPrefix, subnetIPNet,
+			constant.ReleasePolicyNever, "")
 		if err == nil {
 			glog.Infof("allocated ip %s to %s during creating or updating pool", ip.String(), poolPrefix)
 			continue
@@ -194,7 +272,7 @@ func (c *PoolController) Delete(req *restful.Request, resp *restful.Response) {
 		httputil.BadRequest(resp, fmt.Errorf("pool name is empty"))
 		return
 	}
-	if err := c.Client.GalaxyV1alpha1().Pools("kube-system").Delete(name, &v1.DeleteOptions{}); err != nil {
+	if err := c.Client.GalaxyV1alpha1().Pools(c.Namespace).Delete(name, &v1.DeleteOptions{}); err != nil {
 		if errors.IsNotFound(err) {
 			httputil.ItemNotFound(resp, fmt.Errorf("pool %s", name))
 			return
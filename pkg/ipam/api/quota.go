@@ -0,0 +1,82 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package api
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/emicklei/go-restful"
+	"tkestack.io/galaxy/pkg/utils/httputil"
+)
+
+// QuotaController is the API controller of namespace quotas
+type QuotaController struct {
+	// Quotas returns the current namespace quotas
+	Quotas func() map[string]int
+	// Usage returns the number of ips of all ipams used by the namespace
+	Usage func(namespace string) (int, error)
+}
+
+// NamespaceQuota is the floating ip quota and usage of a namespace
+type NamespaceQuota struct {
+	Namespace string `json:"namespace"`
+	Quota     int    `json:"quota"`
+	Used      int    `json:"used"`
+	Unlimited bool   `json:"unlimited,omitempty"`
+}
+
+// SwaggerDoc is to generate Swagger docs
+func (NamespaceQuota) SwaggerDoc() map[string]string {
+	return map[string]string{
+		"namespace": "namespace",
+		"quota":     "max number of floating ips the namespace can hold",
+		"used":      "number of floating ips allocated or reserved to apps of the namespace",
+		"unlimited": "true if the namespace has no quota",
+	}
+}
+
+// ListQuotaResp is the ListQuotas response
+type ListQuotaResp struct {
+	httputil.Resp
+	Content []NamespaceQuota `json:"content,omitempty"`
+}
+
+// ListQuotas lists quotas and usages of namespaces which have quotas, or of the queried namespace
+func (c *QuotaController) ListQuotas(req *restful.Request, resp *restful.Response) {
+	quotas := c.Quotas()
+	var namespaces []string
+	if namespace := req.QueryParameter("namespace"); namespace != "" {
+		namespaces = []string{namespace}
+	} else {
+		for ns := range quotas {
+			namespaces = append(namespaces, ns)
+		}
+		sort.Strings(namespaces)
+	}
+	content := make([]NamespaceQuota, 0, len(namespaces))
+	for _, ns := range namespaces {
+		used, err := c.Usage(ns)
+		if err != nil {
+			httputil.InternalError(resp, err)
+			return
+		}
+		quota, ok := quotas[ns]
+		content = append(content, NamespaceQuota{Namespace: ns, Quota: quota, Used: used, Unlimited: !ok})
+	}
+	resp.WriteEntity(ListQuotaResp{Resp: httputil.NewResp(http.StatusOK, ""), Content: content}) // nolint: errcheck
+}
@@ -65,6 +65,10 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 	scheme.AddKnownTypes(SchemeGroupVersion,
 		&FloatingIP{},
 		&FloatingIPList{},
+		&FloatingIPHistory{},
+		&FloatingIPHistoryList{},
+		&FloatingIPPool{},
+		&FloatingIPPoolList{},
 		&Pool{},
 		&PoolList{},
 	)
@@ -63,6 +63,8 @@ type FloatingIPSpec struct {
 	Subnet string `json:"subnet"`
 	//FloatingIP update(allocate, release or update) timestamp
 	UpdateTime metav1.Time `json:"updateTime"`
+	//excluded ip is never allocated, the object of an unallocated excluded ip has an empty key
+	Excluded bool `json:"excluded,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -77,6 +79,107 @@ type FloatingIPList struct {
 
 // +genclient
 // +genclient:noStatus
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// FloatingIPHistory records a change of a FloatingIP, e.g. allocating it to a pod or releasing it.
+type FloatingIPHistory struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Spec defines what changed.
+	Spec FloatingIPHistorySpec `json:"spec"`
+}
+
+// FloatingIPHistorySpec is spec of FloatingIPHistory.
+type FloatingIPHistorySpec struct {
+	//the changed ip
+	IP string `json:"ip"`
+	//name of the ipam which the ip belongs to
+	IPAM string `json:"ipam"`
+	//allocate, reuse, reserve, release or updatePolicy
+	Action string `json:"action"`
+	//key of the ip after the change, or the key which released the ip
+	Key string `json:"key"`
+	//namespace and app name resolved from key
+	Namespace string `json:"namespace,omitempty"`
+	AppName   string `json:"appName,omitempty"`
+	//node of the pod
+	NodeName string `json:"nodeName,omitempty"`
+	//why the ip changed
+	Reason string `json:"reason,omitempty"`
+	//release policy of the ip
+	Policy constant.ReleasePolicy `json:"policy"`
+	//when the ip changed
+	Time metav1.Time `json:"time"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// FloatingIPHistoryList is list of FloatingIPHistory.
+type FloatingIPHistoryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []FloatingIPHistory `json:"items"`
+}
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// FloatingIPPool describes floating IPs of a routable subnet.
+type FloatingIPPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Spec defines the routable subnet and its IPs.
+	Spec FloatingIPPoolSpec `json:"spec"`
+	// Status shows usage of IPs of the pool.
+	Status FloatingIPPoolStatus `json:"status,omitempty"`
+}
+
+// FloatingIPPoolSpec is spec of FloatingIPPool.
+type FloatingIPPoolSpec struct {
+	//ip type of the pool, internalIP, externalIP, ipv6IP or ip type of a named ipam, defaults to internalIP
+	IPType string `json:"ipType,omitempty"`
+	//subnet of nodes which are able to use IPs of the pool
+	RoutableSubnet string `json:"routableSubnet"`
+	//subnet of IPs
+	Subnet string `json:"subnet"`
+	//gateway of IPs
+	Gateway string `json:"gateway"`
+	//vlan id of IPs
+	Vlan uint16 `json:"vlan,omitempty"`
+	//IPs or IP ranges, e.g. 10.0.0.2 or 10.0.0.10~10.0.0.20
+	IPs []string `json:"ips"`
+	//seconds IPs released from pods stay unallocatable, overrides releaseQuarantineSeconds of galaxy-ipam config
+	QuarantineSeconds uint `json:"quarantineSeconds,omitempty"`
+}
+
+// FloatingIPPoolStatus is status of FloatingIPPool.
+type FloatingIPPoolStatus struct {
+	//number of IPs of the pool
+	Total int `json:"total"`
+	//number of allocated IPs
+	Allocated int `json:"allocated"`
+	//number of unallocated IPs
+	Free int `json:"free"`
+	//reason why the pool is not applied
+	Message string `json:"message,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// FloatingIPPoolList is list of FloatingIPPool.
+type FloatingIPPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []FloatingIPPool `json:"items"`
+}
+
+// +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 // Pool provides configuration for FloatingIP pool which used to store FloatingIP.
@@ -87,6 +190,20 @@ type Pool struct {
 	Size int `json:"size"`
 	// Pre-allocate IP when creating pool
 	PreAllocateIP bool `json:"preAllocateIP"`
+	// Namespaces restricts the pool to pods of these namespaces, the pool is shared by all namespaces if empty
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Status shows IPs held by the pool
+	Status PoolStatus `json:"status,omitempty"`
+}
+
+// PoolStatus is status of Pool.
+type PoolStatus struct {
+	//number of IPs held by the pool
+	Size int `json:"size"`
+	//number of IPs bound to pods
+	Bound int `json:"bound"`
+	//routable subnets of IPs held by the pool
+	Subnets []string `json:"subnets,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -48,6 +48,14 @@ func (c *FakeGalaxyV1alpha1) FloatingIPs() v1alpha1.FloatingIPInterface {
 	return &FakeFloatingIPs{c}
 }
 
+func (c *FakeGalaxyV1alpha1) FloatingIPHistories() v1alpha1.FloatingIPHistoryInterface {
+	return &FakeFloatingIPHistories{c}
+}
+
+func (c *FakeGalaxyV1alpha1) FloatingIPPools() v1alpha1.FloatingIPPoolInterface {
+	return &FakeFloatingIPPools{c}
+}
+
 func (c *FakeGalaxyV1alpha1) Pools(namespace string) v1alpha1.PoolInterface {
 	return &FakePools{c, namespace}
 }
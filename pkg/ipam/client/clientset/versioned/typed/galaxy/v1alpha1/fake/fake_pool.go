@@ -116,6 +116,18 @@ func (c *FakePools) Update(pool *v1alpha1.Pool) (result *v1alpha1.Pool, err erro
 	return obj.(*v1alpha1.Pool), err
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *FakePools) UpdateStatus(pool *v1alpha1.Pool) (*v1alpha1.Pool, error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewUpdateSubresourceAction(poolsResource, "status", c.ns, pool), &v1alpha1.Pool{})
+
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*v1alpha1.Pool), err
+}
+
 // Delete takes name of the pool and deletes it. Returns an error if one occurs.
 func (c *FakePools) Delete(name string, options *v1.DeleteOptions) error {
 	_, err := c.Fake.
@@ -43,6 +43,8 @@ import (
 type GalaxyV1alpha1Interface interface {
 	RESTClient() rest.Interface
 	FloatingIPsGetter
+	FloatingIPHistoriesGetter
+	FloatingIPPoolsGetter
 	PoolsGetter
 }
 
@@ -55,6 +57,14 @@ func (c *GalaxyV1alpha1Client) FloatingIPs() FloatingIPInterface {
 	return newFloatingIPs(c)
 }
 
+func (c *GalaxyV1alpha1Client) FloatingIPHistories() FloatingIPHistoryInterface {
+	return newFloatingIPHistories(c)
+}
+
+func (c *GalaxyV1alpha1Client) FloatingIPPools() FloatingIPPoolInterface {
+	return newFloatingIPPools(c)
+}
+
 func (c *GalaxyV1alpha1Client) Pools(namespace string) PoolInterface {
 	return newPools(c, namespace)
 }
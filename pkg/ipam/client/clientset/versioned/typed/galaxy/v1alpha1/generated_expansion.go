@@ -36,4 +36,8 @@ package v1alpha1
 
 type FloatingIPExpansion interface{}
 
+type FloatingIPHistoryExpansion interface{}
+
+type FloatingIPPoolExpansion interface{}
+
 type PoolExpansion interface{}
@@ -55,6 +55,7 @@ type PoolsGetter interface {
 type PoolInterface interface {
 	Create(*v1alpha1.Pool) (*v1alpha1.Pool, error)
 	Update(*v1alpha1.Pool) (*v1alpha1.Pool, error)
+	UpdateStatus(*v1alpha1.Pool) (*v1alpha1.Pool, error)
 	Delete(name string, options *v1.DeleteOptions) error
 	DeleteCollection(options *v1.DeleteOptions, listOptions v1.ListOptions) error
 	Get(name string, options v1.GetOptions) (*v1alpha1.Pool, error)
@@ -148,6 +149,22 @@ func (c *pools) Update(pool *v1alpha1.Pool) (result *v1alpha1.Pool, err error) {
 	return
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+
+func (c *pools) UpdateStatus(pool *v1alpha1.Pool) (result *v1alpha1.Pool, err error) {
+	result = &v1alpha1.Pool{}
+	err = c.client.Put().
+		Namespace(c.ns).
+		Resource("pools").
+		Name(pool.Name).
+		SubResource("status").
+		Body(pool).
+		Do().
+		Into(result)
+	return
+}
+
 // Delete takes name of the pool and deletes it. Returns an error if one occurs.
 func (c *pools) Delete(name string, options *v1.DeleteOptions) error {
 	return c.client.Delete().
@@ -42,6 +42,10 @@ import (
 type Interface interface {
 	// FloatingIPs returns a FloatingIPInformer.
 	FloatingIPs() FloatingIPInformer
+	// FloatingIPHistories returns a FloatingIPHistoryInformer.
+	FloatingIPHistories() FloatingIPHistoryInformer
+	// FloatingIPPools returns a FloatingIPPoolInformer.
+	FloatingIPPools() FloatingIPPoolInformer
 	// Pools returns a PoolInformer.
 	Pools() PoolInformer
 }
@@ -62,6 +66,16 @@ func (v *version) FloatingIPs() FloatingIPInformer {
 	return &floatingIPInformer{factory: v.factory, tweakListOptions: v.tweakListOptions}
 }
 
+// FloatingIPHistories returns a FloatingIPHistoryInformer.
+func (v *version) FloatingIPHistories() FloatingIPHistoryInformer {
+	return &floatingIPHistoryInformer{factory: v.factory, tweakListOptions: v.tweakListOptions}
+}
+
+// FloatingIPPools returns a FloatingIPPoolInformer.
+func (v *version) FloatingIPPools() FloatingIPPoolInformer {
+	return &floatingIPPoolInformer{factory: v.factory, tweakListOptions: v.tweakListOptions}
+}
+
 // Pools returns a PoolInformer.
 func (v *version) Pools() PoolInformer {
 	return &poolInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
@@ -71,6 +71,10 @@ func (f *sharedInformerFactory) ForResource(resource schema.GroupVersionResource
 	// Group=galaxy.k8s.io, Version=v1alpha1
 	case v1alpha1.SchemeGroupVersion.WithResource("floatingips"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Galaxy().V1alpha1().FloatingIPs().Informer()}, nil
+	case v1alpha1.SchemeGroupVersion.WithResource("floatingiphistories"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Galaxy().V1alpha1().FloatingIPHistories().Informer()}, nil
+	case v1alpha1.SchemeGroupVersion.WithResource("floatingippools"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Galaxy().V1alpha1().FloatingIPPools().Informer()}, nil
 	case v1alpha1.SchemeGroupVersion.WithResource("pools"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Galaxy().V1alpha1().Pools().Informer()}, nil
 
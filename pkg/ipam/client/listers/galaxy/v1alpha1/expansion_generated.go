@@ -38,6 +38,14 @@ package v1alpha1
 // FloatingIPLister.
 type FloatingIPListerExpansion interface{}
 
+// FloatingIPHistoryListerExpansion allows custom methods to be added to
+// FloatingIPHistoryLister.
+type FloatingIPHistoryListerExpansion interface{}
+
+// FloatingIPPoolListerExpansion allows custom methods to be added to
+// FloatingIPPoolLister.
+type FloatingIPPoolListerExpansion interface{}
+
 // PoolListerExpansion allows custom methods to be added to
 // PoolLister.
 type PoolListerExpansion interface{}
@@ -17,6 +17,8 @@
 package crd
 
 import (
+	"reflect"
+
 	extensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -46,6 +48,33 @@ var floatingipCrd = &extensionsv1.CustomResourceDefinition{
 	},
 }
 
+// floatingipHistoryCrd is the crd format of floatingiphistory
+var floatingipHistoryCrd = &extensionsv1.CustomResourceDefinition{
+	ObjectMeta: metav1.ObjectMeta{
+		Name: "floatingiphistories.galaxy.k8s.io",
+	},
+	TypeMeta: metav1.TypeMeta{
+		Kind:       "CustomResourceDefinition",
+		APIVersion: "apiextensions.k8s.io/v1beta1",
+	},
+	Spec: extensionsv1.CustomResourceDefinitionSpec{
+		Group:   galaxy.GroupName,
+		Version: "v1alpha1",
+		Scope:   extensionsv1.ClusterScoped,
+		Names: extensionsv1.CustomResourceDefinitionNames{
+			Kind:       "FloatingIPHistory",
+			Plural:     "floatingiphistories",
+			ShortNames: []string{"fiphistory"},
+		},
+		AdditionalPrinterColumns: []extensionsv1.CustomResourceColumnDefinition{
+			{Name: "IP", Type: "string", JSONPath: ".spec.ip"},
+			{Name: "Action", Type: "string", JSONPath: ".spec.action"},
+			{Name: "Key", Type: "string", JSONPath: ".spec.key"},
+			{Name: "Time", Type: "date", JSONPath: ".spec.time"},
+		},
+	},
+}
+
 // poolCrd is the crd format of pool
 var poolCrd = &extensionsv1.CustomResourceDefinition{
 	ObjectMeta: metav1.ObjectMeta{
@@ -63,20 +92,125 @@ var poolCrd = &extensionsv1.CustomResourceDefinition{
 			Kind:   "Pool",
 			Plural: "pools",
 		},
+		Subresources: &extensionsv1.CustomResourceSubresources{
+			Status: &extensionsv1.CustomResourceSubresourceStatus{},
+		},
+		AdditionalPrinterColumns: []extensionsv1.CustomResourceColumnDefinition{
+			{Name: "Size", Type: "integer", JSONPath: ".size"},
+			{Name: "Held", Type: "integer", JSONPath: ".status.size"},
+			{Name: "Bound", Type: "integer", JSONPath: ".status.bound"},
+		},
+	},
+}
+
+// floatingipPoolCrd is the crd format of floatingippool
+var floatingipPoolCrd = &extensionsv1.CustomResourceDefinition{
+	ObjectMeta: metav1.ObjectMeta{
+		Name: "floatingippools.galaxy.k8s.io",
+	},
+	TypeMeta: metav1.TypeMeta{
+		Kind:       "CustomResourceDefinition",
+		APIVersion: "apiextensions.k8s.io/v1beta1",
+	},
+	Spec: extensionsv1.CustomResourceDefinitionSpec{
+		Group:   galaxy.GroupName,
+		Version: "v1alpha1",
+		Scope:   extensionsv1.ClusterScoped,
+		Names: extensionsv1.CustomResourceDefinitionNames{
+			Kind:       "FloatingIPPool",
+			Plural:     "floatingippools",
+			ShortNames: []string{"fippool"},
+		},
+		Subresources: &extensionsv1.CustomResourceSubresources{
+			Status: &extensionsv1.CustomResourceSubresourceStatus{},
+		},
+		Validation: &extensionsv1.CustomResourceValidation{
+			OpenAPIV3Schema: &extensionsv1.JSONSchemaProps{
+				Type: "object",
+				Properties: map[string]extensionsv1.JSONSchemaProps{
+					"spec": {
+						Type:     "object",
+						Required: []string{"routableSubnet", "subnet", "gateway", "ips"},
+						Properties: map[string]extensionsv1.JSONSchemaProps{
+							// named ipams define their own ip types which are label values of FloatingIP objects,
+							// galaxy-ipam validates ip types against its config
+							"ipType":            {Type: "string", Pattern: `^([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9]$`},
+							"routableSubnet":    {Type: "string", MinLength: int64Ptr(1)},
+							"subnet":            {Type: "string", MinLength: int64Ptr(1)},
+							"gateway":           {Type: "string", MinLength: int64Ptr(1)},
+							"vlan":              {Type: "integer", Minimum: float64Ptr(0), Maximum: float64Ptr(4095)},
+							"quarantineSeconds": {Type: "integer", Minimum: float64Ptr(0)},
+							"ips": {
+								Type:     "array",
+								MinItems: int64Ptr(1),
+								Items: &extensionsv1.JSONSchemaPropsOrArray{
+									Schema: &extensionsv1.JSONSchemaProps{Type: "string", MinLength: int64Ptr(1)},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		AdditionalPrinterColumns: []extensionsv1.CustomResourceColumnDefinition{
+			{Name: "RoutableSubnet", Type: "string", JSONPath: ".spec.routableSubnet"},
+			{Name: "Total", Type: "integer", JSONPath: ".status.total"},
+			{Name: "Allocated", Type: "integer", JSONPath: ".status.allocated"},
+			{Name: "Free", Type: "integer", JSONPath: ".status.free"},
+		},
 	},
 }
 
-// EnsureCRDCreated ensures floatingip and pool are created in apiserver
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+func float64Ptr(f float64) *float64 {
+	return &f
+}
+
+// EnsureCRDCreated ensures floatingip, floatingiphistory, floatingippool and pool are created in apiserver
 func EnsureCRDCreated(client apiextensionsclient.Interface) error {
 	crdClient := client.ApiextensionsV1beta1().CustomResourceDefinitions()
-	crds := []*extensionsv1.CustomResourceDefinition{floatingipCrd, poolCrd}
+	crds := []*extensionsv1.CustomResourceDefinition{floatingipCrd, floatingipHistoryCrd, floatingipPoolCrd, poolCrd}
 	for i := range crds {
 		// try to create each crd and ignores already exist error
-		if _, err := crdClient.Create(crds[i]); err != nil && !apierrors.IsAlreadyExists(err) {
-			glog.Errorf("Error creating CRD: %s", crds[i].Spec.Names.Kind)
-			return err
+		if _, err := crdClient.Create(crds[i]); err != nil {
+			if !apierrors.IsAlreadyExists(err) {
+				glog.Errorf("Error creating CRD: %s", crds[i].Spec.Names.Kind)
+				return err
+			}
+			if err := ensureCRDSubresources(client, crds[i]); err != nil {
+				glog.Errorf("Error updating CRD: %s", crds[i].Spec.Names.Kind)
+				return err
+			}
+			continue
 		}
 		glog.Infof("Create CRD %s successfully.", crds[i].Spec.Names.Kind)
 	}
 	return nil
 }
+
+// ensureCRDSubresources enables subresources, printer columns and updates validation for crds created by older
+// versions
+func ensureCRDSubresources(client apiextensionsclient.Interface, crd *extensionsv1.CustomResourceDefinition) error {
+	crdClient := client.ApiextensionsV1beta1().CustomResourceDefinitions()
+	existing, err := crdClient.Get(crd.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(existing.Spec.Subresources, crd.Spec.Subresources) &&
+		reflect.DeepEqual(existing.Spec.AdditionalPrinterColumns, crd.Spec.AdditionalPrinterColumns) &&
+		reflect.DeepEqual(existing.Spec.Validation, crd.Spec.Validation) {
+		return nil
+	}
+	existing.Spec.Subresources = crd.Spec.Subresources
+	existing.Spec.AdditionalPrinterColumns = crd.Spec.AdditionalPrinterColumns
+	// e.g. ipType of FloatingIPPool was an enum which rejected ip types of named ipams
+	existing.Spec.Validation = crd.Spec.Validation
+	if _, err := crdClient.Update(existing); err != nil {
+		return err
+	}
+	glog.Infof("Update CRD %s successfully.", crd.Spec.Names.Kind)
+	return nil
+}
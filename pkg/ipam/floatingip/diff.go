@@ -0,0 +1,106 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package floatingip
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"tkestack.io/galaxy/pkg/utils/database"
+	"tkestack.io/galaxy/pkg/utils/nets"
+)
+
+// ConfigDiff is the difference a floating ip config makes to ips stored in an IPAM once it is configured
+type ConfigDiff struct {
+	// Added are ips of the config which are not stored yet
+	Added []net.IP
+	// Removed are unallocated ips which are not within the config, they are deleted
+	Removed []net.IP
+	// Orphaned are allocated ips which are not within the config, they are kept until being released
+	Orphaned []database.FloatingIP
+}
+
+// DiffConfig returns the difference floatingIPs makes to ipam without configuring it
+func DiffConfig(ipam IPAM, floatingIPs []*FloatingIP) (*ConfigDiff, error) {
+	fips, err := ipam.ByPrefix("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ips: %v", err)
+	}
+	return Diff(fips, floatingIPs), nil
+}
+
+// Diff returns the difference floatingIPs makes to fips, e.g. ips stored in an ipam which is not configured
+func Diff(fips []database.FloatingIP, floatingIPs []*FloatingIP) *ConfigDiff {
+	diff := &ConfigDiff{}
+	stored := make(map[string]bool, len(fips))
+	for j := range fips {
+		ip := net.IP(fips[j].IP)
+		stored[ip.String()] = true
+		if configured(floatingIPs, ip) {
+			continue
+		}
+		if fips[j].Key == "" {
+			diff.Removed = append(diff.Removed, ip)
+		} else {
+			diff.Orphaned = append(diff.Orphaned, fips[j])
+		}
+	}
+	for _, fipConf := range floatingIPs {
+		for _, ipr := range fipConf.IPRanges {
+			ipr.ForEachIP(func(ip net.IP) bool {
+				if !stored[ip.String()] {
+					stored[ip.String()] = true
+					diff.Added = append(diff.Added, ip)
+				}
+				return true
+			})
+		}
+	}
+	sort.Slice(diff.Removed, func(i, j int) bool {
+		return nets.CompareIP(diff.Removed[i], diff.Removed[j]) < 0
+	})
+	sort.Slice(diff.Orphaned, func(i, j int) bool {
+		return nets.CompareIP(net.IP(diff.Orphaned[i].IP), net.IP(diff.Orphaned[j].IP)) < 0
+	})
+	return diff
+}
+
+// configured returns true if ip is within floatingIPs
+func configured(floatingIPs []*FloatingIP, ip net.IP) bool {
+	for _, fipConf := range floatingIPs {
+		if fipConf.IPNet().Contains(ip) && fipConf.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// orphans returns allocated ips of fips which are not within floatingIPs. Nothing is orphaned if floatingIPs is
+// empty, which means the pool is not configured yet.
+func orphans(fips []database.FloatingIP, floatingIPs []*FloatingIP) []database.FloatingIP {
+	if len(floatingIPs) == 0 {
+		return nil
+	}
+	var result []database.FloatingIP
+	for j := range fips {
+		if fips[j].Key != "" && !configured(floatingIPs, net.IP(fips[j].IP)) {
+			result = append(result, fips[j])
+		}
+	}
+	return result
+}
@@ -0,0 +1,58 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package floatingip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+)
+
+func TestDiffConfig(t *testing.T) {
+	ipam := createTestCrdIPAM(t)
+	for key, ip := range map[string]string{"pod1": "10.173.13.2", "pod2": "10.49.27.205"} {
+		if err := ipam.AllocateSpecificIP(key, net.ParseIP(ip), constant.ReleasePolicyNever, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var fips []*FloatingIP
+	if err := json.Unmarshal([]byte(`[{"routableSubnet":"10.49.27.0/24","ips":["10.49.27.205","10.49.27.218~`+
+		`10.49.27.219"],"subnet":"10.49.27.0/24","gateway":"10.49.27.1","vlan":2}]`), &fips); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := DiffConfig(ipam, fips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(diff.Added) != "[10.49.27.219]" {
+		t.Errorf("unexpected added ips %v", diff.Added)
+	}
+	if fmt.Sprint(diff.Removed) != "[10.49.27.216 10.49.27.217 10.173.13.10 10.173.13.11 10.173.13.12 "+
+		"10.173.13.13 10.173.13.15 10.180.154.2 10.180.154.3 10.180.154.7 10.180.154.8]" {
+		t.Errorf("unexpected removed ips %v", diff.Removed)
+	}
+	if len(diff.Orphaned) != 1 || diff.Orphaned[0].Key != "pod1" {
+		t.Errorf("unexpected orphaned ips %+v", diff.Orphaned)
+	}
+	// nothing is changed
+	if err := checkByPrefix(ipam, "", "pod1", "pod2", "", "", "", "", "", "", "", "", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+}
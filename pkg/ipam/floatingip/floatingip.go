@@ -19,6 +19,8 @@ package floatingip
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"math/big"
 	"net"
 	"sync"
 
@@ -29,6 +31,8 @@ import (
 type FloatingIP struct {
 	RoutableSubnet *net.IPNet // the node subnet
 	nets.SparseSubnet
+	// QuarantineSeconds is how long ips released from pods stay unallocatable, 0 means the global setting
+	QuarantineSeconds uint
 	sync.RWMutex
 }
 
@@ -39,6 +43,8 @@ type FloatingIPConf struct {
 	Subnet         *nets.IPNet `json:"subnet"` // the vip subnet
 	Gateway        net.IP      `json:"gateway"`
 	Vlan           uint16      `json:"vlan,omitempty"`
+	// QuarantineSeconds overrides the global release quarantine of this range if it is not 0
+	QuarantineSeconds uint `json:"quarantineSeconds,omitempty"`
 }
 
 // MarshalJSON can marshal FloatingIPConf to byte slice.
@@ -48,6 +54,7 @@ func (fip *FloatingIP) MarshalJSON() ([]byte, error) {
 	conf.Subnet = nets.NetsIPNet(fip.IPNet())
 	conf.Gateway = fip.Gateway
 	conf.Vlan = fip.Vlan
+	conf.QuarantineSeconds = fip.QuarantineSeconds
 	conf.IPs = make([]string, 0)
 	for _, ipr := range fip.IPRanges {
 		conf.IPs = append(conf.IPs, ipr.String())
@@ -78,6 +85,7 @@ func (fip *FloatingIP) UnmarshalJSON(data []byte) error {
 		return fmt.Errorf("subnet is empty")
 	}
 	fip.Vlan = conf.Vlan
+	fip.QuarantineSeconds = conf.QuarantineSeconds
 	for _, str := range conf.IPs {
 		ipr := nets.ParseIPRange(str)
 		if ipr != nil {
@@ -89,14 +97,23 @@ func (fip *FloatingIP) UnmarshalJSON(data []byte) error {
 	return fipCheck(fip)
 }
 
+// MaxIPRangeSize is the max number of ips of an ipv6 ip range, ips of ranges are enumerated when configuring pools.
+// Ipv4 ranges are not limited as they were accepted before.
+const MaxIPRangeSize = 65536
+
 func fipCheck(fip *FloatingIP) error {
 	net := net.IPNet{IP: fip.Gateway, Mask: fip.Mask}
 	for i := range fip.IPRanges {
 		if !net.Contains(fip.IPRanges[i].First) || !net.Contains(fip.IPRanges[i].Last) {
 			return fmt.Errorf("ip range %s not in subnet %s", fip.IPRanges[i].String(), net.String())
 		}
+		if !nets.IsIPv4(fip.IPRanges[i].First) &&
+			Minus(fip.IPRanges[i].Last, fip.IPRanges[i].First) >= MaxIPRangeSize {
+			return fmt.Errorf("ip range %s has more than %d ips, please split it into smaller ranges",
+				fip.IPRanges[i].String(), MaxIPRangeSize)
+		}
 		if i != 0 {
-			if nets.IPToInt(fip.IPRanges[i].First) <= nets.IPToInt(fip.IPRanges[i-1].Last)+1 {
+			if nets.CompareIP(fip.IPRanges[i].First, nets.NextIP(fip.IPRanges[i-1].Last)) <= 0 {
 				return fmt.Errorf("ip range %s and %s can be merge to one or has wrong order",
 					fip.IPRanges[i-1].String(), fip.IPRanges[i].String())
 			}
@@ -196,20 +213,19 @@ func (fip *FloatingIP) RemoveIP(ip net.IP) bool {
 	for i := range fip.IPRanges {
 		ipRange := fip.IPRanges[i]
 		if ipRange.Contains(ip) {
-			ipn := nets.IPToInt(ip)
 			switch {
 			case ipRange.First.Equal(ipRange.Last):
 				fip.IPRanges = append(fip.IPRanges[:i], fip.IPRanges[i+1:]...)
 			case ipRange.First.Equal(ip):
-				ipRange.First = nets.IntToIP(nets.IPToInt(ipRange.First) + 1)
+				ipRange.First = nets.NextIP(ipRange.First)
 				fip.IPRanges[i] = ipRange
 			case ipRange.Last.Equal(ip):
-				ipRange.Last = nets.IntToIP(nets.IPToInt(ipRange.Last) - 1)
+				ipRange.Last = nets.PrevIP(ipRange.Last)
 				fip.IPRanges[i] = ipRange
 			default:
 				fip.IPRanges = append(fip.IPRanges[:i+1], append([]nets.IPRange{ipRange}, fip.IPRanges[i+1:]...)...)
-				fip.IPRanges[i].Last = nets.IntToIP(ipn - 1)
-				fip.IPRanges[i+1].First = nets.IntToIP(ipn + 1)
+				fip.IPRanges[i].Last = nets.PrevIP(ip)
+				fip.IPRanges[i+1].First = nets.NextIP(ip)
 			}
 			return true
 		}
@@ -218,8 +234,19 @@ func (fip *FloatingIP) RemoveIP(ip net.IP) bool {
 }
 
 // Minus compute how many ips between two given ip.
+// The result is clamped to int64 for ipv6 ips which are too far away from each other.
 func Minus(a, b net.IP) int64 {
-	return int64(nets.IPToInt(a)) - int64(nets.IPToInt(b))
+	if nets.IsIPv4(a) && nets.IsIPv4(b) {
+		return int64(nets.IPToInt(a)) - int64(nets.IPToInt(b))
+	}
+	d := new(big.Int).Sub(nets.IPToBigInt(a), nets.IPToBigInt(b))
+	if d.IsInt64() {
+		return d.Int64()
+	}
+	if d.Sign() > 0 {
+		return math.MaxInt64
+	}
+	return math.MinInt64
 }
 
 type FloatingIPSlice []*FloatingIP
@@ -236,7 +263,6 @@ func (s FloatingIPSlice) Swap(i, j int) {
 
 // Less compares two given ip.
 func (s FloatingIPSlice) Less(i, j int) bool {
-	i1, _ := nets.FirstAndLastIP(s[i].RoutableSubnet)
-	j1, _ := nets.FirstAndLastIP(s[j].RoutableSubnet)
-	return i1 < j1
+	return nets.CompareIP(s[i].RoutableSubnet.IP.Mask(s[i].RoutableSubnet.Mask),
+		s[j].RoutableSubnet.IP.Mask(s[j].RoutableSubnet.Mask)) < 0
 }
@@ -166,3 +166,42 @@ func TestInsertRemoveIP(t *testing.T) {
 		t.Fatal(fip.IPRanges)
 	}
 }
+
+func TestUnmarshalIPv6FloatingIP(t *testing.T) {
+	var fip FloatingIP
+	confStr := `{"routableSubnet":"10.173.14.0/24","ips":["2001:db8::fffe~2001:db8::1:1"],"subnet":"2001:db8::/64","gateway":"2001:db8::1"}`
+	if err := json.Unmarshal([]byte(confStr), &fip); err != nil {
+		t.Fatal(err)
+	}
+	if fip.IPNet().String() != "2001:db8::/64" {
+		t.Fatal(fip.IPNet().String())
+	}
+	if fip.Size() != 4 {
+		t.Fatal(fip.Size())
+	}
+	fip.RemoveIP(net.ParseIP("2001:db8::ffff"))
+	if fmt.Sprintf("%v", fip.IPRanges) != "[2001:db8::fffe 2001:db8::1:0~2001:db8::1:1]" {
+		t.Fatal(fip.IPRanges)
+	}
+	fip.InsertIP(net.ParseIP("2001:db8::ffff"))
+	if fmt.Sprintf("%v", fip.IPRanges) != "[2001:db8::fffe~2001:db8::1:1]" {
+		t.Fatal(fip.IPRanges)
+	}
+	// ipv4 ips are not in ipv6 subnet
+	wrongStr := `{"routableSubnet":"10.173.14.0/24","ips":["10.173.14.203"],"subnet":"2001:db8::/64","gateway":"2001:db8::1"}`
+	if err := json.Unmarshal([]byte(wrongStr), &fip); err == nil {
+		t.Fatal(wrongStr)
+	}
+	// ranges which are too large to enumerate are rejected
+	largeStr := `{"routableSubnet":"10.173.14.0/24","ips":["2001:db8::1~2001:db8::ffff:ffff:ffff:ffff"],` +
+		`"subnet":"2001:db8::/64","gateway":"2001:db8::1"}`
+	if err := json.Unmarshal([]byte(largeStr), &FloatingIP{}); err == nil {
+		t.Fatal(largeStr)
+	}
+	// large ipv4 ranges are still accepted
+	largeIPv4Str := `{"routableSubnet":"10.173.14.0/24","ips":["10.0.0.2~10.2.0.1"],"subnet":"10.0.0.0/8",` +
+		`"gateway":"10.0.0.1"}`
+	if err := json.Unmarshal([]byte(largeIPv4Str), &FloatingIP{}); err != nil {
+		t.Fatalf("%s: %v", largeIPv4Str, err)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package floatingip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/utils/database"
+)
+
+// actions of history records
+const (
+	HistoryAllocate     = "allocate"
+	HistoryReuse        = "reuse"
+	HistoryReserve      = "reserve"
+	HistoryRelease      = "release"
+	HistoryUpdatePolicy = "updatePolicy"
+)
+
+// HistoryRecord records a change of a floating ip
+type HistoryRecord struct {
+	IP     net.IP `json:"ip"`
+	IPAM   string `json:"ipam"`
+	Action string `json:"action"`
+	// Key is the key of the ip after the change, or the key which released the ip
+	Key       string                 `json:"key"`
+	Namespace string                 `json:"namespace,omitempty"`
+	AppName   string                 `json:"appName,omitempty"`
+	NodeName  string                 `json:"nodeName,omitempty"`
+	Reason    string                 `json:"reason,omitempty"`
+	Policy    constant.ReleasePolicy `json:"policy"`
+	Time      time.Time              `json:"time"`
+}
+
+// History is an append-only store of history records
+type History interface {
+	// Record appends a record.
+	Record(*HistoryRecord) error
+	// ByIP returns records of the ip in time order.
+	ByIP(net.IP) ([]HistoryRecord, error)
+	// ByApp returns records of the app in time order.
+	ByApp(namespace, appName string) ([]HistoryRecord, error)
+	// Prune deletes records older than the given time.
+	Prune(before time.Time) error
+}
+
+// NewHistory creates a history which is stored in the same storage as the ipam
+func NewHistory(ipam IPAM) (History, error) {
+	switch i := ipam.(type) {
+	case *dbIpam:
+		return newDBHistory(i.store)
+	case *crdIpam:
+		return &crdHistory{client: i.client}, nil
+	case *boltIpam:
+		return newBoltHistory(i.store)
+	}
+	return nil, fmt.Errorf("history is not supported by ipam %s", ipam.Name())
+}
+
+// KeyParser returns the namespace and app name of the key
+type KeyParser func(key string) (namespace, appName string)
+
+// historyIPAM records each change made by the underlying IPAM to history. Failing to record doesn't fail the change.
+type historyIPAM struct {
+	IPAM
+	history  History
+	parseKey KeyParser
+	// action overrides the default action of the changes if not empty
+	action string
+	reason string
+}
+
+// WithHistory returns an IPAM which records changes of ipam to history
+func WithHistory(ipam IPAM, history History, parseKey KeyParser) IPAM {
+	return &historyIPAM{IPAM: ipam, history: history, parseKey: parseKey}
+}
+
+// WithReason returns a copy of ipam which records its changes with the given action and reason. ipam is returned as it
+// is if it doesn't record history. An empty action keeps the default action of each change.
+func WithReason(ipam IPAM, action, reason string) IPAM {
+	h, ok := ipam.(*historyIPAM)
+	if !ok {
+		return ipam
+	}
+	copied := *h
+	copied.action, copied.reason = action, reason
+	return &copied
+}
+
+// HistoryOf returns the history of ipam or nil if it doesn't record history
+func HistoryOf(ipam IPAM) History {
+	if h, ok := ipam.(*historyIPAM); ok {
+		return h.history
+	}
+	return nil
+}
+
+func (h *historyIPAM) record(action, key string, ip net.IP, policy constant.ReleasePolicy, attr string) {
+	if h.action != "" {
+		action = h.action
+	}
+	record := &HistoryRecord{IP: ip, IPAM: h.Name(), Action: action, Key: key, Reason: h.reason, Policy: policy,
+		NodeName: nodeNameOfAttr(attr), Time: time.Now()}
+	if h.parseKey != nil {
+		record.Namespace, record.AppName = h.parseKey(key)
+	}
+	if err := h.history.Record(record); err != nil {
+		glog.Warningf("[%s] failed to record %s ip %s of %s: %v", h.Name(), action, ip.String(), key, err)
+	}
+}
+
+// nodeNameOfAttr returns the node name of attr which is set by scheduler plugin
+func nodeNameOfAttr(attr string) string {
+	var obj struct{ NodeName string }
+	if attr == "" || json.Unmarshal([]byte(attr), &obj) != nil {
+		return ""
+	}
+	return obj.NodeName
+}
+
+// AllocateSpecificIP records the allocation if it succeeds
+func (h *historyIPAM) AllocateSpecificIP(key string, ip net.IP, policy constant.ReleasePolicy, attr string) error {
+	if err := h.IPAM.AllocateSpecificIP(key, ip, policy, attr); err != nil {
+		return err
+	}
+	h.record(HistoryAllocate, key, ip, policy, attr)
+	return nil
+}
+
+// AllocateInSubnet records the allocation if it succeeds
+func (h *historyIPAM) AllocateInSubnet(key string, subnet *net.IPNet, policy constant.ReleasePolicy,
+	attr string) (net.IP, error) {
+	ip, err := h.IPAM.AllocateInSubnet(key, subnet, policy, attr)
+	if err != nil {
+		return nil, err
+	}
+	h.record(HistoryAllocate, key, ip, policy, attr)
+	return ip, nil
+}
+
+// AllocateInSubnetWithKey records the allocation if it succeeds
+func (h *historyIPAM) AllocateInSubnetWithKey(oldK, newK, subnet string, policy constant.ReleasePolicy,
+	attr string) error {
+	if err := h.IPAM.AllocateInSubnetWithKey(oldK, newK, subnet, policy, attr); err != nil {
+		return err
+	}
+	if fip, err := h.First(newK); err != nil || fip == nil {
+		glog.Warningf("[%s] failed to query ip of %s to record history: %v", h.Name(), newK, err)
+	} else {
+		h.record(HistoryAllocate, newK, fip.IPInfo.IP.IP, policy, attr)
+	}
+	return nil
+}
+
+// ReserveIP records the reservation if it succeeds
+func (h *historyIPAM) ReserveIP(oldK, newK, attr string) error {
+	// newK may hold several ips, so query the ip of oldK before it is gone
+	fip, err := h.First(oldK)
+	if err != nil {
+		return err
+	}
+	if err := h.IPAM.ReserveIP(oldK, newK, attr); err != nil {
+		return err
+	}
+	if fip != nil {
+		h.record(HistoryReserve, newK, fip.IPInfo.IP.IP, constant.ReleasePolicy(fip.FIP.Policy), attr)
+	}
+	return nil
+}
+
+// UpdatePolicy records the update if it succeeds
+func (h *historyIPAM) UpdatePolicy(key string, ip net.IP, policy constant.ReleasePolicy, attr string) error {
+	if err := h.IPAM.UpdatePolicy(key, ip, policy, attr); err != nil {
+		return err
+	}
+	h.record(HistoryUpdatePolicy, key, ip, policy, attr)
+	return nil
+}
+
+// Release records the release if it succeeds
+func (h *historyIPAM) Release(key string, ip net.IP) error {
+	// query the attr before it is cleared to record the node
+	fip, _ := h.ByIP(ip)
+	if err := h.IPAM.Release(key, ip); err != nil {
+		return err
+	}
+	h.record(HistoryRelease, key, ip, constant.ReleasePolicy(fip.Policy), fip.Attr)
+	return nil
+}
+
+// ReleaseIPs records each released ip
+func (h *historyIPAM) ReleaseIPs(keys map[string]string) (map[string]string, map[string]string, error) {
+	fips := map[string]database.FloatingIP{}
+	for ip := range keys {
+		if fip, err := h.ByIP(net.ParseIP(ip)); err == nil {
+			fips[ip] = fip
+		}
+	}
+	released, unreleased, err := h.IPAM.ReleaseIPs(keys)
+	for ip, key := range released {
+		fip := fips[ip]
+		h.record(HistoryRelease, key, net.ParseIP(ip), constant.ReleasePolicy(fip.Policy), fip.Attr)
+	}
+	return released, unreleased, err
+}
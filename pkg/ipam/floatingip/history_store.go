@@ -0,0 +1,373 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package floatingip
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	bolt "go.etcd.io/bbolt"
+	metaErrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy/v1alpha1"
+	crd_clientset "tkestack.io/galaxy/pkg/ipam/client/clientset/versioned"
+	"tkestack.io/galaxy/pkg/utils/database"
+)
+
+// dbHistory stores history records in the history table of the database
+type dbHistory struct {
+	store *database.DBRecorder
+}
+
+func newDBHistory(store *database.DBRecorder) (History, error) {
+	if err := store.CreateTableIfNotExist(&database.FloatingIPHistory{}); err != nil {
+		return nil, err
+	}
+	return &dbHistory{store: store}, nil
+}
+
+func (h *dbHistory) Record(record *HistoryRecord) error {
+	row := &database.FloatingIPHistory{IP: record.IP.String(), IPAM: record.IPAM, Action: record.Action,
+		Key: record.Key, Namespace: record.Namespace, AppName: record.AppName, NodeName: record.NodeName,
+		Reason: record.Reason, Policy: uint16(record.Policy), Time: record.Time}
+	return h.store.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(row).Error
+	})
+}
+
+func (h *dbHistory) find(query string, args ...interface{}) ([]HistoryRecord, error) {
+	var rows []database.FloatingIPHistory
+	if err := h.store.Transaction(func(tx *gorm.DB) error {
+		return tx.Where(query, args...).Order("id").Find(&rows).Error
+	}); err != nil {
+		return nil, err
+	}
+	records := make([]HistoryRecord, len(rows))
+	for i := range rows {
+		records[i] = HistoryRecord{IP: net.ParseIP(rows[i].IP), IPAM: rows[i].IPAM, Action: rows[i].Action,
+			Key: rows[i].Key, Namespace: rows[i].Namespace, AppName: rows[i].AppName, NodeName: rows[i].NodeName,
+			Reason: rows[i].Reason, Policy: constant.ReleasePolicy(rows[i].Policy), Time: rows[i].Time}
+	}
+	return records, nil
+}
+
+func (h *dbHistory) ByIP(ip net.IP) ([]HistoryRecord, error) {
+	return h.find("ip = ?", ip.String())
+}
+
+func (h *dbHistory) ByApp(namespace, appName string) ([]HistoryRecord, error) {
+	return h.find("namespace = ? AND app_name = ?", namespace, appName)
+}
+
+func (h *dbHistory) Prune(before time.Time) error {
+	return h.store.Transaction(func(tx *gorm.DB) error {
+		return tx.Where("`time` < ?", before).Delete(&database.FloatingIPHistory{}).Error
+	})
+}
+
+// boltHistory stores history records in the history bucket of the bolt db. Keys are the big endian nano seconds of
+// the record time followed by a sequence, which keeps records in time order. Index buckets map ips and apps to keys
+// of their records.
+type boltHistory struct {
+	store *bolt.DB
+}
+
+var (
+	// keys of historyIPIndex are 16 bytes ips followed by record keys
+	historyIPIndex = []byte(database.HistoryTableName + "_ip_index")
+	// keys of historyAppIndex are "namespace/appName\x00" followed by record keys
+	historyAppIndex = []byte(database.HistoryTableName + "_app_index")
+)
+
+func newBoltHistory(store *bolt.DB) (History, error) {
+	if err := store.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(database.HistoryTableName))
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(historyIPIndex) != nil && tx.Bucket(historyAppIndex) != nil {
+			return nil
+		}
+		// index records stored before index buckets are introduced
+		ipIndex, err := tx.CreateBucketIfNotExists(historyIPIndex)
+		if err != nil {
+			return err
+		}
+		appIndex, err := tx.CreateBucketIfNotExists(historyAppIndex)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var record HistoryRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			return putHistoryIndex(ipIndex, appIndex, k, &record)
+		})
+	}); err != nil {
+		return nil, fmt.Errorf("failed to create bucket %s: %v", database.HistoryTableName, err)
+	}
+	return &boltHistory{store: store}, nil
+}
+
+func historyIPIndexPrefix(ip net.IP) []byte {
+	return append([]byte(nil), ip.To16()...)
+}
+
+func historyAppIndexPrefix(namespace, appName string) []byte {
+	return []byte(namespace + "/" + appName + "\x00")
+}
+
+func putHistoryIndex(ipIndex, appIndex *bolt.Bucket, key []byte, record *HistoryRecord) error {
+	if err := ipIndex.Put(append(historyIPIndexPrefix(record.IP), key...), []byte{}); err != nil {
+		return err
+	}
+	if record.AppName == "" {
+		return nil
+	}
+	return appIndex.Put(append(historyAppIndexPrefix(record.Namespace, record.AppName), key...), []byte{})
+}
+
+func (h *boltHistory) Record(record *HistoryRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return h.store.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(database.HistoryTableName))
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 16)
+		binary.BigEndian.PutUint64(key, uint64(record.Time.UnixNano()))
+		binary.BigEndian.PutUint64(key[8:], seq)
+		if err := b.Put(key, data); err != nil {
+			return err
+		}
+		return putHistoryIndex(tx.Bucket(historyIPIndex), tx.Bucket(historyAppIndex), key, record)
+	})
+}
+
+// find returns records whose keys are indexed with prefix in the index bucket
+func (h *boltHistory) find(index, prefix []byte) ([]HistoryRecord, error) {
+	var records []HistoryRecord
+	err := h.store.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(database.HistoryTableName))
+		c := tx.Bucket(index).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			v := b.Get(k[len(prefix):])
+			if v == nil {
+				continue
+			}
+			var record HistoryRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+func (h *boltHistory) ByIP(ip net.IP) ([]HistoryRecord, error) {
+	return h.find(historyIPIndex, historyIPIndexPrefix(ip))
+}
+
+func (h *boltHistory) ByApp(namespace, appName string) ([]HistoryRecord, error) {
+	return h.find(historyAppIndex, historyAppIndexPrefix(namespace, appName))
+}
+
+func (h *boltHistory) Prune(before time.Time) error {
+	end := uint64(before.UnixNano())
+	return h.store.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(database.HistoryTableName))
+		ipIndex, appIndex := tx.Bucket(historyIPIndex), tx.Bucket(historyAppIndex)
+		// collect keys first as deleting during iterating skips keys
+		var keys [][]byte
+		var records []HistoryRecord
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && binary.BigEndian.Uint64(k) < end; k, v = c.Next() {
+			var record HistoryRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			keys = append(keys, append([]byte(nil), k...))
+			records = append(records, record)
+		}
+		for i, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			if err := ipIndex.Delete(append(historyIPIndexPrefix(records[i].IP), k...)); err != nil {
+				return err
+			}
+			if records[i].AppName == "" {
+				continue
+			}
+			if err := appIndex.Delete(append(historyAppIndexPrefix(records[i].Namespace, records[i].AppName),
+				k...)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// crdHistory stores history records as FloatingIPHistory objects labeled by ip, app and day, so that they are
+// selected by labels
+type crdHistory struct {
+	client crd_clientset.Interface
+}
+
+const (
+	historyIPLabel        = "ip"
+	historyNamespaceLabel = "namespace"
+	historyAppLabel       = "app"
+	historyDayLabel       = "day"
+	historyDayFormat      = "20060102"
+)
+
+// historyIPLabelValue returns ip as a valid label value, the string form of ipv4 or hex form of ipv6
+func historyIPLabelValue(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return hex.EncodeToString(ip.To16())
+}
+
+// historyAppLabelValue returns app name as a valid label value, or its hash if the name is too long to be one
+func historyAppLabelValue(appName string) string {
+	if len(validation.IsValidLabelValue(appName)) == 0 {
+		return appName
+	}
+	sum := sha1.Sum([]byte(appName))
+	return hex.EncodeToString(sum[:])
+}
+
+func historyDayLabelValue(t time.Time) string {
+	return t.UTC().Format(historyDayFormat)
+}
+
+func (h *crdHistory) Record(record *HistoryRecord) error {
+	ipLabel := historyIPLabelValue(record.IP)
+	obj := &v1alpha1.FloatingIPHistory{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: fmt.Sprintf("%s-%d", ipLabel, record.Time.UnixNano()),
+			Labels: map[string]string{historyIPLabel: ipLabel,
+				historyDayLabel: historyDayLabelValue(record.Time)},
+		},
+		Spec: v1alpha1.FloatingIPHistorySpec{IP: record.IP.String(), IPAM: record.IPAM, Action: record.Action,
+			Key: record.Key, Namespace: record.Namespace, AppName: record.AppName, NodeName: record.NodeName,
+			Reason: record.Reason, Policy: record.Policy, Time: metav1.NewTime(record.Time)},
+	}
+	if record.Namespace != "" {
+		obj.Labels[historyNamespaceLabel] = record.Namespace
+	}
+	if record.AppName != "" {
+		obj.Labels[historyAppLabel] = historyAppLabelValue(record.AppName)
+	}
+	_, err := h.client.GalaxyV1alpha1().FloatingIPHistories().Create(obj)
+	if metaErrs.IsAlreadyExists(err) {
+		// another change of the same ip at the same nano second
+		obj.Name = fmt.Sprintf("%s-%d", ipLabel, record.Time.UnixNano()+1)
+		_, err = h.client.GalaxyV1alpha1().FloatingIPHistories().Create(obj)
+	}
+	return err
+}
+
+func (h *crdHistory) list(selector labels.Selector, match func(*v1alpha1.FloatingIPHistory) bool) ([]HistoryRecord,
+	error) {
+	list, err := h.client.GalaxyV1alpha1().FloatingIPHistories().List(metav1.ListOptions{
+		LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	var records []HistoryRecord
+	for i := range list.Items {
+		spec := &list.Items[i].Spec
+		if match != nil && !match(&list.Items[i]) {
+			continue
+		}
+		records = append(records, HistoryRecord{IP: net.ParseIP(spec.IP), IPAM: spec.IPAM, Action: spec.Action,
+			Key: spec.Key, Namespace: spec.Namespace, AppName: spec.AppName, NodeName: spec.NodeName,
+			Reason: spec.Reason, Policy: spec.Policy, Time: spec.Time.Time})
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records, nil
+}
+
+func (h *crdHistory) ByIP(ip net.IP) ([]HistoryRecord, error) {
+	return h.list(labels.SelectorFromSet(labels.Set{historyIPLabel: historyIPLabelValue(ip)}), nil)
+}
+
+func (h *crdHistory) ByApp(namespace, appName string) ([]HistoryRecord, error) {
+	return h.list(labels.SelectorFromSet(labels.Set{historyNamespaceLabel: namespace,
+		historyAppLabel: historyAppLabelValue(appName)}), func(obj *v1alpha1.FloatingIPHistory) bool {
+		// in case of hash collisions
+		return obj.Spec.AppName == appName
+	})
+}
+
+// Prune deletes objects recorded before the given time. Objects of days after it are excluded by the day label, and
+// objects without the label are selected as well.
+func (h *crdHistory) Prune(before time.Time) error {
+	selector := labels.Everything()
+	// tomorrow is excluded as well in case of clock skew
+	last := historyDayLabelValue(time.Now().AddDate(0, 0, 1))
+	var days []string
+	for day := before.UTC().AddDate(0, 0, 1); historyDayLabelValue(day) <= last; day = day.AddDate(0, 0, 1) {
+		days = append(days, historyDayLabelValue(day))
+	}
+	if len(days) > 0 {
+		req, err := labels.NewRequirement(historyDayLabel, selection.NotIn, days)
+		if err != nil {
+			return err
+		}
+		selector = selector.Add(*req)
+	}
+	list, err := h.client.GalaxyV1alpha1().FloatingIPHistories().List(metav1.ListOptions{
+		LabelSelector: selector.String()})
+	if err != nil {
+		return err
+	}
+	for i := range list.Items {
+		if !list.Items[i].Spec.Time.Time.Before(before) {
+			continue
+		}
+		if err := h.client.GalaxyV1alpha1().FloatingIPHistories().Delete(list.Items[i].Name,
+			&metav1.DeleteOptions{}); err != nil && !metaErrs.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package floatingip
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	bolt "go.etcd.io/bbolt"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy/v1alpha1"
+	"tkestack.io/galaxy/pkg/utils/database"
+)
+
+func parseTestKey(key string) (string, string) {
+	// sts_ns1_demo_demo-0
+	if parts := strings.Split(key, "_"); len(parts) == 4 {
+		return parts[1], parts[2]
+	}
+	return "", ""
+}
+
+func checkHistory(records []HistoryRecord, expect ...string) error {
+	var got []string
+	for i := range records {
+		got = append(got, fmt.Sprintf("%s %s %s %s %s", records[i].Action, records[i].IP.String(), records[i].Key,
+			records[i].NodeName, records[i].Reason))
+	}
+	if strings.Join(got, ",") != strings.Join(expect, ",") {
+		return fmt.Errorf("expect %v, real %v", expect, got)
+	}
+	return nil
+}
+
+// #lizard forgives
+func testHistory(t *testing.T, ipam IPAM) {
+	history, err := NewHistory(ipam)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipam = WithHistory(ipam, history, parseTestKey)
+	if HistoryOf(ipam) != history {
+		t.Fatal("expect history of the ipam")
+	}
+	_, routableSubnet, _ := net.ParseCIDR("10.49.27.0/24")
+	key, prefix := "sts_ns1_demo_demo-0", "sts_ns1_demo_"
+	ip, err := WithReason(ipam, "", "bind").AllocateInSubnet(key, routableSubnet, constant.ReleasePolicyNever,
+		`{"NodeName":"node1"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WithReason(ipam, HistoryReuse, "bind").UpdatePolicy(key, ip, constant.ReleasePolicyImmutable,
+		`{"NodeName":"node2"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.ReserveIP(key, prefix, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := WithReason(ipam, "", "deleted").Release(prefix, ip); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.AllocateSpecificIP("sts_ns2_demo_demo-0", ip, constant.ReleasePolicyPodDelete, ""); err != nil {
+		t.Fatal(err)
+	}
+	// failed changes are not recorded
+	if err := ipam.AllocateSpecificIP("sts_ns1_demo_demo-1", ip, constant.ReleasePolicyPodDelete, ""); err == nil {
+		t.Fatal("expect failing to allocate an allocated ip")
+	}
+	records, err := history.ByIP(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkHistory(records, "allocate 10.49.27.205 sts_ns1_demo_demo-0 node1 bind",
+		"reuse 10.49.27.205 sts_ns1_demo_demo-0 node2 bind", "reserve 10.49.27.205 sts_ns1_demo_  ",
+		"release 10.49.27.205 sts_ns1_demo_  deleted", "allocate 10.49.27.205 sts_ns2_demo_demo-0  "); err != nil {
+		t.Fatal(err)
+	}
+	if records[0].IPAM != ipam.Name() || records[1].Policy != constant.ReleasePolicyImmutable ||
+		records[0].Namespace != "ns1" || records[0].AppName != "demo" {
+		t.Fatalf("unexpected record %+v", records[:2])
+	}
+	if records, err = history.ByApp("ns1", "demo"); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("expect 4 records of ns1/demo, real %+v", records)
+	}
+	if records, err = history.ByApp("ns2", "demo"); err != nil || len(records) != 1 {
+		t.Fatalf("expect 1 record of ns2/demo, real %+v, err %v", records, err)
+	}
+	// prune keeps records after the given time
+	if err := history.Prune(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if records, err = history.ByIP(ip); err != nil || len(records) != 5 {
+		t.Fatalf("expect 5 records, real %+v, err %v", records, err)
+	}
+	if err := history.Prune(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if records, err = history.ByIP(ip); err != nil || len(records) != 0 {
+		t.Fatalf("expect no records, real %+v, err %v", records, err)
+	}
+}
+
+func TestCRDHistory(t *testing.T) {
+	testHistory(t, createTestCrdIPAM(t))
+}
+
+func TestBoltHistory(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	testHistory(t, ipam)
+}
+
+func TestBoltHistoryIndexOldRecords(t *testing.T) {
+	store, cleanup := openTestBoltStore(t)
+	defer cleanup()
+	// a record stored before index buckets are introduced
+	record := &HistoryRecord{IP: net.ParseIP("10.49.27.205"), Action: HistoryAllocate, Namespace: "ns1",
+		AppName: "demo", Time: time.Now()}
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(database.HistoryTableName))
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 16)
+		binary.BigEndian.PutUint64(key, uint64(record.Time.UnixNano()))
+		return b.Put(key, data)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	history, err := newBoltHistory(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records, err := history.ByIP(record.IP); err != nil || len(records) != 1 {
+		t.Fatalf("expect 1 record, real %+v, err %v", records, err)
+	}
+	if records, err := history.ByApp("ns1", "demo"); err != nil || len(records) != 1 {
+		t.Fatalf("expect 1 record, real %+v, err %v", records, err)
+	}
+}
+
+func TestCRDHistoryLabels(t *testing.T) {
+	ipam := createTestCrdIPAM(t)
+	history := &crdHistory{client: ipam.client}
+	longName := strings.Repeat("a", 64)
+	now := time.Now()
+	for i, appName := range []string{"demo", longName} {
+		if err := history.Record(&HistoryRecord{IP: net.ParseIP("10.49.27.205"), Action: HistoryAllocate,
+			Namespace: "ns1", AppName: appName, Time: now.Add(time.Duration(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if records, err := history.ByApp("ns1", longName); err != nil || len(records) != 1 ||
+		records[0].AppName != longName {
+		t.Fatalf("expect 1 record of long app name, real %+v, err %v", records, err)
+	}
+	// an object recorded before day labels are introduced
+	if _, err := ipam.client.GalaxyV1alpha1().FloatingIPHistories().Create(&v1alpha1.FloatingIPHistory{
+		ObjectMeta: v1.ObjectMeta{Name: "old", Labels: map[string]string{historyIPLabel: "10.49.27.205"}},
+		Spec: v1alpha1.FloatingIPHistorySpec{IP: "10.49.27.205", Action: HistoryRelease,
+			Time: v1.NewTime(now.AddDate(0, 0, -3))},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := history.Prune(now.AddDate(0, 0, -1)); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := history.ByIP(net.ParseIP("10.49.27.205")); err != nil || len(records) != 2 {
+		t.Fatalf("expect 2 records, real %+v, err %v", records, err)
+	}
+}
+
+func TestDBHistory(t *testing.T) {
+	ipam := Start(t)
+	defer ipam.Shutdown()
+	if err := ipam.store.CreateTableIfNotExist(&database.FloatingIPHistory{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.store.Transaction(func(tx *gorm.DB) error {
+		return tx.Exec(fmt.Sprintf("TRUNCATE %s;", database.HistoryTableName)).Error
+	}); err != nil {
+		t.Fatal(err)
+	}
+	testHistory(t, ipam)
+}
+
+func TestNodeNameOfAttr(t *testing.T) {
+	for attr, expect := range map[string]string{
+		`{"NodeName":"node1"}`: "node1",
+		"":                     "",
+		"212":                  "",
+	} {
+		if got := nodeNameOfAttr(attr); got != expect {
+			t.Errorf("attr %q: expect %q, got %q", attr, expect, got)
+		}
+	}
+}
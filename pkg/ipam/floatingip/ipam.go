@@ -32,12 +32,17 @@ var (
 	// ErrNoEnoughIP is error when there is no available floatingIPs
 	ErrNoEnoughIP     = fmt.Errorf("no enough available ips left")
 	ErrNoFIPForSubnet = fmt.Errorf("no fip configured for subnet")
+	// ErrNotInPool is error when the ip is not in the configured pool
+	ErrNotInPool = fmt.Errorf("ip is not in pool")
 )
 
 // IPAM interface which implemented by database and kubernetes CRD
 type IPAM interface {
-	// ConfigurePool init floatingIP pool.
+	// ConfigurePool init floatingIP pool. Allocated ips which are no longer configured are kept as orphans, they
+	// won't be allocated again and are deleted the next time the pool is configured after being released.
 	ConfigurePool([]*FloatingIP) error
+	// Orphans returns allocated ips which are kept though they are no longer configured.
+	Orphans() ([]database.FloatingIP, error)
 	// ReleaseIPs releases given ips as long as their keys match and returned released and unreleased map
 	// released and unreleased map are guaranteed to be none nil even if err is not nil
 	// unreleased map stores ip with its latest key if key changed
@@ -56,7 +61,7 @@ type IPAM interface {
 	Release(string, net.IP) error
 	// First returns the first matched IP by key.
 	First(string) (*FloatingIPInfo, error) // returns nil,nil if key is not found
-	// ByIP transform a given IP to database.FloatingIP struct.
+	// ByIP transform a given IP to database.FloatingIP struct. It returns an empty FloatingIP if ip is not stored.
 	ByIP(net.IP) (database.FloatingIP, error)
 	// ByPrefix filter floatingIPs by prefix key.
 	ByPrefix(string) ([]database.FloatingIP, error)
@@ -66,6 +71,14 @@ type IPAM interface {
 	RoutableSubnet(net.IP) *net.IPNet
 	// RoutableSubnet returns node's net subnet.
 	QueryRoutableSubnetByKey(key string) ([]string, error)
+	// RestoreIPs sets key, policy, attr and update time of the given ips as they are, e.g. when migrating ips from
+	// another IPAM. IPs must be within the pool, and ips with an empty key are released.
+	RestoreIPs([]database.FloatingIP) error
+	// SetExcluded excludes the ip from or includes it back to allocation. An allocated ip keeps its key after being
+	// excluded and won't be allocated again once released. It returns ErrNotInPool if ip is not in the pool.
+	SetExcluded(net.IP, bool) error
+	// SetStrategy sets the strategy of choosing ips by AllocateInSubnet.
+	SetStrategy(Strategy)
 	// Shutdown shutdowns IPAM.
 	Shutdown()
 	// Name returns IPAM's name.
@@ -76,6 +89,8 @@ type IPAM interface {
 type FloatingIPInfo struct {
 	IPInfo constant.IPInfo
 	FIP    database.FloatingIP
+	// QuarantineSeconds of the range which the ip belongs to
+	QuarantineSeconds uint
 }
 
 // ipam manages floating ip allocation and release and does it atomically
@@ -84,6 +99,7 @@ type dbIpam struct {
 	FloatingIPs []*FloatingIP `json:"floatingips,omitempty"`
 	store       *database.DBRecorder
 	TableName   string
+	selector    *selector
 }
 
 // NewIPAM init database IPAM
@@ -98,6 +114,20 @@ func NewIPAMWithTableName(store *database.DBRecorder, tableName string) IPAM {
 	return &dbIpam{
 		store:     store,
 		TableName: tableName,
+		selector:  newSelector(),
+	}
+}
+
+// NewIPv6IPAM init database IPAM which stores ipv6 floating ips
+func NewIPv6IPAM(store *database.DBRecorder) IPAM {
+	tableName := database.IPv6FloatingipTableName
+	if err := store.CreateIPv6TableIfNotExist(&database.FloatingIP{Table: tableName}); err != nil {
+		glog.Fatalf("failed to create table %s: %v", tableName, err)
+	}
+	return &dbIpam{
+		store:     store,
+		TableName: tableName,
+		selector:  newSelector(),
 	}
 }
 
@@ -106,15 +136,21 @@ func (i *dbIpam) Name() string {
 	return i.TableName
 }
 
+// SetStrategy sets the strategy of choosing ips by AllocateInSubnet.
+func (i *dbIpam) SetStrategy(strategy Strategy) {
+	i.selector.setStrategy(strategy)
+}
+
 func (i *dbIpam) mergeWithDB(fipMap map[string]*FloatingIP) error {
 	ips, err := i.findAll()
 	if err != nil {
 		return err
 	}
-	var toBeDelete []uint32
+	var toBeDelete []database.IP
+	var orphaned []string
 	// delete no longer available floating ips stored in the db first
 	for _, ip := range ips {
-		netIP := nets.IntToIP(ip.IP)
+		netIP := net.IP(ip.IP)
 		found := false
 		for _, fipConf := range fipMap {
 			if fipConf.IPNet().Contains(netIP) {
@@ -124,9 +160,19 @@ func (i *dbIpam) mergeWithDB(fipMap map[string]*FloatingIP) error {
 				}
 			}
 		}
-		if !found {
-			toBeDelete = append(toBeDelete, ip.IP)
+		if found {
+			continue
 		}
+		if ip.Key != "" {
+			// never drop allocated ips, keep them until they are released
+			orphaned = append(orphaned, netIP.String())
+			continue
+		}
+		toBeDelete = append(toBeDelete, ip.IP)
+	}
+	if len(orphaned) > 0 {
+		glog.Warningf("[%s] keep %d allocated ips which are no longer configured: %v", i.Name(), len(orphaned),
+			orphaned)
 	}
 	if len(toBeDelete) > 0 {
 		deleted, err := i.deleteUnScoped(toBeDelete)
@@ -143,15 +189,22 @@ func (i *dbIpam) insertNewFips(fipMap map[string]*FloatingIP) error {
 	for _, fipConf := range fipMap {
 		subnet := fipConf.RoutableSubnet.String()
 		for _, ipr := range fipConf.IPRanges {
-			first := nets.IPToInt(ipr.First)
-			last := nets.IPToInt(ipr.Last)
-			for ; first <= last; first++ {
-				fip := database.FloatingIP{IP: first, Key: "", Subnet: subnet}
-				if err := i.create(&fip); err != nil {
-					if !strings.Contains(err.Error(), fmt.Sprintf(`Duplicate entry '%d' for key 'PRIMARY'`, first)) {
-						return fmt.Errorf("Error creating floating ip %d: %v", first, err)
+			var err error
+			ipr.ForEachIP(func(ip net.IP) bool {
+				fip := database.FloatingIP{IP: database.IP(ip), Key: "", Subnet: subnet}
+				if err = i.create(&fip); err != nil {
+					// ipv6 ip is binary in the error message, so don't match it
+					if !strings.Contains(err.Error(), "Duplicate entry") ||
+						!strings.Contains(err.Error(), "for key 'PRIMARY'") {
+						err = fmt.Errorf("Error creating floating ip %s: %v", ip.String(), err)
+						return false
 					}
+					err = nil
 				}
+				return true
+			})
+			if err != nil {
+				return err
 			}
 		}
 	}
@@ -177,33 +230,34 @@ func (i *dbIpam) ConfigurePool(floatingIPs []*FloatingIP) error {
 	return nil
 }
 
+// Orphans returns allocated ips which are kept though they are no longer configured.
+func (i *dbIpam) Orphans() ([]database.FloatingIP, error) {
+	fips, err := i.findAll()
+	if err != nil {
+		return nil, err
+	}
+	return orphans(fips, i.FloatingIPs), nil
+}
+
 // Release release a given IP.
 func (i *dbIpam) Release(key string, ip net.IP) error {
-	return i.releaseIP(key, nets.IPToInt(ip))
+	return i.releaseIP(key, database.IP(ip))
 }
 
 func (i *dbIpam) ReleaseByPrefix(keyPrefix string) error {
 	return i.releaseByPrefix(keyPrefix)
 }
 
-func (i *dbIpam) first(key string) (*constant.IPInfo, error) {
-	fipInfo, err := i.First(key)
-	if err != nil || fipInfo == nil {
-		return nil, err
-	}
-	return &fipInfo.IPInfo, nil
-}
-
 // First returns the first matched IP by key.
 func (i *dbIpam) First(key string) (*FloatingIPInfo, error) {
 	var fip database.FloatingIP
 	if err := i.findByKey(key, &fip); err != nil {
 		return nil, err
 	}
-	if fip.IP == 0 {
+	if len(fip.IP) == 0 {
 		return nil, nil
 	}
-	netIP := nets.IntToIP(fip.IP)
+	netIP := net.IP(fip.IP)
 	for _, fips := range i.FloatingIPs {
 		if fips.Contains(netIP) {
 			ip := nets.IPNet(net.IPNet{
@@ -217,7 +271,8 @@ func (i *dbIpam) First(key string) (*FloatingIPInfo, error) {
 					Gateway:        fips.Gateway,
 					RoutableSubnet: nets.NetsIPNet(fips.RoutableSubnet),
 				},
-				FIP: fip,
+				FIP:               fip,
+				QuarantineSeconds: fips.QuarantineSeconds,
 			}, nil
 		}
 	}
@@ -249,24 +304,20 @@ func (i *dbIpam) AllocateInSubnet(key string, routableSubnet *net.IPNet, policy
 		err = ErrNoFIPForSubnet
 		return
 	}
-	if err = i.updateOneInSubnet("", key, routableSubnet.String(), uint16(policy), attr); err != nil {
+	if allocated, err = i.allocateOneInSubnet(key, routableSubnet.String(), uint16(policy), attr); err != nil {
 		if err == ErrNotUpdated {
 			err = ErrNoEnoughIP
 		}
-		return
-	}
-	var fip database.FloatingIP
-	if err = i.findByKey(key, &fip); err != nil {
-		return
+		return nil, err
 	}
-	allocated = nets.IntToIP(fip.IP)
 	return
 }
 
-func (i *dbIpam) applyFloatingIPs(fips []*FloatingIP) []*FloatingIP {
-	res := make(map[string]*FloatingIP, len(i.FloatingIPs))
-	for j := range i.FloatingIPs {
-		ofip := i.FloatingIPs[j]
+// applyFloatingIPs merges fips into confs by routable subnet
+func applyFloatingIPs(confs, fips []*FloatingIP) []*FloatingIP {
+	res := make(map[string]*FloatingIP, len(confs))
+	for j := range confs {
+		ofip := confs[j]
 		fip := FloatingIP{
 			RoutableSubnet: ofip.RoutableSubnet,
 			SparseSubnet: nets.SparseSubnet{
@@ -274,6 +325,7 @@ func (i *dbIpam) applyFloatingIPs(fips []*FloatingIP) []*FloatingIP {
 				Mask:    ofip.Mask,
 				Vlan:    ofip.Vlan,
 			},
+			QuarantineSeconds: ofip.QuarantineSeconds,
 		}
 		for k := range ofip.IPRanges {
 			fip.IPRanges = append(fip.IPRanges, ofip.IPRanges[k])
@@ -284,9 +336,10 @@ func (i *dbIpam) applyFloatingIPs(fips []*FloatingIP) []*FloatingIP {
 	for j, fip := range fips {
 		if ofip, exist := res[fip.RoutableSubnet.String()]; exist {
 			for _, ipRange := range fip.IPRanges {
-				for ipn := nets.IPToInt(ipRange.First); ipn <= nets.IPToInt(ipRange.Last); ipn++ {
-					ofip.InsertIP(nets.IntToIP(ipn))
-				}
+				ipRange.ForEachIP(func(ip net.IP) bool {
+					ofip.InsertIP(ip)
+					return true
+				})
 			}
 		} else {
 			res[fip.RoutableSubnet.String()] = fips[j]
@@ -320,9 +373,8 @@ func (i *dbIpam) ByPrefix(prefix string) ([]database.FloatingIP, error) {
 
 // RoutableSubnet returns node's net subnet.
 func (i *dbIpam) RoutableSubnet(nodeIP net.IP) *net.IPNet {
-	intIP := nets.IPToInt(nodeIP)
 	minIndex := sort.Search(len(i.FloatingIPs), func(j int) bool {
-		return nets.IPToInt(i.FloatingIPs[j].RoutableSubnet.IP) > intIP
+		return nets.CompareIP(i.FloatingIPs[j].RoutableSubnet.IP, nodeIP) > 0
 	})
 	if minIndex == 0 {
 		return nil
@@ -340,17 +392,20 @@ func (i *dbIpam) QueryRoutableSubnetByKey(key string) ([]string, error) {
 
 // ByIP transform a given IP to database.FloatingIP struct.
 func (i *dbIpam) ByIP(ip net.IP) (database.FloatingIP, error) {
-	return i.findByIP(nets.IPToInt(ip))
+	return i.findByIP(database.IP(ip))
 }
 
 // AllocateSpecificIP allocate pod a specific IP.
 func (i *dbIpam) AllocateSpecificIP(key string, ip net.IP, policy constant.ReleasePolicy, attr string) error {
-	return i.allocateSpecificIP(nets.IPToInt(ip), key, uint16(policy), attr)
+	if !configured(i.FloatingIPs, ip) {
+		return ErrNotInPool
+	}
+	return i.allocateSpecificIP(database.IP(ip), key, uint16(policy), attr)
 }
 
 // UpdatePolicy update floatingIP's release policy.
 func (i *dbIpam) UpdatePolicy(key string, ip net.IP, policy constant.ReleasePolicy, attr string) error {
-	return i.updatePolicy(nets.IPToInt(ip), key, uint16(policy), attr)
+	return i.updatePolicy(database.IP(ip), key, uint16(policy), attr)
 }
 
 // ReserveIP can reserve a IP entitled by a terminated pod.
@@ -358,6 +413,11 @@ func (i *dbIpam) ReserveIP(oldK, newK, attr string) error {
 	return i.updateKey(oldK, newK, attr)
 }
 
+// SetExcluded excludes the ip from or includes it back to allocation.
+func (i *dbIpam) SetExcluded(ip net.IP, excluded bool) error {
+	return i.updateExcluded(database.IP(ip), excluded)
+}
+
 // AllocateInSubnetWithKey allocate a floatingIP in given subnet and key.
 func (i *dbIpam) AllocateInSubnetWithKey(oldK, newK, subnet string, policy constant.ReleasePolicy, attr string) error {
 	return i.updateOneInSubnet(oldK, newK, subnet, uint16(policy), attr)
@@ -377,3 +437,17 @@ func (i *dbIpam) ByKeyword(keyword string) ([]database.FloatingIP, error) {
 func (i *dbIpam) ReleaseIPs(ipToKey map[string]string) (map[string]string, map[string]string, error) {
 	return i.deleteIPs(i.TableName, ipToKey)
 }
+
+// RestoreIPs sets key, policy, attr and update time of the given ips as they are
+func (i *dbIpam) RestoreIPs(fips []database.FloatingIP) error {
+	return i.restoreIPs(fips)
+}
+
+// Stored returns all ips stored by the ipam. Unlike ByPrefix it doesn't require the pool to be configured, so that
+// ips can be read without ConfigurePool which inserts and deletes unallocated ips.
+func Stored(ipam IPAM) ([]database.FloatingIP, error) {
+	if ci, ok := ipam.(*crdIpam); ok {
+		return ci.stored()
+	}
+	return ipam.ByPrefix("")
+}
@@ -0,0 +1,411 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package floatingip
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/utils/database"
+	"tkestack.io/galaxy/pkg/utils/nets"
+)
+
+// boltIpam manages floating ips in a bucket of an embedded bolt db file. Each operation is done in a bolt
+// transaction, which makes it as atomic as dbIpam
+type boltIpam struct {
+	FloatingIPs []*FloatingIP `json:"floatingips,omitempty"`
+	store       *bolt.DB
+	bucket      string
+	selector    *selector
+}
+
+// OpenBoltStore opens or creates the bolt db file
+func OpenBoltStore(path string) (*bolt.DB, error) {
+	// bolt holds a file lock, so don't wait forever if another process opened it
+	store, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt db %s: %v", path, err)
+	}
+	return store, nil
+}
+
+// NewBoltIPAM init bolt IPAM which stores floating ips in the given bucket
+func NewBoltIPAM(store *bolt.DB, bucket string) IPAM {
+	if err := store.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	}); err != nil {
+		glog.Fatalf("failed to create bucket %s: %v", bucket, err)
+	}
+	return &boltIpam{
+		store:    store,
+		bucket:   bucket,
+		selector: newSelector(),
+	}
+}
+
+// Name returns IPAM's name.
+func (i *boltIpam) Name() string {
+	return i.bucket
+}
+
+// SetStrategy sets the strategy of choosing ips by AllocateInSubnet.
+func (i *boltIpam) SetStrategy(strategy Strategy) {
+	i.selector.setStrategy(strategy)
+}
+
+// ConfigurePool init floatingIP pool.
+func (i *boltIpam) ConfigurePool(floatingIPs []*FloatingIP) error {
+	sort.Sort(FloatingIPSlice(floatingIPs))
+	glog.Infof("floating ip config %v", floatingIPs)
+	i.FloatingIPs = floatingIPs
+	floatingIPMap := make(map[string]*FloatingIP)
+	for _, fip := range i.FloatingIPs {
+		if _, exists := floatingIPMap[fip.Key()]; exists {
+			glog.Warningf("Exists floating ip conf %v", fip)
+			continue
+		}
+		floatingIPMap[fip.Key()] = fip
+	}
+	return i.mergeWithBolt(floatingIPMap)
+}
+
+// Orphans returns allocated ips which are kept though they are no longer configured.
+func (i *boltIpam) Orphans() ([]database.FloatingIP, error) {
+	fips, err := i.findByMatch(func(_ net.IP, fip *boltFloatingIP) bool {
+		return fip.Key != ""
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orphans(fips, i.FloatingIPs), nil
+}
+
+// ReleaseIPs releases given ips
+func (i *boltIpam) ReleaseIPs(ipToKey map[string]string) (map[string]string, map[string]string, error) {
+	deleted, undeleted := map[string]string{}, map[string]string{}
+	for ipStr, key := range ipToKey {
+		undeleted[ipStr] = key
+	}
+	err := i.update(func(b *bolt.Bucket) error {
+		for ipStr, key := range ipToKey {
+			ip := net.ParseIP(ipStr)
+			if ip == nil {
+				continue
+			}
+			fip, err := boltGet(b, ip)
+			if err != nil {
+				return err
+			}
+			if fip == nil {
+				continue
+			}
+			if fip.Key != key {
+				// update key
+				undeleted[ipStr] = fip.Key
+				continue
+			}
+			if err := boltUpdateIP(b, ip, key, "", 0, ""); err != nil {
+				return err
+			}
+			deleted[ipStr] = key
+			delete(undeleted, ipStr)
+		}
+		return nil
+	})
+	if err != nil {
+		// the transaction is rolled back, nothing is released
+		undeleted = map[string]string{}
+		for ipStr, key := range ipToKey {
+			undeleted[ipStr] = key
+		}
+		return map[string]string{}, undeleted, err
+	}
+	return deleted, undeleted, nil
+}
+
+// AllocateSpecificIP allocate pod a specific IP.
+func (i *boltIpam) AllocateSpecificIP(key string, ip net.IP, policy constant.ReleasePolicy, attr string) error {
+	if !configured(i.FloatingIPs, ip) {
+		return ErrNotInPool
+	}
+	return i.update(func(b *bolt.Bucket) error {
+		return boltUpdateIP(b, ip, "", key, uint16(policy), attr)
+	})
+}
+
+// AllocateInSubnet allocate subnet of IPs.
+func (i *boltIpam) AllocateInSubnet(key string, routableSubnet *net.IPNet, policy constant.ReleasePolicy,
+	attr string) (allocated net.IP, err error) {
+	if routableSubnet == nil {
+		// this should never happen
+		return nil, fmt.Errorf("nil routableSubnet")
+	}
+	if i.toFIPSubnet(routableSubnet) == nil {
+		var allRoutableSubnet []string
+		for j := range i.FloatingIPs {
+			allRoutableSubnet = append(allRoutableSubnet, i.FloatingIPs[j].RoutableSubnet.String())
+		}
+		glog.V(3).Infof("can't find fit routableSubnet %s, all routableSubnets %v", routableSubnet.String(),
+			allRoutableSubnet)
+		return nil, ErrNoFIPForSubnet
+	}
+	subnet := routableSubnet.String()
+	err = i.update(func(b *bolt.Bucket) error {
+		fips, err := boltFind(b, func(ip net.IP, fip *boltFloatingIP) bool {
+			// released orphans are not available
+			return fip.Key == "" && fip.Subnet == subnet && !fip.Excluded && configured(i.FloatingIPs, ip)
+		})
+		if err != nil {
+			return err
+		}
+		if len(fips) == 0 {
+			return ErrNoEnoughIP
+		}
+		candidates := make([]candidate, len(fips))
+		for j := range fips {
+			candidates[j] = candidate{ip: net.IP(fips[j].IP), updatedAt: fips[j].UpdatedAt}
+		}
+		i.selector.order(subnet, candidates)
+		allocated = candidates[0].ip
+		return boltUpdateIP(b, allocated, "", key, uint16(policy), attr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	i.selector.allocated(subnet, allocated)
+	return
+}
+
+// allocateOneInSubnet updates the latest updated ip of oldK in the subnet to newK
+func (i *boltIpam) allocateOneInSubnet(oldK, newK, subnet string, policy uint16, attr string) error {
+	return i.update(func(b *bolt.Bucket) error {
+		latest, err := boltFindLatest(b, func(ip net.IP, fip *boltFloatingIP) bool {
+			// orphans are not available
+			return fip.Key == oldK && fip.Subnet == subnet && !fip.Excluded && configured(i.FloatingIPs, ip)
+		})
+		if err != nil {
+			return err
+		}
+		if latest == nil {
+			return ErrNotUpdated
+		}
+		return boltUpdateIP(b, net.IP(latest.IP), oldK, newK, policy, attr)
+	})
+}
+
+// AllocateInSubnetWithKey allocate a floatingIP in given subnet and key.
+func (i *boltIpam) AllocateInSubnetWithKey(oldK, newK, subnet string, policy constant.ReleasePolicy,
+	attr string) error {
+	return i.allocateOneInSubnet(oldK, newK, subnet, uint16(policy), attr)
+}
+
+// SetExcluded excludes the ip from or includes it back to allocation.
+func (i *boltIpam) SetExcluded(ip net.IP, excluded bool) error {
+	return i.update(func(b *bolt.Bucket) error {
+		fip, err := boltGet(b, ip)
+		if err != nil {
+			return err
+		}
+		if fip == nil {
+			return ErrNotInPool
+		}
+		if fip.Excluded == excluded {
+			return nil
+		}
+		fip.Excluded = excluded
+		return boltPut(b, ip, fip)
+	})
+}
+
+// ReserveIP can reserve a IP entitled by a terminated pod.
+func (i *boltIpam) ReserveIP(oldK, newK, attr string) error {
+	return i.update(func(b *bolt.Bucket) error {
+		fips, err := boltFind(b, boltKeyEquals(oldK))
+		if err != nil {
+			return err
+		}
+		for j := range fips {
+			ip := net.IP(fips[j].IP)
+			if err := boltUpdateIP(b, ip, oldK, newK, fips[j].Policy, attr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdatePolicy update floatingIP's release policy.
+func (i *boltIpam) UpdatePolicy(key string, ip net.IP, policy constant.ReleasePolicy, attr string) error {
+	return i.update(func(b *bolt.Bucket) error {
+		// don't return ErrNotUpdated as dbIpam does
+		if err := boltUpdateIP(b, ip, key, key, uint16(policy), attr); err != nil && err != ErrNotUpdated {
+			return err
+		}
+		return nil
+	})
+}
+
+// Release release a given IP.
+func (i *boltIpam) Release(key string, ip net.IP) error {
+	return i.update(func(b *bolt.Bucket) error {
+		return boltUpdateIP(b, ip, key, "", 0, "")
+	})
+}
+
+// First returns the first matched IP by key.
+func (i *boltIpam) First(key string) (*FloatingIPInfo, error) {
+	fips, err := i.findByMatch(boltKeyEquals(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(fips) == 0 {
+		return nil, nil
+	}
+	fip := fips[0]
+	netIP := net.IP(fip.IP)
+	for _, fipConf := range i.FloatingIPs {
+		if fipConf.Contains(netIP) {
+			ip := nets.IPNet(net.IPNet{
+				IP:   netIP,
+				Mask: fipConf.Mask,
+			})
+			return &FloatingIPInfo{
+				IPInfo: constant.IPInfo{
+					IP:             &ip,
+					Vlan:           fipConf.Vlan,
+					Gateway:        fipConf.Gateway,
+					RoutableSubnet: nets.NetsIPNet(fipConf.RoutableSubnet),
+				},
+				FIP:               fip,
+				QuarantineSeconds: fipConf.QuarantineSeconds,
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// ByIP transform a given IP to database.FloatingIP struct.
+func (i *boltIpam) ByIP(ip net.IP) (database.FloatingIP, error) {
+	var ret database.FloatingIP
+	err := i.view(func(b *bolt.Bucket) error {
+		fip, err := boltGet(b, ip)
+		if err != nil || fip == nil {
+			return err
+		}
+		ret = toDBFloatingIP(ip, fip)
+		return nil
+	})
+	return ret, err
+}
+
+// ByPrefix filter floatingIPs by prefix key.
+func (i *boltIpam) ByPrefix(prefix string) ([]database.FloatingIP, error) {
+	fips, err := i.findByMatch(func(_ net.IP, fip *boltFloatingIP) bool {
+		return strings.HasPrefix(fip.Key, prefix)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find by prefix %s: %v", prefix, err)
+	}
+	return fips, nil
+}
+
+// ByKeyword returns floatingIP set by a given keyword.
+func (i *boltIpam) ByKeyword(keyword string) ([]database.FloatingIP, error) {
+	return i.findByMatch(func(_ net.IP, fip *boltFloatingIP) bool {
+		return strings.Contains(fip.Key, keyword)
+	})
+}
+
+// RoutableSubnet returns node's net subnet.
+func (i *boltIpam) RoutableSubnet(nodeIP net.IP) *net.IPNet {
+	minIndex := sort.Search(len(i.FloatingIPs), func(j int) bool {
+		return nets.CompareIP(i.FloatingIPs[j].RoutableSubnet.IP, nodeIP) > 0
+	})
+	if minIndex == 0 {
+		return nil
+	}
+	if i.FloatingIPs[minIndex-1].RoutableSubnet.Contains(nodeIP) {
+		return i.FloatingIPs[minIndex-1].RoutableSubnet
+	}
+	return nil
+}
+
+// QueryRoutableSubnetByKey returns subnets of ips of the key.
+func (i *boltIpam) QueryRoutableSubnetByKey(key string) ([]string, error) {
+	fips, err := i.findByMatch(func(_ net.IP, fip *boltFloatingIP) bool {
+		// excluded ips are not available
+		return fip.Key == key && (key != "" || !fip.Excluded)
+	})
+	if err != nil {
+		return nil, err
+	}
+	subnetSet := make(map[string]struct{})
+	var result []string
+	for j := range fips {
+		if _, ok := subnetSet[fips[j].Subnet]; !ok {
+			subnetSet[fips[j].Subnet] = struct{}{}
+			result = append(result, fips[j].Subnet)
+		}
+	}
+	return result, nil
+}
+
+// RestoreIPs sets key, policy, attr and update time of the given ips as they are
+func (i *boltIpam) RestoreIPs(fips []database.FloatingIP) error {
+	return i.update(func(b *bolt.Bucket) error {
+		for j := range fips {
+			ip := net.IP(fips[j].IP)
+			fip, err := boltGet(b, ip)
+			if err != nil {
+				return err
+			}
+			if fip == nil {
+				return fmt.Errorf("ip %s is not in pool", ip.String())
+			}
+			fip.Key, fip.Policy, fip.Attr, fip.UpdatedAt = fips[j].Key, fips[j].Policy, fips[j].Attr, fips[j].UpdatedAt
+			if err := boltPut(b, ip, fip); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Shutdown shutdowns IPAM.
+func (i *boltIpam) Shutdown() {
+	if i.store != nil {
+		if err := i.store.Close(); err != nil {
+			glog.Warningf("failed to close bolt db: %v", err)
+		}
+	}
+}
+
+func (i *boltIpam) toFIPSubnet(routableSubnet *net.IPNet) *net.IPNet {
+	for _, fip := range i.FloatingIPs {
+		if fip.RoutableSubnet.String() == routableSubnet.String() {
+			return fip.IPNet()
+		}
+	}
+	return nil
+}
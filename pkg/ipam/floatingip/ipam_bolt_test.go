@@ -0,0 +1,255 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package floatingip
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/utils/database"
+)
+
+func openTestBoltStore(t *testing.T) (*bolt.DB, func()) {
+	dir, err := ioutil.TempDir("", "galaxy-ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenBoltStore(filepath.Join(dir, "ipam.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, func() {
+		store.Close()     // nolint: errcheck
+		os.RemoveAll(dir) // nolint: errcheck
+	}
+}
+
+func createTestBoltIPAM(t *testing.T) (*boltIpam, func()) {
+	store, cleanup := openTestBoltStore(t)
+	return createBoltIPAMWithBucket(t, store, database.DefaultFloatingipTableName), cleanup
+}
+
+func createBoltIPAMWithBucket(t *testing.T, store *bolt.DB, bucket string) *boltIpam {
+	ipam := NewBoltIPAM(store, bucket).(*boltIpam)
+	var conf struct {
+		Floatingips []*FloatingIP `json:"floatingips"`
+	}
+	if err := json.Unmarshal([]byte(database.TestConfig), &conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.ConfigurePool(conf.Floatingips); err != nil {
+		t.Fatal(err)
+	}
+	// There should be 14 ips
+	if m, err := ipam.ByPrefix(""); err != nil || len(m) != 14 {
+		t.Fatalf("map %v, err %v", m, err)
+	}
+	return ipam
+}
+
+// #lizard forgives
+func TestBoltConfigurePool(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	if err := ipam.AllocateSpecificIP("pod1", net.ParseIP("10.49.27.205"), constant.ReleasePolicyNever, ""); err != nil {
+		t.Fatal(err)
+	}
+	var fips []*FloatingIP
+	if err := json.Unmarshal([]byte(`[{"routableSubnet":"10.49.27.0/24","ips":["10.49.27.205","10.49.27.216"],`+
+		`"subnet":"10.49.27.0/24","gateway":"10.49.27.1","vlan":2}]`), &fips); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.ConfigurePool(fips); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkByPrefix(ipam, "", "pod1", ""); err != nil {
+		t.Fatal(err)
+	}
+	// allocated ip is kept after reconfiguring
+	if err := checkIPKey(ipam, "10.49.27.205", "pod1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// #lizard forgives
+func TestBoltAllocateInSubnet(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	allocatedIP, err := ipam.AllocateInSubnet("pod1", node4IPNet, constant.ReleasePolicyPodDelete, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !node4FIPSubnet.Contains(allocatedIP) {
+		t.Fatal(allocatedIP)
+	}
+	if allocatedIP, err = ipam.AllocateInSubnet("pod2", node2IPNet, constant.ReleasePolicyPodDelete, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !node2FIPSubnet.Contains(allocatedIP) {
+		t.Fatal(allocatedIP)
+	}
+	_, noConfigNode, _ := net.ParseCIDR("10.173.14.0/24")
+	if _, err := ipam.AllocateInSubnet("pod1-1", noConfigNode, constant.ReleasePolicyPodDelete, ""); err != ErrNoFIPForSubnet {
+		t.Fatalf("should fail because of ErrNoFIPForSubnet: %v", err)
+	}
+	// drain 10.180.1.3/32
+	if _, err := ipam.AllocateInSubnet("pod3", node4IPNet, constant.ReleasePolicyPodDelete, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ipam.AllocateInSubnet("pod4", node4IPNet, constant.ReleasePolicyPodDelete, ""); err != ErrNoEnoughIP {
+		t.Fatalf("should fail because of ErrNoEnoughIP: %v", err)
+	}
+	if err = ipam.AllocateInSubnetWithKey("pod2", "pod5", node2IPNet.String(), constant.ReleasePolicyPodDelete, ""); err != nil {
+		t.Fatal(err)
+	}
+	if ipInfo, err := ipam.First("pod2"); err != nil || ipInfo != nil {
+		t.Errorf("err %v ipInfo %v", err, ipInfo)
+	}
+	ipInfo, err := ipam.First("pod5")
+	if err != nil || ipInfo == nil || ipInfo.IPInfo.IP.IP.String() != allocatedIP.String() {
+		t.Fatalf("err %v ipInfo %v", err, ipInfo)
+	}
+	if ipInfo.IPInfo.Gateway.String() != "10.173.13.1" || ipInfo.IPInfo.Vlan != 2 {
+		t.Fatalf("%+v", ipInfo.IPInfo)
+	}
+}
+
+// #lizard forgives
+func TestBoltQueryRoutableSubnetByKey(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	subnets, err := ipam.QueryRoutableSubnetByKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(subnets)
+	if fmt.Sprintf("%v", subnets) != "[10.173.13.0/24 10.180.1.2/32 10.180.1.3/32 10.49.27.0/24]" {
+		t.Fatal(subnets)
+	}
+	if _, err := ipam.AllocateInSubnet("p1", node2IPNet, constant.ReleasePolicyPodDelete, ""); err != nil {
+		t.Fatal(err)
+	}
+	if subnets, err = ipam.QueryRoutableSubnetByKey("p1"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", subnets) != "[10.173.13.0/24]" {
+		t.Fatal(subnets)
+	}
+}
+
+func TestBoltAllocateSpecificIP(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	ip := net.ParseIP("10.49.27.216")
+	if err := ipam.AllocateSpecificIP("pod1", ip, constant.ReleasePolicyPodDelete, ""); err != nil {
+		t.Fatal(err)
+	}
+	// an allocated ip can't be allocated again
+	if err := ipam.AllocateSpecificIP("pod2", ip, constant.ReleasePolicyPodDelete, ""); err != ErrNotUpdated {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltReserveIP(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	testReserveIP(t, ipam)
+}
+
+func TestBoltRelease(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	testRelease(t, ipam)
+}
+
+func TestBoltReleaseIPs(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	testReleaseIPs(t, ipam)
+}
+
+func TestBoltByKeyword(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	testByKeyword(t, ipam)
+}
+
+func TestBoltByPrefix(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	testByPrefix(t, ipam)
+}
+
+func TestBoltSetExcluded(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	testSetExcluded(t, ipam)
+}
+
+func TestBoltOrphans(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	testOrphans(t, ipam)
+}
+
+func TestBoltApplyFloatingIPs(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	testApplyFloatingIPs(t, ipam.FloatingIPs)
+}
+
+func TestBoltEmptyFloatingIPConf(t *testing.T) {
+	store, cleanup := openTestBoltStore(t)
+	defer cleanup()
+	if err := NewBoltIPAM(store, database.DefaultFloatingipTableName).ConfigurePool(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltRoutableSubnet(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	testRoutableSubnet(t, ipam)
+}
+
+// TestBoltMultipleIPAM test two ipams stored in different buckets of the same bolt db.
+func TestBoltMultipleIPAM(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	secondIPAM := createBoltIPAMWithBucket(t, ipam.store, "test_table")
+	ip2 := testMultipleIPAM(t, ipam, secondIPAM)
+	if err := secondIPAM.Release("pod2", ip2); err != nil {
+		t.Fatal(err)
+	}
+	if ipInfo, err := secondIPAM.First("pod2"); err != nil || ipInfo != nil {
+		t.Fatalf("ipInfo %v, err %v", ipInfo, err)
+	}
+}
+
+func TestBoltUpdateKeyUpdatePolicy(t *testing.T) {
+	ipam, cleanup := createTestBoltIPAM(t)
+	defer cleanup()
+	testUpdateKeyUpdatePolicy(t, ipam)
+}
@@ -20,13 +20,19 @@ import (
 	"fmt"
 	"net"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	metaErrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
 	glog "k8s.io/klog"
 	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy/v1alpha1"
 	crd_clientset "tkestack.io/galaxy/pkg/ipam/client/clientset/versioned"
+	crdInformers "tkestack.io/galaxy/pkg/ipam/client/informers/externalversions/galaxy/v1alpha1"
 	"tkestack.io/galaxy/pkg/utils/database"
 	"tkestack.io/galaxy/pkg/utils/nets"
 )
@@ -39,6 +45,8 @@ const (
 	InternalIp Type = iota
 	// ExternalIp is enum of pod's external IP.
 	ExternalIp
+	// IPv6Ip is enum of pod's ipv6 IP.
+	IPv6Ip
 )
 
 // String used to transform IP Type to string.
@@ -47,6 +55,8 @@ func (t *Type) String() (string, error) {
 		return "internalIP", nil
 	} else if *t == ExternalIp {
 		return "externalIP", nil
+	} else if *t == IPv6Ip {
+		return "ipv6IP", nil
 	}
 	return "", fmt.Errorf("unknown ip type %v", *t)
 }
@@ -58,9 +68,17 @@ type FloatingIPObj struct {
 	policy     constant.ReleasePolicy
 	subnet     string
 	updateTime time.Time
+	// resourceVersion of the FloatingIP object, for unallocated ips it is the version when the object is deleted
+	// unless the object is stored
+	resourceVersion string
+	// excluded ips are kept in allocatedFIPs even if they are released, since their objects persist the exclusion
+	excluded bool
+	// stored is true if the FloatingIP object exists, which is always true for allocatedFIPs. Unallocated ips
+	// released with StrategyLeastRecentlyReleased keep their objects to persist the release time
+	stored bool
 }
 
-// FIP is cache of floatingIP, key is FloatingIP name (ip typed as uint32)
+// FIP is cache of floatingIP, key is ip string which differs from FloatingIP name for ipv6 ips
 // value stores FloatingIPSpec in FloatingIP CRD.
 type FIPCache struct {
 	cacheLock       *sync.RWMutex
@@ -71,21 +89,52 @@ type FIPCache struct {
 type crdIpam struct {
 	FloatingIPs []*FloatingIP `json:"floatingips,omitempty"`
 	client      crd_clientset.Interface
-	ipType      Type
+	// ipType is the ipType label of FloatingIP objects of this ipam
+	ipType string
 	//caches for FloatingIP crd, both stores allocated FloatingIPs and unallocated FloatingIPs
-	caches FIPCache
+	caches   FIPCache
+	selector *selector
 }
 
-// NewCrdIPAM init IPAM struct.
-func NewCrdIPAM(fipClient crd_clientset.Interface, ipType Type) IPAM {
+// NewCrdIPAM init IPAM struct. If fipInformer is not nil, caches are kept up to date by watching FloatingIP
+// objects, so that replicas which are not leader also hold a warm cache to serve reads.
+func NewCrdIPAM(fipClient crd_clientset.Interface, ipType Type, fipInformer crdInformers.FloatingIPInformer) IPAM {
+	// unknown ip type is an empty label which fails listing and creating FloatingIP objects
+	name, _ := ipType.String()
+	return NewCrdIPAMWithIPType(fipClient, name, fipInformer)
+}
+
+// NewCrdIPAMWithIPType init IPAM struct which stores floating ips as FloatingIP objects labeled with the given ipType
+func NewCrdIPAMWithIPType(fipClient crd_clientset.Interface, ipType string,
+	fipInformer crdInformers.FloatingIPInformer) IPAM {
 	ipam := &crdIpam{
-		client: fipClient,
-		ipType: ipType,
+		client:   fipClient,
+		ipType:   ipType,
+		selector: newSelector(),
 	}
 	ipam.caches.cacheLock = new(sync.RWMutex)
+	ipam.caches.allocatedFIPs = make(map[string]*FloatingIPObj)
+	ipam.caches.unallocatedFIPs = make(map[string]*FloatingIPObj)
+	if fipInformer != nil {
+		fipInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+			FilterFunc: ipam.ownFloatingIP,
+			Handler: cache.ResourceEventHandlerFuncs{
+				AddFunc: ipam.onFloatingIPUpdate,
+				UpdateFunc: func(oldObj, newObj interface{}) {
+					ipam.onFloatingIPUpdate(newObj)
+				},
+				DeleteFunc: ipam.onFloatingIPDelete,
+			},
+		})
+	}
 	return ipam
 }
 
+// SetStrategy sets the strategy of choosing ips by AllocateInSubnet.
+func (ci *crdIpam) SetStrategy(strategy Strategy) {
+	ci.selector.setStrategy(strategy)
+}
+
 // ConfigurePool init floatingIP pool.
 func (ci *crdIpam) ConfigurePool(floatIPs []*FloatingIP) error {
 	sort.Sort(FloatingIPSlice(floatIPs))
@@ -105,23 +154,37 @@ func (ci *crdIpam) ConfigurePool(floatIPs []*FloatingIP) error {
 	return nil
 }
 
+// Orphans returns allocated ips which are kept though they are no longer configured.
+func (ci *crdIpam) Orphans() ([]database.FloatingIP, error) {
+	fips, err := ci.ByPrefix("")
+	if err != nil {
+		return nil, err
+	}
+	return orphans(fips, ci.FloatingIPs), nil
+}
+
 // AllocateSpecificIP allocate pod a specific IP.
 func (ci *crdIpam) AllocateSpecificIP(key string, ip net.IP, policy constant.ReleasePolicy, attr string) error {
 	ipStr := ip.String()
 	ci.caches.cacheLock.RLock()
-	spec, find := ci.caches.unallocatedFIPs[ipStr]
+	v, find := ci.caches.unallocatedFIPs[ipStr]
+	var spec FloatingIPObj
+	if find {
+		spec = *v
+	}
 	ci.caches.cacheLock.RUnlock()
 	if !find {
 		return fmt.Errorf("failed to find floating ip by %s in cache", ipStr)
 	}
-	date := time.Now()
-	if err := ci.createFloatingIP(ipStr, key, policy, attr, spec.subnet, date); err != nil {
-		glog.Errorf("failed to create floatingIP %s: %v", ipStr, err)
+	fip, err := ci.claimFloatingIP(ipStr, &spec, key, policy, attr, spec.subnet, time.Now())
+	ci.caches.cacheLock.Lock()
+	defer ci.caches.cacheLock.Unlock()
+	if err != nil {
+		glog.Errorf("failed to allocate floatingIP %s: %v", ipStr, err)
+		ci.resyncOnConflict(ipStr, err)
 		return err
 	}
-	ci.caches.cacheLock.Lock()
-	ci.syncCacheAfterCreate(ipStr, key, attr, policy, spec.subnet, date)
-	ci.caches.cacheLock.Unlock()
+	ci.syncCacheAfterCreate(ipStr, fip)
 	return nil
 }
 
@@ -144,22 +207,40 @@ func (ci *crdIpam) AllocateInSubnet(key string, routableSubnet *net.IPNet, polic
 		return
 	}
 	var ipStr string
+	subnet := routableSubnet.String()
 	ci.caches.cacheLock.Lock()
+	var candidates []candidate
 	for k, v := range ci.caches.unallocatedFIPs {
-		//find an unallocated fip, then use it
-		if v.subnet == routableSubnet.String() {
-			ipStr = k
-			date := time.Now()
-			if err = ci.createFloatingIP(ipStr, key, policy, attr, v.subnet, date); err != nil {
-				glog.Errorf("failed to create floatingIP %s: %v", ipStr, err)
-				ci.caches.cacheLock.Unlock()
-				return
+		if v.subnet == subnet {
+			c := candidate{ip: net.ParseIP(k)}
+			// release time of ips without objects is lost after restarting, take them as released earliest
+			if v.stored {
+				c.updatedAt = v.updateTime
 			}
-			//sync cache when crd create success
-			ci.syncCacheAfterCreate(ipStr, key, attr, policy, v.subnet, date)
-			break
+			candidates = append(candidates, c)
 		}
 	}
+	ci.selector.order(subnet, candidates)
+	for j := range candidates {
+		k := candidates[j].ip.String()
+		fip, createErr := ci.claimFloatingIP(k, ci.caches.unallocatedFIPs[k], key, policy, attr, subnet, time.Now())
+		if createErr != nil {
+			glog.Errorf("failed to allocate floatingIP %s: %v", k, createErr)
+			if metaErrs.IsAlreadyExists(createErr) || metaErrs.IsConflict(createErr) || metaErrs.IsNotFound(createErr) {
+				// allocated by others, but we haven't received the event yet, try another one
+				ci.resyncIP(k)
+				continue
+			}
+			ci.caches.cacheLock.Unlock()
+			err = createErr
+			return
+		}
+		//sync cache when crd create success
+		ipStr = k
+		ci.syncCacheAfterCreate(ipStr, fip)
+		ci.selector.allocated(subnet, candidates[j].ip)
+		break
+	}
 	ci.caches.cacheLock.Unlock()
 	if ipStr == "" {
 		return nil, ErrNoEnoughIP
@@ -185,7 +266,8 @@ func (ci *crdIpam) AllocateInSubnetWithKey(oldK, newK, subnet string, policy con
 	)
 	//find latest floatingIP by updateTime.
 	for k, v := range ci.caches.allocatedFIPs {
-		if v.key == oldK && v.subnet == subnet {
+		// orphans are not available
+		if v.key == oldK && v.subnet == subnet && !v.excluded && ci.inPool(net.ParseIP(k)) {
 			if v.updateTime.Unix() > recordTs {
 				recordIP = k
 				latest = v
@@ -195,8 +277,10 @@ func (ci *crdIpam) AllocateInSubnetWithKey(oldK, newK, subnet string, policy con
 	}
 	if latest != nil {
 		date := time.Now()
-		if err := ci.updateFloatingIP(recordIP, newK, subnet, policy, attr, date); err != nil {
+		fip, err := ci.updateFloatingIP(recordIP, newK, subnet, policy, attr, date, latest.resourceVersion)
+		if err != nil {
 			glog.Errorf("failed to update floatingIP %s: %v", recordIP, err)
+			ci.resyncOnConflict(recordIP, err)
 			return err
 		}
 		latest.key = newK
@@ -204,6 +288,7 @@ func (ci *crdIpam) AllocateInSubnetWithKey(oldK, newK, subnet string, policy con
 		latest.subnet = subnet
 		latest.policy = policy
 		latest.att = attr
+		latest.resourceVersion = fip.ResourceVersion
 		return nil
 	}
 	return fmt.Errorf("failed to find floatIP by key %s", oldK)
@@ -216,13 +301,16 @@ func (ci *crdIpam) ReserveIP(oldK, newK, attr string) error {
 	for k, v := range ci.caches.allocatedFIPs {
 		if v.key == oldK {
 			date := time.Now()
-			if err := ci.updateFloatingIP(k, newK, v.subnet, v.policy, attr, date); err != nil {
+			fip, err := ci.updateFloatingIP(k, newK, v.subnet, v.policy, attr, date, v.resourceVersion)
+			if err != nil {
 				glog.Errorf("failed to update floatingIP %s: %v", k, err)
+				ci.resyncOnConflict(k, err)
 				return err
 			}
 			v.key = newK
 			v.updateTime = date
 			v.att = attr
+			v.resourceVersion = fip.ResourceVersion
 			return nil
 		}
 	}
@@ -239,13 +327,16 @@ func (ci *crdIpam) UpdatePolicy(key string, ip net.IP, policy constant.ReleasePo
 		return fmt.Errorf("failed to find floatIP in cache by IP %s", ipStr)
 	}
 	date := time.Now()
-	if err := ci.updateFloatingIP(ipStr, key, v.subnet, policy, attr, date); err != nil {
+	fip, err := ci.updateFloatingIP(ipStr, key, v.subnet, policy, attr, date, v.resourceVersion)
+	if err != nil {
 		glog.Errorf("failed to update floatingIP %s: %v", ipStr, err)
+		ci.resyncOnConflict(ipStr, err)
 		return err
 	}
 	v.policy = policy
 	v.att = attr
 	v.updateTime = date
+	v.resourceVersion = fip.ResourceVersion
 	return nil
 }
 
@@ -261,10 +352,79 @@ func (ci *crdIpam) Release(key string, ip net.IP) error {
 	if v.key != key {
 		return fmt.Errorf("key in %s is %s, not %s", ipStr, v.key, key)
 	}
-	if err := ci.deleteFloatingIP(ipStr); err != nil {
+	return ci.releaseFloatingIP(ipStr, v)
+}
+
+// releaseFloatingIP deletes the FloatingIP object of an allocated ip, or clears its key if the ip is excluded so
+// that the object still persists the exclusion, or if the strategy is StrategyLeastRecentlyReleased so that the
+// object persists the release time. cacheLock must be held by the caller
+func (ci *crdIpam) releaseFloatingIP(ipStr string, v *FloatingIPObj) error {
+	strategy, _ := ci.selector.state(v.subnet)
+	keepReleaseTime := strategy == StrategyLeastRecentlyReleased && ci.inPool(net.ParseIP(ipStr))
+	if !v.excluded && !keepReleaseTime {
+		if err := ci.deleteFloatingIP(ipStr, v.resourceVersion); err != nil && !metaErrs.IsNotFound(err) {
+			ci.resyncOnConflict(ipStr, err)
+			return err
+		}
+		ci.syncCacheAfterDel(ipStr, v.resourceVersion)
+		return nil
+	}
+	fip, err := ci.updateFloatingIP(ipStr, "", v.subnet, constant.ReleasePolicyPodDelete, "", time.Now(),
+		v.resourceVersion)
+	if err != nil {
+		ci.resyncOnConflict(ipStr, err)
 		return err
 	}
-	ci.syncCacheAfterDel(ipStr)
+	ci.syncCacheAfterCreate(ipStr, fip)
+	return nil
+}
+
+// SetExcluded excludes the ip from or includes it back to allocation.
+func (ci *crdIpam) SetExcluded(ip net.IP, excluded bool) error {
+	ipStr := ip.String()
+	ci.caches.cacheLock.Lock()
+	defer ci.caches.cacheLock.Unlock()
+	if v, find := ci.caches.allocatedFIPs[ipStr]; find {
+		if v.excluded == excluded {
+			return nil
+		}
+		if v.key == "" {
+			// the object of an unallocated ip only persists the exclusion
+			if err := ci.deleteFloatingIP(ipStr, v.resourceVersion); err != nil && !metaErrs.IsNotFound(err) {
+				ci.resyncOnConflict(ipStr, err)
+				return err
+			}
+			ci.syncCacheAfterDel(ipStr, v.resourceVersion)
+			return nil
+		}
+		fip, err := ci.setFloatingIPExcluded(ipStr, excluded, v.resourceVersion)
+		if err != nil {
+			ci.resyncOnConflict(ipStr, err)
+			return err
+		}
+		v.excluded = excluded
+		v.resourceVersion = fip.ResourceVersion
+		return nil
+	}
+	v, find := ci.caches.unallocatedFIPs[ipStr]
+	if !find {
+		return ErrNotInPool
+	}
+	if !excluded {
+		return nil
+	}
+	var fip *v1alpha1.FloatingIP
+	var err error
+	if v.stored {
+		fip, err = ci.setFloatingIPExcluded(ipStr, true, v.resourceVersion)
+	} else {
+		fip, err = ci.createFloatingIP(ipStr, "", constant.ReleasePolicyPodDelete, "", v.subnet, time.Now(), true)
+	}
+	if err != nil {
+		ci.resyncOnConflict(ipStr, err)
+		return err
+	}
+	ci.syncCacheAfterCreate(ipStr, fip)
 	return nil
 }
 
@@ -277,7 +437,7 @@ func (ci *crdIpam) First(key string) (*FloatingIPInfo, error) {
 	if fip.Key == "" {
 		return nil, nil
 	}
-	netIP := nets.IntToIP(fip.IP)
+	netIP := net.IP(fip.IP)
 	for _, fips := range ci.FloatingIPs {
 		if fips.Contains(netIP) {
 			ip := nets.IPNet(net.IPNet{
@@ -291,7 +451,8 @@ func (ci *crdIpam) First(key string) (*FloatingIPInfo, error) {
 					Gateway:        fips.Gateway,
 					RoutableSubnet: nets.NetsIPNet(fips.RoutableSubnet),
 				},
-				FIP: fip,
+				FIP:               fip,
+				QuarantineSeconds: fips.QuarantineSeconds,
 			}, nil
 		}
 	}
@@ -315,7 +476,7 @@ func (ci *crdIpam) ByIP(ip net.IP) (database.FloatingIP, error) {
 		fip.Policy = uint16(v.policy)
 		fip.Key = v.key
 		fip.Attr = v.att
-		fip.IP = nets.IPToInt(ip)
+		fip.IP = database.IP(ip)
 		fip.UpdatedAt = v.updateTime
 		return fip, nil
 	}
@@ -323,8 +484,9 @@ func (ci *crdIpam) ByIP(ip net.IP) (database.FloatingIP, error) {
 	fip.Policy = uint16(v.policy)
 	fip.Key = v.key
 	fip.Attr = v.att
-	fip.IP = nets.IPToInt(ip)
+	fip.IP = database.IP(ip)
 	fip.UpdatedAt = v.updateTime
+	fip.Excluded = v.excluded
 	return fip, nil
 }
 
@@ -335,38 +497,34 @@ func (ci *crdIpam) ByPrefix(prefix string) ([]database.FloatingIP, error) {
 	defer ci.caches.cacheLock.RUnlock()
 	for ip, spec := range ci.caches.allocatedFIPs {
 		if strings.HasPrefix(spec.key, prefix) {
-			tmp := database.FloatingIP{
-				Key:       spec.key,
-				Subnet:    spec.subnet,
-				Attr:      spec.att,
-				Policy:    uint16(spec.policy),
-				IP:        nets.IPToInt(net.ParseIP(ip)),
-				UpdatedAt: spec.updateTime,
-			}
-			fips = append(fips, tmp)
+			fips = append(fips, spec.toFloatingIP(net.ParseIP(ip)))
 		}
 	}
 	if prefix == "" {
 		for ip, spec := range ci.caches.unallocatedFIPs {
-			tmp := database.FloatingIP{
-				Key:       spec.key,
-				Subnet:    spec.subnet,
-				Attr:      spec.att,
-				Policy:    uint16(spec.policy),
-				IP:        nets.IPToInt(net.ParseIP(ip)),
-				UpdatedAt: spec.updateTime,
-			}
-			fips = append(fips, tmp)
+			fips = append(fips, spec.toFloatingIP(net.ParseIP(ip)))
 		}
 	}
 	return fips, nil
 }
 
+// stored lists FloatingIP objects of the ipam from apiserver instead of caches which are filled by ConfigurePool
+func (ci *crdIpam) stored() ([]database.FloatingIP, error) {
+	ips, err := ci.listFloatingIPs()
+	if err != nil {
+		return nil, err
+	}
+	fips := make([]database.FloatingIP, len(ips.Items))
+	for j := range ips.Items {
+		fips[j] = newFloatingIPObj(&ips.Items[j]).toFloatingIP(floatingIPFromName(ips.Items[j].Name))
+	}
+	return fips, nil
+}
+
 // RoutableSubnet returns node's net subnet.
 func (ci *crdIpam) RoutableSubnet(nodeIP net.IP) *net.IPNet {
-	intIP := nets.IPToInt(nodeIP)
 	minIndex := sort.Search(len(ci.FloatingIPs), func(j int) bool {
-		return nets.IPToInt(ci.FloatingIPs[j].RoutableSubnet.IP) > intIP
+		return nets.CompareIP(ci.FloatingIPs[j].RoutableSubnet.IP, nodeIP) > 0
 	})
 	if minIndex == 0 {
 		return nil
@@ -394,11 +552,10 @@ func (ci *crdIpam) Shutdown() {
 
 // Name returns IPAM's name.
 func (ci *crdIpam) Name() string {
-	name, err := ci.ipType.String()
-	if err != nil {
+	if ci.ipType == "" {
 		return "unknown type"
 	}
-	return name
+	return ci.ipType
 }
 
 // #lizard forgives
@@ -409,45 +566,67 @@ func (ci *crdIpam) freshCache(fipMap map[string]*FloatingIP) error {
 		glog.Errorf("fail to list floatIP %v", err)
 		return err
 	}
-	var deletingIPs []string
+	var deletingIPs []v1alpha1.FloatingIP
+	var orphaned []string
 	tmpCacheAllocated := make(map[string]*FloatingIPObj)
 	//delete no longer available floating ips stored in etcd first
 	for _, ip := range ips.Items {
-		netIP := net.ParseIP(ip.Name)
+		netIP := floatingIPFromName(ip.Name)
 		found := false
 		for _, fipConf := range fipMap {
 			if fipConf.IPNet().Contains(netIP) {
 				if fipConf.Contains(netIP) {
 					found = true
 					//ip in config, insert it into cache
-					tmpFip := &FloatingIPObj{
-						key:        ip.Spec.Key,
-						att:        ip.Spec.Attribute,
-						policy:     ip.Spec.Policy,
-						subnet:     ip.Spec.Subnet,
-						updateTime: ip.Spec.UpdateTime.Time,
-					}
-					tmpCacheAllocated[ip.Name] = tmpFip
+					tmpCacheAllocated[netIP.String()] = newFloatingIPObj(&ip)
 					break
 				}
 			}
 		}
-		if !found {
-			deletingIPs = append(deletingIPs, ip.Name)
+		if found {
+			continue
+		}
+		if ip.Spec.Key != "" {
+			// never drop allocated ips, keep them until they are released
+			tmpCacheAllocated[netIP.String()] = newFloatingIPObj(&ip)
+			orphaned = append(orphaned, netIP.String())
+			continue
 		}
+		deletingIPs = append(deletingIPs, ip)
+	}
+	if len(orphaned) > 0 {
+		glog.Warningf("[%s] keep %d allocated ips which are no longer configured: %v", ci.Name(), len(orphaned),
+			orphaned)
 	}
 	ci.caches.cacheLock.Lock()
 	defer ci.caches.cacheLock.Unlock()
+	// keep the ones synced by informer after listing
+	for _, cached := range []map[string]*FloatingIPObj{ci.caches.allocatedFIPs, ci.caches.unallocatedFIPs} {
+		for ipStr, v := range cached {
+			if !v.stored || !ci.inPool(net.ParseIP(ipStr)) {
+				continue
+			}
+			if listed, find := tmpCacheAllocated[ipStr]; find {
+				if newerResourceVersion(v.resourceVersion, listed.resourceVersion) {
+					tmpCacheAllocated[ipStr] = v
+				}
+			} else if newerResourceVersion(v.resourceVersion, ips.ResourceVersion) {
+				tmpCacheAllocated[ipStr] = v
+			}
+		}
+	}
 	ci.caches.allocatedFIPs = tmpCacheAllocated
 	if len(deletingIPs) > 0 {
+		var names []string
 		for _, ip := range deletingIPs {
-			if err := ci.deleteFloatingIP(ip); err != nil {
+			names = append(names, ip.Name)
+			if err := ci.deleteFloatingIP(ip.Name, ip.ResourceVersion); err != nil {
 				//if a FloatingIP crd in etcd can't be deleted, every freshCache will produce an error
 				//it won't return error when error happens in deletion
-				glog.Errorf("failed to delete ip %v: %v", ip, err)
+				glog.Errorf("failed to delete ip %v: %v", ip.Name, err)
 			}
 		}
-		glog.Infof("expect to delete %d ips from %v", len(deletingIPs), deletingIPs)
+		glog.Infof("expect to delete %d ips from %v", len(deletingIPs), names)
 	}
 	now := time.Now()
 	// fresh unallocated floatIP
@@ -455,21 +634,27 @@ func (ci *crdIpam) freshCache(fipMap map[string]*FloatingIP) error {
 	for _, fipConf := range fipMap {
 		subnet := fipConf.RoutableSubnet.String()
 		for _, ipr := range fipConf.IPRanges {
-			first := nets.IPToInt(ipr.First)
-			last := nets.IPToInt(ipr.Last)
-			for ; first <= last; first++ {
-				ipStr := nets.IntToIP(first).String()
-				if _, contain := ci.caches.allocatedFIPs[ipStr]; !contain {
+			ipr.ForEachIP(func(ip net.IP) bool {
+				ipStr := ip.String()
+				if v, contain := ci.caches.allocatedFIPs[ipStr]; contain && v.released() {
+					// the object only persists the release time
+					v.subnet = subnet
+					delete(ci.caches.allocatedFIPs, ipStr)
+					tmpCacheUnallocated[ipStr] = v
+				} else if !contain {
+					// objects deleted before listing are older than list's resourceVersion
 					tmpFip := &FloatingIPObj{
-						key:        "",
-						att:        "",
-						policy:     constant.ReleasePolicyPodDelete,
-						subnet:     subnet,
-						updateTime: now,
+						key:             "",
+						att:             "",
+						policy:          constant.ReleasePolicyPodDelete,
+						subnet:          subnet,
+						updateTime:      now,
+						resourceVersion: ips.ResourceVersion,
 					}
 					tmpCacheUnallocated[ipStr] = tmpFip
 				}
-			}
+				return true
+			})
 		}
 	}
 	ci.caches.unallocatedFIPs = tmpCacheUnallocated
@@ -485,49 +670,233 @@ func (ci *crdIpam) toFIPSubnet(routableSubnet *net.IPNet) *net.IPNet {
 	return nil
 }
 
+func (o *FloatingIPObj) toFloatingIP(ip net.IP) database.FloatingIP {
+	return database.FloatingIP{
+		Key:       o.key,
+		Subnet:    o.subnet,
+		Attr:      o.att,
+		Policy:    uint16(o.policy),
+		IP:        database.IP(ip),
+		UpdatedAt: o.updateTime,
+		Excluded:  o.excluded,
+	}
+}
+
+// released returns true if the object of an unallocated ip is stored only to persist its release time
+func (o *FloatingIPObj) released() bool {
+	return o.key == "" && !o.excluded
+}
+
+func newFloatingIPObj(fip *v1alpha1.FloatingIP) *FloatingIPObj {
+	return &FloatingIPObj{
+		key:             fip.Spec.Key,
+		att:             fip.Spec.Attribute,
+		policy:          fip.Spec.Policy,
+		subnet:          fip.Spec.Subnet,
+		updateTime:      fip.Spec.UpdateTime.Time,
+		resourceVersion: fip.ResourceVersion,
+		excluded:        fip.Spec.Excluded,
+		stored:          true,
+	}
+}
+
 // cacheLock is used when the function called,
 // don't use lock inner function, otherwise deadlock will be caused
-func (ci *crdIpam) syncCacheAfterCreate(ip string, key string, att string, policy constant.ReleasePolicy,
-	subnet string, date time.Time) {
-	tmp := &FloatingIPObj{
-		key:        key,
-		att:        att,
-		policy:     policy,
-		subnet:     subnet,
-		updateTime: date,
+func (ci *crdIpam) syncCacheAfterCreate(ip string, fip *v1alpha1.FloatingIP) {
+	obj := newFloatingIPObj(fip)
+	if obj.released() {
+		delete(ci.caches.allocatedFIPs, ip)
+		if ci.inPool(net.ParseIP(ip)) {
+			ci.caches.unallocatedFIPs[ip] = obj
+		}
+		return
 	}
-	ci.caches.allocatedFIPs[ip] = tmp
+	ci.caches.allocatedFIPs[ip] = obj
 	delete(ci.caches.unallocatedFIPs, ip)
 	return
 }
 
+// claimFloatingIP allocates the unallocated ip to key by creating its FloatingIP object, or by updating the object
+// if it is stored to persist the release time. cacheLock must be held by the caller if v is in cache
+func (ci *crdIpam) claimFloatingIP(ip string, v *FloatingIPObj, key string, policy constant.ReleasePolicy,
+	attr, subnet string, updateTime time.Time) (*v1alpha1.FloatingIP, error) {
+	if v != nil && v.stored {
+		return ci.updateFloatingIP(ip, key, subnet, policy, attr, updateTime, v.resourceVersion)
+	}
+	return ci.createFloatingIP(ip, key, policy, attr, subnet, updateTime, false)
+}
+
 // CacheLock will be used when syncCacheAfterDel called,
 // don't use lock inner function, otherwise deadlock will be caused
-func (ci *crdIpam) syncCacheAfterDel(ip string) {
+func (ci *crdIpam) syncCacheAfterDel(ip, resourceVersion string) {
+	if !ci.inPool(net.ParseIP(ip)) {
+		// released orphans are gone
+		delete(ci.caches.allocatedFIPs, ip)
+		return
+	}
 	tmp := &FloatingIPObj{
-		key:        "",
-		att:        "",
-		policy:     constant.ReleasePolicyPodDelete,
-		subnet:     ci.caches.allocatedFIPs[ip].subnet,
-		updateTime: time.Now(),
+		key:             "",
+		att:             "",
+		policy:          constant.ReleasePolicyPodDelete,
+		subnet:          ci.caches.allocatedFIPs[ip].subnet,
+		updateTime:      time.Now(),
+		resourceVersion: resourceVersion,
 	}
 	delete(ci.caches.allocatedFIPs, ip)
 	ci.caches.unallocatedFIPs[ip] = tmp
 	return
 }
 
+// resyncOnConflict refreshes cache of ip from apiserver if err shows the cache is stale.
+// cacheLock must be held by the caller
+func (ci *crdIpam) resyncOnConflict(ip string, err error) {
+	if metaErrs.IsConflict(err) || metaErrs.IsAlreadyExists(err) || metaErrs.IsNotFound(err) {
+		ci.resyncIP(ip)
+	}
+}
+
+// resyncIP refreshes cache of ip from apiserver. cacheLock must be held by the caller
+func (ci *crdIpam) resyncIP(ip string) {
+	fip, err := ci.client.GalaxyV1alpha1().FloatingIPs().Get(floatingIPName(ip), metav1.GetOptions{})
+	if err != nil {
+		if metaErrs.IsNotFound(err) {
+			if _, find := ci.caches.allocatedFIPs[ip]; find {
+				ci.syncCacheAfterDel(ip, "")
+			} else if v, find := ci.caches.unallocatedFIPs[ip]; find {
+				v.stored = false
+			}
+			return
+		}
+		glog.Warningf("failed to get floatingIP %s: %v", ip, err)
+		return
+	}
+	ci.syncCacheAfterCreate(ip, fip)
+}
+
+// ownFloatingIP filters FloatingIP objects of this ipam's ip type
+func (ci *crdIpam) ownFloatingIP(obj interface{}) bool {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	fip, ok := obj.(*v1alpha1.FloatingIP)
+	if !ok {
+		return false
+	}
+	return ci.ipType != "" && fip.Labels[constant.IpType] == ci.ipType
+}
+
+// onFloatingIPUpdate syncs cache with a newly added or updated FloatingIP object. The object is ignored if cache
+// already holds the same or a newer version, which happens when the change is made by ourselves.
+func (ci *crdIpam) onFloatingIPUpdate(obj interface{}) {
+	fip, ok := obj.(*v1alpha1.FloatingIP)
+	if !ok {
+		return
+	}
+	netIP := floatingIPFromName(fip.Name)
+	if netIP == nil {
+		return
+	}
+	ipStr := netIP.String()
+	ci.caches.cacheLock.Lock()
+	defer ci.caches.cacheLock.Unlock()
+	v, find := ci.caches.allocatedFIPs[ipStr]
+	if !find && !ci.inPool(netIP) {
+		// orphans are the only ips out of pool in cache
+		return
+	}
+	if find && !newerResourceVersion(fip.ResourceVersion, v.resourceVersion) {
+		return
+	}
+	if v, find := ci.caches.unallocatedFIPs[ipStr]; find && !newerResourceVersion(fip.ResourceVersion,
+		v.resourceVersion) {
+		return
+	}
+	glog.V(4).Infof("[%s] sync cache of %s by object of version %s", ci.Name(), ipStr, fip.ResourceVersion)
+	ci.syncCacheAfterCreate(ipStr, fip)
+}
+
+// onFloatingIPDelete syncs cache with a deleted FloatingIP object unless cache holds a newer version
+func (ci *crdIpam) onFloatingIPDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	fip, ok := obj.(*v1alpha1.FloatingIP)
+	if !ok {
+		return
+	}
+	netIP := floatingIPFromName(fip.Name)
+	if netIP == nil || fip.ResourceVersion == "" {
+		return
+	}
+	ipStr := netIP.String()
+	ci.caches.cacheLock.Lock()
+	defer ci.caches.cacheLock.Unlock()
+	if v, find := ci.caches.unallocatedFIPs[ipStr]; find {
+		if v.stored && !newerResourceVersion(v.resourceVersion, fip.ResourceVersion) {
+			// the object persisting the release time is deleted
+			v.stored = false
+			v.resourceVersion = fip.ResourceVersion
+		}
+		return
+	}
+	v, find := ci.caches.allocatedFIPs[ipStr]
+	if !find || newerResourceVersion(v.resourceVersion, fip.ResourceVersion) {
+		return
+	}
+	glog.V(4).Infof("[%s] sync cache of %s by deleted object of version %s", ci.Name(), ipStr,
+		fip.ResourceVersion)
+	if len(ci.FloatingIPs) == 0 {
+		// pool is not configured yet
+		delete(ci.caches.allocatedFIPs, ipStr)
+		return
+	}
+	ci.syncCacheAfterDel(ipStr, fip.ResourceVersion)
+}
+
+// inPool returns true if ip is in the configured pool or pool is not configured yet
+func (ci *crdIpam) inPool(ip net.IP) bool {
+	if len(ci.FloatingIPs) == 0 {
+		return true
+	}
+	for _, fip := range ci.FloatingIPs {
+		if fip.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newerResourceVersion returns true if resource version a is newer than b. Resource versions are compared as
+// integers which is how etcd3 backed apiserver generates them. It returns false if a is empty since there is no
+// way to tell which is newer.
+func newerResourceVersion(a, b string) bool {
+	if a == "" {
+		return false
+	}
+	if b == "" {
+		return true
+	}
+	av, err1 := strconv.ParseUint(a, 10, 64)
+	bv, err2 := strconv.ParseUint(b, 10, 64)
+	if err1 != nil || err2 != nil {
+		return a != b
+	}
+	return av > bv
+}
+
 func (ci *crdIpam) findFloatingIPByKey(key string) (database.FloatingIP, error) {
 	var fip database.FloatingIP
 	ci.caches.cacheLock.RLock()
 	defer ci.caches.cacheLock.RUnlock()
 	for ip, spec := range ci.caches.allocatedFIPs {
 		if spec.key == key {
-			fip.IP = nets.IPToInt(net.ParseIP(ip))
+			fip.IP = database.IP(net.ParseIP(ip))
 			fip.Key = key
 			fip.Attr = spec.att
 			fip.Subnet = spec.subnet
 			fip.Policy = uint16(spec.policy)
 			fip.UpdatedAt = spec.updateTime
+			fip.Excluded = spec.excluded
 			return fip, nil
 		}
 	}
@@ -578,12 +947,13 @@ func (ci *crdIpam) ByKeyword(keyword string) ([]database.FloatingIP, error) {
 	for ip, spec := range ci.caches.allocatedFIPs {
 		if strings.Contains(spec.key, keyword) {
 			tmp := database.FloatingIP{
-				IP:        nets.IPToInt(net.ParseIP(ip)),
+				IP:        database.IP(net.ParseIP(ip)),
 				Key:       spec.key,
 				Subnet:    spec.subnet,
 				Attr:      spec.att,
 				Policy:    uint16(spec.policy),
 				UpdatedAt: spec.updateTime,
+				Excluded:  spec.excluded,
 			}
 			fips = append(fips, tmp)
 		}
@@ -606,11 +976,10 @@ func (ci *crdIpam) ReleaseIPs(ipToKey map[string]string) (map[string]string, map
 	for ipStr, key := range ipToKey {
 		if v, find := ci.caches.allocatedFIPs[ipStr]; find {
 			if v.key == key {
-				if err := ci.deleteFloatingIP(ipStr); err != nil {
-					glog.Errorf("failed to delete %v", ipStr)
+				if err := ci.releaseFloatingIP(ipStr, v); err != nil {
+					glog.Errorf("failed to delete %v: %v", ipStr, err)
 					return deleted, undeleted, fmt.Errorf("failed to delete %v", ipStr)
 				}
-				ci.syncCacheAfterDel(ipStr)
 				glog.Infof("%v has been deleted", ipStr)
 				deleted[ipStr] = key
 				delete(undeleted, ipStr)
@@ -624,3 +993,49 @@ func (ci *crdIpam) ReleaseIPs(ipToKey map[string]string) (map[string]string, map
 	}
 	return deleted, undeleted, nil
 }
+
+// RestoreIPs sets key, policy, attr and update time of the given ips as they are
+func (ci *crdIpam) RestoreIPs(fips []database.FloatingIP) error {
+	ci.caches.cacheLock.Lock()
+	defer ci.caches.cacheLock.Unlock()
+	for j := range fips {
+		fip := &fips[j]
+		ipStr := fip.IP.String()
+		policy := constant.ReleasePolicy(fip.Policy)
+		if v, find := ci.caches.allocatedFIPs[ipStr]; find {
+			if fip.Key == "" {
+				if v.key == "" {
+					continue
+				}
+				if err := ci.releaseFloatingIP(ipStr, v); err != nil {
+					return err
+				}
+				continue
+			}
+			obj, err := ci.updateFloatingIP(ipStr, fip.Key, v.subnet, policy, fip.Attr, fip.UpdatedAt,
+				v.resourceVersion)
+			if err != nil {
+				ci.resyncOnConflict(ipStr, err)
+				return err
+			}
+			v.key = fip.Key
+			v.policy = policy
+			v.att = fip.Attr
+			v.updateTime = fip.UpdatedAt
+			v.resourceVersion = obj.ResourceVersion
+		} else if v, find := ci.caches.unallocatedFIPs[ipStr]; find {
+			if fip.Key == "" {
+				continue
+			}
+			obj, err := ci.claimFloatingIP(ipStr, v, fip.Key, policy, fip.Attr, v.subnet, fip.UpdatedAt)
+			if err != nil {
+				ci.resyncOnConflict(ipStr, err)
+				return err
+			}
+			ci.syncCacheAfterCreate(ipStr, obj)
+		} else {
+			return fmt.Errorf("ip %s is not in pool", ipStr)
+		}
+	}
+	return nil
+}
@@ -24,10 +24,15 @@ import (
 	"testing"
 	"time"
 
+	metaErrs "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
 	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy/v1alpha1"
 	fakeGalaxyCli "tkestack.io/galaxy/pkg/ipam/client/clientset/versioned/fake"
+	crdInformer "tkestack.io/galaxy/pkg/ipam/client/informers/externalversions"
 	"tkestack.io/galaxy/pkg/utils/database"
 )
 
@@ -38,7 +43,7 @@ const (
 
 func createTestCrdIPAM(t *testing.T, objs ...runtime.Object) *crdIpam {
 	galaxyCli := fakeGalaxyCli.NewSimpleClientset(objs...)
-	crdIPAM := NewCrdIPAM(galaxyCli, InternalIp).(*crdIpam)
+	crdIPAM := NewCrdIPAM(galaxyCli, InternalIp, nil).(*crdIpam)
 	var conf struct {
 		Floatingips []*FloatingIP `json:"floatingips"`
 	}
@@ -89,7 +94,7 @@ func TestCRDAllocateSpecificIP(t *testing.T) {
 		t.Fatal(allocated.updateTime)
 	}
 	allocated.updateTime = time.Time{}
-	if `&{key:pod1 att:212 policy:2 subnet:10.49.27.0/24 updateTime:{wall:0 ext:0 loc:<nil>}}` != fmt.Sprintf("%+v", allocated) {
+	if `&{key:pod1 att:212 policy:2 subnet:10.49.27.0/24 updateTime:{wall:0 ext:0 loc:<nil>} resourceVersion:}` != fmt.Sprintf("%+v", allocated) {
 		t.Fatal(allocated)
 	}
 	if err := checkFIP(ipam, pod1CRD); err != nil {
@@ -151,6 +156,173 @@ func TestCRDByPrefix(t *testing.T) {
 	testByPrefix(t, ipam)
 }
 
+func TestCRDOrphans(t *testing.T) {
+	ipam := createTestCrdIPAM(t)
+	testOrphans(t, ipam)
+	// orphans are kept after restarting
+	restarted := NewCrdIPAM(ipam.client, InternalIp, nil)
+	if err := restarted.ConfigurePool(ipam.FloatingIPs); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkIPKey(restarted, "10.49.27.217", "dp_ns1_dp1_"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCRDSetExcluded(t *testing.T) {
+	ipam := createTestCrdIPAM(t)
+	testSetExcluded(t, ipam)
+	// exclusions are persisted by FloatingIP objects
+	restarted := NewCrdIPAM(ipam.client, InternalIp, nil)
+	if err := restarted.ConfigurePool(ipam.FloatingIPs); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkExcluded(restarted, "10.49.27.216", "", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkExcluded(restarted, "10.49.27.205", "pod3", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// #lizard forgives
+func testSetExcluded(t *testing.T, ipam IPAM) {
+	_, routableSubnet, _ := net.ParseCIDR("10.49.27.0/24")
+	for _, ip := range []string{"10.49.27.205", "10.49.27.216"} {
+		if err := ipam.SetExcluded(net.ParseIP(ip), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ipam.SetExcluded(net.ParseIP("10.0.0.1"), true); err != ErrNotInPool {
+		t.Fatalf("expect ErrNotInPool, real %v", err)
+	}
+	if err := ipam.AllocateSpecificIP("pod1", net.ParseIP("10.49.27.205"), constant.ReleasePolicyNever,
+		""); err == nil {
+		t.Fatal("expect failing to allocate an excluded ip")
+	}
+	allocated, err := ipam.AllocateInSubnet("pod1", routableSubnet, constant.ReleasePolicyNever, "")
+	if err != nil || allocated.String() != "10.49.27.217" {
+		t.Fatalf("expect 10.49.27.217, real %v, err %v", allocated, err)
+	}
+	// excluding an allocated ip keeps its key
+	if err := ipam.SetExcluded(allocated, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkExcluded(ipam, "10.49.27.217", "pod1", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ipam.AllocateInSubnet("pod2", routableSubnet, constant.ReleasePolicyNever, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ipam.AllocateInSubnet("pod3", routableSubnet, constant.ReleasePolicyNever, ""); err != ErrNoEnoughIP {
+		t.Fatalf("expect ErrNoEnoughIP, real %v", err)
+	}
+	subnets, err := ipam.QueryRoutableSubnetByKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subnet := range subnets {
+		if subnet == routableSubnet.String() {
+			t.Fatalf("expect no unallocated ips in %s", subnet)
+		}
+	}
+	// released excluded ip is still excluded
+	if err := ipam.Release("pod1", allocated); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkExcluded(ipam, "10.49.27.217", "", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ipam.AllocateInSubnet("pod3", routableSubnet, constant.ReleasePolicyNever, ""); err != ErrNoEnoughIP {
+		t.Fatalf("expect ErrNoEnoughIP, real %v", err)
+	}
+	// included ip is allocatable again
+	if err := ipam.SetExcluded(net.ParseIP("10.49.27.205"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkExcluded(ipam, "10.49.27.205", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if allocated, err = ipam.AllocateInSubnet("pod3", routableSubnet, constant.ReleasePolicyNever,
+		""); err != nil || allocated.String() != "10.49.27.205" {
+		t.Fatalf("expect 10.49.27.205, real %v, err %v", allocated, err)
+	}
+}
+
+func checkExcluded(ipam IPAM, checkIP, expectKey string, expectExcluded bool) error {
+	fip, err := ipam.ByIP(net.ParseIP(checkIP))
+	if err != nil {
+		return err
+	}
+	if fip.Key != expectKey || fip.Excluded != expectExcluded {
+		return fmt.Errorf("expect %s key %q excluded %v, real key %q excluded %v", checkIP, expectKey,
+			expectExcluded, fip.Key, fip.Excluded)
+	}
+	return nil
+}
+
+// orphanTestConf removes 10.49.27.217~10.49.27.218 and 10.173.13.2~10.173.13.13 from the test config
+const orphanTestConf = `[{"routableSubnet":"10.49.27.0/24","ips":["10.49.27.205","10.49.27.216"],` +
+	`"subnet":"10.49.27.0/24","gateway":"10.49.27.1","vlan":2},{"routableSubnet":"10.173.13.0/24",` +
+	`"ips":["10.173.13.15"],"subnet":"10.173.13.0/24","gateway":"10.173.13.1","vlan":2}]`
+
+// #lizard forgives
+func testOrphans(t *testing.T, ipam IPAM) {
+	for key, ip := range map[string]string{"pod1": "10.173.13.2", "dp_ns1_dp1_": "10.49.27.217"} {
+		if err := ipam.AllocateSpecificIP(key, net.ParseIP(ip), constant.ReleasePolicyNever, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var fips []*FloatingIP
+	if err := json.Unmarshal([]byte(orphanTestConf), &fips); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.ConfigurePool(fips); err != nil {
+		t.Fatal(err)
+	}
+	// allocated ips are kept as orphans
+	if err := checkByPrefix(ipam, "", "", "", "", "pod1", "dp_ns1_dp1_"); err != nil {
+		t.Fatal(err)
+	}
+	orphaned, err := ipam.Orphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphaned) != 2 {
+		t.Fatalf("expect 2 orphans, real %+v", orphaned)
+	}
+	if err := ipam.AllocateInSubnetWithKey("dp_ns1_dp1_", "dp_ns1_dp1_dp1-x-y", "10.49.27.0/24",
+		constant.ReleasePolicyNever, ""); err == nil {
+		t.Fatal("expect failing to allocate an orphan")
+	}
+	// released orphans are not allocated again
+	if err := ipam.Release("pod1", net.ParseIP("10.173.13.2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.AllocateSpecificIP("pod2", net.ParseIP("10.173.13.2"), constant.ReleasePolicyNever,
+		""); err == nil {
+		t.Fatal("expect failing to allocate a released orphan")
+	}
+	_, routableSubnet, _ := net.ParseCIDR("10.173.13.0/24")
+	allocated, err := ipam.AllocateInSubnet("pod2", routableSubnet, constant.ReleasePolicyNever, "")
+	if err != nil || allocated.String() != "10.173.13.15" {
+		t.Fatalf("expect 10.173.13.15, real %v, err %v", allocated, err)
+	}
+	if _, err := ipam.AllocateInSubnet("pod3", routableSubnet, constant.ReleasePolicyNever, ""); err != ErrNoEnoughIP {
+		t.Fatalf("expect ErrNoEnoughIP, real %v", err)
+	}
+	if orphaned, err = ipam.Orphans(); err != nil || len(orphaned) != 1 || orphaned[0].Key != "dp_ns1_dp1_" {
+		t.Fatalf("expect orphan of dp_ns1_dp1_, real %+v, err %v", orphaned, err)
+	}
+	// released orphans are deleted once reconfigured
+	if err := ipam.ConfigurePool(fips); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkByPrefix(ipam, "", "", "", "pod2", "dp_ns1_dp1_"); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func testRelease(t *testing.T, ipam IPAM) {
 	allocateSomeIPs(t, ipam)
 	// test key ip mismatch
@@ -276,3 +448,235 @@ func checkByIP(ipam IPAM, checkIP, expectKey string, expectAttr *string) error {
 	}
 	return nil
 }
+
+func TestCRDAllocateIPv6(t *testing.T) {
+	galaxyCli := fakeGalaxyCli.NewSimpleClientset()
+	ipam := NewCrdIPAM(galaxyCli, IPv6Ip, nil).(*crdIpam)
+	var fip FloatingIP
+	if err := json.Unmarshal([]byte(`{"routableSubnet":"10.49.27.0/24","ips":["2001:db8::2~2001:db8::3"],`+
+		`"subnet":"2001:db8::/64","gateway":"2001:db8::1"}`), &fip); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.ConfigurePool([]*FloatingIP{&fip}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.AllocateSpecificIP("pod1", net.ParseIP("2001:db8::2"), constant.ReleasePolicyNever, ""); err != nil {
+		t.Fatal(err)
+	}
+	// colons are not allowed in object names
+	if _, err := galaxyCli.GalaxyV1alpha1().FloatingIPs().Get("2001-0db8-0000-0000-0000-0000-0000-0002",
+		v1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	_, routableSubnet, _ := net.ParseCIDR("10.49.27.0/24")
+	allocated, err := ipam.AllocateInSubnet("pod2", routableSubnet, constant.ReleasePolicyPodDelete, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocated.String() != "2001:db8::3" {
+		t.Fatal(allocated.String())
+	}
+	if err := checkByIP(ipam, "2001:db8::3", "pod2", nil); err != nil {
+		t.Fatal(err)
+	}
+	// the cache is rebuilt from FloatingIP objects
+	if err := ipam.ConfigurePool([]*FloatingIP{&fip}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkByIP(ipam, "2001:db8::2", "pod1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.Release("pod1", net.ParseIP("2001:db8::2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkByIP(ipam, "2001:db8::2", "", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestFloatingIP(name, key, resourceVersion string) *v1alpha1.FloatingIP {
+	return &v1alpha1.FloatingIP{
+		ObjectMeta: v1.ObjectMeta{Name: name, ResourceVersion: resourceVersion,
+			Labels: map[string]string{constant.IpType: "internalIP"}},
+		Spec: v1alpha1.FloatingIPSpec{Key: key, Policy: constant.ReleasePolicyPodDelete, Subnet: "10.49.27.0/24",
+			UpdateTime: v1.Now()},
+	}
+}
+
+func TestCRDInformerSyncCache(t *testing.T) {
+	galaxyCli := fakeGalaxyCli.NewSimpleClientset(newTestFloatingIP("10.49.27.205", "pod1", "1"))
+	factory := crdInformer.NewSharedInformerFactory(galaxyCli, 0)
+	fipInformer := factory.Galaxy().V1alpha1().FloatingIPs()
+	ipam := NewCrdIPAM(galaxyCli, InternalIp, fipInformer).(*crdIpam)
+	// a standby replica which never configures pool
+	standby := NewCrdIPAM(galaxyCli, InternalIp, fipInformer)
+	var conf struct {
+		Floatingips []*FloatingIP `json:"floatingips"`
+	}
+	if err := json.Unmarshal([]byte(database.TestConfig), &conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.ConfigurePool(conf.Floatingips); err != nil {
+		t.Fatal(err)
+	}
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	factory.Start(stopChan)
+	cache.WaitForCacheSync(stopChan, fipInformer.Informer().HasSynced)
+	waitIPKey := func(ipam IPAM, ip, key string) {
+		if err := wait.PollImmediate(10*time.Millisecond, 3*time.Second, func() (bool, error) {
+			return checkIPKey(ipam, ip, key) == nil, nil
+		}); err != nil {
+			t.Fatalf("ip %s: %v", ip, checkIPKey(ipam, ip, key))
+		}
+	}
+	waitIPKey(ipam, "10.49.27.205", "pod1")
+	waitIPKey(standby, "10.49.27.205", "pod1")
+	// changes made by other replicas
+	fips := galaxyCli.GalaxyV1alpha1().FloatingIPs()
+	if _, err := fips.Create(newTestFloatingIP("10.49.27.216", "pod2", "2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fips.Update(newTestFloatingIP("10.49.27.205", "pod3", "3")); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []IPAM{ipam, standby} {
+		waitIPKey(i, "10.49.27.216", "pod2")
+		waitIPKey(i, "10.49.27.205", "pod3")
+	}
+	if err := fips.Delete("10.49.27.216", &v1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitIPKey(ipam, "10.49.27.216", "")
+	if _, find := ipam.caches.unallocatedFIPs["10.49.27.216"]; !find {
+		t.Fatal("expect 10.49.27.216 to be unallocated")
+	}
+	waitIPKey(standby, "10.49.27.216", "")
+	// stale objects are ignored
+	ipam.onFloatingIPUpdate(newTestFloatingIP("10.49.27.205", "pod1", "1"))
+	ipam.onFloatingIPUpdate(newTestFloatingIP("10.49.27.216", "pod2", "2"))
+	if err := checkIPKey(ipam, "10.49.27.205", "pod3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkIPKey(ipam, "10.49.27.216", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCRDUpdateConflict(t *testing.T) {
+	ipam := createTestCrdIPAM(t)
+	allocateSomeIPs(t, ipam)
+	// another replica updates the object after we cache it
+	ipam.caches.allocatedFIPs["10.49.27.205"].resourceVersion = "1"
+	if _, err := ipam.client.GalaxyV1alpha1().FloatingIPs().Update(
+		newTestFloatingIP("10.49.27.205", "pod3", "2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.UpdatePolicy("pod1", net.ParseIP("10.49.27.205"), constant.ReleasePolicyImmutable,
+		""); !metaErrs.IsConflict(err) {
+		t.Fatalf("expect conflict error, got %v", err)
+	}
+	// cache is refreshed after conflict
+	if err := checkIPKey(ipam, "10.49.27.205", "pod3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.UpdatePolicy("pod3", net.ParseIP("10.49.27.205"), constant.ReleasePolicyImmutable,
+		""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCRDAllocateAlreadyExists(t *testing.T) {
+	ipam := createTestCrdIPAM(t)
+	// allocated by another replica, but not synced into our cache
+	for _, fip := range []*v1alpha1.FloatingIP{newTestFloatingIP("10.49.27.205", "pod2", "1"),
+		newTestFloatingIP("10.49.27.216", "pod3", "2")} {
+		if _, err := ipam.client.GalaxyV1alpha1().FloatingIPs().Create(fip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ipam.AllocateSpecificIP("pod1", net.ParseIP("10.49.27.205"), constant.ReleasePolicyNever,
+		""); !metaErrs.IsAlreadyExists(err) {
+		t.Fatalf("expect already exists error, got %v", err)
+	}
+	if err := checkIPKey(ipam, "10.49.27.205", "pod2"); err != nil {
+		t.Fatal(err)
+	}
+	_, routableSubnet, _ := net.ParseCIDR("10.49.27.0/24")
+	for _, key := range []string{"pod5", "pod6"} {
+		allocated, err := ipam.AllocateInSubnet(key, routableSubnet, constant.ReleasePolicyNever, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allocated.String() == "10.49.27.216" {
+			t.Fatal(allocated)
+		}
+	}
+	if err := checkIPKey(ipam, "10.49.27.216", "pod3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ipam.AllocateInSubnet("pod4", routableSubnet, constant.ReleasePolicyNever, ""); err != ErrNoEnoughIP {
+		t.Fatalf("expect ErrNoEnoughIP, got %v", err)
+	}
+}
+
+// #lizard forgives
+func TestCRDPersistReleaseTime(t *testing.T) {
+	ipam := createTestCrdIPAM(t)
+	ipam.SetStrategy(StrategyLeastRecentlyReleased)
+	_, routableSubnet, _ := net.ParseCIDR("10.49.27.0/24")
+	for _, ip := range []string{"10.49.27.216", "10.49.27.205"} {
+		if err := ipam.AllocateSpecificIP("pod1", net.ParseIP(ip), constant.ReleasePolicyPodDelete,
+			""); err != nil {
+			t.Fatal(err)
+		}
+		if err := ipam.Release("pod1", net.ParseIP(ip)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the object of the released ip persists its release time
+	fip, err := ipam.client.GalaxyV1alpha1().FloatingIPs().Get("10.49.27.205", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fip.Spec.Key != "" || fip.Spec.UpdateTime.IsZero() {
+		t.Fatalf("expect released object, real %+v", fip.Spec)
+	}
+	// another ipam restores the release time from objects
+	restarted := NewCrdIPAM(ipam.client, InternalIp, nil)
+	restarted.SetStrategy(StrategyLeastRecentlyReleased)
+	if err := restarted.ConfigurePool(ipam.FloatingIPs); err != nil {
+		t.Fatal(err)
+	}
+	for i, expect := range []string{"10.49.27.217", "10.49.27.218", "10.49.27.216", "10.49.27.205"} {
+		allocated, err := restarted.AllocateInSubnet(fmt.Sprintf("pod%d", i+2), routableSubnet,
+			constant.ReleasePolicyPodDelete, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allocated.String() != expect {
+			t.Fatalf("step %d: expect %s, real %s", i, expect, allocated.String())
+		}
+	}
+	if err := checkIPKey(restarted, "10.49.27.205", "pod5"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewerResourceVersion(t *testing.T) {
+	for i, c := range []struct {
+		a, b   string
+		expect bool
+	}{
+		{a: "", b: "", expect: false},
+		{a: "", b: "1", expect: false},
+		{a: "1", b: "", expect: true},
+		{a: "10", b: "9", expect: true},
+		{a: "9", b: "10", expect: false},
+		{a: "10", b: "10", expect: false},
+	} {
+		if newerResourceVersion(c.a, c.b) != c.expect {
+			t.Errorf("case %d: expect %v", i, c.expect)
+		}
+	}
+}
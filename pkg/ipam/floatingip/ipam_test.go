@@ -76,11 +76,15 @@ func CreateIPAMWithTableName(t *testing.T, tableName string) *dbIpam {
 	return i.(*dbIpam)
 }
 
-// #lizard forgives
 // TestApplyFloatingIPs test ipam applyFloatingIPs function.
 func TestApplyFloatingIPs(t *testing.T) {
 	ipam := Start(t)
 	defer ipam.Shutdown()
+	testApplyFloatingIPs(t, ipam.FloatingIPs)
+}
+
+// #lizard forgives
+func testApplyFloatingIPs(t *testing.T, confs []*FloatingIP) {
 	fips := []*FloatingIP{}
 	fipStr := `[{
       "routableSubnet": "10.49.27.0/24",
@@ -110,7 +114,7 @@ func TestApplyFloatingIPs(t *testing.T) {
 	if err := json.Unmarshal([]byte(fipStr), &fips); err != nil {
 		t.Fatal(err)
 	}
-	conf := ipam.applyFloatingIPs(fips)
+	conf := applyFloatingIPs(confs, fips)
 	if len(conf) != 5 {
 		t.Fatal(conf)
 	}
@@ -144,11 +148,15 @@ func TestEmptyFloatingIPConf(t *testing.T) {
 	}
 }
 
-// #lizard forgives
 // TestRoutableSubnet test RoutableSubnet function.
 func TestRoutableSubnet(t *testing.T) {
 	ipam := Start(t)
 	defer ipam.Shutdown()
+	testRoutableSubnet(t, ipam)
+}
+
+// #lizard forgives
+func testRoutableSubnet(t *testing.T, ipam IPAM) {
 	//10.173.13.0/24
 	if ipNet := ipam.RoutableSubnet(net.ParseIP("10.173.13.3")); ipNet == nil || ipNet.String() != "10.173.13.0/24" {
 		t.Fatal()
@@ -241,13 +249,24 @@ func TestAllocateSpecificIP(t *testing.T) {
 	}
 }
 
-// #lizard forgives
 // TestMultipleIPAM test two dbIpam situation.
 func TestMultipleIPAM(t *testing.T) {
 	ipam := Start(t)
 	defer ipam.Shutdown()
 	secondIPAM := CreateIPAMWithTableName(t, "test_table")
 	defer secondIPAM.Shutdown()
+	testMultipleIPAM(t, ipam, secondIPAM)
+	if err := secondIPAM.ReleaseByPrefix("pod2"); err != nil {
+		t.Fatal(err)
+	}
+	if ipInfo, err := secondIPAM.First("pod2"); err != nil || ipInfo != nil {
+		t.Fatalf("ipInfo %v, err %v", ipInfo, err)
+	}
+}
+
+// #lizard forgives
+// testMultipleIPAM allocates ips to pod1 and pod2 in secondIPAM and releases pod1's, it returns the ip of pod2
+func testMultipleIPAM(t *testing.T, ipam, secondIPAM IPAM) net.IP {
 	ip := net.ParseIP("10.49.27.216")
 	if err := secondIPAM.AllocateSpecificIP("pod1", ip, constant.ReleasePolicyPodDelete, ""); err != nil {
 		t.Fatal(err)
@@ -263,19 +282,14 @@ func TestMultipleIPAM(t *testing.T) {
 	if err := secondIPAM.Release("pod1", ip); err != nil {
 		t.Fatal(err)
 	}
-	if ipInfo, err := secondIPAM.first("pod1"); err != nil || ipInfo != nil {
-		t.Fatalf("ipInfo %v, err %v", ipInfo, err)
-	}
-	if err := secondIPAM.ReleaseByPrefix("pod2"); err != nil {
-		t.Fatal(err)
-	}
-	if ipInfo, err := secondIPAM.first("pod2"); err != nil || ipInfo != nil {
+	if ipInfo, err := secondIPAM.First("pod1"); err != nil || ipInfo != nil {
 		t.Fatalf("ipInfo %v, err %v", ipInfo, err)
 	}
+	return ip2
 }
 
 // #lizard forgives
-func checkMultipleIPAM(t *testing.T, ipam, secondIPAM *dbIpam, ip net.IP, expectKey string) {
+func checkMultipleIPAM(t *testing.T, ipam, secondIPAM IPAM, ip net.IP, expectKey string) {
 	// t.Logf("testing expectKey %s, ip %s", expectKey, ip.String())
 	// t.Logf("secondIPAM...")
 	// check secondIPAM query result is not empty
@@ -283,8 +297,8 @@ func checkMultipleIPAM(t *testing.T, ipam, secondIPAM *dbIpam, ip net.IP, expect
 	if err != nil || secondFip.Key != expectKey {
 		t.Fatalf("key %s, err %v", secondFip.Key, err)
 	}
-	ipInfo, err := secondIPAM.first(expectKey)
-	if err != nil || ipInfo.IP.IP.String() != ip.String() {
+	ipInfo, err := secondIPAM.First(expectKey)
+	if err != nil || ipInfo == nil || ipInfo.IPInfo.IP.IP.String() != ip.String() {
 		t.Fatalf("ipInfo %v, err %v", ipInfo, err)
 	}
 	if err := checkByPrefix(secondIPAM, expectKey, expectKey); err != nil {
@@ -300,7 +314,7 @@ func checkMultipleIPAM(t *testing.T, ipam, secondIPAM *dbIpam, ip net.IP, expect
 	if err != nil || secondFip.Key != "" {
 		t.Fatalf("key %s, err %v", secondFip.Key, err)
 	}
-	ipInfo, err = ipam.first(expectKey)
+	ipInfo, err = ipam.First(expectKey)
 	if err != nil || ipInfo != nil {
 		t.Fatalf("ipInfo %v, err %v", ipInfo, err)
 	}
@@ -374,11 +388,15 @@ func TestAllocateInSubnet(t *testing.T) {
 	}
 }
 
-// #lizard forgives
 // TestUpdateKeyUpdatePolicy test UpdatePolicy function.
 func TestUpdateKeyUpdatePolicy(t *testing.T) {
 	ipam := Start(t)
 	defer ipam.Shutdown()
+	testUpdateKeyUpdatePolicy(t, ipam)
+}
+
+// #lizard forgives
+func testUpdateKeyUpdatePolicy(t *testing.T, ipam IPAM) {
 	if err := ipam.AllocateSpecificIP("pod2", net.ParseIP("10.173.13.2"), constant.ReleasePolicyPodDelete, ""); err != nil {
 		t.Fatal(err)
 	}
@@ -396,7 +414,7 @@ func TestUpdateKeyUpdatePolicy(t *testing.T) {
 		t.Fatalf("err %v ipInfo %v", err, ipInfo)
 	}
 	ipInfo.FIP.UpdatedAt = time.Time{}
-	if fmt.Sprintf("%+v", ipInfo) != "&{IPInfo:{IP:10.173.13.2/24 Vlan:2 Gateway:10.173.13.1 RoutableSubnet:10.173.13.0/24} FIP:{Table: Key:pod3 Subnet:10.173.13.0/24 Attr: IP:179113218 Policy:0 UpdatedAt:0001-01-01 00:00:00 +0000 UTC}}" {
+	if fmt.Sprintf("%+v", ipInfo) != "&{IPInfo:{IP:10.173.13.2/24 Vlan:2 Gateway:10.173.13.1 RoutableSubnet:10.173.13.0/24} FIP:{Table: Key:pod3 Subnet:10.173.13.0/24 Attr: IP:10.173.13.2 Policy:0 UpdatedAt:0001-01-01 00:00:00 +0000 UTC Excluded:false} QuarantineSeconds:0}" {
 		t.Error(fmt.Sprintf("%+v", ipInfo))
 	}
 
@@ -408,7 +426,7 @@ func TestUpdateKeyUpdatePolicy(t *testing.T) {
 		t.Fatalf("err %v ipInfo %v", err, ipInfo)
 	}
 	ipInfo.FIP.UpdatedAt = time.Time{}
-	if fmt.Sprintf("%+v", ipInfo) != "&{IPInfo:{IP:10.173.13.2/24 Vlan:2 Gateway:10.173.13.1 RoutableSubnet:10.173.13.0/24} FIP:{Table: Key:pod3 Subnet:10.173.13.0/24 Attr:111 IP:179113218 Policy:2 UpdatedAt:0001-01-01 00:00:00 +0000 UTC}}" {
+	if fmt.Sprintf("%+v", ipInfo) != "&{IPInfo:{IP:10.173.13.2/24 Vlan:2 Gateway:10.173.13.1 RoutableSubnet:10.173.13.0/24} FIP:{Table: Key:pod3 Subnet:10.173.13.0/24 Attr:111 IP:10.173.13.2 Policy:2 UpdatedAt:0001-01-01 00:00:00 +0000 UTC Excluded:false} QuarantineSeconds:0}" {
 		t.Error(fmt.Sprintf("%+v", ipInfo))
 	}
 }
@@ -447,3 +465,17 @@ func TestDBByPrefix(t *testing.T) {
 	defer ipam.Shutdown()
 	testByPrefix(t, ipam)
 }
+
+// TestDBSetExcluded test SetExcluded function.
+func TestDBSetExcluded(t *testing.T) {
+	ipam := Start(t)
+	defer ipam.Shutdown()
+	testSetExcluded(t, ipam)
+}
+
+// TestDBOrphans test allocated ips are kept by ConfigurePool.
+func TestDBOrphans(t *testing.T) {
+	ipam := Start(t)
+	defer ipam.Shutdown()
+	testOrphans(t, ipam)
+}
@@ -25,7 +25,6 @@ import (
 	"github.com/jinzhu/gorm"
 	glog "k8s.io/klog"
 	"tkestack.io/galaxy/pkg/utils/database"
-	"tkestack.io/galaxy/pkg/utils/nets"
 )
 
 var (
@@ -82,19 +81,88 @@ func allocateOp(fip *database.FloatingIP, tableName string) database.ActionFunc
 
 func (i *dbIpam) updateOneInSubnet(oldK, newK, subnet string, policy uint16, attr string) error {
 	return i.store.Transaction(func(tx *gorm.DB) error {
-		// UPDATE `ip_pool` SET `key` = 'newK', `policy` = '0', `attr` = ''  WHERE (`key` = "oldK"
-		// AND subnet = '10.180.1.3/32') ORDER BY updated_at desc LIMIT 1
-		ret := tx.Table(i.Name()).Where("`key` = ? AND subnet = ?", oldK, subnet).
-			Order("updated_at desc").Limit(1).
-			UpdateColumns(map[string]interface{}{`key`: newK, "policy": policy, "attr": attr, `updated_at`: time.Now()})
-		if ret.Error != nil {
-			return ret.Error
+		var fips []database.FloatingIP
+		if err := tx.Table(i.Name()).Select("ip").Where("`key` = ? AND subnet = ? AND excluded = ?", oldK, subnet,
+			false).Order("updated_at desc").Find(&fips).Error; err != nil {
+			return err
 		}
-		if ret.RowsAffected != 1 {
-			return ErrNotUpdated
+		for j := range fips {
+			// orphans are not available
+			if !configured(i.FloatingIPs, net.IP(fips[j].IP)) {
+				continue
+			}
+			// UPDATE `ip_pool` SET `key` = 'newK', `policy` = '0', `attr` = ''  WHERE (ip = '10.180.1.3'
+			// AND `key` = "oldK")
+			ret := tx.Table(i.Name()).Where("ip = ? AND `key` = ?", fips[j].IP, oldK).
+				UpdateColumns(map[string]interface{}{`key`: newK, "policy": policy, "attr": attr, `updated_at`: time.Now()})
+			if ret.Error != nil {
+				return ret.Error
+			}
+			if ret.RowsAffected != 1 {
+				return ErrNotUpdated
+			}
+			return nil
+		}
+		return ErrNotUpdated
+	})
+}
+
+// allocateOneInSubnet allocates an unallocated ip of the subnet to key, the ip is chosen by the strategy of the
+// selector in sql so that only one row is selected each time
+func (i *dbIpam) allocateOneInSubnet(key, subnet string, policy uint16, attr string) (allocated net.IP, err error) {
+	strategy, last := i.selector.state(subnet)
+	err = i.store.Transaction(func(tx *gorm.DB) error {
+		var skipped []database.IP
+		for {
+			db := tx.Table(i.Name()).Select("ip").Where("`key` = ? AND subnet = ? AND excluded = ?", "", subnet,
+				false)
+			if len(skipped) > 0 {
+				db = db.Where("ip NOT IN (?)", skipped)
+			}
+			switch strategy {
+			case StrategyRandom:
+				db = db.Order("RAND()")
+			case StrategyLeastRecentlyReleased:
+				db = db.Order("updated_at").Order("ip")
+			case StrategyRoundRobin:
+				if last != nil {
+					// ips after the last allocated one come first
+					db = db.Order(gorm.Expr("ip > ? DESC", database.IP(last)))
+				}
+				db = db.Order("ip")
+			default:
+				db = db.Order("ip")
+			}
+			var fips []database.FloatingIP
+			if err := db.Limit(1).Find(&fips).Error; err != nil {
+				return err
+			}
+			if len(fips) == 0 {
+				return ErrNotUpdated
+			}
+			ip := fips[0].IP
+			// released orphans are not available
+			if !configured(i.FloatingIPs, net.IP(ip)) {
+				skipped = append(skipped, ip)
+				continue
+			}
+			ret := tx.Table(i.Name()).Where("ip = ? AND `key` = ? AND excluded = ?", ip, "", false).
+				UpdateColumns(map[string]interface{}{`key`: key, "policy": policy, "attr": attr, `updated_at`: time.Now()})
+			if ret.Error != nil {
+				return ret.Error
+			}
+			if ret.RowsAffected == 1 {
+				allocated = net.IP(ip)
+				return nil
+			}
+			// allocated by others, try another one
+			skipped = append(skipped, ip)
 		}
-		return nil
 	})
+	if err == nil {
+		i.selector.allocated(subnet, allocated)
+	}
+	return
 }
 
 func (i *dbIpam) create(fip *database.FloatingIP) error {
@@ -103,7 +171,7 @@ func (i *dbIpam) create(fip *database.FloatingIP) error {
 	})
 }
 
-func (i *dbIpam) releaseIP(key string, ip uint32) error {
+func (i *dbIpam) releaseIP(key string, ip database.IP) error {
 	return i.store.Transaction(func(tx *gorm.DB) error {
 		ret := tx.Table(i.Name()).Where("ip = ? AND `key` = ?", ip, key).
 			UpdateColumns(map[string]interface{}{`key`: "", "policy": 0, "attr": "", `updated_at`: time.Now()})
@@ -131,7 +199,12 @@ type Result struct {
 func (i *dbIpam) queryByKeyGroupBySubnet(key string) ([]string, error) {
 	var results []Result
 	if err := i.store.Transaction(func(tx *gorm.DB) error {
-		ret := tx.Table(i.TableName).Select("DISTINCT subnet").Where("`key` = ?", key).Scan(&results)
+		db := tx.Table(i.TableName).Select("DISTINCT subnet").Where("`key` = ?", key)
+		if key == "" {
+			// excluded ips are not available
+			db = db.Where("excluded = ?", false)
+		}
+		ret := db.Scan(&results)
 		if ret.RecordNotFound() {
 			return nil
 		}
@@ -146,10 +219,10 @@ func (i *dbIpam) queryByKeyGroupBySubnet(key string) ([]string, error) {
 	return ret, nil
 }
 
-func (i *dbIpam) deleteUnScoped(ips []uint32) (int, error) {
+func (i *dbIpam) deleteUnScoped(ips []database.IP) (int, error) {
 	if glog.V(4) {
 		for _, ip := range ips {
-			glog.V(4).Infof("will delete unscoped ip: %v", nets.IntToIP(ip))
+			glog.V(4).Infof("will delete unscoped ip: %v", ip)
 		}
 	}
 	var deleted int
@@ -163,16 +236,20 @@ func (i *dbIpam) deleteUnScoped(ips []uint32) (int, error) {
 	})
 }
 
-func (i *dbIpam) findByIP(ip uint32) (database.FloatingIP, error) {
+func (i *dbIpam) findByIP(ip database.IP) (database.FloatingIP, error) {
 	var fip database.FloatingIP
 	return fip, i.store.Transaction(func(tx *gorm.DB) error {
-		return tx.Table(i.TableName).Where(fmt.Sprintf("ip=%d", ip)).First(&fip).Error
+		db := tx.Table(i.TableName).Where("ip = ?", ip).First(&fip)
+		if db.RecordNotFound() {
+			return nil
+		}
+		return db.Error
 	})
 }
 
-func (i *dbIpam) allocateSpecificIP(ip uint32, key string, policy uint16, attr string) error {
+func (i *dbIpam) allocateSpecificIP(ip database.IP, key string, policy uint16, attr string) error {
 	return i.store.Transaction(func(tx *gorm.DB) error {
-		ret := tx.Table(i.TableName).Where("ip = ? and `key` = ?", ip, "").
+		ret := tx.Table(i.TableName).Where("ip = ? and `key` = ? and excluded = ?", ip, "", false).
 			UpdateColumns(map[string]interface{}{`key`: key, "policy": policy, "attr": attr, `updated_at`: time.Now()})
 		if ret.Error != nil {
 			return ret.Error
@@ -184,7 +261,21 @@ func (i *dbIpam) allocateSpecificIP(ip uint32, key string, policy uint16, attr s
 	})
 }
 
-func (i *dbIpam) updatePolicy(ip uint32, key string, policy uint16, attr string) error {
+func (i *dbIpam) updateExcluded(ip database.IP, excluded bool) error {
+	return i.store.Transaction(func(tx *gorm.DB) error {
+		var count int
+		if err := tx.Table(i.TableName).Where("ip = ?", ip).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrNotInPool
+		}
+		// don't check RowsAffected != 1 as excluded may not be changed
+		return tx.Table(i.TableName).Where("ip = ?", ip).UpdateColumn("excluded", excluded).Error
+	})
+}
+
+func (i *dbIpam) updatePolicy(ip database.IP, key string, policy uint16, attr string) error {
 	return i.store.Transaction(func(tx *gorm.DB) error {
 		ret := tx.Table(i.TableName).Where("ip = ? and `key` = ?", ip, key).
 			UpdateColumns(map[string]interface{}{"policy": policy, "attr": attr, `updated_at`: time.Now()})
@@ -223,8 +314,8 @@ func (i *dbIpam) deleteIPs(tableName string, ipToKey map[string]string) (map[str
 		undeleted[ipStr] = key
 	}
 	for ipStr, key := range ipToKey {
-		ipUint := nets.IPToInt(net.ParseIP(ipStr))
-		err := i.releaseIP(key, ipUint)
+		ip := database.IP(net.ParseIP(ipStr))
+		err := i.releaseIP(key, ip)
 		if err == nil {
 			deleted[ipStr] = key
 			delete(undeleted, ipStr)
@@ -233,7 +324,7 @@ func (i *dbIpam) deleteIPs(tableName string, ipToKey map[string]string) (map[str
 				return deleted, undeleted, err
 			}
 			// try to update key
-			fip, err := i.findByIP(ipUint)
+			fip, err := i.findByIP(ip)
 			if err != nil {
 				if err == gorm.ErrRecordNotFound {
 					continue
@@ -245,3 +336,23 @@ func (i *dbIpam) deleteIPs(tableName string, ipToKey map[string]string) (map[str
 	}
 	return deleted, undeleted, nil
 }
+
+func (i *dbIpam) restoreIPs(fips []database.FloatingIP) error {
+	return i.store.Transaction(func(tx *gorm.DB) error {
+		for j := range fips {
+			var count int
+			if err := tx.Table(i.TableName).Where("ip = ?", fips[j].IP).Count(&count).Error; err != nil {
+				return err
+			}
+			if count == 0 {
+				return fmt.Errorf("ip %s is not in pool", fips[j].IP.String())
+			}
+			if err := tx.Table(i.TableName).Where("ip = ?", fips[j].IP).
+				UpdateColumns(map[string]interface{}{`key`: fips[j].Key, "policy": fips[j].Policy,
+					"attr": fips[j].Attr, `updated_at`: fips[j].UpdatedAt}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
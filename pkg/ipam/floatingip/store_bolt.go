@@ -0,0 +1,222 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package floatingip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/utils/database"
+)
+
+// boltFloatingIP is the value of a floating ip in bolt bucket, the key of which is the 16 bytes form of the ip
+type boltFloatingIP struct {
+	Key       string    `json:"key"`
+	Subnet    string    `json:"subnet"`
+	Attr      string    `json:"attr,omitempty"`
+	Policy    uint16    `json:"policy"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Excluded  bool      `json:"excluded,omitempty"`
+}
+
+// boltMatchFunc returns true if the floating ip matches the query
+type boltMatchFunc func(ip net.IP, fip *boltFloatingIP) bool
+
+func boltKey(ip net.IP) []byte {
+	return []byte(ip.To16())
+}
+
+// fromBoltKey copies the ip of bolt key, as the key is only valid during the transaction
+func fromBoltKey(k []byte) net.IP {
+	ip := make(net.IP, len(k))
+	copy(ip, k)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func toDBFloatingIP(ip net.IP, fip *boltFloatingIP) database.FloatingIP {
+	return database.FloatingIP{
+		IP:        database.IP(ip),
+		Key:       fip.Key,
+		Subnet:    fip.Subnet,
+		Attr:      fip.Attr,
+		Policy:    fip.Policy,
+		UpdatedAt: fip.UpdatedAt,
+		Excluded:  fip.Excluded,
+	}
+}
+
+func (i *boltIpam) view(fn func(b *bolt.Bucket) error) error {
+	return i.store.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(i.bucket))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", i.bucket)
+		}
+		return fn(b)
+	})
+}
+
+func (i *boltIpam) update(fn func(b *bolt.Bucket) error) error {
+	return i.store.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(i.bucket))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", i.bucket)
+		}
+		return fn(b)
+	})
+}
+
+// boltFind returns all floating ips in the bucket which match
+func boltFind(b *bolt.Bucket, match boltMatchFunc) ([]database.FloatingIP, error) {
+	var fips []database.FloatingIP
+	err := b.ForEach(func(k, v []byte) error {
+		ip := fromBoltKey(k)
+		var fip boltFloatingIP
+		if err := json.Unmarshal(v, &fip); err != nil {
+			return fmt.Errorf("failed to unmarshal floating ip %s: %v", ip.String(), err)
+		}
+		if match(ip, &fip) {
+			fips = append(fips, toDBFloatingIP(ip, &fip))
+		}
+		return nil
+	})
+	return fips, err
+}
+
+// boltFindLatest returns the latest updated floating ip in the bucket which matches, it returns nil if none matches
+func boltFindLatest(b *bolt.Bucket, match boltMatchFunc) (*database.FloatingIP, error) {
+	fips, err := boltFind(b, match)
+	if err != nil || len(fips) == 0 {
+		return nil, err
+	}
+	latest := &fips[0]
+	for j := range fips {
+		if fips[j].UpdatedAt.After(latest.UpdatedAt) {
+			latest = &fips[j]
+		}
+	}
+	return latest, nil
+}
+
+func boltGet(b *bolt.Bucket, ip net.IP) (*boltFloatingIP, error) {
+	v := b.Get(boltKey(ip))
+	if v == nil {
+		return nil, nil
+	}
+	var fip boltFloatingIP
+	if err := json.Unmarshal(v, &fip); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal floating ip %s: %v", ip.String(), err)
+	}
+	return &fip, nil
+}
+
+func boltPut(b *bolt.Bucket, ip net.IP, fip *boltFloatingIP) error {
+	data, err := json.Marshal(fip)
+	if err != nil {
+		return err
+	}
+	return b.Put(boltKey(ip), data)
+}
+
+// boltUpdateIP updates key, policy and attr of the ip if its key is expectKey, returns ErrNotUpdated if not or if
+// an excluded ip is being allocated
+func boltUpdateIP(b *bolt.Bucket, ip net.IP, expectKey, key string, policy uint16, attr string) error {
+	fip, err := boltGet(b, ip)
+	if err != nil {
+		return err
+	}
+	if fip == nil || fip.Key != expectKey || (expectKey == "" && key != "" && fip.Excluded) {
+		return ErrNotUpdated
+	}
+	fip.Key, fip.Policy, fip.Attr, fip.UpdatedAt = key, policy, attr, time.Now()
+	return boltPut(b, ip, fip)
+}
+
+func boltKeyEquals(key string) boltMatchFunc {
+	return func(_ net.IP, fip *boltFloatingIP) bool {
+		return fip.Key == key
+	}
+}
+
+func (i *boltIpam) findByMatch(match boltMatchFunc) (fips []database.FloatingIP, err error) {
+	err = i.view(func(b *bolt.Bucket) error {
+		fips, err = boltFind(b, match)
+		return err
+	})
+	return
+}
+
+func (i *boltIpam) mergeWithBolt(fipMap map[string]*FloatingIP) error {
+	return i.update(func(b *bolt.Bucket) error {
+		// delete no longer available floating ips first
+		fips, err := boltFind(b, func(ip net.IP, _ *boltFloatingIP) bool {
+			for _, fipConf := range fipMap {
+				if fipConf.IPNet().Contains(ip) && fipConf.Contains(ip) {
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		deleted := 0
+		var orphaned []string
+		for j := range fips {
+			if fips[j].Key != "" {
+				// never drop allocated ips, keep them until they are released
+				orphaned = append(orphaned, net.IP(fips[j].IP).String())
+				continue
+			}
+			if err := b.Delete(boltKey(net.IP(fips[j].IP))); err != nil {
+				return err
+			}
+			deleted++
+		}
+		if deleted > 0 {
+			glog.Infof("deleted %d ips which are no longer configured", deleted)
+		}
+		if len(orphaned) > 0 {
+			glog.Warningf("[%s] keep %d allocated ips which are no longer configured: %v", i.Name(), len(orphaned),
+				orphaned)
+		}
+		// insert new floating ips
+		now := time.Now()
+		for _, fipConf := range fipMap {
+			subnet := fipConf.RoutableSubnet.String()
+			for _, ipr := range fipConf.IPRanges {
+				ipr.ForEachIP(func(ip net.IP) bool {
+					if b.Get(boltKey(ip)) != nil {
+						return true
+					}
+					err = boltPut(b, ip, &boltFloatingIP{Subnet: subnet, UpdatedAt: now})
+					return err == nil
+				})
+				if err != nil {
+					return fmt.Errorf("Error creating floating ip: %v", err)
+				}
+			}
+		}
+		return nil
+	})
+}
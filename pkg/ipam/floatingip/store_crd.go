@@ -18,8 +18,11 @@ package floatingip
 
 import (
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
+	metaErrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	glog "k8s.io/klog"
 	"tkestack.io/galaxy/pkg/api/galaxy/constant"
@@ -27,12 +30,11 @@ import (
 )
 
 func (ci *crdIpam) listFloatingIPs() (*v1alpha1.FloatingIPList, error) {
-	val, err := ci.ipType.String()
-	if err != nil {
-		return nil, err
+	if ci.ipType == "" {
+		return nil, fmt.Errorf("unknown ip type")
 	}
 	listOpt := metav1.ListOptions{
-		LabelSelector: fmt.Sprintf("%s=%s", constant.IpType, val),
+		LabelSelector: fmt.Sprintf("%s=%s", constant.IpType, ci.ipType),
 	}
 	fips, err := ci.client.GalaxyV1alpha1().FloatingIPs().List(listOpt)
 	if err != nil {
@@ -41,9 +43,33 @@ func (ci *crdIpam) listFloatingIPs() (*v1alpha1.FloatingIPList, error) {
 	return fips, nil
 }
 
-func (ci *crdIpam) createFloatingIP(name string, key string, policy constant.ReleasePolicy, attr string,
-	subnet string, updateTime time.Time) error {
-	glog.V(4).Infof("create floatingIP name %s, key %s, subnet %s, policy %v", name, key, subnet, policy)
+// floatingIPName returns FloatingIP object name of ip. Colons are not allowed in object names, so ipv6 ips
+// are named by its fully expanded form with colons replaced by dashes, e.g. 2001-0db8-0000-...-0001
+func floatingIPName(ip string) string {
+	netIP := net.ParseIP(ip)
+	if netIP == nil || netIP.To4() != nil {
+		return ip
+	}
+	groups := make([]string, 0, net.IPv6len/2)
+	for i := 0; i < net.IPv6len; i += 2 {
+		groups = append(groups, fmt.Sprintf("%02x%02x", netIP[i], netIP[i+1]))
+	}
+	return strings.Join(groups, "-")
+}
+
+// floatingIPFromName parses ip from FloatingIP object name
+func floatingIPFromName(name string) net.IP {
+	if ip := net.ParseIP(name); ip != nil {
+		return ip
+	}
+	return net.ParseIP(strings.Replace(name, "-", ":", -1))
+}
+
+func (ci *crdIpam) createFloatingIP(ip string, key string, policy constant.ReleasePolicy, attr string,
+	subnet string, updateTime time.Time, excluded bool) (*v1alpha1.FloatingIP, error) {
+	name := floatingIPName(ip)
+	glog.V(4).Infof("create floatingIP name %s, key %s, subnet %s, policy %v, excluded %v", name, key, subnet,
+		policy, excluded)
 	fip := &v1alpha1.FloatingIP{}
 	fip.Kind = constant.ResourceKind
 	fip.APIVersion = constant.ApiVersion
@@ -53,41 +79,71 @@ func (ci *crdIpam) createFloatingIP(name string, key string, policy constant.Rel
 	fip.Spec.Attribute = attr
 	fip.Spec.Subnet = subnet
 	fip.Spec.UpdateTime = metav1.NewTime(updateTime)
-	ipTypeVal, err := ci.ipType.String()
-	if err != nil {
-		return err
+	fip.Spec.Excluded = excluded
+	if ci.ipType == "" {
+		return nil, fmt.Errorf("unknown ip type")
 	}
 	label := make(map[string]string)
-	label[constant.IpType] = ipTypeVal
+	label[constant.IpType] = ci.ipType
 	fip.Labels = label
-	if _, err := ci.client.GalaxyV1alpha1().FloatingIPs().Create(fip); err != nil {
-		return err
-	}
-	return nil
+	return ci.client.GalaxyV1alpha1().FloatingIPs().Create(fip)
 }
 
-func (ci *crdIpam) deleteFloatingIP(name string) error {
-	glog.V(4).Infof("delete floatingIP name %s", name)
-	return ci.client.GalaxyV1alpha1().FloatingIPs().Delete(name, &metav1.DeleteOptions{})
+// deleteFloatingIP deletes FloatingIP object of ip. If resourceVersion is not empty, deletion only happens if the
+// object is not changed since then
+func (ci *crdIpam) deleteFloatingIP(ip, resourceVersion string) error {
+	name := floatingIPName(ip)
+	glog.V(4).Infof("delete floatingIP name %s, resourceVersion %s", name, resourceVersion)
+	opts := &metav1.DeleteOptions{}
+	if resourceVersion != "" {
+		opts.Preconditions = &metav1.Preconditions{ResourceVersion: &resourceVersion}
+	}
+	return ci.client.GalaxyV1alpha1().FloatingIPs().Delete(name, opts)
 }
 
-func (ci *crdIpam) getFloatingIP(name string) error {
-	_, err := ci.client.GalaxyV1alpha1().FloatingIPs().Get(name, metav1.GetOptions{})
+func (ci *crdIpam) getFloatingIP(ip string) error {
+	_, err := ci.client.GalaxyV1alpha1().FloatingIPs().Get(floatingIPName(ip), metav1.GetOptions{})
 	return err
 }
 
-func (ci *crdIpam) updateFloatingIP(name, key, subnet string, policy constant.ReleasePolicy, attr string,
-	updateTime time.Time) error {
-	glog.V(4).Infof("update floatingIP name %s, key %s, subnet %s, policy %v", name, key, subnet, policy)
+// updateFloatingIP updates FloatingIP object of ip. If resourceVersion is not empty, a conflict error is returned
+// if the object has been changed since then
+func (ci *crdIpam) updateFloatingIP(ip, key, subnet string, policy constant.ReleasePolicy, attr string,
+	updateTime time.Time, resourceVersion string) (*v1alpha1.FloatingIP, error) {
+	name := floatingIPName(ip)
+	glog.V(4).Infof("update floatingIP name %s, key %s, subnet %s, policy %v, resourceVersion %s", name, key,
+		subnet, policy, resourceVersion)
 	fip, err := ci.client.GalaxyV1alpha1().FloatingIPs().Get(name, metav1.GetOptions{})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if resourceVersion != "" && fip.ResourceVersion != resourceVersion {
+		return nil, metaErrs.NewConflict(v1alpha1.Resource("floatingips"), name,
+			fmt.Errorf("cached resourceVersion %s is stale, latest is %s", resourceVersion, fip.ResourceVersion))
 	}
 	fip.Spec.Key = key
 	fip.Spec.Policy = policy
 	fip.Spec.Subnet = subnet
 	fip.Spec.Attribute = attr
 	fip.Spec.UpdateTime = metav1.NewTime(updateTime)
-	_, err = ci.client.GalaxyV1alpha1().FloatingIPs().Update(fip)
-	return err
+	// apiserver rejects the update with a conflict error if someone else updates it after we get it
+	return ci.client.GalaxyV1alpha1().FloatingIPs().Update(fip)
+}
+
+// setFloatingIPExcluded updates excluded of FloatingIP object of ip. If resourceVersion is not empty, a conflict
+// error is returned if the object has been changed since then
+func (ci *crdIpam) setFloatingIPExcluded(ip string, excluded bool, resourceVersion string) (*v1alpha1.FloatingIP,
+	error) {
+	name := floatingIPName(ip)
+	glog.V(4).Infof("update floatingIP name %s, excluded %v, resourceVersion %s", name, excluded, resourceVersion)
+	fip, err := ci.client.GalaxyV1alpha1().FloatingIPs().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if resourceVersion != "" && fip.ResourceVersion != resourceVersion {
+		return nil, metaErrs.NewConflict(v1alpha1.Resource("floatingips"), name,
+			fmt.Errorf("cached resourceVersion %s is stale, latest is %s", resourceVersion, fip.ResourceVersion))
+	}
+	fip.Spec.Excluded = excluded
+	return ci.client.GalaxyV1alpha1().FloatingIPs().Update(fip)
 }
@@ -0,0 +1,128 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package floatingip
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"tkestack.io/galaxy/pkg/utils/nets"
+)
+
+// Strategy decides which unallocated ip of a subnet AllocateInSubnet allocates
+type Strategy string
+
+const (
+	// StrategyLowestIP allocates the lowest unallocated ip
+	StrategyLowestIP Strategy = "lowest-ip"
+	// StrategyRoundRobin allocates the lowest unallocated ip after the one allocated last time in the same subnet
+	StrategyRoundRobin Strategy = "round-robin"
+	// StrategyRandom allocates a random unallocated ip
+	StrategyRandom Strategy = "random"
+	// StrategyLeastRecentlyReleased allocates the unallocated ip which is released earliest
+	StrategyLeastRecentlyReleased Strategy = "least-recently-released"
+)
+
+// ParseStrategy returns the strategy of the given name, StrategyLowestIP if name is empty
+func ParseStrategy(name string) (Strategy, error) {
+	switch s := Strategy(name); s {
+	case "":
+		return StrategyLowestIP, nil
+	case StrategyLowestIP, StrategyRoundRobin, StrategyRandom, StrategyLeastRecentlyReleased:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown allocation strategy %s", name)
+	}
+}
+
+// candidate is an unallocated ip with its last update time
+type candidate struct {
+	ip        net.IP
+	updatedAt time.Time
+}
+
+// selector orders unallocated ips of a subnet by its strategy. It is shared by all storage drivers so that they
+// allocate ips the same way.
+type selector struct {
+	lock     sync.Mutex
+	strategy Strategy
+	// subnet to the ip allocated last time, used by StrategyRoundRobin
+	last map[string]net.IP
+	rand *rand.Rand
+}
+
+func newSelector() *selector {
+	return &selector{
+		strategy: StrategyLowestIP,
+		last:     map[string]net.IP{},
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *selector) setStrategy(strategy Strategy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.strategy = strategy
+}
+
+// order sorts candidates of the subnet in the order they should be tried
+func (s *selector) order(subnet string, candidates []candidate) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		return nets.CompareIP(candidates[i].ip, candidates[j].ip) < 0
+	})
+	switch s.strategy {
+	case StrategyRoundRobin:
+		last, ok := s.last[subnet]
+		if !ok {
+			return
+		}
+		next := sort.Search(len(candidates), func(i int) bool {
+			return nets.CompareIP(candidates[i].ip, last) > 0
+		})
+		rotated := append(append([]candidate{}, candidates[next:]...), candidates[:next]...)
+		copy(candidates, rotated)
+	case StrategyRandom:
+		s.rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	case StrategyLeastRecentlyReleased:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].updatedAt.Before(candidates[j].updatedAt)
+		})
+	}
+}
+
+// state returns the strategy and the ip allocated last time in the subnet for storage drivers which select ips by
+// themselves
+func (s *selector) state(subnet string) (Strategy, net.IP) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.strategy, s.last[subnet]
+}
+
+// allocated records the ip allocated in the subnet
+func (s *selector) allocated(subnet string, ip net.IP) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.last[subnet] = ip
+}
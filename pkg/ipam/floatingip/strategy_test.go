@@ -0,0 +1,138 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package floatingip
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+)
+
+func TestSelectorOrder(t *testing.T) {
+	now := time.Now()
+	newCandidates := func() []candidate {
+		return []candidate{
+			{ip: net.ParseIP("10.0.0.3"), updatedAt: now.Add(-time.Minute)},
+			{ip: net.ParseIP("10.0.0.1"), updatedAt: now},
+			{ip: net.ParseIP("10.0.0.4"), updatedAt: now},
+			{ip: net.ParseIP("10.0.0.2"), updatedAt: now.Add(-time.Hour)},
+		}
+	}
+	for i, c := range []struct {
+		strategy Strategy
+		last     string
+		expect   []string
+	}{
+		{strategy: StrategyLowestIP, expect: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}},
+		{strategy: StrategyRoundRobin, expect: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}},
+		{strategy: StrategyRoundRobin, last: "10.0.0.2", expect: []string{"10.0.0.3", "10.0.0.4", "10.0.0.1", "10.0.0.2"}},
+		{strategy: StrategyRoundRobin, last: "10.0.0.4", expect: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}},
+		{strategy: StrategyLeastRecentlyReleased, expect: []string{"10.0.0.2", "10.0.0.3", "10.0.0.1", "10.0.0.4"}},
+	} {
+		s := newSelector()
+		s.setStrategy(c.strategy)
+		if c.last != "" {
+			s.allocated("10.0.0.0/24", net.ParseIP(c.last))
+		}
+		candidates := newCandidates()
+		s.order("10.0.0.0/24", candidates)
+		var ips []string
+		for j := range candidates {
+			ips = append(ips, candidates[j].ip.String())
+		}
+		if !reflect.DeepEqual(ips, c.expect) {
+			t.Errorf("case %d, expect %v, real %v", i, c.expect, ips)
+		}
+	}
+	// random strategy keeps all candidates
+	s := newSelector()
+	s.setStrategy(StrategyRandom)
+	candidates := newCandidates()
+	s.order("10.0.0.0/24", candidates)
+	if len(candidates) != 4 {
+		t.Fatal(candidates)
+	}
+}
+
+func TestParseStrategy(t *testing.T) {
+	if s, err := ParseStrategy(""); err != nil || s != StrategyLowestIP {
+		t.Fatalf("expect default strategy %s, real %s, err %v", StrategyLowestIP, s, err)
+	}
+	if s, err := ParseStrategy("round-robin"); err != nil || s != StrategyRoundRobin {
+		t.Fatalf("expect strategy %s, real %s, err %v", StrategyRoundRobin, s, err)
+	}
+	if _, err := ParseStrategy("first-fit"); err == nil {
+		t.Fatal("expect an error for unknown strategy")
+	}
+}
+
+// each step allocates an ip, or releases the ip if it starts with "-"
+var strategyCases = []struct {
+	strategy Strategy
+	steps    []string
+}{
+	{strategy: StrategyLowestIP, steps: []string{"10.49.27.205", "10.49.27.216", "-10.49.27.205", "10.49.27.205"}},
+	{strategy: StrategyRoundRobin, steps: []string{"10.49.27.205", "10.49.27.216", "-10.49.27.205",
+		"10.49.27.217", "10.49.27.218", "10.49.27.205"}},
+	{strategy: StrategyLeastRecentlyReleased, steps: []string{"10.49.27.205", "-10.49.27.205", "10.49.27.216",
+		"10.49.27.217", "10.49.27.218", "10.49.27.205"}},
+}
+
+func TestAllocateInSubnetByStrategy(t *testing.T) {
+	for i, c := range strategyCases {
+		boltIPAM, cleanup := createTestBoltIPAM(t)
+		for _, ipam := range []IPAM{createTestCrdIPAM(t), boltIPAM} {
+			testAllocateInSubnetByStrategy(t, i, ipam, c.strategy, c.steps, 0)
+		}
+		cleanup()
+	}
+}
+
+func TestDBAllocateInSubnetByStrategy(t *testing.T) {
+	for i, c := range strategyCases {
+		// updated_at column is of second precision
+		testAllocateInSubnetByStrategy(t, i, Start(t), c.strategy, c.steps, time.Second)
+	}
+}
+
+// testAllocateInSubnetByStrategy runs steps of the strategy, it sleeps releaseDelay before each release
+func testAllocateInSubnetByStrategy(t *testing.T, i int, ipam IPAM, strategy Strategy, steps []string,
+	releaseDelay time.Duration) {
+	_, routableSubnet, _ := net.ParseCIDR("10.49.27.0/24")
+	ipam.SetStrategy(strategy)
+	for j, step := range steps {
+		key := "pod" + step
+		if step[0] == '-' {
+			key = "pod" + step[1:]
+			time.Sleep(releaseDelay)
+			if err := ipam.Release(key, net.ParseIP(step[1:])); err != nil {
+				t.Fatalf("case %d step %d: %v", i, j, err)
+			}
+			continue
+		}
+		allocated, err := ipam.AllocateInSubnet(key, routableSubnet, constant.ReleasePolicyPodDelete, "")
+		if err != nil {
+			t.Fatalf("case %d step %d: %v", i, j, err)
+		}
+		if allocated.String() != step {
+			t.Fatalf("case %d step %d [%s]: expect %s, real %s", i, j, ipam.Name(), step, allocated.String())
+		}
+	}
+}
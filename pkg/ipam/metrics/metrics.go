@@ -0,0 +1,70 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Namespace is the prometheus namespace of galaxy-ipam metrics
+const Namespace = "galaxy_ipam"
+
+var (
+	// FilterLatency is the latency of scheduler extender filter requests
+	FilterLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "filter_duration_seconds",
+		Help:      "Latency of scheduler extender filter requests in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	})
+	// BindLatency is the latency of scheduler extender bind requests
+	BindLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "bind_duration_seconds",
+		Help:      "Latency of scheduler extender bind requests in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	})
+	// IPAllocations counts ips bound to pods by how they are got, reused or allocated
+	IPAllocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "ip_allocations_total",
+		Help:      "Number of ips bound to pods by ipam and how they are got, reused or allocated.",
+	}, []string{"ipam", "how"})
+	// IPReleases counts released ips by reason
+	IPReleases = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "ip_releases_total",
+		Help:      "Number of released ips by ipam and reason.",
+	}, []string{"ipam", "reason"})
+	// CloudProviderErrors counts failed requests to cloud provider by method, AssignIP or UnAssignIP
+	CloudProviderErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "cloud_provider_errors_total",
+		Help:      "Number of failed cloud provider requests by method.",
+	}, []string{"method"})
+)
+
+var registerOnce sync.Once
+
+// Register registers galaxy-ipam metrics to the default prometheus registry
+func Register() {
+	registerOnce.Do(func() {
+		prometheus.MustRegister(FilterLatency, BindLatency, IPAllocations, IPReleases, CloudProviderErrors)
+	})
+}
@@ -0,0 +1,505 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	extensionClient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	metaErrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy/v1alpha1"
+	crd_clientset "tkestack.io/galaxy/pkg/ipam/client/clientset/versioned"
+	"tkestack.io/galaxy/pkg/ipam/crd"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin"
+	"tkestack.io/galaxy/pkg/utils/database"
+)
+
+// BackupVersion is the version of backup files which Export writes and Import reads
+const BackupVersion = 1
+
+// Backup is the ipam state of galaxy-ipam which is independent of storage drivers
+type Backup struct {
+	Version int `json:"version"`
+	// Config is floatingip configs of ipams by their configmap data keys
+	Config map[string][]*floatingip.FloatingIP `json:"config"`
+	// IPs is allocated ips of ipams by their configmap data keys
+	IPs map[string][]AllocatedIP `json:"ips,omitempty"`
+	// Orphans is allocated ips of ipams which are no longer within Config by their configmap data keys, they are
+	// kept for reference and not imported
+	Orphans map[string][]AllocatedIP `json:"orphans,omitempty"`
+	// Excluded is excluded ips of ipams which are within Config by their configmap data keys
+	Excluded map[string][]string `json:"excluded,omitempty"`
+	// Pools is Pool objects of the pool namespace without status
+	Pools []v1alpha1.Pool `json:"pools,omitempty"`
+	// FloatingIPPools is FloatingIPPool objects without status if ipams are configured by them
+	FloatingIPPools []v1alpha1.FloatingIPPool `json:"floatingIPPools,omitempty"`
+}
+
+// AllocatedIP is an allocated ip with the fields which migrating keeps
+type AllocatedIP struct {
+	IP        string    `json:"ip"`
+	Key       string    `json:"key"`
+	Policy    uint16    `json:"policy"`
+	Attr      string    `json:"attr,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Export returns floatingip configs, allocated and excluded ips of all ipams, Pool objects and FloatingIPPool objects.
+// It is read only, ipams are not configured but their stored ips are listed. Allocated ips which are no longer
+// configured are exported as orphans.
+func Export(conf *schedulerplugin.Conf, client kubernetes.Interface, crdClient crd_clientset.Interface) (*Backup,
+	error) {
+	conf.Validate()
+	poolConfs, err := loadPoolConfs(conf, client, crdClient)
+	if err != nil {
+		return nil, err
+	}
+	ipams, err := newIPAMs(conf, conf.StorageDriver, crdClient)
+	if err != nil {
+		return nil, err
+	}
+	defer shutdown(ipams...)
+	backup := &Backup{Version: BackupVersion, Config: map[string][]*floatingip.FloatingIP{},
+		IPs: map[string][]AllocatedIP{}, Orphans: map[string][]AllocatedIP{},
+		Excluded: map[string][]string{}}
+	for i, key := range configKeys(conf) {
+		if poolConfs[i] == nil {
+			continue
+		}
+		backup.Config[key] = poolConfs[i]
+		stored, err := floatingip.Stored(ipams[i])
+		if err != nil {
+			return nil, fmt.Errorf("[%s] %v", ipams[i].Name(), err)
+		}
+		diff := floatingip.Diff(stored, poolConfs[i])
+		orphaned, removed := map[string]bool{}, map[string]bool{}
+		for _, fip := range diff.Orphaned {
+			orphaned[fip.IP.String()] = true
+		}
+		for _, ip := range diff.Removed {
+			removed[ip.String()] = true
+		}
+		var ips, orphans []AllocatedIP
+		var excluded []string
+		for j := range stored {
+			ipStr := stored[j].IP.String()
+			if stored[j].Excluded && !orphaned[ipStr] && !removed[ipStr] {
+				excluded = append(excluded, ipStr)
+			}
+			if stored[j].Key == "" {
+				continue
+			}
+			ip := AllocatedIP{IP: ipStr, Key: stored[j].Key, Policy: stored[j].Policy,
+				Attr: stored[j].Attr, UpdatedAt: stored[j].UpdatedAt}
+			if orphaned[ip.IP] {
+				orphans = append(orphans, ip)
+			} else {
+				ips = append(ips, ip)
+			}
+		}
+		sort.Slice(ips, func(m, n int) bool { return ips[m].IP < ips[n].IP })
+		backup.IPs[key] = ips
+		if len(excluded) > 0 {
+			sort.Strings(excluded)
+			backup.Excluded[key] = excluded
+		}
+		if len(orphans) > 0 {
+			sort.Slice(orphans, func(m, n int) bool { return orphans[m].IP < orphans[n].IP })
+			backup.Orphans[key] = orphans
+			glog.Warningf("[%s] exported %d orphaned ips which are no longer configured, they can't be imported",
+				ipams[i].Name(), len(orphans))
+		}
+	}
+	pools, err := crdClient.GalaxyV1alpha1().Pools(conf.PoolNamespace).List(v1.ListOptions{})
+	if err != nil && !metaErrs.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to list pools: %v", err)
+	}
+	if pools != nil {
+		for i := range pools.Items {
+			backup.Pools = append(backup.Pools, exportedPool(&pools.Items[i]))
+		}
+	}
+	if conf.UseFloatingIPPoolCRD {
+		fipPools, err := listFloatingIPPools(crdClient)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(fipPools, func(m, n int) bool { return fipPools[m].Name < fipPools[n].Name })
+		for i := range fipPools {
+			backup.FloatingIPPools = append(backup.FloatingIPPools, exportedFloatingIPPool(fipPools[i]))
+		}
+	}
+	return backup, nil
+}
+
+// exportedPool returns the pool without status and server generated metadata
+func exportedPool(pool *v1alpha1.Pool) v1alpha1.Pool {
+	return v1alpha1.Pool{
+		ObjectMeta: v1.ObjectMeta{Name: pool.Name, Namespace: pool.Namespace, Labels: pool.Labels,
+			Annotations: pool.Annotations},
+		Size: pool.Size, PreAllocateIP: pool.PreAllocateIP, Namespaces: pool.Namespaces,
+	}
+}
+
+// exportedFloatingIPPool returns the FloatingIPPool object without status and server generated metadata
+func exportedFloatingIPPool(pool *v1alpha1.FloatingIPPool) v1alpha1.FloatingIPPool {
+	return v1alpha1.FloatingIPPool{
+		ObjectMeta: v1.ObjectMeta{Name: pool.Name, Labels: pool.Labels, Annotations: pool.Annotations},
+		Spec:       pool.Spec,
+	}
+}
+
+// #lizard forgives
+// Import restores floatingip configs, allocated and excluded ips, Pool objects and FloatingIPPool objects of the
+// backup. It validates the backup against the current state without writing anything, ipams are not configured until
+// no conflict is found. It returns all conflicts, i.e. configs or pools which differ, ips which are not in pool once
+// ipams are configured or allocated to other keys. Configs missing in the configmap are added and missing pools are
+// created, so importing the same backup again changes nothing. If dryRun is true, it only validates the backup.
+// Orphans of the backup are not imported, and ips excluded currently are kept excluded. Galaxy-ipam should be stopped
+// during importing, importing is refused if a galaxy-ipam replica holds the leader lease of resourceLock type.
+func Import(conf *schedulerplugin.Conf, client kubernetes.Interface, crdClient crd_clientset.Interface,
+	extClient extensionClient.Interface, backup *Backup, dryRun bool, resourceLock string) error {
+	if backup.Version != BackupVersion {
+		return fmt.Errorf("unsupported backup version %d, expect %d", backup.Version, BackupVersion)
+	}
+	if !dryRun {
+		if err := checkLeaderLease(client, resourceLock); err != nil {
+			return err
+		}
+		if err := crd.EnsureCRDCreated(extClient); err != nil {
+			return err
+		}
+	}
+	conf.Validate()
+	keys := configKeys(conf)
+	var (
+		curConfs  map[string][]*floatingip.FloatingIP
+		cm        *corev1.ConfigMap
+		fipPools  []*v1alpha1.FloatingIPPool
+		conflicts []string
+		err       error
+	)
+	if conf.UseFloatingIPPoolCRD {
+		curConfs, fipPools, conflicts, err = checkFloatingIPPools(conf, crdClient, backup.FloatingIPPools)
+	} else {
+		curConfs, cm, err = currentConfs(conf, client)
+	}
+	if err != nil {
+		return err
+	}
+	for key := range backup.Config {
+		if _, ok := curConfs[key]; !ok {
+			conflicts = append(conflicts, fmt.Sprintf("config %s: unknown config key or ipam configured by "+
+				"json config", key))
+		}
+	}
+	for key := range backup.IPs {
+		if _, ok := backup.Config[key]; !ok {
+			conflicts = append(conflicts, fmt.Sprintf("ips %s: no config of this config key in backup", key))
+		}
+	}
+	for key := range backup.Excluded {
+		if _, ok := backup.Config[key]; !ok {
+			conflicts = append(conflicts, fmt.Sprintf("excluded %s: no config of this config key in backup", key))
+		}
+	}
+	// configs to add to the configmap
+	missing := map[string]string{}
+	ipams, err := newIPAMs(conf, conf.StorageDriver, crdClient)
+	if err != nil {
+		return err
+	}
+	defer shutdown(ipams...)
+	poolConfs := make([][]*floatingip.FloatingIP, len(keys))
+	fips := make([][]database.FloatingIP, len(keys))
+	excluded := make([][]net.IP, len(keys))
+	for i, key := range keys {
+		poolConf, ok := backup.Config[key]
+		if !ok {
+			continue
+		}
+		data, err := json.Marshal(poolConf)
+		if err != nil {
+			return fmt.Errorf("failed to marshal config %s: %v", key, err)
+		}
+		if cur := curConfs[key]; cur == nil {
+			if conf.UseFloatingIPPoolCRD {
+				conflicts = append(conflicts, fmt.Sprintf("config %s: no floatingip pool of the ipam", key))
+				continue
+			}
+			missing[key] = string(data)
+		} else if curData, err := json.Marshal(cur); err != nil {
+			return fmt.Errorf("failed to marshal config %s: %v", key, err)
+		} else if string(curData) != string(data) {
+			conflicts = append(conflicts, fmt.Sprintf("config %s: %s vs %s", key, curData, data))
+			continue
+		}
+		poolConfs[i] = poolConf
+		var ipConflicts []string
+		if fips[i], excluded[i], ipConflicts, err = checkIPs(ipams[i], poolConf, backup.IPs[key],
+			backup.Excluded[key]); err != nil {
+			return err
+		}
+		for _, conflict := range ipConflicts {
+			conflicts = append(conflicts, fmt.Sprintf("ips %s: %s", key, conflict))
+		}
+	}
+	pools, poolConflicts, err := checkPools(crdClient, backup.Pools)
+	if err != nil {
+		return err
+	}
+	conflicts = append(conflicts, poolConflicts...)
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("backup conflicts with the current state:\n%s", strings.Join(conflicts, "\n"))
+	}
+	for key, orphans := range backup.Orphans {
+		glog.Warningf("skipped %d orphaned ips of %s which are not configured", len(orphans), key)
+	}
+	if dryRun {
+		glog.Infof("backup agrees with the current state")
+		return nil
+	}
+	if len(missing) > 0 {
+		if err := addConfigs(conf, client, cm, missing); err != nil {
+			return err
+		}
+	}
+	for i := range fipPools {
+		if _, err := crdClient.GalaxyV1alpha1().FloatingIPPools().Create(fipPools[i]); err != nil {
+			return fmt.Errorf("failed to create floatingip pool %s: %v", fipPools[i].Name, err)
+		}
+		glog.Infof("created floatingip pool %s", fipPools[i].Name)
+	}
+	for i := range poolConfs {
+		if poolConfs[i] == nil {
+			continue
+		}
+		if err := ipams[i].ConfigurePool(poolConfs[i]); err != nil {
+			return fmt.Errorf("[%s] failed to configure pool: %v", ipams[i].Name(), err)
+		}
+		if len(fips[i]) > 0 {
+			if err := ipams[i].RestoreIPs(fips[i]); err != nil {
+				return fmt.Errorf("[%s] failed to restore ips: %v", ipams[i].Name(), err)
+			}
+			glog.Infof("[%s] restored %d ips", ipams[i].Name(), len(fips[i]))
+		}
+		for _, ip := range excluded[i] {
+			if err := ipams[i].SetExcluded(ip, true); err != nil {
+				return fmt.Errorf("[%s] failed to exclude %s: %v", ipams[i].Name(), ip.String(), err)
+			}
+		}
+		if len(excluded[i]) > 0 {
+			glog.Infof("[%s] excluded %d ips", ipams[i].Name(), len(excluded[i]))
+		}
+	}
+	for i := range pools {
+		if _, err := crdClient.GalaxyV1alpha1().Pools(pools[i].Namespace).Create(pools[i]); err != nil {
+			return fmt.Errorf("failed to create pool %s: %v", pools[i].Name, err)
+		}
+		glog.Infof("created pool %s", pools[i].Name)
+	}
+	return nil
+}
+
+// checkFloatingIPPools returns floatingip configs of ipams by their configmap data keys once FloatingIPPool objects
+// of the backup are created, FloatingIPPool objects to create and conflicts of those whose specs differ from
+// existing ones. Config is nil if the ipam has no valid FloatingIPPool object.
+func checkFloatingIPPools(conf *schedulerplugin.Conf, crdClient crd_clientset.Interface,
+	pools []v1alpha1.FloatingIPPool) (map[string][]*floatingip.FloatingIP, []*v1alpha1.FloatingIPPool, []string,
+	error) {
+	existing, err := listFloatingIPPools(crdClient)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	byName := make(map[string]*v1alpha1.FloatingIPPool, len(existing))
+	for i := range existing {
+		byName[existing[i].Name] = existing[i]
+	}
+	var toCreate []*v1alpha1.FloatingIPPool
+	var conflicts []string
+	for i := range pools {
+		pool := exportedFloatingIPPool(&pools[i])
+		cur, ok := byName[pool.Name]
+		if !ok {
+			toCreate = append(toCreate, &pool)
+			continue
+		}
+		if !reflect.DeepEqual(cur.Spec, pool.Spec) {
+			conflicts = append(conflicts, fmt.Sprintf("floatingip pool %s: %+v vs %+v", pool.Name, cur.Spec,
+				pool.Spec))
+		}
+	}
+	confs := map[string][]*floatingip.FloatingIP{}
+	poolConfs := floatingIPPoolConfs(conf, append(existing, toCreate...))
+	for i, key := range configKeys(conf) {
+		confs[key] = poolConfs[i]
+	}
+	return confs, toCreate, conflicts, nil
+}
+
+// currentConfs returns current floatingip configs of ipams by their configmap data keys, config is nil if the ipam is
+// not configured, and the configmap if configs are loaded from it. Ipams other than the first one are not configurable
+// if the first one is configured in json config.
+func currentConfs(conf *schedulerplugin.Conf, client kubernetes.Interface) (map[string][]*floatingip.FloatingIP,
+	*corev1.ConfigMap, error) {
+	if len(conf.FloatingIPs) > 0 {
+		return map[string][]*floatingip.FloatingIP{conf.FloatingIPKey: conf.FloatingIPs}, nil, nil
+	}
+	confs := map[string][]*floatingip.FloatingIP{}
+	for _, key := range configKeys(conf) {
+		confs[key] = nil
+	}
+	cm, err := client.CoreV1().ConfigMaps(conf.ConfigMapNamespace).Get(conf.ConfigMapName, v1.GetOptions{})
+	if metaErrs.IsNotFound(err) {
+		return confs, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to get floatingip configmap %s_%s: %v", conf.ConfigMapName,
+			conf.ConfigMapNamespace, err)
+	}
+	for key := range confs {
+		val, ok := cm.Data[key]
+		if !ok || val == "" {
+			continue
+		}
+		var fips []*floatingip.FloatingIP
+		if err := json.Unmarshal([]byte(val), &fips); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal configmap val %s to floatingip config", val)
+		}
+		confs[key] = fips
+	}
+	return confs, cm, nil
+}
+
+// checkIPs returns ips to restore, ips to exclude and conflicts of ips which are not in pool once ipam is configured
+// with poolConf or are allocated to other keys. It reads stored ips without configuring ipam. Ips which are already
+// allocated to the same keys are restored again to keep their policies, attrs and update times.
+func checkIPs(ipam floatingip.IPAM, poolConf []*floatingip.FloatingIP, ips []AllocatedIP,
+	excludedIPs []string) ([]database.FloatingIP, []net.IP, []string, error) {
+	stored, err := floatingip.Stored(ipam)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("[%s] %v", ipam.Name(), err)
+	}
+	current := make(map[string]database.FloatingIP, len(stored))
+	// ips in pool once ipam is configured, i.e. stored ips except those configuring removes or orphans, and ips
+	// configuring adds
+	inPool := make(map[string]bool, len(stored))
+	for i := range stored {
+		current[stored[i].IP.String()] = stored[i]
+		inPool[stored[i].IP.String()] = true
+	}
+	diff := floatingip.Diff(stored, poolConf)
+	for _, ip := range diff.Removed {
+		delete(inPool, ip.String())
+	}
+	for i := range diff.Orphaned {
+		delete(inPool, diff.Orphaned[i].IP.String())
+	}
+	for _, ip := range diff.Added {
+		inPool[ip.String()] = true
+	}
+	var fips []database.FloatingIP
+	var conflicts []string
+	for _, allocated := range ips {
+		ip := net.ParseIP(allocated.IP)
+		if ip == nil {
+			conflicts = append(conflicts, fmt.Sprintf("%s: invalid ip", allocated.IP))
+			continue
+		}
+		if !inPool[ip.String()] {
+			conflicts = append(conflicts, fmt.Sprintf("%s: not in pool", allocated.IP))
+			continue
+		}
+		if fip, ok := current[ip.String()]; ok && fip.Key != "" && fip.Key != allocated.Key {
+			conflicts = append(conflicts, fmt.Sprintf("%s: allocated to %s vs %s", allocated.IP, fip.Key,
+				allocated.Key))
+			continue
+		}
+		fips = append(fips, database.FloatingIP{IP: database.IP(ip), Key: allocated.Key, Policy: allocated.Policy,
+			Attr: allocated.Attr, UpdatedAt: allocated.UpdatedAt})
+	}
+	var excluded []net.IP
+	for _, ipStr := range excludedIPs {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			conflicts = append(conflicts, fmt.Sprintf("%s: invalid excluded ip", ipStr))
+		} else if !inPool[ip.String()] {
+			conflicts = append(conflicts, fmt.Sprintf("%s: excluded but not in pool", ipStr))
+		} else {
+			excluded = append(excluded, ip)
+		}
+	}
+	return fips, excluded, conflicts, nil
+}
+
+// checkPools returns pools to create and conflicts of pools whose specs differ from existing ones
+func checkPools(crdClient crd_clientset.Interface, pools []v1alpha1.Pool) ([]*v1alpha1.Pool, []string, error) {
+	var toCreate []*v1alpha1.Pool
+	var conflicts []string
+	for i := range pools {
+		pool := exportedPool(&pools[i])
+		existing, err := crdClient.GalaxyV1alpha1().Pools(pool.Namespace).Get(pool.Name, v1.GetOptions{})
+		if metaErrs.IsNotFound(err) {
+			toCreate = append(toCreate, &pool)
+			continue
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to get pool %s: %v", pool.Name, err)
+		}
+		if existing.Size != pool.Size || existing.PreAllocateIP != pool.PreAllocateIP ||
+			!reflect.DeepEqual(existing.Namespaces, pool.Namespaces) {
+			conflicts = append(conflicts, fmt.Sprintf("pool %s: size=%d preAllocateIP=%v namespaces=%v vs "+
+				"size=%d preAllocateIP=%v namespaces=%v", pool.Name, existing.Size, existing.PreAllocateIP,
+				existing.Namespaces, pool.Size, pool.PreAllocateIP, pool.Namespaces))
+		}
+	}
+	return toCreate, conflicts, nil
+}
+
+// addConfigs adds configs to the floatingip configmap, creating it if it doesn't exist
+func addConfigs(conf *schedulerplugin.Conf, client kubernetes.Interface, cm *corev1.ConfigMap,
+	configs map[string]string) error {
+	if cm == nil {
+		cm = &corev1.ConfigMap{ObjectMeta: v1.ObjectMeta{Name: conf.ConfigMapName,
+			Namespace: conf.ConfigMapNamespace}, Data: configs}
+		if _, err := client.CoreV1().ConfigMaps(cm.Namespace).Create(cm); err != nil {
+			return fmt.Errorf("failed to create floatingip configmap %s_%s: %v", cm.Name, cm.Namespace, err)
+		}
+		return nil
+	}
+	cm = cm.DeepCopy()
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	for key, val := range configs {
+		cm.Data[key] = val
+	}
+	if _, err := client.CoreV1().ConfigMaps(cm.Namespace).Update(cm); err != nil {
+		return fmt.Errorf("failed to update floatingip configmap %s_%s: %v", cm.Name, cm.Namespace, err)
+	}
+	return nil
+}
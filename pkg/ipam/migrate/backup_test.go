@@ -0,0 +1,262 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package migrate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	extensionFake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy/v1alpha1"
+	fakeGalaxyCli "tkestack.io/galaxy/pkg/ipam/client/clientset/versioned/fake"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin"
+	"tkestack.io/galaxy/pkg/utils/database"
+)
+
+// #lizard forgives
+func TestExportImport(t *testing.T) {
+	var testConf struct {
+		Floatingips json.RawMessage `json:"floatingips"`
+	}
+	if err := json.Unmarshal([]byte(database.TestConfig), &testConf); err != nil {
+		t.Fatal(err)
+	}
+	newConf := func() *schedulerplugin.Conf {
+		return &schedulerplugin.Conf{StorageDriver: "k8s-crd"}
+	}
+	cm := &corev1.ConfigMap{ObjectMeta: v1.ObjectMeta{Name: "floatingip-config", Namespace: "kube-system"},
+		Data: map[string]string{"floatingips": string(testConf.Floatingips)}}
+	pool := &v1alpha1.Pool{ObjectMeta: v1.ObjectMeta{Name: "pool1", Namespace: "kube-system"}, Size: 3,
+		Namespaces: []string{"ns1"}}
+	srcClient, srcCrdClient := fake.NewSimpleClientset(cm), fakeGalaxyCli.NewSimpleClientset(pool)
+	src := floatingip.NewCrdIPAM(srcCrdClient, floatingip.InternalIp, nil)
+	configurePool(t, src)
+	if err := src.AllocateSpecificIP("pod1", net.ParseIP("10.49.27.205"), constant.ReleasePolicyNever,
+		`{"NodeName":"node1"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetExcluded(net.ParseIP("10.49.27.216"), true); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := Export(newConf(), srcClient, srcCrdClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.Version != BackupVersion || len(backup.Config) != 1 || len(backup.IPs["floatingips"]) != 1 ||
+		len(backup.Excluded["floatingips"]) != 1 || len(backup.Pools) != 1 || backup.Pools[0].Size != 3 {
+		t.Fatalf("unexpected backup %+v", backup)
+	}
+	// the backup survives a round trip of its file
+	data, err := json.Marshal(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup = &Backup{}
+	if err := json.Unmarshal(data, backup); err != nil {
+		t.Fatal(err)
+	}
+
+	// import into a cluster without the configmap, the pool and the ip
+	dstClient, dstCrdClient := fake.NewSimpleClientset(), fakeGalaxyCli.NewSimpleClientset()
+	if err := Import(newConf(), dstClient, dstCrdClient, extensionFake.NewSimpleClientset(), backup,
+		true, resourcelock.EndpointsResourceLock); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dstClient.CoreV1().ConfigMaps("kube-system").Get("floatingip-config", v1.GetOptions{}); err == nil {
+		t.Fatal("expect dry run writes nothing")
+	}
+	// importing again changes nothing
+	for i := 0; i < 2; i++ {
+		if err := Import(newConf(), dstClient, dstCrdClient, extensionFake.NewSimpleClientset(), backup,
+			false, resourcelock.EndpointsResourceLock); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := dstClient.CoreV1().ConfigMaps("kube-system").Get("floatingip-config", v1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dstCrdClient.GalaxyV1alpha1().Pools("kube-system").Get("pool1", v1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	dst := floatingip.NewCrdIPAM(dstCrdClient, floatingip.InternalIp, nil)
+	configurePool(t, dst)
+	// verifying also compares exclusion of ips
+	if diffs, err := Verify(src, dst); err != nil || len(diffs) != 0 {
+		t.Fatalf("diffs %v, err %v", diffs, err)
+	}
+
+	// conflicts are reported before writing anything
+	conflictPool := pool.DeepCopy()
+	conflictPool.Size = 1
+	conflictClient, conflictCrdClient := fake.NewSimpleClientset(cm), fakeGalaxyCli.NewSimpleClientset(conflictPool)
+	conflict := floatingip.NewCrdIPAM(conflictCrdClient, floatingip.InternalIp, nil)
+	configurePool(t, conflict)
+	if err := conflict.AllocateSpecificIP("pod2", net.ParseIP("10.49.27.205"), constant.ReleasePolicyNever,
+		""); err != nil {
+		t.Fatal(err)
+	}
+	backup.IPs["floatingips"] = append(backup.IPs["floatingips"], AllocatedIP{IP: "10.0.0.2", Key: "pod3"})
+	backup.Excluded["floatingips"] = append(backup.Excluded["floatingips"], "10.0.0.3")
+	err = Import(newConf(), conflictClient, conflictCrdClient, extensionFake.NewSimpleClientset(), backup, false,
+		resourcelock.EndpointsResourceLock)
+	if err == nil {
+		t.Fatal("expect conflicts")
+	}
+	for _, expect := range []string{"10.49.27.205: allocated to pod2 vs pod1", "10.0.0.2: not in pool",
+		"10.0.0.3: excluded but not in pool", "pool pool1: size=1"} {
+		if !strings.Contains(err.Error(), expect) {
+			t.Errorf("expect conflict %q in %v", expect, err)
+		}
+	}
+	if fip, err := conflict.ByIP(net.ParseIP("10.49.27.205")); err != nil || fip.Key != "pod2" {
+		t.Fatalf("fip %+v, err %v", fip, err)
+	}
+}
+
+// #lizard forgives
+func TestExportImportReadOnly(t *testing.T) {
+	var testConf struct {
+		Floatingips json.RawMessage `json:"floatingips"`
+	}
+	if err := json.Unmarshal([]byte(database.TestConfig), &testConf); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "galaxy-ipam-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	dbPath := filepath.Join(dir, "ipam.db")
+	newConf := func() *schedulerplugin.Conf {
+		return &schedulerplugin.Conf{StorageDriver: "bolt", BoltDBPath: dbPath}
+	}
+	checkEmpty := func(when string) {
+		store, err := floatingip.OpenBoltStore(dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipam := floatingip.NewBoltIPAM(store, database.DefaultFloatingipTableName)
+		defer ipam.Shutdown()
+		if fips, err := ipam.ByPrefix(""); err != nil || len(fips) != 0 {
+			t.Fatalf("expect no ip stored %s, real %v, err %v", when, fips, err)
+		}
+	}
+	cm := &corev1.ConfigMap{ObjectMeta: v1.ObjectMeta{Name: "floatingip-config", Namespace: "kube-system"},
+		Data: map[string]string{"floatingips": string(testConf.Floatingips)}}
+	client, crdClient := fake.NewSimpleClientset(cm), fakeGalaxyCli.NewSimpleClientset()
+	backup, err := Export(newConf(), client, crdClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEmpty("after exporting")
+	if err := Import(newConf(), client, crdClient, extensionFake.NewSimpleClientset(), backup, true,
+		resourcelock.EndpointsResourceLock); err != nil {
+		t.Fatal(err)
+	}
+	checkEmpty("after dry run")
+	backup.IPs["floatingips"] = append(backup.IPs["floatingips"], AllocatedIP{IP: "10.0.0.2", Key: "pod1"})
+	if err := Import(newConf(), client, crdClient, extensionFake.NewSimpleClientset(), backup, false,
+		resourcelock.EndpointsResourceLock); err == nil {
+		t.Fatal("expect conflicts")
+	}
+	checkEmpty("after conflicts")
+	// importing is refused while the lease is held, but dry run only reads
+	backup.IPs["floatingips"] = nil
+	holdLeaderLease(t, client)
+	if err := Import(newConf(), client, crdClient, extensionFake.NewSimpleClientset(), backup, true,
+		resourcelock.EndpointsResourceLock); err != nil {
+		t.Fatal(err)
+	}
+	if err := Import(newConf(), client, crdClient, extensionFake.NewSimpleClientset(), backup, false,
+		resourcelock.EndpointsResourceLock); err == nil {
+		t.Fatal("expect an error as the lease is held")
+	}
+	checkEmpty("while the lease is held")
+}
+
+func TestExportOrphans(t *testing.T) {
+	cm := &corev1.ConfigMap{ObjectMeta: v1.ObjectMeta{Name: "floatingip-config", Namespace: "kube-system"},
+		Data: map[string]string{"floatingips": `[{"routableSubnet":"10.49.27.0/24","ips":["10.49.27.216"],` +
+			`"subnet":"10.49.27.0/24","gateway":"10.49.27.1"}]`}}
+	client, crdClient := fake.NewSimpleClientset(cm), fakeGalaxyCli.NewSimpleClientset()
+	ipam := floatingip.NewCrdIPAM(crdClient, floatingip.InternalIp, nil)
+	configurePool(t, ipam)
+	if err := ipam.AllocateSpecificIP("pod1", net.ParseIP("10.49.27.205"), constant.ReleasePolicyNever,
+		""); err != nil {
+		t.Fatal(err)
+	}
+	// 10.49.27.205 is no longer configured
+	backup, err := Export(&schedulerplugin.Conf{StorageDriver: "k8s-crd"}, client, crdClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backup.IPs["floatingips"]) != 0 || len(backup.Orphans["floatingips"]) != 1 ||
+		backup.Orphans["floatingips"][0].IP != "10.49.27.205" || backup.Orphans["floatingips"][0].Key != "pod1" {
+		t.Fatalf("unexpected backup %+v", backup)
+	}
+}
+
+// #lizard forgives
+func TestExportImportFloatingIPPools(t *testing.T) {
+	newConf := func() *schedulerplugin.Conf {
+		return &schedulerplugin.Conf{StorageDriver: "k8s-crd", UseFloatingIPPoolCRD: true}
+	}
+	fipPool := &v1alpha1.FloatingIPPool{ObjectMeta: v1.ObjectMeta{Name: "pool1"},
+		Spec: v1alpha1.FloatingIPPoolSpec{RoutableSubnet: "10.49.27.0/24", Subnet: "10.49.27.0/24",
+			Gateway: "10.49.27.1", IPs: []string{"10.49.27.205", "10.49.27.216"}}}
+	srcCrdClient := fakeGalaxyCli.NewSimpleClientset(fipPool)
+	// floatingips are configured by FloatingIPPool objects without the configmap
+	backup, err := Export(newConf(), fake.NewSimpleClientset(), srcCrdClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backup.Config["floatingips"]) != 1 || len(backup.FloatingIPPools) != 1 ||
+		backup.FloatingIPPools[0].Name != "pool1" {
+		t.Fatalf("unexpected backup %+v", backup)
+	}
+	dstClient, dstCrdClient := fake.NewSimpleClientset(), fakeGalaxyCli.NewSimpleClientset()
+	for i := 0; i < 2; i++ {
+		if err := Import(newConf(), dstClient, dstCrdClient, extensionFake.NewSimpleClientset(), backup,
+			false, resourcelock.EndpointsResourceLock); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := dstCrdClient.GalaxyV1alpha1().FloatingIPPools().Get("pool1", v1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dstClient.CoreV1().ConfigMaps("kube-system").Get("floatingip-config", v1.GetOptions{}); err == nil {
+		t.Fatal("expect no configmap created")
+	}
+	conflictPool := fipPool.DeepCopy()
+	conflictPool.Spec.Vlan = 2
+	err = Import(newConf(), fake.NewSimpleClientset(), fakeGalaxyCli.NewSimpleClientset(conflictPool),
+		extensionFake.NewSimpleClientset(), backup, false, resourcelock.EndpointsResourceLock)
+	if err == nil || !strings.Contains(err.Error(), "floatingip pool pool1:") {
+		t.Fatalf("expect conflict of floatingip pool pool1, real %v", err)
+	}
+}
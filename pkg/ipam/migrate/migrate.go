@@ -0,0 +1,336 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	extensionClient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	metaErrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy/v1alpha1"
+	crd_clientset "tkestack.io/galaxy/pkg/ipam/client/clientset/versioned"
+	"tkestack.io/galaxy/pkg/ipam/crd"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin"
+	"tkestack.io/galaxy/pkg/utils/database"
+)
+
+// Options contains the options of migrating ips between storage drivers
+type Options struct {
+	From   string
+	To     string
+	Verify bool
+	// ResourceLock is the lock type of galaxy-ipam leader election
+	ResourceLock string
+}
+
+// AddFlags add flags of migrate subcommand to the specified FlagSet
+func (o *Options) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.From, "from", o.From, "The storage driver to migrate ips from, mysql, k8s-crd or bolt")
+	fs.StringVar(&o.To, "to", o.To, "The storage driver to migrate ips to, mysql, k8s-crd or bolt")
+	fs.BoolVar(&o.Verify, "verify", o.Verify, "Only diff ips of the two storage drivers without migrating")
+	fs.StringVar(&o.ResourceLock, "leader-elect-resource-lock", resourcelock.EndpointsResourceLock, "The type of "+
+		"resource object galaxy-ipam uses for leader election, migrating is refused if the lease is held")
+}
+
+// Run migrates allocated ips of all ipams from one storage driver to another, and then verifies that they agree
+// with each other. Galaxy-ipam should be stopped during migrating.
+func Run(conf *schedulerplugin.Conf, client kubernetes.Interface, crdClient crd_clientset.Interface,
+	extClient extensionClient.Interface, opt *Options) error {
+	if opt.From == opt.To {
+		return fmt.Errorf("can't migrate from %s to itself", opt.From)
+	}
+	if opt.From == "k8s-crd" || opt.To == "k8s-crd" {
+		if err := crd.EnsureCRDCreated(extClient); err != nil {
+			return err
+		}
+	}
+	conf.Validate()
+	if err := checkLeaderLease(client, opt.ResourceLock); err != nil {
+		if !opt.Verify {
+			return err
+		}
+		glog.Warningf("%v, ips may change during verifying", err)
+	}
+	poolConfs, err := loadPoolConfs(conf, client, crdClient)
+	if err != nil {
+		return err
+	}
+	srcs, err := newIPAMs(conf, opt.From, crdClient)
+	if err != nil {
+		return err
+	}
+	defer shutdown(srcs...)
+	dsts, err := newIPAMs(conf, opt.To, crdClient)
+	if err != nil {
+		return err
+	}
+	defer shutdown(dsts...)
+	for i := range poolConfs {
+		if poolConfs[i] == nil {
+			continue
+		}
+		// verifying is read only, ConfigurePool inserts and deletes unallocated ips
+		if !opt.Verify {
+			if err := srcs[i].ConfigurePool(poolConfs[i]); err != nil {
+				return fmt.Errorf("[%s] failed to configure pool: %v", srcs[i].Name(), err)
+			}
+			if err := dsts[i].ConfigurePool(poolConfs[i]); err != nil {
+				return fmt.Errorf("[%s] failed to configure pool: %v", dsts[i].Name(), err)
+			}
+			migrated, err := Migrate(srcs[i], dsts[i])
+			if err != nil {
+				return fmt.Errorf("failed to migrate ips from %s to %s: %v", srcs[i].Name(), dsts[i].Name(), err)
+			}
+			glog.Infof("migrated %d ips from %s %s to %s %s", migrated, opt.From, srcs[i].Name(), opt.To,
+				dsts[i].Name())
+		}
+		diffs, err := Verify(srcs[i], dsts[i])
+		if err != nil {
+			return err
+		}
+		if len(diffs) > 0 {
+			return fmt.Errorf("ips of %s %s and %s %s disagree:\n%s", opt.From, srcs[i].Name(), opt.To,
+				dsts[i].Name(), strings.Join(diffs, "\n"))
+		}
+		glog.Infof("ips of %s %s and %s %s agree", opt.From, srcs[i].Name(), opt.To, dsts[i].Name())
+	}
+	return nil
+}
+
+// newIPAMs returns the ipam, the ipv6 ipam and named ipams of the driver in the order of configKeys
+func newIPAMs(conf *schedulerplugin.Conf, driver string, crdClient crd_clientset.Interface) ([]floatingip.IPAM,
+	error) {
+	ipam, ipv6IPAM, namedIPAMs, _, err := schedulerplugin.NewIPAMs(conf, driver, crdClient, nil)
+	if err != nil {
+		return nil, err
+	}
+	ipams := []floatingip.IPAM{ipam, ipv6IPAM}
+	for _, named := range conf.NamedIPAMs {
+		ipams = append(ipams, namedIPAMs[named.Name])
+	}
+	return ipams, nil
+}
+
+// configKeys returns configmap data keys of the ipam, the ipv6 ipam and named ipams
+func configKeys(conf *schedulerplugin.Conf) []string {
+	keys := []string{conf.FloatingIPKey, conf.IPv6FloatingIPKey}
+	for _, named := range conf.NamedIPAMs {
+		keys = append(keys, named.ConfigKey)
+	}
+	return keys
+}
+
+// checkLeaderLease returns an error if a galaxy-ipam replica holds the leader lease, as the leader keeps allocating
+// and releasing ips
+func checkLeaderLease(client kubernetes.Interface, lockType string) error {
+	// the lock is named after galaxy-ipam component in kube-system namespace, see server.initk8sClient
+	rl, err := resourcelock.New(lockType, "kube-system", "galaxy-ipam", client.CoreV1(), client.CoordinationV1(),
+		resourcelock.ResourceLockConfig{})
+	if err != nil {
+		return err
+	}
+	record, err := rl.Get()
+	if err != nil {
+		if metaErrs.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get leader lease of galaxy-ipam: %v", err)
+	}
+	expire := record.RenewTime.Add(time.Duration(record.LeaseDurationSeconds) * time.Second)
+	if record.HolderIdentity != "" && expire.After(time.Now()) {
+		return fmt.Errorf("galaxy-ipam %s holds the leader lease until %s, stop galaxy-ipam first",
+			record.HolderIdentity, expire.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func shutdown(ipams ...floatingip.IPAM) {
+	for _, ipam := range ipams {
+		ipam.Shutdown()
+	}
+}
+
+// loadPoolConfs loads floatingip configs of ipam, ipv6 ipam and named ipams in the order of configKeys from
+// FloatingIPPool objects, json config or configmap in the same way galaxy-ipam does. Config is nil if the ipam is not
+// configured.
+func loadPoolConfs(conf *schedulerplugin.Conf, client kubernetes.Interface,
+	crdClient crd_clientset.Interface) ([][]*floatingip.FloatingIP, error) {
+	keys := configKeys(conf)
+	poolConfs := make([][]*floatingip.FloatingIP, len(keys))
+	if conf.UseFloatingIPPoolCRD {
+		pools, err := listFloatingIPPools(crdClient)
+		if err != nil {
+			return poolConfs, err
+		}
+		poolConfs = floatingIPPoolConfs(conf, pools)
+		if poolConfs[0] == nil {
+			return poolConfs, fmt.Errorf("no valid floatingip pool of the first ipam")
+		}
+		return poolConfs, nil
+	}
+	if len(conf.FloatingIPs) > 0 {
+		poolConfs[0] = conf.FloatingIPs
+		return poolConfs, nil
+	}
+	cm, err := client.CoreV1().ConfigMaps(conf.ConfigMapNamespace).Get(conf.ConfigMapName, v1.GetOptions{})
+	if err != nil {
+		return poolConfs, fmt.Errorf("failed to get floatingip configmap %s_%s: %v", conf.ConfigMapName,
+			conf.ConfigMapNamespace, err)
+	}
+	for i, key := range keys {
+		val, ok := cm.Data[key]
+		if !ok || val == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(val), &poolConfs[i]); err != nil {
+			return poolConfs, fmt.Errorf("failed to unmarshal configmap val %s to floatingip config", val)
+		}
+	}
+	if poolConfs[0] == nil {
+		return poolConfs, fmt.Errorf("configmap %s_%s doesn't have a key %s", conf.ConfigMapName,
+			conf.ConfigMapNamespace, conf.FloatingIPKey)
+	}
+	return poolConfs, nil
+}
+
+// listFloatingIPPools lists FloatingIPPool objects
+func listFloatingIPPools(crdClient crd_clientset.Interface) ([]*v1alpha1.FloatingIPPool, error) {
+	list, err := crdClient.GalaxyV1alpha1().FloatingIPPools().List(v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list floatingip pools: %v", err)
+	}
+	pools := make([]*v1alpha1.FloatingIPPool, len(list.Items))
+	for i := range list.Items {
+		pools[i] = &list.Items[i]
+	}
+	return pools, nil
+}
+
+// floatingIPPoolConfs returns floatingip configs of FloatingIPPool objects in the order of configKeys
+func floatingIPPoolConfs(conf *schedulerplugin.Conf, pools []*v1alpha1.FloatingIPPool) [][]*floatingip.FloatingIP {
+	confs := schedulerplugin.FloatingIPPoolConfs(conf, pools)
+	ipTypes := schedulerplugin.IPTypes(conf)
+	poolConfs := make([][]*floatingip.FloatingIP, len(ipTypes))
+	for i, ipType := range ipTypes {
+		poolConfs[i] = confs[ipType]
+	}
+	return poolConfs
+}
+
+// Migrate makes allocated and excluded ips of dst the same as src, keeping their keys, policies, attrs, update
+// times and exclusion. Both ipams should have been configured with the same pool. It returns the number of ips
+// migrated.
+func Migrate(src, dst floatingip.IPAM) (int, error) {
+	srcIPs, err := migratedIPs(src)
+	if err != nil {
+		return 0, err
+	}
+	dstIPs, err := migratedIPs(dst)
+	if err != nil {
+		return 0, err
+	}
+	var fips []database.FloatingIP
+	for _, fip := range srcIPs {
+		fips = append(fips, fip)
+	}
+	// release ips which are only allocated in dst
+	for ip, fip := range dstIPs {
+		if _, ok := srcIPs[ip]; !ok && fip.Key != "" {
+			fips = append(fips, database.FloatingIP{IP: fip.IP})
+		}
+	}
+	if err := dst.RestoreIPs(fips); err != nil {
+		return 0, err
+	}
+	for ip, fip := range srcIPs {
+		if fip.Excluded != dstIPs[ip].Excluded {
+			if err := dst.SetExcluded(fip.IP, fip.Excluded); err != nil {
+				return 0, fmt.Errorf("failed to set excluded of %s: %v", ip, err)
+			}
+		}
+	}
+	// include ips which are only excluded in dst
+	for ip, fip := range dstIPs {
+		if _, ok := srcIPs[ip]; !ok && fip.Excluded {
+			if err := dst.SetExcluded(fip.IP, false); err != nil {
+				return 0, fmt.Errorf("failed to set excluded of %s: %v", ip, err)
+			}
+		}
+	}
+	return len(srcIPs), nil
+}
+
+// Verify diffs allocated and excluded ips of the two ipams, it returns a line for each disagreed ip
+func Verify(src, dst floatingip.IPAM) ([]string, error) {
+	srcIPs, err := migratedIPs(src)
+	if err != nil {
+		return nil, err
+	}
+	dstIPs, err := migratedIPs(dst)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []string
+	for ip, fip := range srcIPs {
+		dstFip := dstIPs[ip]
+		if format(&fip) != format(&dstFip) {
+			diffs = append(diffs, fmt.Sprintf("%s: %s vs %s", ip, format(&fip), format(&dstFip)))
+		}
+	}
+	for ip, fip := range dstIPs {
+		if _, ok := srcIPs[ip]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: %s vs %s", ip, format(&database.FloatingIP{}), format(&fip)))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs, nil
+}
+
+// migratedIPs returns ip string to FloatingIP map of allocated or excluded ips
+func migratedIPs(ipam floatingip.IPAM) (map[string]database.FloatingIP, error) {
+	fips, err := floatingip.Stored(ipam)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", ipam.Name(), err)
+	}
+	migrated := make(map[string]database.FloatingIP)
+	for i := range fips {
+		if fips[i].Key != "" || fips[i].Excluded {
+			migrated[fips[i].IP.String()] = fips[i]
+		}
+	}
+	return migrated, nil
+}
+
+// format formats the fields to be migrated. Update time is compared in seconds as mysql and crd don't store
+// nanoseconds, and is ignored for unallocated ips as releasing doesn't keep it.
+func format(fip *database.FloatingIP) string {
+	if fip.Key == "" {
+		return fmt.Sprintf("unallocated excluded=%v", fip.Excluded)
+	}
+	return fmt.Sprintf("key=%s policy=%d attr=%s updatedAt=%d excluded=%v", fip.Key, fip.Policy, fip.Attr,
+		fip.UpdatedAt.Unix(), fip.Excluded)
+}
@@ -0,0 +1,160 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package migrate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	fakeGalaxyCli "tkestack.io/galaxy/pkg/ipam/client/clientset/versioned/fake"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/utils/database"
+)
+
+func configurePool(t *testing.T, ipam floatingip.IPAM) {
+	var conf struct {
+		Floatingips []*floatingip.FloatingIP `json:"floatingips"`
+	}
+	if err := json.Unmarshal([]byte(database.TestConfig), &conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.ConfigurePool(conf.Floatingips); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// #lizard forgives
+func TestMigrate(t *testing.T) {
+	crdClient := fakeGalaxyCli.NewSimpleClientset()
+	src := floatingip.NewCrdIPAM(crdClient, floatingip.InternalIp, nil)
+	configurePool(t, src)
+	dir, err := ioutil.TempDir("", "galaxy-ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	store, err := floatingip.OpenBoltStore(filepath.Join(dir, "ipam.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := floatingip.NewBoltIPAM(store, database.DefaultFloatingipTableName)
+	defer dst.Shutdown()
+	configurePool(t, dst)
+
+	if err := src.AllocateSpecificIP("pod1", net.ParseIP("10.49.27.205"), constant.ReleasePolicyNever,
+		`{"NodeName":"node1"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.AllocateSpecificIP("pod2", net.ParseIP("10.173.13.2"), constant.ReleasePolicyImmutable,
+		""); err != nil {
+		t.Fatal(err)
+	}
+	// this ip is only allocated in dst and should be released
+	if err := dst.AllocateSpecificIP("pod3", net.ParseIP("10.173.13.10"), constant.ReleasePolicyPodDelete,
+		""); err != nil {
+		t.Fatal(err)
+	}
+	// exclusion of both allocated and unallocated ips should be migrated
+	for _, ip := range []string{"10.173.13.2", "10.173.13.12"} {
+		if err := src.SetExcluded(net.ParseIP(ip), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// this ip is only excluded in dst and should be included
+	if err := dst.SetExcluded(net.ParseIP("10.173.13.11"), true); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := Verify(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 5 {
+		t.Fatalf("expect 5 diffs, got %v", diffs)
+	}
+	migrated, err := Migrate(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 3 {
+		t.Fatalf("expect 3 migrated ips, got %d", migrated)
+	}
+	if diffs, err = Verify(src, dst); err != nil || len(diffs) != 0 {
+		t.Fatalf("diffs %v, err %v", diffs, err)
+	}
+	srcFip, err := src.ByIP(net.ParseIP("10.49.27.205"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstFip, err := dst.ByIP(net.ParseIP("10.49.27.205"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dstFip.Key != "pod1" || dstFip.Attr != `{"NodeName":"node1"}` ||
+		dstFip.Policy != uint16(constant.ReleasePolicyNever) || !dstFip.UpdatedAt.Equal(srcFip.UpdatedAt) {
+		t.Fatalf("expect %+v, got %+v", srcFip, dstFip)
+	}
+	if fip, err := dst.ByIP(net.ParseIP("10.173.13.10")); err != nil || fip.Key != "" {
+		t.Fatalf("fip %+v, err %v", fip, err)
+	}
+	for ip, excluded := range map[string]bool{"10.173.13.2": true, "10.173.13.12": true, "10.173.13.11": false} {
+		if fip, err := dst.ByIP(net.ParseIP(ip)); err != nil || fip.Excluded != excluded {
+			t.Fatalf("expect %s excluded %v, fip %+v, err %v", ip, excluded, fip, err)
+		}
+	}
+	// verifying reads ipams which are not configured
+	unconfigured := floatingip.NewCrdIPAM(crdClient, floatingip.InternalIp, nil)
+	if diffs, err = Verify(unconfigured, dst); err != nil || len(diffs) != 0 {
+		t.Fatalf("diffs %v, err %v", diffs, err)
+	}
+}
+
+func TestCheckLeaderLease(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	if err := checkLeaderLease(client, resourcelock.EndpointsResourceLock); err != nil {
+		t.Fatal(err)
+	}
+	holdLeaderLease(t, client)
+	if err := checkLeaderLease(client, resourcelock.EndpointsResourceLock); err == nil {
+		t.Fatal("expect an error as the lease is held")
+	}
+}
+
+// holdLeaderLease creates the endpoints lock of galaxy-ipam held by another replica
+func holdLeaderLease(t *testing.T, client kubernetes.Interface) {
+	now := v1.Now()
+	record, err := json.Marshal(resourcelock.LeaderElectionRecord{HolderIdentity: "ipam1", LeaseDurationSeconds: 15,
+		AcquireTime: now, RenewTime: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoreV1().Endpoints("kube-system").Create(&corev1.Endpoints{ObjectMeta: v1.ObjectMeta{
+		Name: "galaxy-ipam", Namespace: "kube-system",
+		Annotations: map[string]string{resourcelock.LeaderElectionRecordAnnotationKey: string(record)},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+}
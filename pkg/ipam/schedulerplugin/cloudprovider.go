@@ -23,14 +23,19 @@ import (
 	glog "k8s.io/klog"
 	"tkestack.io/galaxy/pkg/ipam/cloudprovider/rpc"
 	"tkestack.io/galaxy/pkg/ipam/floatingip"
-	"tkestack.io/galaxy/pkg/utils/nets"
+	"tkestack.io/galaxy/pkg/ipam/metrics"
 )
 
 // cloudProviderAssignIP send assign ip req to cloud provider
-func (p *FloatingIPPlugin) cloudProviderAssignIP(req *rpc.AssignIPRequest) error {
+func (p *FloatingIPPlugin) cloudProviderAssignIP(req *rpc.AssignIPRequest) (err error) {
 	if p.cloudProvider == nil {
 		return nil
 	}
+	defer func() {
+		if err != nil {
+			metrics.CloudProviderErrors.WithLabelValues("AssignIP").Inc()
+		}
+	}()
 	reply, err := p.cloudProvider.AssignIP(req)
 	if err != nil {
 		return fmt.Errorf("cloud provider AssignIP reply err %v", err)
@@ -46,10 +51,15 @@ func (p *FloatingIPPlugin) cloudProviderAssignIP(req *rpc.AssignIPRequest) error
 }
 
 // cloudProviderUnAssignIP send unassign ip req to cloud provider
-func (p *FloatingIPPlugin) cloudProviderUnAssignIP(req *rpc.UnAssignIPRequest) error {
+func (p *FloatingIPPlugin) cloudProviderUnAssignIP(req *rpc.UnAssignIPRequest) (err error) {
 	if p.cloudProvider == nil {
 		return nil
 	}
+	defer func() {
+		if err != nil {
+			metrics.CloudProviderErrors.WithLabelValues("UnAssignIP").Inc()
+		}
+	}()
 	reply, err := p.cloudProvider.UnAssignIP(req)
 	if err != nil {
 		return fmt.Errorf("cloud provider UnAssignIP reply err %v", err)
@@ -84,18 +94,19 @@ func (p *FloatingIPPlugin) resyncCloudProviderIPs(ipam floatingip.IPAM, meta *re
 			continue
 		}
 		glog.Infof("UnAssignIP nodeName %s, ip %s, key %s during resync", attr.NodeName,
-			nets.IntToIP(obj.fip.IP).String(), key)
+			obj.fip.IP.String(), key)
 		if err := p.cloudProviderUnAssignIP(&rpc.UnAssignIPRequest{
 			NodeName:  attr.NodeName,
-			IPAddress: nets.IntToIP(obj.fip.IP).String(),
+			IPAddress: obj.fip.IP.String(),
 		}); err != nil {
 			// delete this record from allocatedIPs map to have a retry
 			delete(meta.allocatedIPs, key)
-			glog.Warningf("failed to unassign ip %s to %s: %v", nets.IntToIP(obj.fip.IP).String(), key, err)
+			glog.Warningf("failed to unassign ip %s to %s: %v", obj.fip.IP.String(), key, err)
 			continue
 		}
 		// for tapp and sts pod, we need to clean its node attr
-		if err := ipam.ReserveIP(key, key, getAttr("")); err != nil {
+		if err := floatingip.WithReason(ipam, "", "unassigned during resync").ReserveIP(key, key,
+			marshalAttr(Attr{TTL: attr.TTL})); err != nil {
 			glog.Errorf("failed to reserve %s ip: %v", key, err)
 		}
 	}
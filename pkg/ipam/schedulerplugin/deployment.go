@@ -18,6 +18,7 @@ package schedulerplugin
 
 import (
 	"fmt"
+	"time"
 
 	appv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -30,41 +31,47 @@ import (
 	"tkestack.io/galaxy/pkg/utils/keylock"
 )
 
-// unbindDpPod unbind deployment pod
-func (p *FloatingIPPlugin) unbindDpPod(pod *corev1.Pod, keyObj *util.KeyObj, policy constant.ReleasePolicy) error {
+// unbindDpPod unbind deployment pod and returns outcomes of its ips
+func (p *FloatingIPPlugin) unbindDpPod(pod *corev1.Pod, keyObj *util.KeyObj, policy constant.ReleasePolicy) ([]string,
+	error) {
 	key, prefixKey := keyObj.KeyInDB, keyObj.PoolPrefix()
 	dp, err := p.DeploymentLister.Deployments(keyObj.Namespace).Get(keyObj.AppName)
 	replicas := 0
 	if err != nil {
 		if !metaErrs.IsNotFound(err) {
-			return err
+			return nil, err
 		}
 	} else {
 		replicas = int(*dp.Spec.Replicas)
 	}
-	// if ipam or secondIPAM failed, we can depend on resync to release ip
-	if err := unbindDpPod(key, prefixKey, p.ipam, p.dpLockPool, replicas, policy, "unbinding pod"); err != nil {
-		return err
-	}
-	if p.enabledSecondIP(pod) {
-		return unbindDpPod(key, prefixKey, p.secondIPAM, p.dpLockPool, replicas, policy, "unbinding pod")
+	quarantine, attr := p.releaseQuarantine(), getPodAttr(pod, "")
+	var outcomes []string
+	// if ipam or extra ipams failed, we can depend on resync to release ip
+	for _, ipam := range append([]floatingip.IPAM{p.ipam}, p.extraIPAMs(pod)...) {
+		outcome, err := unbindDpPod(key, prefixKey, ipam, p.dpLockPool, replicas, policy, attr, quarantine,
+			"unbinding pod")
+		if err != nil {
+			return outcomes, err
+		}
+		outcomes = appendOutcome(outcomes, outcome)
 	}
-	return nil
+	return outcomes, nil
 }
 
-// unbindDpPod unbind deployment pod
+// unbindDpPod unbind deployment pod, attr is set to ips which are reserved. It returns what happened to the ip.
 func unbindDpPod(key, prefixKey string, ipam floatingip.IPAM, dpLockPool *keylock.Keylock, replicas int,
-	policy constant.ReleasePolicy, when string) error {
+	policy constant.ReleasePolicy, attr string, quarantine time.Duration, when string) (string, error) {
 	if policy == constant.ReleasePolicyPodDelete {
-		return releaseIP(ipam, key, fmt.Sprintf("%s %s", deletedAndIPMutablePod, when))
-	} else if policy == constant.ReleasePolicyNever {
+		return releaseIP(ipam, key, fmt.Sprintf("%s %s", deletedAndIPMutablePod, when), quarantine)
+	} else if policy == constant.ReleasePolicyNever || policy == constant.ReleasePolicyTTL {
+		// ips of ttl policy are released by resyncing once ttl expires
 		if key != prefixKey {
-			return reserveIP(key, prefixKey, ipam, fmt.Sprintf("never release policy %s", when))
+			return reserveIP(key, prefixKey, ipam, attr, fmt.Sprintf("never or ttl release policy %s", when))
 		}
-		return nil
+		return "", nil
 	}
 	if replicas == 0 {
-		return releaseIP(ipam, key, fmt.Sprintf("%s %s", deletedAndIPMutablePod, when))
+		return releaseIP(ipam, key, fmt.Sprintf("%s %s", deletedAndIPMutablePod, when), quarantine)
 	}
 	// locks the pool name if it is a pool
 	// locks the deployment app name if it isn't a pool
@@ -73,23 +80,24 @@ func unbindDpPod(key, prefixKey string, ipam floatingip.IPAM, dpLockPool *keyloc
 	defer dpLockPool.RawUnlock(lockIndex)
 	fips, err := ipam.ByPrefix(prefixKey)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// if num of fips is large than replicas, release exceeded part
 	if len(fips) > replicas {
-		return releaseIP(ipam, key, fmt.Sprintf("%s %s", deletedAndScaledDownDpPod, when))
+		return releaseIP(ipam, key, fmt.Sprintf("%s %s", deletedAndScaledDownDpPod, when), quarantine)
 	} else {
 		if key != prefixKey {
-			return reserveIP(key, prefixKey, ipam, fmt.Sprintf("allocated %d <= replicas %d %s", len(fips), replicas, when))
+			return reserveIP(key, prefixKey, ipam, attr, fmt.Sprintf("allocated %d <= replicas %d %s", len(fips),
+				replicas, when))
 		}
 	}
-	return nil
+	return "", nil
 }
 
 // getDpReplicas returns replicas, isPoolSizeDefined, error
 func (p *FloatingIPPlugin) getDpReplicas(keyObj *util.KeyObj) (int, bool, error) {
 	if keyObj.PoolName != "" {
-		pool, err := p.PoolLister.Pools("kube-system").Get(keyObj.PoolName)
+		pool, err := p.PoolLister.Pools(p.conf.PoolNamespace).Get(keyObj.PoolName)
 		if err == nil {
 			glog.V(4).Infof("pool %s size %d", pool.Name, pool.Size)
 			return pool.Size, true, nil
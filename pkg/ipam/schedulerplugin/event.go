@@ -17,6 +17,7 @@
 package schedulerplugin
 
 import (
+	"fmt"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -68,12 +69,16 @@ func (p *FloatingIPPlugin) loop(stop chan struct{}) {
 		case <-stop:
 			return
 		case event := <-p.unreleased:
-			if err := p.unbind(event.pod); err != nil {
+			if outcomes, err := p.unbind(event.pod); err == nil {
+				p.recordUnbound(event.pod, outcomes)
+			} else {
 				event.retryTimes++
 				glog.Warningf("unbind pod %s failed for %d times: %v", util.PodName(event.pod), event.retryTimes, err)
 				if event.retryTimes > 3 {
 					// leave it to resync to protect chan from explosion
 					glog.Errorf("abort unbind for pod %s, retried %d times: %v", util.PodName(event.pod), event.retryTimes, err)
+					p.recordPodEvent(event.pod, corev1.EventTypeWarning, eventReleaseFailed, fmt.Sprintf(
+						"Failed to release floating ips of the pod, left to resync: %v", err))
 				} else {
 					go func() {
 						// backoff time if required
@@ -33,9 +33,12 @@ import (
 	"tkestack.io/galaxy/pkg/api/galaxy/constant"
 	"tkestack.io/galaxy/pkg/api/galaxy/private"
 	"tkestack.io/galaxy/pkg/api/k8s/schedulerapi"
+	crd_clientset "tkestack.io/galaxy/pkg/ipam/client/clientset/versioned"
+	crdInformers "tkestack.io/galaxy/pkg/ipam/client/informers/externalversions/galaxy/v1alpha1"
 	"tkestack.io/galaxy/pkg/ipam/cloudprovider"
 	"tkestack.io/galaxy/pkg/ipam/cloudprovider/rpc"
 	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/metrics"
 	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
 	"tkestack.io/galaxy/pkg/utils/database"
 	"tkestack.io/galaxy/pkg/utils/keylock"
@@ -43,57 +46,173 @@ import (
 
 // FloatingIPPlugin Allocates Floating IP for deployments
 type FloatingIPPlugin struct {
-	ipam, secondIPAM floatingip.IPAM
+	ipam floatingip.IPAM
+	// namedIPAMs are ipams which pods select by name, including the second ipam
+	namedIPAMs map[string]*namedIPAM
+	// ipv6IPAM allocates the ipv6 ip of dual-stack pods
+	ipv6IPAM floatingip.IPAM
 	// node name to subnet cache
 	nodeSubnet     map[string]*net.IPNet
 	nodeSubnetLock sync.Mutex
 	sync.Mutex
 	*PluginFactoryArgs
-	lastIPConf, lastSecondIPConf string
-	conf                         *Conf
-	unreleased                   chan *releaseEvent
-	hasSecondIPConf              atomic.Value
-	db                           *database.DBRecorder
-	cloudProvider                cloudprovider.CloudProvider
+	lastIPConf, lastIPv6Conf string
+	lastQuotaConf            string
+	conf                     *Conf
+	unreleased               chan *releaseEvent
+	hasIPv6Conf              atomic.Value
+	// namespace to max number of floating ips it can hold
+	namespaceQuotas atomic.Value
+	// makes checking namespace quota and allocating ips of the namespace atomic during bind
+	quotaLockPool *keylock.Keylock
+	db            *database.DBRecorder
+	cloudProvider cloudprovider.CloudProvider
 	// protect unbind immutable deployment pod
 	dpLockPool *keylock.Keylock
+	// notifies syncing floatingip config from FloatingIPPool objects
+	poolSync chan struct{}
+	// last valid floatingip config of FloatingIPPool objects by name, only accessed when syncing pools
+	lastPoolConfs map[string]appliedPool
+	// notifies reconciling Pool objects
+	poolReconcile chan struct{}
+	// names of deleted Pool objects whose ips are not released yet
+	deletedPools     sets.String
+	deletedPoolsLock sync.Mutex
+	// history records changes of ips of all ipams, nil if disabled
+	history floatingip.History
 }
 
 // NewFloatingIPPlugin creates FloatingIPPlugin
 func NewFloatingIPPlugin(conf Conf, args *PluginFactoryArgs) (*FloatingIPPlugin, error) {
-	conf.validate()
+	conf.Validate()
 	glog.Infof("floating ip config: %v", conf)
+	if err := checkNetworks(&conf); err != nil {
+		return nil, err
+	}
 	plugin := &FloatingIPPlugin{
 		nodeSubnet:        make(map[string]*net.IPNet),
 		PluginFactoryArgs: args,
 		conf:              &conf,
 		unreleased:        make(chan *releaseEvent, 100),
 		dpLockPool:        keylock.NewKeylock(),
+		quotaLockPool:     keylock.NewKeylock(),
+		poolSync:          make(chan struct{}, 1),
+		poolReconcile:     make(chan struct{}, 1),
+		deletedPools:      sets.NewString(),
+	}
+	var err error
+	var namedIPAMs map[string]floatingip.IPAM
+	plugin.ipam, plugin.ipv6IPAM, namedIPAMs, plugin.db, err = NewIPAMs(&conf, conf.StorageDriver,
+		args.CrdClient, args.FloatingIPInformer)
+	if err != nil {
+		return nil, err
+	}
+	plugin.namedIPAMs = make(map[string]*namedIPAM, len(namedIPAMs))
+	for _, c := range conf.NamedIPAMs {
+		plugin.namedIPAMs[c.Name] = newNamedIPAM(namedIPAMs[c.Name], c)
 	}
-	if conf.StorageDriver == "mysql" {
-		db := database.NewDBRecorder(conf.DBConfig)
-		if err := db.Run(); err != nil {
+	if conf.HistoryRetentionDays > 0 {
+		if err := plugin.enableHistory(); err != nil {
 			return nil, err
 		}
-		plugin.db = db
-		plugin.ipam = floatingip.NewIPAM(db)
-		plugin.secondIPAM = floatingip.NewIPAMWithTableName(db, database.SecondFloatingipTableName)
-	} else if conf.StorageDriver == "k8s-crd" {
-		plugin.ipam = floatingip.NewCrdIPAM(args.CrdClient, floatingip.InternalIp)
-		plugin.secondIPAM = floatingip.NewCrdIPAM(args.CrdClient, floatingip.ExternalIp)
-	} else {
-		return nil, fmt.Errorf("unknown storage driver %s", conf.StorageDriver)
 	}
-	plugin.hasSecondIPConf.Store(false)
+	plugin.hasIPv6Conf.Store(false)
+	quotas := map[string]int{}
+	for ns, quota := range conf.NamespaceQuotas {
+		quotas[ns] = quota
+	}
+	plugin.namespaceQuotas.Store(quotas)
 	if conf.CloudProviderGRPCAddr != "" {
 		plugin.cloudProvider = cloudprovider.NewGRPCCloudProvider(conf.CloudProviderGRPCAddr)
 	}
+	if conf.UseFloatingIPPoolCRD {
+		if args.FloatingIPPoolInformer == nil {
+			return nil, fmt.Errorf("floatingip pool informer is required if useFloatingIPPoolCRD is true")
+		}
+		plugin.addFloatingIPPoolEventHandler()
+	}
+	if args.PoolInformer != nil {
+		plugin.addPoolEventHandler()
+	}
+	if args.NodeInformer != nil {
+		plugin.addNodeEventHandler()
+	}
+	if err := plugin.registerOwnerResolvers(); err != nil {
+		return nil, err
+	}
 	return plugin, nil
 }
 
-// Init retrieves floatingips from json config or config map and calls ipam to update
+// NewIPAMs creates the ipam, ipv6 ipam and named ipams of the storage driver, conf should have been validated.
+// DBRecorder is returned if driver is mysql. fipInformer is optional for k8s-crd driver to keep its caches up to date.
+func NewIPAMs(conf *Conf, driver string, crdClient crd_clientset.Interface,
+	fipInformer crdInformers.FloatingIPInformer) (ipam, ipv6IPAM floatingip.IPAM,
+	namedIPAMs map[string]floatingip.IPAM, db *database.DBRecorder, err error) {
+	strategy, err := floatingip.ParseStrategy(conf.AllocationStrategy)
+	if err != nil {
+		return
+	}
+	if err = checkNamedIPAMs(conf); err != nil {
+		return
+	}
+	namedIPAMs = make(map[string]floatingip.IPAM, len(conf.NamedIPAMs))
+	switch driver {
+	case "mysql":
+		db = database.NewDBRecorder(conf.DBConfig)
+		if err = db.Run(); err != nil {
+			return
+		}
+		ipam = floatingip.NewIPAM(db)
+		ipv6IPAM = floatingip.NewIPv6IPAM(db)
+		for _, named := range conf.NamedIPAMs {
+			namedIPAMs[named.Name] = floatingip.NewIPAMWithTableName(db, named.Table)
+		}
+	case "k8s-crd":
+		ipam = floatingip.NewCrdIPAM(crdClient, floatingip.InternalIp, fipInformer)
+		ipv6IPAM = floatingip.NewCrdIPAM(crdClient, floatingip.IPv6Ip, fipInformer)
+		for _, named := range conf.NamedIPAMs {
+			namedIPAMs[named.Name] = floatingip.NewCrdIPAMWithIPType(crdClient, named.IPType, fipInformer)
+		}
+	case "bolt":
+		store, e := floatingip.OpenBoltStore(conf.BoltDBPath)
+		if e != nil {
+			err = e
+			return
+		}
+		ipam = floatingip.NewBoltIPAM(store, database.DefaultFloatingipTableName)
+		ipv6IPAM = floatingip.NewBoltIPAM(store, database.IPv6FloatingipTableName)
+		for _, named := range conf.NamedIPAMs {
+			namedIPAMs[named.Name] = floatingip.NewBoltIPAM(store, named.Table)
+		}
+	default:
+		err = fmt.Errorf("unknown storage driver %s", driver)
+		return
+	}
+	ipam.SetStrategy(strategy)
+	ipv6IPAM.SetStrategy(strategy)
+	for _, i := range namedIPAMs {
+		i.SetStrategy(strategy)
+	}
+	return
+}
+
+// Init retrieves floatingips from FloatingIPPool objects, json config or config map and calls ipam to update
 func (p *FloatingIPPlugin) Init() error {
-	if len(p.conf.FloatingIPs) > 0 {
+	if p.conf.UseFloatingIPPoolCRD {
+		glog.Infof("fetching floatingips from floatingip pools")
+		if err := wait.PollInfinite(time.Second, func() (done bool, err error) {
+			if !p.FloatingIPPoolInformer.Informer().HasSynced() {
+				glog.V(3).Infof("the floatingip pool store has not been synced yet")
+				return false, nil
+			}
+			if err := p.syncFloatingIPPools(); err != nil {
+				glog.Warning(err)
+			}
+			return p.lastIPConf != "", nil
+		}); err != nil {
+			return fmt.Errorf("failed to get floatingip config from floatingip pools: %v", err)
+		}
+	} else if len(p.conf.FloatingIPs) > 0 {
 		if err := p.ipam.ConfigurePool(p.conf.FloatingIPs); err != nil {
 			return err
 		}
@@ -119,23 +238,36 @@ func (p *FloatingIPPlugin) Init() error {
 
 // Run starts resyncing pod routine
 func (p *FloatingIPPlugin) Run(stop chan struct{}) {
-	if len(p.conf.FloatingIPs) == 0 {
+	if len(p.conf.FloatingIPs) == 0 || p.conf.UseFloatingIPPoolCRD {
 		go wait.Until(func() {
 			if _, err := p.updateConfigMap(); err != nil {
 				glog.Warning(err)
 			}
 		}, time.Minute, stop)
 	}
+	if p.conf.UseFloatingIPPoolCRD {
+		go p.poolSyncLoop(stop)
+	}
+	if p.PoolInformer != nil {
+		go p.poolReconcileLoop(stop)
+		// keeps status of pools up to date as ips of pools are bound and unbound
+		go wait.Until(p.enqueuePoolReconcile, poolReconcileInterval, stop)
+	}
+	go wait.Until(p.releaseExpiredQuarantine, quarantineCheckInterval, stop)
+	if p.history != nil {
+		go wait.Until(p.pruneHistory, historyPruneInterval, stop)
+	}
 	go wait.Until(func() {
-		if err := p.resyncPod(p.ipam); err != nil {
-			glog.Warningf("[%s] %v", p.ipam.Name(), err)
-		}
-		if p.hasSecondIPConf.Load().(bool) {
-			if err := p.resyncPod(p.secondIPAM); err != nil {
-				glog.Warningf("[%s] %v", p.secondIPAM.Name(), err)
+		for _, ipam := range p.configuredIPAMs() {
+			if err := p.resyncPod(ipam); err != nil {
+				glog.Warningf("[%s] %v", ipam.Name(), err)
 			}
 		}
 		p.syncPodIPsIntoDB()
+		if p.conf.UseFloatingIPPoolCRD {
+			// refresh usage in status of floatingip pools
+			p.enqueuePoolSync()
+		}
 	}, time.Duration(p.conf.ResyncInterval)*time.Minute, stop)
 	for i := 0; i < 5; i++ {
 		go p.loop(stop)
@@ -147,26 +279,59 @@ func (p *FloatingIPPlugin) Run(stop chan struct{}) {
 func (p *FloatingIPPlugin) updateConfigMap() (bool, error) {
 	cm, err := p.Client.CoreV1().ConfigMaps(p.conf.ConfigMapNamespace).Get(p.conf.ConfigMapName, v1.GetOptions{})
 	if err != nil {
+		if p.conf.UseFloatingIPPoolCRD && metaErrs.IsNotFound(err) {
+			// configmap is optional if floatingips are configured by FloatingIPPool objects
+			return false, nil
+		}
 		return false, fmt.Errorf("failed to get floatingip configmap %s_%s: %v", p.conf.ConfigMapName,
 			p.conf.ConfigMapNamespace, err)
 	}
+	if !p.conf.UseFloatingIPPoolCRD {
+		if err := p.updateIPAMConfFromConfigMap(cm); err != nil {
+			return false, err
+		}
+	}
+	if quotaVal, ok := cm.Data[p.conf.NamespaceQuotaKey]; ok {
+		if err = p.ensureNamespaceQuotas(quotaVal); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// updateIPAMConfFromConfigMap syncs ipam config with floatingips of configmap
+func (p *FloatingIPPlugin) updateIPAMConfFromConfigMap(cm *corev1.ConfigMap) error {
 	val, ok := cm.Data[p.conf.FloatingIPKey]
 	if !ok {
-		return false, fmt.Errorf("configmap %s_%s doesn't have a key floatingips", p.conf.ConfigMapName,
+		return fmt.Errorf("configmap %s_%s doesn't have a key floatingips", p.conf.ConfigMapName,
 			p.conf.ConfigMapNamespace)
 	}
+	lastIPConf := p.lastIPConf
 	if err := ensureIPAMConf(p.ipam, &p.lastIPConf, val); err != nil {
-		return false, fmt.Errorf("[%s] %v", p.ipam.Name(), err)
+		return fmt.Errorf("[%s] %v", p.ipam.Name(), err)
 	}
-	secondVal, ok := cm.Data[p.conf.SecondFloatingIPKey]
-	if !ok {
-		return true, nil
+	if p.lastIPConf != lastIPConf {
+		// routable subnets may change
+		p.resetNodeSubnet()
+	}
+	for _, c := range p.conf.NamedIPAMs {
+		namedVal, ok := cm.Data[c.ConfigKey]
+		if !ok {
+			continue
+		}
+		named := p.namedIPAMs[c.Name]
+		if err := ensureIPAMConf(named.ipam, &named.lastConf, namedVal); err != nil {
+			return fmt.Errorf("[%s] %v", named.ipam.Name(), err)
+		}
+		named.hasConf.Store(named.lastConf != "")
 	}
-	if err = ensureIPAMConf(p.secondIPAM, &p.lastSecondIPConf, secondVal); err != nil {
-		return false, fmt.Errorf("[%s] %v", p.secondIPAM.Name(), err)
+	if ipv6Val, ok := cm.Data[p.conf.IPv6FloatingIPKey]; ok {
+		if err := ensureIPAMConf(p.ipv6IPAM, &p.lastIPv6Conf, ipv6Val); err != nil {
+			return fmt.Errorf("[%s] %v", p.ipv6IPAM.Name(), err)
+		}
+		p.hasIPv6Conf.Store(p.lastIPv6Conf != "")
 	}
-	p.hasSecondIPConf.Store(p.lastSecondIPConf != "")
-	return true, nil
+	return nil
 }
 
 // Filter marks nodes which have no available ips as FailedNodes
@@ -180,8 +345,19 @@ func (p *FloatingIPPlugin) Filter(pod *corev1.Pod, nodes []corev1.Node) ([]corev
 	filteredNodes := []corev1.Node{}
 	subnetSet, err := p.getSubnet(pod)
 	if err != nil {
+		p.recordPodEvent(pod, corev1.EventTypeWarning, eventFilterFailed, err.Error())
+		switch err.(type) {
+		case *quotaExceededError, *specificIPError, *poolNamespaceError, *ipamsError:
+			glog.Warningf("pod %s_%s: %v", pod.Namespace, pod.Name, err)
+			for i := range nodes {
+				failedNodesMap[nodes[i].Name] = err.Error()
+			}
+			return filteredNodes, failedNodesMap, nil
+		}
 		return filteredNodes, failedNodesMap, err
 	}
+	// subnets of nodes which fail because of no ips left
+	noFIPSubnets := sets.NewString()
 	for i := range nodes {
 		nodeName := nodes[i].Name
 		subnet, err := p.getNodeSubnet(&nodes[i])
@@ -193,8 +369,12 @@ func (p *FloatingIPPlugin) Filter(pod *corev1.Pod, nodes []corev1.Node) ([]corev
 			filteredNodes = append(filteredNodes, nodes[i])
 		} else {
 			failedNodesMap[nodeName] = "FloatingIPPlugin:NoFIPLeft"
+			noFIPSubnets.Insert(subnet.String())
 		}
 	}
+	if len(filteredNodes) == 0 && noFIPSubnets.Len() > 0 {
+		p.recordNoFIPLeft(pod, len(nodes), noFIPSubnets)
+	}
 	if bool(glog.V(4)) {
 		nodeNames := make([]string, len(filteredNodes))
 		for i := range filteredNodes {
@@ -207,17 +387,37 @@ func (p *FloatingIPPlugin) Filter(pod *corev1.Pod, nodes []corev1.Node) ([]corev
 
 // #lizard forgives
 func (p *FloatingIPPlugin) getSubnet(pod *corev1.Pod) (sets.String, error) {
+	if err := p.checkIPAMs(pod); err != nil {
+		return nil, err
+	}
 	keyObj := util.FormatKey(pod)
+	if err := p.reclaimQuarantinedIPs(pod, keyObj.KeyInDB); err != nil {
+		return nil, err
+	}
+	specificIP, err := getSpecificIP(pod)
+	if err != nil {
+		return nil, err
+	}
+	if specificIP != nil {
+		// the specific ip may be reserved by the pool, so check the pool before it
+		if err := p.checkPoolNamespace(keyObj); err != nil {
+			return nil, err
+		}
+		return p.getSpecificIPSubnet(keyObj, specificIP)
+	}
 	// first check if exists an already allocated ip for this pod
 	subnets, err := p.ipam.QueryRoutableSubnetByKey(keyObj.KeyInDB)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query by key %s: %v", keyObj.KeyInDB, err)
 	}
 	if len(subnets) > 0 {
-		// assure second IPAM gets the same subnets
+		// assure extra ipams get the same subnets
 		glog.V(3).Infof("%s already have an allocated ip in subnets %v", keyObj.KeyInDB, subnets)
 		return sets.NewString(subnets...), nil
 	}
+	if err := p.checkPoolNamespace(keyObj); err != nil {
+		return nil, err
+	}
 	policy := parseReleasePolicy(&pod.ObjectMeta)
 	var replicas int
 	var isPoolSizeDefined bool
@@ -235,14 +435,28 @@ func (p *FloatingIPPlugin) getSubnet(pod *corev1.Pod) (sets.String, error) {
 	if err != nil {
 		return nil, fmt.Errorf("[%s] %v", p.ipam.Name(), err)
 	}
+	// the number of new ips, ips reserved for the deployment are already counted in the quota of the namespace
+	var newIPs int
+	if !reserve {
+		newIPs++
+	}
 	subnetSet := sets.NewString(subnets...)
-	if p.enabledSecondIP(pod) {
-		secondSubnets, reserve2, err := getAvailableSubnet(p.secondIPAM, keyObj, policy, replicas, isPoolSizeDefined)
+	extraIPAMs := p.extraIPAMs(pod)
+	for _, ipam := range extraIPAMs {
+		extraSubnets, extraReserve, err := getAvailableSubnet(ipam, keyObj, policy, replicas, isPoolSizeDefined)
 		if err != nil {
-			return nil, fmt.Errorf("[%s] %v", p.secondIPAM.Name(), err)
+			return nil, fmt.Errorf("[%s] %v", ipam.Name(), err)
+		}
+		subnetSet = subnetSet.Intersection(sets.NewString(extraSubnets...))
+		reserve = reserve || extraReserve
+		if !extraReserve {
+			newIPs++
+		}
+	}
+	if newIPs > 0 {
+		if err := p.checkNamespaceQuota(pod.Namespace, newIPs); err != nil {
+			return nil, err
 		}
-		subnetSet = subnetSet.Intersection(sets.NewString(secondSubnets...))
-		reserve = reserve || reserve2
 	}
 	if (reserve || isPoolSizeDefined) && subnetSet.Len() > 0 {
 		// Since bind is in a different goroutine than filter in scheduler, we can't ensure this pod got binded
@@ -250,23 +464,20 @@ func (p *FloatingIPPlugin) getSubnet(pod *corev1.Pod) (sets.String, error) {
 		// So we'd better do the allocate in filter for reserve situation.
 		reserveSubnet := subnetSet.List()[0]
 		subnetSet = sets.NewString(reserveSubnet)
-		p.allocateDuringFilter(keyObj, p.enabledSecondIP(pod), reserve, isPoolSizeDefined, reserveSubnet, policy)
+		p.allocateDuringFilter(keyObj, extraIPAMs, reserve, isPoolSizeDefined, reserveSubnet, policy)
 	}
 	return subnetSet, nil
 }
 
-func (p *FloatingIPPlugin) allocateDuringFilter(keyObj *util.KeyObj, enabledSecondIP, reserve, isPoolSizeDefined bool,
-	reserveSubnet string, policy constant.ReleasePolicy) error {
+func (p *FloatingIPPlugin) allocateDuringFilter(keyObj *util.KeyObj, extraIPAMs []floatingip.IPAM, reserve,
+	isPoolSizeDefined bool, reserveSubnet string, policy constant.ReleasePolicy) error {
 	// we can't get nodename during filter, update attr on bind
 	attr := getAttr("")
+	ipams := append([]floatingip.IPAM{p.ipam}, extraIPAMs...)
 	if reserve {
-		if err := allocateInSubnetWithKey(p.ipam, keyObj.PoolPrefix(), keyObj.KeyInDB, reserveSubnet, policy, attr,
-			"filter"); err != nil {
-			return err
-		}
-		if enabledSecondIP {
-			if err := allocateInSubnetWithKey(p.secondIPAM, keyObj.PoolPrefix(), keyObj.KeyInDB, reserveSubnet, policy,
-				attr, "filter"); err != nil {
+		for _, ipam := range ipams {
+			if err := allocateInSubnetWithKey(ipam, keyObj.PoolPrefix(), keyObj.KeyInDB, reserveSubnet, policy, attr,
+				"filter"); err != nil {
 				return err
 			}
 		}
@@ -276,11 +487,8 @@ func (p *FloatingIPPlugin) allocateDuringFilter(keyObj *util.KeyObj, enabledSeco
 		if err != nil {
 			return err
 		}
-		if err := allocateInSubnet(p.ipam, keyObj.KeyInDB, ipNet, policy, attr, "filter"); err != nil {
-			return err
-		}
-		if enabledSecondIP {
-			if err := allocateInSubnet(p.secondIPAM, keyObj.KeyInDB, ipNet, policy, attr, "filter"); err != nil {
+		for _, ipam := range ipams {
+			if _, err := allocateInSubnet(ipam, keyObj.KeyInDB, ipNet, policy, attr, "filter"); err != nil {
 				return err
 			}
 		}
@@ -288,43 +496,157 @@ func (p *FloatingIPPlugin) allocateDuringFilter(keyObj *util.KeyObj, enabledSeco
 	return nil
 }
 
-// Prioritize can score each node, currently it does nothing
+// Prioritize scores nodes by the number of unallocated ips of their subnets so that large subnets fill last. Nodes
+// whose subnets hold ips reusable by the pod get the max score.
 func (p *FloatingIPPlugin) Prioritize(pod *corev1.Pod, nodes []corev1.Node) (*schedulerapi.HostPriorityList, error) {
 	list := &schedulerapi.HostPriorityList{}
 	if !p.hasResourceName(&pod.Spec) {
 		return list, nil
 	}
-	//TODO
+	keyObj := util.FormatKey(pod)
+	var reusePrefix string
+	if keyObj.Deployment() && parseReleasePolicy(&pod.ObjectMeta) != constant.ReleasePolicyPodDelete {
+		reusePrefix = keyObj.PoolPrefix()
+	}
+	reusableSubnets, err := queryReusableSubnets(p.ipam, keyObj.KeyInDB, reusePrefix)
+	if err != nil {
+		return list, err
+	}
+	freeIPs, err := countFreeIPs(append([]floatingip.IPAM{p.ipam}, p.extraIPAMs(pod)...))
+	if err != nil {
+		return list, err
+	}
+	var maxFree int
+	for _, free := range freeIPs {
+		if free > maxFree {
+			maxFree = free
+		}
+	}
+	for i := range nodes {
+		var score int
+		if subnet, err := p.getNodeSubnet(&nodes[i]); err != nil {
+			glog.V(4).Infof("failed to get subnet of node %s: %v", nodes[i].Name, err)
+		} else if reusableSubnets.Has(subnet.String()) {
+			score = schedulerapi.MaxPriority
+		} else if maxFree > 0 {
+			// leave the max score to nodes having reusable ips
+			score = freeIPs[subnet.String()] * (schedulerapi.MaxPriority - 1) / maxFree
+		}
+		*list = append(*list, schedulerapi.HostPriority{Host: nodes[i].Name, Score: score})
+	}
+	glog.V(5).Infof("prioritized nodes %v for pod %s", *list, keyObj.KeyInDB)
 	return list, nil
 }
 
+// queryReusableSubnets returns subnets of ips allocated to key or reserved by reusePrefix if it is not empty
+func queryReusableSubnets(ipam floatingip.IPAM, key, reusePrefix string) (sets.String, error) {
+	subnets, err := ipam.QueryRoutableSubnetByKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to query by key %s: %v", ipam.Name(), key, err)
+	}
+	subnetSet := sets.NewString(subnets...)
+	if reusePrefix == "" {
+		return subnetSet, nil
+	}
+	fips, err := ipam.ByPrefix(reusePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to query by prefix %s: %v", ipam.Name(), reusePrefix, err)
+	}
+	for i := range fips {
+		if fips[i].Key == reusePrefix {
+			subnetSet.Insert(fips[i].Subnet)
+		}
+	}
+	return subnetSet, nil
+}
+
+// countFreeIPs returns the number of unallocated ips of each routable subnet. If there are multiple ipams, it is the
+// minimum of them as a pod needs an ip from each of them.
+func countFreeIPs(ipams []floatingip.IPAM) (map[string]int, error) {
+	var freeIPs map[string]int
+	for _, ipam := range ipams {
+		fips, err := ipam.ByPrefix("")
+		if err != nil {
+			return nil, fmt.Errorf("[%s] failed to query ips: %v", ipam.Name(), err)
+		}
+		free := map[string]int{}
+		for i := range fips {
+			if fips[i].Key == "" && !fips[i].Excluded {
+				free[fips[i].Subnet]++
+			}
+		}
+		if freeIPs == nil {
+			freeIPs = free
+			continue
+		}
+		for subnet, num := range freeIPs {
+			if free[subnet] < num {
+				freeIPs[subnet] = free[subnet]
+			}
+		}
+	}
+	return freeIPs, nil
+}
+
+// allocateIP reuses the ip of key or allocates a new one and assigns it to the node. The returned allocation records
+// what has been done to the ip so far even if it fails, which should be undone if binding fails.
 func (p *FloatingIPPlugin) allocateIP(ipam floatingip.IPAM, key string, nodeName string,
-	pod *corev1.Pod) (*constant.IPInfo, error) {
+	pod *corev1.Pod) (*constant.IPInfo, *allocation, error) {
 	var how string
 	ipInfo, err := ipam.First(key)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query floating ip by key %s: %v", key, err)
+		return nil, nil, fmt.Errorf("failed to query floating ip by key %s: %v", key, err)
+	}
+	var specificIP net.IP
+	// specific ip annotation applies to the ip of the first ipam only
+	if ipam == p.ipam {
+		if specificIP, err = getSpecificIP(pod); err != nil {
+			return nil, nil, err
+		}
 	}
 	started := time.Now()
 	policy := parseReleasePolicy(&pod.ObjectMeta)
-	attr := getAttr(nodeName)
+	attr := getPodAttr(pod, nodeName)
+	var alloc *allocation
 	if ipInfo != nil {
+		if specificIP != nil && !specificIP.Equal(ipInfo.IPInfo.IP.IP) {
+			return nil, nil, fmt.Errorf("%s holds ip %s other than the specified ip %s", key,
+				ipInfo.IPInfo.IP.IP.String(), specificIP.String())
+		}
 		how = "reused"
+		alloc = &allocation{ipam: ipam, key: key, ip: ipInfo.IPInfo.IP.IP, nodeName: nodeName, reused: true,
+			policy: constant.ReleasePolicy(ipInfo.FIP.Policy), attr: ipInfo.FIP.Attr}
 	} else {
 		subnet, err := p.queryNodeSubnet(nodeName)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		if err := allocateInSubnet(ipam, key, subnet, policy, attr, "bind"); err != nil {
-			return nil, err
+		unlock := p.lockNamespaceQuota(pod.Namespace)
+		// pods of the namespace which passed filter may be bound concurrently, so recheck quota under its lock
+		err = p.recheckNamespaceQuota(ipam, pod.Namespace, specificIP)
+		if err == nil && specificIP != nil {
+			alloc, err = p.allocateSpecificIP(ipam, util.FormatKey(pod), specificIP, subnet, policy, attr)
+		} else if err == nil {
+			var ip net.IP
+			if ip, err = allocateInSubnet(ipam, key, subnet, policy, attr, "bind"); err == nil {
+				alloc = &allocation{ipam: ipam, key: key, ip: ip, nodeName: nodeName}
+			} else if err == floatingip.ErrNoEnoughIP {
+				p.recordPodEvent(pod, corev1.EventTypeWarning, eventNoFIPLeft, fmt.Sprintf(
+					"[%s] No floating ip left in subnet %s of node %s", ipam.Name(), subnet.String(), nodeName))
+			}
+		}
+		unlock()
+		if err != nil {
+			return nil, nil, err
 		}
 		how = "allocated"
+		alloc.nodeName = nodeName
 		ipInfo, err = ipam.First(key)
 		if err != nil {
-			return nil, fmt.Errorf("failed to query floating ip by key %s: %v", key, err)
+			return nil, alloc, fmt.Errorf("failed to query floating ip by key %s: %v", key, err)
 		}
 		if ipInfo == nil {
-			return nil, fmt.Errorf("nil floating ip for key %s: %v", key, err)
+			return nil, alloc, fmt.Errorf("nil floating ip for key %s: %v", key, err)
 		}
 	}
 	glog.Infof("AssignIP nodeName %s, ip %s, key %s", nodeName, ipInfo.IPInfo.IP.IP.String(), key)
@@ -332,22 +654,33 @@ func (p *FloatingIPPlugin) allocateIP(ipam floatingip.IPAM, key string, nodeName
 		NodeName:  nodeName,
 		IPAddress: ipInfo.IPInfo.IP.IP.String(),
 	}); err != nil {
-		// do not rollback allocated ip
-		return nil, fmt.Errorf("failed to assign ip %s to %s: %v", ipInfo.IPInfo.IP.IP.String(), key, err)
+		p.recordPodEvent(pod, corev1.EventTypeWarning, eventCloudProviderAssignIP, fmt.Sprintf(
+			"[%s] Failed to assign ip %s to node %s: %v", ipam.Name(), ipInfo.IPInfo.IP.IP.String(), nodeName, err))
+		return nil, alloc, fmt.Errorf("failed to assign ip %s to %s: %v", ipInfo.IPInfo.IP.IP.String(), key, err)
 	}
+	// a reused ip which has been assigned to the node before should stay assigned on undo
+	alloc.assigned = !alloc.reused || alloc.attr != attr
 	if how == "reused" {
 		glog.Infof("pod %s reused %s, updating policy to %v attr %s", key, ipInfo.IPInfo.IP.String(), policy, attr)
-		if err := ipam.UpdatePolicy(key, ipInfo.IPInfo.IP.IP, policy, attr); err != nil {
-			return nil, fmt.Errorf("failed to update floating ip release policy: %v", err)
+		if err := floatingip.WithReason(ipam, floatingip.HistoryReuse, "bind").UpdatePolicy(key, ipInfo.IPInfo.IP.IP,
+			policy, attr); err != nil {
+			return nil, alloc, fmt.Errorf("failed to update floating ip release policy: %v", err)
 		}
 	}
 	glog.Infof("[%s] started at %d %s ip %s, policy %v, attr %s for %s", ipam.Name(), started.UnixNano(), how,
 		ipInfo.IPInfo.IP.String(), policy, attr, key)
-	return &ipInfo.IPInfo, nil
+	metrics.IPAllocations.WithLabelValues(ipam.Name(), how).Inc()
+	reason, verb := eventAllocated, "Allocated"
+	if how == "reused" {
+		reason, verb = eventReused, "Reused"
+	}
+	p.recordPodEvent(pod, corev1.EventTypeNormal, reason, fmt.Sprintf("[%s] %s ip %s on node %s", ipam.Name(), verb,
+		ipInfo.IPInfo.IP.IP.String(), nodeName))
+	return &ipInfo.IPInfo, alloc, nil
 }
 
-// Bind binds a new floatingip or reuse an old one to pod
-func (p *FloatingIPPlugin) Bind(args *schedulerapi.ExtenderBindingArgs) error {
+// Bind binds a new floatingip or reuse an old one to pod. If it fails, ips allocated or reused by it are rolled back.
+func (p *FloatingIPPlugin) Bind(args *schedulerapi.ExtenderBindingArgs) (err error) {
 	pod, err := p.PluginFactoryArgs.PodLister.Pods(args.PodNamespace).Get(args.PodName)
 	if err != nil {
 		return fmt.Errorf("failed to find pod %s: %v", util.Join(args.PodName, args.PodNamespace), err)
@@ -358,19 +691,32 @@ func (p *FloatingIPPlugin) Bind(args *schedulerapi.ExtenderBindingArgs) error {
 		return fmt.Errorf("pod which doesn't want floatingip have been sent to plugin")
 	}
 	keyObj := util.FormatKey(pod)
-	ipInfo, err := p.allocateIP(p.ipam, keyObj.KeyInDB, args.Node, pod)
+	var allocations []*allocation
+	defer func() {
+		if err != nil && len(allocations) > 0 {
+			p.rollbackBind(pod, allocations, err)
+		}
+	}()
+	ipInfo, alloc, err := p.allocateIP(p.ipam, keyObj.KeyInDB, args.Node, pod)
+	if alloc != nil {
+		allocations = append(allocations, alloc)
+	}
 	if err != nil {
 		return err
 	}
 	ipInfos := []constant.IPInfo{*ipInfo}
-	if p.enabledSecondIP(pod) {
-		secondIPInfo, err := p.allocateIP(p.secondIPAM, keyObj.KeyInDB, args.Node, pod)
-		// TODO release ip if it's been allocated in this goroutine?
+	// ipinfos are in the order of named ipams which the pod selects and then ipv6 ip
+	for _, ipam := range p.extraIPAMs(pod) {
+		extraIPInfo, alloc, err := p.allocateIP(ipam, keyObj.KeyInDB, args.Node, pod)
+		if alloc != nil {
+			allocations = append(allocations, alloc)
+		}
 		if err != nil {
-			return fmt.Errorf("[%s] %v", p.secondIPAM.Name(), err)
+			return fmt.Errorf("[%s] %v", ipam.Name(), err)
 		}
-		ipInfos = append(ipInfos, *secondIPInfo)
+		ipInfos = append(ipInfos, *extraIPInfo)
 	}
+	p.setIPInfoNetworks(pod, ipInfos)
 	bindAnnotation := make(map[string]string)
 	data, err := constant.FormatIPInfo(ipInfos)
 	if err != nil {
@@ -395,15 +741,13 @@ func (p *FloatingIPPlugin) Bind(args *schedulerapi.ExtenderBindingArgs) error {
 			bindAnnotation[constant.ExtendedCNIArgsAnnotation])
 		return true, nil
 	}); err != nil {
-		// If fails to update, depending on resync to update
 		return fmt.Errorf("failed to update pod %s: %v", keyObj.KeyInDB, err1)
-		//TODO release ip
 	}
 	return nil
 }
 
-// unbind release ip from pod
-func (p *FloatingIPPlugin) unbind(pod *corev1.Pod) error {
+// unbind release ip from pod and returns outcomes of its ips
+func (p *FloatingIPPlugin) unbind(pod *corev1.Pod) ([]string, error) {
 	glog.V(3).Infof("handle unbind pod %s", pod.Name)
 	keyObj := util.FormatKey(pod)
 	key := keyObj.KeyInDB
@@ -411,11 +755,11 @@ func (p *FloatingIPPlugin) unbind(pod *corev1.Pod) error {
 		if pod.Annotations == nil || pod.Annotations[constant.ExtendedCNIArgsAnnotation] == "" {
 			// If a pod has not been allocated an ip, e.g. ip pool is drained, do nothing
 			// If the annotation is deleted manually, we count on resync to release ips
-			return nil
+			return nil, nil
 		}
 		ipInfos, err := constant.ParseIPInfo(pod.Annotations[constant.ExtendedCNIArgsAnnotation])
 		if err != nil || len(ipInfos) == 0 || ipInfos[0].IP == nil {
-			return fmt.Errorf("bad format of %s: %s, err %v", key,
+			return nil, fmt.Errorf("bad format of %s: %s, err %v", key,
 				pod.Annotations[constant.ExtendedCNIArgsAnnotation], err)
 		} else {
 			glog.Infof("UnAssignIP nodeName %s, ip %s, key %s", pod.Spec.NodeName, ipInfos[0].IP.IP.String(), key)
@@ -423,7 +767,9 @@ func (p *FloatingIPPlugin) unbind(pod *corev1.Pod) error {
 				NodeName:  pod.Spec.NodeName,
 				IPAddress: ipInfos[0].IP.IP.String(),
 			}); err != nil {
-				return fmt.Errorf("failed to unassign ip %s from %s: %v", ipInfos[0].IP.IP.String(), key, err)
+				p.recordPodEvent(pod, corev1.EventTypeWarning, eventCloudProviderUnAssignIP, fmt.Sprintf(
+					"Failed to unassign ip %s from node %s: %v", ipInfos[0].IP.IP.String(), pod.Spec.NodeName, err))
+				return nil, fmt.Errorf("failed to unassign ip %s from %s: %v", ipInfos[0].IP.IP.String(), key, err)
 			}
 		}
 	}
@@ -447,63 +793,37 @@ func (p *FloatingIPPlugin) hasResourceName(spec *corev1.PodSpec) bool {
 	return false
 }
 
-func getNodeIP(node *corev1.Node) net.IP {
-	for i := range node.Status.Addresses {
-		if node.Status.Addresses[i].Type == corev1.NodeInternalIP {
-			return net.ParseIP(node.Status.Addresses[i].Address)
-		}
-	}
-	return nil
-}
-
 func evicted(pod *corev1.Pod) bool {
 	return pod.Status.Phase == corev1.PodFailed && pod.Status.Reason == "Evicted"
 }
 
-// getNodeSubnet gets node subnet from ipam
-func (p *FloatingIPPlugin) getNodeSubnet(node *corev1.Node) (*net.IPNet, error) {
-	p.nodeSubnetLock.Lock()
-	defer p.nodeSubnetLock.Unlock()
-	if subnet, ok := p.nodeSubnet[node.Name]; !ok {
-		return p.getNodeSubnetfromIPAM(node)
-	} else {
-		return subnet, nil
-	}
-}
-
-// queryNodeSubnet gets node subnet from ipam
-func (p *FloatingIPPlugin) queryNodeSubnet(nodeName string) (*net.IPNet, error) {
-	var (
-		node *corev1.Node
-	)
-	p.nodeSubnetLock.Lock()
-	defer p.nodeSubnetLock.Unlock()
-	if subnet, ok := p.nodeSubnet[nodeName]; !ok {
-		if err := wait.Poll(time.Millisecond*100, time.Minute, func() (done bool, err error) {
-			node, err = p.Client.CoreV1().Nodes().Get(nodeName, v1.GetOptions{})
-			if !metaErrs.IsServerTimeout(err) {
-				return true, err
-			}
-			return false, nil
-		}); err != nil {
-			return nil, err
-		}
-		return p.getNodeSubnetfromIPAM(node)
-	} else {
-		return subnet, nil
+func wantSecondIP(pod *corev1.Pod) bool {
+	labelMap := pod.GetLabels()
+	if labelMap == nil {
+		return false
 	}
+	return labelMap[private.LabelKeyEnableSecondIP] == private.LabelValueEnabled
 }
 
-func (p *FloatingIPPlugin) enabledSecondIP(pod *corev1.Pod) bool {
-	return p.hasSecondIPConf.Load().(bool) && wantSecondIP(pod)
+func (p *FloatingIPPlugin) enabledDualStack(pod *corev1.Pod) bool {
+	return p.hasIPv6Conf.Load().(bool) && wantDualStack(pod)
 }
 
-func wantSecondIP(pod *corev1.Pod) bool {
+func wantDualStack(pod *corev1.Pod) bool {
 	labelMap := pod.GetLabels()
 	if labelMap == nil {
 		return false
 	}
-	return labelMap[private.LabelKeyEnableSecondIP] == private.LabelValueEnabled
+	return labelMap[private.LabelKeyEnableDualStack] == private.LabelValueEnabled
+}
+
+// extraIPAMs returns ipams other than p.ipam which the pod wants ips from, in the order of its ipinfos
+func (p *FloatingIPPlugin) extraIPAMs(pod *corev1.Pod) []floatingip.IPAM {
+	ipams := p.selectedIPAMs(pod)
+	if p.enabledDualStack(pod) {
+		ipams = append(ipams, p.ipv6IPAM)
+	}
+	return ipams
 }
 
 func parseReleasePolicy(meta *v1.ObjectMeta) constant.ReleasePolicy {
@@ -515,16 +835,50 @@ func parseReleasePolicy(meta *v1.ObjectMeta) constant.ReleasePolicy {
 	if pool != "" {
 		return constant.ReleasePolicyNever
 	}
-	return constant.ConvertReleasePolicy(meta.Annotations[constant.ReleasePolicyAnnotation])
+	policy := constant.ConvertReleasePolicy(meta.Annotations[constant.ReleasePolicyAnnotation])
+	if policy == constant.ReleasePolicyTTL {
+		if _, err := parseReleaseTTL(meta); err != nil {
+			glog.Warningf("%v, release ip once pod %s is deleted", err, util.Join(meta.Name, meta.Namespace))
+			return constant.ReleasePolicyPodDelete
+		}
+	}
+	return policy
+}
+
+// parseReleaseTTL parses ttl of ips of pods whose release policy is ttl
+func parseReleaseTTL(meta *v1.ObjectMeta) (time.Duration, error) {
+	val := meta.Annotations[constant.ReleaseTTLAnnotation]
+	ttl, err := time.ParseDuration(val)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q", constant.ReleaseTTLAnnotation, val)
+	}
+	return ttl, nil
 }
 
 // Attr stores attrs about this pod
 type Attr struct {
 	NodeName string // need this attr to send unassign request to cloud provider on resync
+	// QuarantineUntil is when a released ip in quarantine becomes allocatable again
+	QuarantineUntil *time.Time `json:",omitempty"`
+	// TTL is how long the ip is kept after the pod is gone if its release policy is ttl
+	TTL string `json:",omitempty"`
 }
 
 func getAttr(nodeName string) string {
+	return marshalAttr(Attr{NodeName: nodeName})
+}
+
+// getPodAttr returns attr of the pod, ttl of the pod is kept in attr to release its ip once the pod is gone
+func getPodAttr(pod *corev1.Pod, nodeName string) string {
 	obj := Attr{NodeName: nodeName}
+	if parseReleasePolicy(&pod.ObjectMeta) == constant.ReleasePolicyTTL {
+		ttl, _ := parseReleaseTTL(&pod.ObjectMeta)
+		obj.TTL = ttl.String()
+	}
+	return marshalAttr(obj)
+}
+
+func marshalAttr(obj Attr) string {
 	attr, err := json.Marshal(obj)
 	if err != nil {
 		glog.Warningf("failed to marshal attr %+v: %v", obj, err)
@@ -536,10 +890,33 @@ func (p *FloatingIPPlugin) GetLockPool() *keylock.Keylock {
 	return p.dpLockPool
 }
 
+// PoolNamespace returns the namespace of Pool objects
+func (p *FloatingIPPlugin) PoolNamespace() string {
+	return p.conf.PoolNamespace
+}
+
 func (p *FloatingIPPlugin) GetIpam() floatingip.IPAM {
 	return p.ipam
 }
 
 func (p *FloatingIPPlugin) GetSecondIpam() floatingip.IPAM {
-	return p.secondIPAM
+	return p.namedIPAMs[SecondIPAMName].ipam
+}
+
+// GetNamedIpams returns named ipams by their names
+func (p *FloatingIPPlugin) GetNamedIpams() map[string]floatingip.IPAM {
+	ipams := make(map[string]floatingip.IPAM, len(p.namedIPAMs))
+	for name, named := range p.namedIPAMs {
+		ipams[name] = named.ipam
+	}
+	return ipams
+}
+
+func (p *FloatingIPPlugin) GetIPv6Ipam() floatingip.IPAM {
+	return p.ipv6IPAM
+}
+
+// GetHistory returns the history of ips or nil if recording history is disabled
+func (p *FloatingIPPlugin) GetHistory() floatingip.History {
+	return p.history
 }
@@ -35,6 +35,8 @@ import (
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
 	fakeV1 "k8s.io/client-go/kubernetes/typed/core/v1/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 	"tkestack.io/galaxy/pkg/api/galaxy/constant"
 	"tkestack.io/galaxy/pkg/api/galaxy/private"
 	"tkestack.io/galaxy/pkg/api/k8s/schedulerapi"
@@ -88,6 +90,29 @@ func createPluginTestNodes(t *testing.T, objs ...runtime.Object) (*FloatingIPPlu
 	return fipPlugin, stopChan, nodes
 }
 
+// createCrdPlugin creates a plugin which stores ips by crd, the first ipam of which is configured by the test config.
+// mutateConf changes the test config before creating the plugin if it is not nil.
+func createCrdPlugin(t *testing.T, mutateConf func(conf *Conf), objs ...runtime.Object) (*FloatingIPPlugin,
+	chan struct{}) {
+	var conf Conf
+	if err := json.Unmarshal([]byte(database.TestConfig), &conf); err != nil {
+		t.Fatal(err)
+	}
+	conf.StorageDriver = "k8s-crd"
+	if mutateConf != nil {
+		mutateConf(&conf)
+	}
+	pluginArgs, stopChan := createPluginFactoryArgs(t, objs...)
+	fipPlugin, err := NewFloatingIPPlugin(conf, pluginArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fipPlugin.ipam.ConfigurePool(conf.FloatingIPs); err != nil {
+		t.Fatal(err)
+	}
+	return fipPlugin, stopChan
+}
+
 // #lizard forgives
 func TestFilter(t *testing.T) {
 	fipPlugin, stopChan, nodes := createPluginTestNodes(t)
@@ -127,6 +152,59 @@ func TestFilter(t *testing.T) {
 	}
 }
 
+func TestPrioritize(t *testing.T) {
+	fipPlugin, stopChan, nodes := createPluginTestNodes(t)
+	defer func() { stopChan <- struct{}{} }()
+	// a pod has no floating ip resource name, prioritize should return no scores
+	list, err := fipPlugin.Prioritize(&corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "pod1", Namespace: "ns1"}}, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*list) != 0 {
+		t.Fatalf("expect no scores, real %v", *list)
+	}
+	// node3 subnet 10.49.27.0/24 has 4 free ips, node4 subnet 10.173.13.0/24 has 6 free ips
+	if err := checkPrioritize(fipPlugin, pod, nodes, map[string]int{drainedNode: 0, nodeHasNoIP: 0, node3: 6,
+		node4: 9}); err != nil {
+		t.Fatal(err)
+	}
+	// node3 subnet holds the ip of pod
+	if err := fipPlugin.ipam.AllocateSpecificIP(podKey.KeyInDB, net.ParseIP("10.49.27.205"),
+		constant.ReleasePolicyNever, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPrioritize(fipPlugin, pod, nodes, map[string]int{drainedNode: 0, nodeHasNoIP: 0, node3: 10,
+		node4: 9}); err != nil {
+		t.Fatal(err)
+	}
+	// node3 subnet holds an ip reserved by the deployment of dpPod
+	dpPod := CreateDeploymentPod("dp-xxx-yyy", "ns1", immutableAnnotation)
+	if err := fipPlugin.ipam.AllocateSpecificIP(util.FormatKey(dpPod).PoolPrefix(), net.ParseIP("10.49.27.216"),
+		constant.ReleasePolicyNever, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPrioritize(fipPlugin, dpPod, nodes, map[string]int{drainedNode: 0, nodeHasNoIP: 0, node3: 10,
+		node4: 9}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkPrioritize(fipPlugin *FloatingIPPlugin, pod *corev1.Pod, nodes []corev1.Node,
+	expect map[string]int) error {
+	list, err := fipPlugin.Prioritize(pod, nodes)
+	if err != nil {
+		return err
+	}
+	scores := map[string]int{}
+	for _, priority := range *list {
+		scores[priority.Host] = priority.Score
+	}
+	if !reflect.DeepEqual(expect, scores) {
+		return fmt.Errorf("expect scores %v, real %v", expect, scores)
+	}
+	return nil
+}
+
 func TestAllocateIP(t *testing.T) {
 	fipPlugin, stopChan, _ := createPluginTestNodes(t)
 	defer func() { stopChan <- struct{}{} }()
@@ -136,7 +214,7 @@ func TestAllocateIP(t *testing.T) {
 	}
 	// check update from ReleasePolicyPodDelete to ReleasePolicyImmutable
 	pod.Spec.NodeName = node4
-	ipInfo, err := fipPlugin.allocateIP(fipPlugin.ipam, podKey.KeyInDB, pod.Spec.NodeName, pod)
+	ipInfo, _, err := fipPlugin.allocateIP(fipPlugin.ipam, podKey.KeyInDB, pod.Spec.NodeName, pod)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -182,7 +260,7 @@ func TestReleaseIP(t *testing.T) {
 	if err := checkIPKey(fipPlugin.ipam, "10.173.13.2", podKey.KeyInDB); err != nil {
 		t.Fatal(err)
 	}
-	if err := fipPlugin.releaseIP(podKey.KeyInDB, "", pod); err != nil {
+	if _, err := fipPlugin.releaseIP(podKey.KeyInDB, "", pod); err != nil {
 		t.Fatal(err)
 	}
 	if err := checkIPKey(fipPlugin.ipam, "10.173.13.2", ""); err != nil {
@@ -199,7 +277,7 @@ func TestFilterForDeployment(t *testing.T) {
 	defer func() { stopChan <- struct{}{} }()
 	// pre-allocate ip in filter for deployment pod
 	podKey, deadPodKey := util.FormatKey(pod), util.FormatKey(deadPod)
-	fip, err := fipPlugin.allocateIP(fipPlugin.ipam, deadPodKey.KeyInDB, node3, deadPod)
+	fip, _, err := fipPlugin.allocateIP(fipPlugin.ipam, deadPodKey.KeyInDB, node3, deadPod)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -209,7 +287,7 @@ func TestFilterForDeployment(t *testing.T) {
 		t.Fatal(err)
 	}
 	// because replicas = 1, ip will be reserved
-	if err := fipPlugin.unbind(deadPod); err != nil {
+	if _, err := fipPlugin.unbind(deadPod); err != nil {
 		t.Fatal(err)
 	}
 	if filtered, failed, err = fipPlugin.Filter(pod, nodes); err != nil {
@@ -229,7 +307,7 @@ func TestFilterForDeployment(t *testing.T) {
 	deadPod.Annotations = immutableAnnotation
 	// when replicas = 0 and never release policy, ip will be reserved
 	*dp.Spec.Replicas = 0
-	if err := fipPlugin.unbind(pod); err != nil {
+	if _, err := fipPlugin.unbind(pod); err != nil {
 		t.Fatal(err)
 	}
 	*dp.Spec.Replicas = 1
@@ -247,6 +325,10 @@ func TestFilterForDeployment(t *testing.T) {
 	}
 }
 
+func ttlAnnotation(ttl string) map[string]string {
+	return map[string]string{constant.ReleasePolicyAnnotation: constant.TTL, constant.ReleaseTTLAnnotation: ttl}
+}
+
 func poolAnnotation(poolName string) map[string]string {
 	return map[string]string{constant.IPPoolAnnotation: poolName}
 }
@@ -346,7 +428,7 @@ func TestFilterForDeploymentIPPool(t *testing.T) {
 			testPod: pod2, expectFiltererd: []string{node4}, expectFailed: []string{drainedNode, nodeHasNoIP, node3},
 			preHook: func() error {
 				// because replicas = 1, ip will be reserved
-				if err := fipPlugin.unbind(pod); err != nil {
+				if _, err := fipPlugin.unbind(pod); err != nil {
 					t.Fatal(err)
 				}
 				if err := checkIPKey(fipPlugin.ipam, "10.173.13.2", podKey.PoolPrefix()); err != nil {
@@ -462,29 +544,44 @@ func createPluginFactoryArgs(t *testing.T, objs ...runtime.Object) (*PluginFacto
 	galaxyCli := fakeGalaxyCli.NewSimpleClientset()
 	crdInformerFactory := crdInformer.NewSharedInformerFactory(galaxyCli, 0)
 	poolInformer := crdInformerFactory.Galaxy().V1alpha1().Pools()
+	fipPoolInformer := crdInformerFactory.Galaxy().V1alpha1().FloatingIPPools()
+	fipPoolInformer.Informer() // register it before starting the factory
 	client := fake.NewSimpleClientset(objs...)
 	informerFactory := informers.NewFilteredSharedInformerFactory(client, time.Minute, v1.NamespaceAll, nil)
 	podInformer := informerFactory.Core().V1().Pods()
 	statefulsetInformer := informerFactory.Apps().V1().StatefulSets()
 	deploymentInformer := informerFactory.Apps().V1().Deployments()
+	daemonSetInformer := informerFactory.Apps().V1().DaemonSets()
+	jobInformer := informerFactory.Batch().V1().Jobs()
+	nodeInformer := informerFactory.Core().V1().Nodes()
+	nodeInformer.Informer() // register it before starting the factory
 	tappCli := fakeTAppCli.NewSimpleClientset()
 	tappInformerFactory := tappInformer.NewSharedInformerFactory(tappCli, 0)
 	tappInformer := tappInformerFactory.Tappcontroller().V1().TApps()
 	stopChan := make(chan struct{})
 	pluginArgs := &PluginFactoryArgs{
-		PodLister:         podInformer.Lister(),
-		StatefulSetLister: statefulsetInformer.Lister(),
-		DeploymentLister:  deploymentInformer.Lister(),
-		Client:            client,
-		PodHasSynced:      podInformer.Informer().HasSynced,
-		StatefulSetSynced: statefulsetInformer.Informer().HasSynced,
-		DeploymentSynced:  deploymentInformer.Informer().HasSynced,
-		PoolLister:        poolInformer.Lister(),
-		PoolSynced:        poolInformer.Informer().HasSynced,
-		TAppClient:        tappCli,
-		TAppHasSynced:     tappInformer.Informer().HasSynced,
-		TAppLister:        tappInformer.Lister(),
-		ExtClient:         extensionClient.NewSimpleClientset(),
+		PodLister:              podInformer.Lister(),
+		StatefulSetLister:      statefulsetInformer.Lister(),
+		DeploymentLister:       deploymentInformer.Lister(),
+		DaemonSetLister:        daemonSetInformer.Lister(),
+		JobLister:              jobInformer.Lister(),
+		Client:                 client,
+		PodHasSynced:           podInformer.Informer().HasSynced,
+		StatefulSetSynced:      statefulsetInformer.Informer().HasSynced,
+		DeploymentSynced:       deploymentInformer.Informer().HasSynced,
+		DaemonSetSynced:        daemonSetInformer.Informer().HasSynced,
+		JobSynced:              jobInformer.Informer().HasSynced,
+		PoolLister:             poolInformer.Lister(),
+		PoolSynced:             poolInformer.Informer().HasSynced,
+		TAppClient:             tappCli,
+		TAppHasSynced:          tappInformer.Informer().HasSynced,
+		TAppLister:             tappInformer.Lister(),
+		ExtClient:              extensionClient.NewSimpleClientset(),
+		CrdClient:              galaxyCli,
+		FloatingIPPoolInformer: fipPoolInformer,
+		PoolInformer:           poolInformer,
+		EventRecorder:          record.NewFakeRecorder(1024),
+		NodeInformer:           nodeInformer,
 	}
 	go informerFactory.Start(stopChan)
 	go crdInformerFactory.Start(stopChan)
@@ -534,7 +631,7 @@ func TestLoadConfigMap(t *testing.T) {
 	if fipPlugin.lastIPConf != cm.Data["key"] {
 		t.Errorf(fipPlugin.lastIPConf)
 	}
-	if fipPlugin.enabledSecondIP(pod1) || fipPlugin.enabledSecondIP(pod2) {
+	if len(fipPlugin.selectedIPAMs(pod1)) != 0 || len(fipPlugin.selectedIPAMs(pod2)) != 0 {
 		t.Error("plugin has no second ip configs")
 	}
 
@@ -546,10 +643,10 @@ func TestLoadConfigMap(t *testing.T) {
 	if fipPlugin.lastIPConf != cm.Data["key"] {
 		t.Errorf(fipPlugin.lastIPConf)
 	}
-	if fipPlugin.lastSecondIPConf != cm.Data["secondKey"] {
+	if fipPlugin.namedIPAMs[SecondIPAMName].lastConf != cm.Data["secondKey"] {
 		t.Errorf(fipPlugin.lastIPConf)
 	}
-	if fipPlugin.enabledSecondIP(pod1) || !fipPlugin.enabledSecondIP(pod2) {
+	if len(fipPlugin.selectedIPAMs(pod1)) != 0 || len(fipPlugin.selectedIPAMs(pod2)) != 1 {
 		t.Error("pod1 doesn't want second ip, but pod2 does")
 	}
 }
@@ -592,6 +689,81 @@ func TestBind(t *testing.T) {
 	}
 }
 
+// #lizard forgives
+func TestBindRollback(t *testing.T) {
+	node := createNode("node1", nil, "10.49.27.2")
+	pod1 := CreateStatefulSetPod("sts1-1", "demo", nil)
+	pod1Key := util.FormatKey(pod1)
+	var conf Conf
+	if err := json.Unmarshal([]byte(database.TestConfig), &conf); err != nil {
+		t.Fatal(err)
+	}
+	fipPlugin, stopChan := newPlugin(t, conf, pod1, &node)
+	defer func() { stopChan <- struct{}{} }()
+	recorder := fipPlugin.EventRecorder.(*record.FakeRecorder)
+	// cloud provider fails to assign the allocated ip, it should be released
+	fakeCP := &fakeCloudProvider{expectIP: "10.49.27.205", expectNode: "node2"}
+	fipPlugin.cloudProvider = fakeCP
+	if _, err := checkBind(fipPlugin, pod1, node.Name, pod1Key.KeyInDB, "10.49.27.205"); err == nil {
+		t.Fatal("expect bind fails")
+	}
+	if fipInfo, err := fipPlugin.ipam.First(pod1Key.KeyInDB); err != nil || fipInfo != nil {
+		t.Fatalf("expect ip released, real %v, err %v", fipInfo, err)
+	}
+	if fakeCP.invokedUnAssignIP {
+		t.Fatal("expect not unassigning ip which is not assigned")
+	}
+	if err := checkEvent(recorder, "Warning CloudProviderAssignIPFailed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEvent(recorder, "Warning BindRollback Rolled back ips [10.49.27.205]"); err != nil {
+		t.Fatal(err)
+	}
+	// binding pod fails, the reused ip should be unassigned and restored
+	if err := fipPlugin.ipam.AllocateSpecificIP(pod1Key.KeyInDB, net.ParseIP("10.49.27.216"),
+		constant.ReleasePolicyNever, ""); err != nil {
+		t.Fatal(err)
+	}
+	fakeCP = &fakeCloudProvider{expectIP: "10.49.27.216", expectNode: node.Name}
+	fipPlugin.cloudProvider = fakeCP
+	fipPlugin.Client.(*fake.Clientset).PrependReactor("create", "pods", func(action k8stesting.Action) (bool,
+		runtime.Object, error) {
+		return action.GetSubresource() == "binding", nil, fmt.Errorf("injected binding error")
+	})
+	if _, err := checkBind(fipPlugin, pod1, node.Name, pod1Key.KeyInDB, "10.49.27.216"); err == nil ||
+		!strings.Contains(err.Error(), "injected binding error") {
+		t.Fatalf("expect bind fails, real %v", err)
+	}
+	if !fakeCP.invokedAssignIP || !fakeCP.invokedUnAssignIP {
+		t.Fatal("expect ip assigned and then unassigned")
+	}
+	if err := checkIPKey(fipPlugin.ipam, "10.49.27.216", pod1Key.KeyInDB); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPolicyAndAttr(fipPlugin.ipam, pod1Key.KeyInDB, constant.ReleasePolicyNever,
+		expectAttrEmpty()); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEvent(recorder, "Normal FloatingIPReused"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEvent(recorder, "Warning BindRollback Rolled back ips [10.49.27.216]"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkEvent(recorder *record.FakeRecorder, expectPrefix string) error {
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, expectPrefix) {
+			return fmt.Errorf("expect event %q, real %q", expectPrefix, event)
+		}
+		return nil
+	default:
+		return fmt.Errorf("expect event %q, real none", expectPrefix)
+	}
+}
+
 func TestParseReleasePolicy(t *testing.T) {
 	testCases := []struct {
 		meta   *v1.ObjectMeta
@@ -617,6 +789,18 @@ func TestParseReleasePolicy(t *testing.T) {
 			meta:   &v1.ObjectMeta{Labels: map[string]string{}, Annotations: map[string]string{constant.IPPoolAnnotation: ""}},
 			expect: constant.ReleasePolicyPodDelete,
 		},
+		{
+			meta:   &v1.ObjectMeta{Annotations: ttlAnnotation("1h")},
+			expect: constant.ReleasePolicyTTL,
+		},
+		{
+			meta:   &v1.ObjectMeta{Annotations: ttlAnnotation("1x")},
+			expect: constant.ReleasePolicyPodDelete,
+		},
+		{
+			meta:   &v1.ObjectMeta{Annotations: map[string]string{constant.ReleasePolicyAnnotation: constant.TTL}},
+			expect: constant.ReleasePolicyPodDelete,
+		},
 	}
 	for i := range testCases {
 		testCase := testCases[i]
@@ -675,12 +859,12 @@ func TestUnBind(t *testing.T) {
 	defer func() { stopChan <- struct{}{} }()
 	fipPlugin.cloudProvider = &fakeCloudProvider{}
 	// if a pod has not got cni args annotation, unbind should return nil
-	if err := fipPlugin.unbind(pod1); err != nil {
+	if _, err := fipPlugin.unbind(pod1); err != nil {
 		t.Fatal(err)
 	}
 	// if a pod has got bad cni args annotation, unbind should return error
 	pod1.Annotations[constant.ExtendedCNIArgsAnnotation] = "fff"
-	if err := fipPlugin.unbind(pod1); err == nil {
+	if _, err := fipPlugin.unbind(pod1); err == nil {
 		t.Fatal(err)
 	}
 	// drain ips other than expectIP of this subnet
@@ -702,7 +886,7 @@ func TestUnBind(t *testing.T) {
 	}
 	pod1.Annotations[constant.ExtendedCNIArgsAnnotation] = str
 	pod1.Spec.NodeName = node.Name
-	if err := fipPlugin.unbind(pod1); err != nil {
+	if _, err := fipPlugin.unbind(pod1); err != nil {
 		t.Fatal(err)
 	}
 	if !fakeCP.invokedAssignIP || !fakeCP.invokedUnAssignIP {
@@ -719,7 +903,7 @@ func TestUnBindImmutablePod(t *testing.T) {
 		t.Fatal(err)
 	}
 	// unbind the pod, check ip should be reserved, because pod has is immutable
-	if err := fipPlugin.unbind(pod); err != nil {
+	if _, err := fipPlugin.unbind(pod); err != nil {
 		t.Fatal(err)
 	}
 	if err := checkIPKey(fipPlugin.ipam, "10.173.13.2", podKey.KeyInDB); err != nil {
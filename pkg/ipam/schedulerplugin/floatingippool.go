@@ -0,0 +1,306 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy/v1alpha1"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+)
+
+// FloatingIPPoolToConf validates a FloatingIPPool object of one of the ip types and converts it to floatingip config
+func FloatingIPPoolToConf(pool *v1alpha1.FloatingIPPool, ipTypes sets.String) (*floatingip.FloatingIP, error) {
+	if !ipTypes.Has(poolIPType(pool)) {
+		return nil, fmt.Errorf("unknown ip type %s", pool.Spec.IPType)
+	}
+	// spec shares json field names with floatingip.FloatingIPConf
+	data, err := json.Marshal(pool.Spec)
+	if err != nil {
+		return nil, err
+	}
+	var fip floatingip.FloatingIP
+	if err := json.Unmarshal(data, &fip); err != nil {
+		return nil, err
+	}
+	if len(fip.IPRanges) == 0 {
+		return nil, fmt.Errorf("empty ips")
+	}
+	return &fip, nil
+}
+
+// ip types of the first ipam and the ipv6 ipam
+var internalIPType, ipv6IPType = ipTypeName(floatingip.InternalIp), ipTypeName(floatingip.IPv6Ip)
+
+func ipTypeName(t floatingip.Type) string {
+	name, _ := t.String()
+	return name
+}
+
+// poolIPType returns ip type of pool, defaults to internalIP
+func poolIPType(pool *v1alpha1.FloatingIPPool) string {
+	if pool.Spec.IPType == "" {
+		return internalIPType
+	}
+	return pool.Spec.IPType
+}
+
+// IPTypes returns ip types of FloatingIPPool objects of the first ipam, the ipv6 ipam and named ipams in this order,
+// conf should have been validated
+func IPTypes(conf *Conf) []string {
+	ipTypes := []string{internalIPType, ipv6IPType}
+	for _, named := range conf.NamedIPAMs {
+		ipTypes = append(ipTypes, named.IPType)
+	}
+	return ipTypes
+}
+
+// FloatingIPPoolConfs converts FloatingIPPool objects to sorted floatingip configs by ip types in the same way
+// galaxy-ipam applies them. Invalid pools and pools of routable subnets which are already defined are skipped, as
+// their last valid configs only exist in memory of galaxy-ipam.
+func FloatingIPPoolConfs(conf *Conf, pools []*v1alpha1.FloatingIPPool) map[string][]*floatingip.FloatingIP {
+	pools = append([]*v1alpha1.FloatingIPPool{}, pools...)
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+	ipTypes := sets.NewString(IPTypes(conf)...)
+	confs := map[string][]*floatingip.FloatingIP{}
+	definedBy := map[string]sets.String{}
+	for _, pool := range pools {
+		fip, err := FloatingIPPoolToConf(pool, ipTypes)
+		if err != nil {
+			glog.Warningf("floatingip pool %s: invalid pool: %v", pool.Name, err)
+			continue
+		}
+		ipType := poolIPType(pool)
+		if definedBy[ipType] == nil {
+			definedBy[ipType] = sets.NewString()
+		}
+		if definedBy[ipType].Has(fip.Key()) {
+			glog.Warningf("floatingip pool %s: routable subnet %s is already defined", pool.Name, fip.Key())
+			continue
+		}
+		definedBy[ipType].Insert(fip.Key())
+		confs[ipType] = append(confs[ipType], fip)
+	}
+	for ipType := range confs {
+		sort.Sort(floatingip.FloatingIPSlice(confs[ipType]))
+	}
+	return confs
+}
+
+// ipamsByIPType returns the first ipam, the ipv6 ipam and named ipams by the ip type of their FloatingIPPool objects
+func (p *FloatingIPPlugin) ipamsByIPType() map[string]floatingip.IPAM {
+	ipams := map[string]floatingip.IPAM{internalIPType: p.ipam, ipv6IPType: p.ipv6IPAM}
+	for _, named := range p.namedIPAMs {
+		ipams[named.conf.IPType] = named.ipam
+	}
+	return ipams
+}
+
+// addFloatingIPPoolEventHandler triggers syncing floatingip config once FloatingIPPool objects change
+func (p *FloatingIPPlugin) addFloatingIPPoolEventHandler() {
+	p.FloatingIPPoolInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			p.enqueuePoolSync()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPool, ok1 := oldObj.(*v1alpha1.FloatingIPPool)
+			newPool, ok2 := newObj.(*v1alpha1.FloatingIPPool)
+			// ignore status updates
+			if ok1 && ok2 && reflect.DeepEqual(oldPool.Spec, newPool.Spec) {
+				return
+			}
+			p.enqueuePoolSync()
+		},
+		DeleteFunc: func(obj interface{}) {
+			p.enqueuePoolSync()
+		},
+	})
+}
+
+func (p *FloatingIPPlugin) enqueuePoolSync() {
+	select {
+	case p.poolSync <- struct{}{}:
+	default:
+		// a sync is pending which will see this change
+	}
+}
+
+// poolSyncLoop syncs floatingip config from FloatingIPPool objects whenever they change
+func (p *FloatingIPPlugin) poolSyncLoop(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-p.poolSync:
+			if err := p.syncFloatingIPPools(); err != nil {
+				glog.Warningf("failed to sync floatingip pools: %v", err)
+			}
+		}
+	}
+}
+
+// appliedPool is the last valid floatingip config of a FloatingIPPool object
+type appliedPool struct {
+	ipType string
+	fip    *floatingip.FloatingIP
+}
+
+// #lizard forgives
+// syncFloatingIPPools applies FloatingIPPool objects to ipams whose pools changed and updates status of them. Only
+// deleting a pool removes it from the config, a pool which becomes invalid keeps its last valid config, so that
+// unallocated ips of it are not dropped by a bad edit.
+func (p *FloatingIPPlugin) syncFloatingIPPools() error {
+	pools, err := p.FloatingIPPoolInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+	ipams := p.ipamsByIPType()
+	ipTypes := sets.StringKeySet(ipams)
+	confs := map[string][]*floatingip.FloatingIP{}
+	applied := map[string]appliedPool{}
+	messages := map[string]string{}
+	// routable subnet to pool name of each ip type
+	definedBy := map[string]map[string]string{}
+	for _, pool := range pools {
+		fip, err := FloatingIPPoolToConf(pool, ipTypes)
+		ipType := poolIPType(pool)
+		if err == nil {
+			if name, ok := definedBy[ipType][fip.Key()]; ok {
+				err = fmt.Errorf("routable subnet %s is already defined by pool %s", fip.Key(), name)
+			}
+		} else {
+			err = fmt.Errorf("invalid pool: %v", err)
+		}
+		if err != nil {
+			last, ok := p.lastPoolConfs[pool.Name]
+			if ok {
+				if _, conflict := definedBy[last.ipType][last.fip.Key()]; conflict {
+					ok = false
+				}
+			}
+			if !ok {
+				messages[pool.Name] = err.Error()
+				glog.Warningf("floatingip pool %s: %v", pool.Name, err)
+				continue
+			}
+			messages[pool.Name] = fmt.Sprintf("%v, keep the last valid config", err)
+			glog.Warningf("floatingip pool %s: %s", pool.Name, messages[pool.Name])
+			ipType, fip = last.ipType, last.fip
+		}
+		if definedBy[ipType] == nil {
+			definedBy[ipType] = map[string]string{}
+		}
+		definedBy[ipType][fip.Key()] = pool.Name
+		confs[ipType] = append(confs[ipType], fip)
+		applied[pool.Name] = appliedPool{ipType: ipType, fip: fip}
+	}
+	lastIPConf := p.lastIPConf
+	if err := p.ensurePoolConf(p.ipam, &p.lastIPConf, internalIPType, confs[internalIPType]); err != nil {
+		return fmt.Errorf("[%s] %v", p.ipam.Name(), err)
+	}
+	if p.lastIPConf != lastIPConf {
+		// routable subnets may change
+		p.resetNodeSubnet()
+	}
+	for _, c := range p.conf.NamedIPAMs {
+		named := p.namedIPAMs[c.Name]
+		if err := p.ensurePoolConf(named.ipam, &named.lastConf, c.IPType, confs[c.IPType]); err != nil {
+			return fmt.Errorf("[%s] %v", named.ipam.Name(), err)
+		}
+		named.hasConf.Store(named.lastConf != "")
+	}
+	if err := p.ensurePoolConf(p.ipv6IPAM, &p.lastIPv6Conf, ipv6IPType, confs[ipv6IPType]); err != nil {
+		return fmt.Errorf("[%s] %v", p.ipv6IPAM.Name(), err)
+	}
+	p.hasIPv6Conf.Store(p.lastIPv6Conf != "")
+	p.lastPoolConfs = applied
+	poolConfs := make(map[string]*floatingip.FloatingIP, len(applied))
+	for name := range applied {
+		poolConfs[name] = applied[name].fip
+	}
+	return p.updateFloatingIPPoolStatus(pools, ipams, poolConfs, messages)
+}
+
+// ensurePoolConf configures ipam if pool config of it changes. The current config is kept if there is no valid
+// pool of the ip type, as it is most likely that pools are being recreated, e.g. restored from a backup.
+func (p *FloatingIPPlugin) ensurePoolConf(ipam floatingip.IPAM, lastConf *string, ipType string,
+	fips []*floatingip.FloatingIP) error {
+	if len(fips) == 0 {
+		if *lastConf != "" {
+			glog.Warningf("no valid floatingip pool of ip type %s, keep the current config", ipType)
+		}
+		return nil
+	}
+	sort.Sort(floatingip.FloatingIPSlice(fips))
+	data, err := json.Marshal(fips)
+	if err != nil {
+		return err
+	}
+	return ensureIPAMConf(ipam, lastConf, string(data))
+}
+
+// updateFloatingIPPoolStatus updates total, allocated and free ips of pools
+func (p *FloatingIPPlugin) updateFloatingIPPoolStatus(pools []*v1alpha1.FloatingIPPool,
+	ipams map[string]floatingip.IPAM, poolConfs map[string]*floatingip.FloatingIP, messages map[string]string) error {
+	// ip type to allocated ips
+	allocated := map[string][]net.IP{}
+	for ipType, ipam := range ipams {
+		fips, err := ipam.ByPrefix("")
+		if err != nil {
+			return fmt.Errorf("[%s] %v", ipam.Name(), err)
+		}
+		for j := range fips {
+			if fips[j].Key != "" {
+				allocated[ipType] = append(allocated[ipType], net.IP(fips[j].IP))
+			}
+		}
+	}
+	for _, pool := range pools {
+		status := v1alpha1.FloatingIPPoolStatus{Message: messages[pool.Name]}
+		if fip, ok := poolConfs[pool.Name]; ok {
+			status.Total = int(fip.Size())
+			for _, ip := range allocated[poolIPType(pool)] {
+				if fip.Contains(ip) {
+					status.Allocated++
+				}
+			}
+			status.Free = status.Total - status.Allocated
+		}
+		if status == pool.Status {
+			continue
+		}
+		updated := pool.DeepCopy()
+		updated.Status = status
+		if _, err := p.CrdClient.GalaxyV1alpha1().FloatingIPPools().UpdateStatus(updated); err != nil {
+			glog.Warningf("failed to update status of floatingip pool %s: %v", pool.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy/v1alpha1"
+)
+
+func createFloatingIPPool(name, ipType, routableSubnet, gateway string, ips ...string) *v1alpha1.FloatingIPPool {
+	return &v1alpha1.FloatingIPPool{
+		ObjectMeta: v1.ObjectMeta{Name: name},
+		Spec: v1alpha1.FloatingIPPoolSpec{IPType: ipType, RoutableSubnet: routableSubnet, Subnet: routableSubnet,
+			Gateway: gateway, Vlan: 2, IPs: ips},
+	}
+}
+
+// #lizard forgives
+func TestSyncFloatingIPPools(t *testing.T) {
+	conf := Conf{StorageDriver: "k8s-crd", UseFloatingIPPoolCRD: true}
+	pluginArgs, stopChan := createPluginFactoryArgs(t)
+	defer func() { stopChan <- struct{}{} }()
+	fipPlugin, err := NewFloatingIPPlugin(conf, pluginArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pools := pluginArgs.CrdClient.GalaxyV1alpha1().FloatingIPPools()
+	for _, pool := range []*v1alpha1.FloatingIPPool{
+		createFloatingIPPool("pool1", "", "10.49.27.0/24", "10.49.27.1", "10.49.27.205", "10.49.27.216~10.49.27.218"),
+		// ip is not in subnet
+		createFloatingIPPool("pool2", "", "10.50.0.0/24", "10.50.0.1", "10.49.27.2"),
+		// duplicated routable subnet
+		createFloatingIPPool("pool3", "internalIP", "10.49.27.0/24", "10.49.27.1", "10.49.27.2"),
+	} {
+		if _, err := pools.Create(pool); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fipPlugin.Init(); err != nil {
+		t.Fatal(err)
+	}
+	subnets, err := fipPlugin.ipam.QueryRoutableSubnetByKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subnets) != 1 || subnets[0] != "10.49.27.0/24" {
+		t.Fatalf("unexpected subnets %v", subnets)
+	}
+	if err := fipPlugin.ipam.AllocateSpecificIP("pod1", net.ParseIP("10.49.27.205"), constant.ReleasePolicyPodDelete,
+		""); err != nil {
+		t.Fatal(err)
+	}
+	if err := fipPlugin.syncFloatingIPPools(); err != nil {
+		t.Fatal(err)
+	}
+	pool1, err := pools.Get("pool1", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool1.Status != (v1alpha1.FloatingIPPoolStatus{Total: 4, Allocated: 1, Free: 3}) {
+		t.Fatalf("unexpected status %+v", pool1.Status)
+	}
+	for name, msg := range map[string]string{"pool2": "invalid pool", "pool3": "routable subnet 10.49.27.0/24 is " +
+		"already defined by pool pool1"} {
+		pool, err := pools.Get(name, v1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(pool.Status.Message, msg) {
+			t.Fatalf("expect message of %s starts with %q, got %q", name, msg, pool.Status.Message)
+		}
+	}
+	// adding a pool of second ips leaves ipam config untouched
+	lastIPConf := fipPlugin.lastIPConf
+	if _, err := pools.Create(createFloatingIPPool("pool4", "externalIP", "10.173.13.0/24", "10.173.13.1",
+		"10.173.13.15")); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 3*time.Second, func() (bool, error) {
+		_, err := fipPlugin.FloatingIPPoolInformer.Lister().Get("pool4")
+		return err == nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fipPlugin.syncFloatingIPPools(); err != nil {
+		t.Fatal(err)
+	}
+	if !fipPlugin.namedIPAMs[SecondIPAMName].configured() {
+		t.Fatal("expect second ip conf")
+	}
+	if fipPlugin.lastIPConf != lastIPConf {
+		t.Fatalf("ipam config changed from %s to %s", lastIPConf, fipPlugin.lastIPConf)
+	}
+	if err := checkIPKey(fipPlugin.ipam, "10.49.27.205", "pod1"); err != nil {
+		t.Fatal(err)
+	}
+	// an invalid edit keeps the last valid config of the pool
+	pool1.Spec.IPs = []string{"10.50.0.2"}
+	if _, err := pools.Update(pool1); err != nil {
+		t.Fatal(err)
+	}
+	// deleting the last pool of second ips keeps the second ipam config
+	if err := pools.Delete("pool4", &v1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 3*time.Second, func() (bool, error) {
+		pool, err := fipPlugin.FloatingIPPoolInformer.Lister().Get("pool1")
+		if err != nil || len(pool.Spec.IPs) != 1 {
+			return false, nil
+		}
+		_, err = fipPlugin.FloatingIPPoolInformer.Lister().Get("pool4")
+		return err != nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fipPlugin.syncFloatingIPPools(); err != nil {
+		t.Fatal(err)
+	}
+	if fipPlugin.lastIPConf != lastIPConf {
+		t.Fatalf("ipam config changed from %s to %s", lastIPConf, fipPlugin.lastIPConf)
+	}
+	if !fipPlugin.namedIPAMs[SecondIPAMName].configured() {
+		t.Fatal("expect second ip conf")
+	}
+	if pool1, err = pools.Get("pool1", v1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(pool1.Status.Message, "keep the last valid config") || pool1.Status.Total != 4 {
+		t.Fatalf("unexpected status %+v", pool1.Status)
+	}
+}
+
+func TestFloatingIPPoolToConf(t *testing.T) {
+	ipTypes := sets.NewString("internalIP", "externalIP", "ipv6IP")
+	fip, err := FloatingIPPoolToConf(createFloatingIPPool("pool1", "", "10.49.27.0/24", "10.49.27.1",
+		"10.49.27.205", "10.49.27.216~10.49.27.218"), ipTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fip.String() != `{"routableSubnet":"10.49.27.0/24","ips":["10.49.27.205","10.49.27.216~10.49.27.218"],`+
+		`"subnet":"10.49.27.0/24","gateway":"10.49.27.1","vlan":2}` {
+		t.Fatal(fip.String())
+	}
+	for _, pool := range []*v1alpha1.FloatingIPPool{
+		createFloatingIPPool("pool2", "unknown", "10.49.27.0/24", "10.49.27.1", "10.49.27.205"),
+		createFloatingIPPool("pool3", "", "10.49.27.0/24", "", "10.49.27.205"),
+		createFloatingIPPool("pool4", "", "10.49.27.0/24", "10.49.27.1"),
+		createFloatingIPPool("pool5", "", "10.49.27.0/24", "10.49.27.1", "10.49.27.x"),
+	} {
+		if _, err := FloatingIPPoolToConf(pool, ipTypes); err == nil {
+			t.Fatalf("expect an error for %s", pool.Name)
+		}
+	}
+}
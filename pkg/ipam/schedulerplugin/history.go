@@ -0,0 +1,59 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"time"
+
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+)
+
+// historyPruneInterval is the interval of deleting history records older than the retention
+const historyPruneInterval = time.Hour
+
+// enableHistory records changes of ips of all ipams to the history of the storage driver
+func (p *FloatingIPPlugin) enableHistory() error {
+	history, err := floatingip.NewHistory(p.ipam)
+	if err != nil {
+		return err
+	}
+	p.history = history
+	p.ipam = floatingip.WithHistory(p.ipam, history, parseHistoryKey)
+	for _, named := range p.namedIPAMs {
+		named.ipam = floatingip.WithHistory(named.ipam, history, parseHistoryKey)
+	}
+	p.ipv6IPAM = floatingip.WithHistory(p.ipv6IPAM, history, parseHistoryKey)
+	return nil
+}
+
+// parseHistoryKey returns the namespace and app name of key, keys in quarantine belong to the app which released them
+func parseHistoryKey(key string) (string, string) {
+	key, _ = util.ParseQuarantineKey(key)
+	// prefix keys such as dp_ns1_demo_ resolve to the app too
+	keyObj := util.ParseKey(key)
+	return keyObj.Namespace, keyObj.AppName
+}
+
+// pruneHistory deletes history records older than the retention
+func (p *FloatingIPPlugin) pruneHistory() {
+	before := time.Now().Add(-time.Duration(p.conf.HistoryRetentionDays) * 24 * time.Hour)
+	if err := p.history.Prune(before); err != nil {
+		glog.Warningf("failed to prune history before %v: %v", before, err)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"net"
+	"testing"
+
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+)
+
+func TestParseHistoryKey(t *testing.T) {
+	for key, expect := range map[string][2]string{
+		"sts_ns1_demo_demo-0":              {"ns1", "demo"},
+		"dp_ns1_demo_":                     {"ns1", "demo"},
+		"pool__pool1_dp_ns1_demo_demo-x-y": {"ns1", "demo"},
+		"quarantine__tapp_ns2_demo_demo-1": {"ns2", "demo"},
+		"pool__pool1_":                     {"", ""},
+	} {
+		if ns, app := parseHistoryKey(key); ns != expect[0] || app != expect[1] {
+			t.Errorf("key %s: expect %v, got %s %s", key, expect, ns, app)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	fipPlugin, stopChan := createCrdPlugin(t, func(conf *Conf) {
+		conf.HistoryRetentionDays = 1
+	})
+	defer func() { stopChan <- struct{}{} }()
+	key, ip := "sts_ns1_demo_demo-0", net.ParseIP("10.49.27.205")
+	if err := fipPlugin.ipam.AllocateSpecificIP(key, ip, constant.ReleasePolicyPodDelete,
+		getAttr("node1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := releaseIP(fipPlugin.ipam, key, deletedAndIPMutablePod, 0); err != nil {
+		t.Fatal(err)
+	}
+	records, err := fipPlugin.GetHistory().ByApp("ns1", "demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Action != floatingip.HistoryAllocate || records[0].NodeName != "node1" ||
+		records[1].Action != floatingip.HistoryRelease || records[1].Reason != deletedAndIPMutablePod {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	fipPlugin.pruneHistory()
+	if records, err = fipPlugin.GetHistory().ByIP(ip); err != nil || len(records) != 2 {
+		t.Fatalf("expect records within retention are kept, real %+v, err %v", records, err)
+	}
+}
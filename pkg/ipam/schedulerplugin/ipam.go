@@ -18,16 +18,17 @@ package schedulerplugin
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
 	glog "k8s.io/klog"
 	"tkestack.io/galaxy/pkg/api/galaxy/constant"
 	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/metrics"
 	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
 	"tkestack.io/galaxy/pkg/utils/database"
 )
@@ -50,18 +51,19 @@ func ensureIPAMConf(ipam floatingip.IPAM, lastConf *string, newConf string) erro
 }
 
 func allocateInSubnet(ipam floatingip.IPAM, key string, subnet *net.IPNet, policy constant.ReleasePolicy, attr,
-	when string) error {
-	ip, err := ipam.AllocateInSubnet(key, subnet, policy, attr)
+	when string) (net.IP, error) {
+	ip, err := floatingip.WithReason(ipam, "", when).AllocateInSubnet(key, subnet, policy, attr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	glog.Infof("[%s] allocated ip %s to pod %s during %s", ipam.Name(), ip.String(), key, when)
-	return nil
+	return ip, nil
 }
 
 func allocateInSubnetWithKey(ipam floatingip.IPAM, oldK, newK, subnet string, policy constant.ReleasePolicy,
 	attr, when string) error {
-	if err := ipam.AllocateInSubnetWithKey(oldK, newK, subnet, policy, attr); err != nil {
+	if err := floatingip.WithReason(ipam, "", when).AllocateInSubnetWithKey(oldK, newK, subnet, policy,
+		attr); err != nil {
 		return err
 	}
 	fip, err := ipam.First(newK)
@@ -121,72 +123,119 @@ func getAvailableSubnet(ipam floatingip.IPAM, keyObj *util.KeyObj, policy consta
 	return
 }
 
-func (p *FloatingIPPlugin) releaseIP(key string, reason string, pod *corev1.Pod) error {
-	if err := releaseIP(p.ipam, key, reason); err != nil {
-		return fmt.Errorf("[%s] %v", p.ipam.Name(), err)
-	}
-	// skip release second ip if not enabled
-	if !(p.hasSecondIPConf.Load().(bool)) {
-		return nil
+// releaseIP releases ips of key in all ipams the pod asks for and returns outcomes of them
+func (p *FloatingIPPlugin) releaseIP(key string, reason string, pod *corev1.Pod) ([]string, error) {
+	quarantine := p.releaseQuarantine()
+	var outcomes []string
+	outcome, err := releaseIP(p.ipam, key, reason, quarantine)
+	if err != nil {
+		return outcomes, fmt.Errorf("[%s] %v", p.ipam.Name(), err)
+	}
+	outcomes = appendOutcome(outcomes, outcome)
+	// skip releasing ips of named ipams which are not configured or not selected by the pod
+	for _, c := range p.conf.NamedIPAMs {
+		named := p.namedIPAMs[c.Name]
+		if !named.configured() || (pod != nil && !p.wantIPAM(pod, c.Name)) {
+			continue
+		}
+		if outcome, err = releaseIP(named.ipam, key, reason, quarantine); err != nil {
+			return outcomes, fmt.Errorf("[%s] %v", named.ipam.Name(), err)
+		}
+		outcomes = appendOutcome(outcomes, outcome)
 	}
-	if pod != nil && !wantSecondIP(pod) {
-		return nil
+	if p.hasIPv6Conf.Load().(bool) && (pod == nil || wantDualStack(pod)) {
+		if outcome, err = releaseIP(p.ipv6IPAM, key, reason, quarantine); err != nil {
+			return outcomes, fmt.Errorf("[%s] %v", p.ipv6IPAM.Name(), err)
+		}
+		outcomes = appendOutcome(outcomes, outcome)
 	}
-	if err := releaseIP(p.secondIPAM, key, reason); err != nil {
-		return fmt.Errorf("[%s] %v", p.secondIPAM.Name(), err)
+	return outcomes, nil
+}
+
+// appendOutcome appends outcome to outcomes unless it is empty
+func appendOutcome(outcomes []string, outcome string) []string {
+	if outcome == "" {
+		return outcomes
 	}
-	return nil
+	return append(outcomes, outcome)
 }
 
-func releaseIP(ipam floatingip.IPAM, key string, reason string) error {
+// releaseIP releases the ip of key. If quarantine of its range or the given default quarantine is not 0, the ip is
+// kept in quarantine instead so that it won't be allocated to others until the quarantine is over. It returns what
+// happened to the ip, or an empty string if there is no ip of key.
+func releaseIP(ipam floatingip.IPAM, key string, reason string, quarantine time.Duration) (string, error) {
 	ipInfo, err := ipam.First(key)
 	if err != nil {
-		return fmt.Errorf("failed to query floating ip of %s: %v", key, err)
+		return "", fmt.Errorf("failed to query floating ip of %s: %v", key, err)
 	}
 	if ipInfo == nil {
 		glog.Infof("[%s] release floating ip from %s because of %s, but already been released", ipam.Name(), key,
 			reason)
-		return nil
-	}
-	if err := ipam.Release(key, ipInfo.IPInfo.IP.IP); err != nil {
-		return fmt.Errorf("failed to release floating ip of %s because of %s: %v", key, reason, err)
+		return "", nil
+	}
+	var outcome string
+	// quarantining an ip is recorded as releasing it as well
+	history := floatingip.WithReason(ipam, floatingip.HistoryRelease, reason)
+	if ipInfo.QuarantineSeconds > 0 {
+		quarantine = time.Duration(ipInfo.QuarantineSeconds) * time.Second
+	}
+	if quarantine > 0 {
+		if err := history.ReserveIP(key, util.QuarantineKey(key),
+			getQuarantineAttr(time.Now().Add(quarantine))); err != nil {
+			return "", fmt.Errorf("failed to quarantine floating ip of %s because of %s: %v", key, reason, err)
+		}
+		glog.Infof("[%s] released floating ip %s from %s because of %s, quarantined for %v", ipam.Name(),
+			ipInfo.IPInfo.IP.String(), key, reason, quarantine)
+		outcome = fmt.Sprintf("[%s] quarantined %s for %v because of %s", ipam.Name(), ipInfo.IPInfo.IP.IP.String(),
+			quarantine, reason)
+	} else {
+		if err := history.Release(key, ipInfo.IPInfo.IP.IP); err != nil {
+			return "", fmt.Errorf("failed to release floating ip of %s because of %s: %v", key, reason, err)
+		}
+		glog.Infof("[%s] released floating ip %s from %s because of %s", ipam.Name(), ipInfo.IPInfo.IP.String(), key,
+			reason)
+		outcome = fmt.Sprintf("[%s] released %s because of %s", ipam.Name(), ipInfo.IPInfo.IP.IP.String(), reason)
 	}
-	glog.Infof("[%s] released floating ip %s from %s because of %s", ipam.Name(), ipInfo.IPInfo.IP.String(), key,
-		reason)
-	return nil
+	metrics.IPReleases.WithLabelValues(ipam.Name(), releaseReason(reason)).Inc()
+	return outcome, nil
 }
 
-func (p *FloatingIPPlugin) reserveIP(old, new, reason string, enabledSecondIP bool) error {
-	if err := reserveIP(old, new, p.ipam, reason); err != nil {
-		return err
+// releaseReason returns the leading word of reason, e.g. deletedAndIPMutablePod of
+// "deletedAndIPMutablePod during resyncing"
+func releaseReason(reason string) string {
+	if i := strings.Index(reason, " "); i > 0 {
+		return reason[:i]
 	}
-	if enabledSecondIP {
-		if err := reserveIP(old, new, p.secondIPAM, reason); err != nil {
-			return err
+	return reason
+}
+
+// reserveIP reserves ips of the pod from key old to new in all ipams the pod asks for and returns outcomes of them
+func (p *FloatingIPPlugin) reserveIP(old, new, reason string, pod *corev1.Pod) ([]string, error) {
+	attr := getPodAttr(pod, "")
+	var outcomes []string
+	for _, ipam := range append([]floatingip.IPAM{p.ipam}, p.extraIPAMs(pod)...) {
+		outcome, err := reserveIP(old, new, ipam, attr, reason)
+		if err != nil {
+			return outcomes, err
 		}
+		outcomes = appendOutcome(outcomes, outcome)
 	}
-	return nil
+	return outcomes, nil
 }
 
-func reserveIP(key, prefixKey string, ipam floatingip.IPAM, reason string) error {
-	if err := ipam.ReserveIP(key, prefixKey, getAttr("")); err != nil {
-		return fmt.Errorf("[%s] failed to reserve ip from pod %s to %s: %v", ipam.Name(), key, prefixKey, err)
+// reserveIP reserves the ip of key to prefixKey and returns what happened to the ip
+func reserveIP(key, prefixKey string, ipam floatingip.IPAM, attr, reason string) (string, error) {
+	ipInfo, err := ipam.First(key)
+	if err != nil {
+		return "", fmt.Errorf("[%s] failed to query floating ip of %s: %v", ipam.Name(), key, err)
+	}
+	if err := floatingip.WithReason(ipam, "", reason).ReserveIP(key, prefixKey, attr); err != nil {
+		return "", fmt.Errorf("[%s] failed to reserve ip from pod %s to %s: %v", ipam.Name(), key, prefixKey, err)
 	}
 	glog.Infof("[%s] reserved ip from pod %s to %s, because %s", ipam.Name(), key, prefixKey, reason)
-	return nil
-}
-
-// getNodeSubnetfromIPAM gets node subnet from ipam
-func (p *FloatingIPPlugin) getNodeSubnetfromIPAM(node *corev1.Node) (*net.IPNet, error) {
-	nodeIP := getNodeIP(node)
-	if nodeIP == nil {
-		return nil, errors.New("FloatingIPPlugin:UnknowNode")
-	}
-	if ipNet := p.ipam.RoutableSubnet(nodeIP); ipNet != nil {
-		glog.V(4).Infof("node %s %s %s", node.Name, nodeIP.String(), ipNet.String())
-		p.nodeSubnet[node.Name] = ipNet
-		return ipNet, nil
-	} else {
-		return nil, errors.New("FloatingIPPlugin:NoFIPConfigNode")
+	if ipInfo == nil {
+		return "", nil
 	}
+	return fmt.Sprintf("[%s] reserved %s to %s because of %s", ipam.Name(), ipInfo.IPInfo.IP.IP.String(), prefixKey,
+		reason), nil
 }
@@ -0,0 +1,139 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/labels"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/metrics"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+)
+
+var (
+	subnetCapacityDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "subnet_capacity_ips"),
+		"Number of ips of each routable subnet.", []string{"ipam", "subnet"}, nil)
+	subnetAllocatedDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "subnet_allocated_ips"),
+		"Number of allocated ips of each routable subnet.", []string{"ipam", "subnet"}, nil)
+	subnetFreeDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "subnet_free_ips"),
+		"Number of unallocated ips of each routable subnet.", []string{"ipam", "subnet"}, nil)
+	subnetExcludedDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "subnet_excluded_ips"),
+		"Number of unallocated ips of each routable subnet which are excluded from allocation.",
+		[]string{"ipam", "subnet"}, nil)
+	poolCapacityDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "pool_capacity_ips"),
+		"Size of each pool.", []string{"pool"}, nil)
+	poolAllocatedDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "pool_allocated_ips"),
+		"Number of ips of each pool which are bound to pods.", []string{"ipam", "pool"}, nil)
+	poolFreeDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "pool_free_ips"),
+		"Number of ips reserved by each pool which are not bound to any pod.", []string{"ipam", "pool"}, nil)
+	orphanedDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "orphaned_ips"),
+		"Number of allocated ips which are kept though they are no longer configured.", []string{"ipam"}, nil)
+	unreleasedDepthDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "unreleased_queue_depth"),
+		"Number of pod events waiting for releasing ips.", nil, nil)
+)
+
+// ipamCollector collects ip usage of ipams and pools each time metrics are scraped
+type ipamCollector struct {
+	p *FloatingIPPlugin
+}
+
+// NewCollector returns a prometheus collector which reports ip usage of the plugin
+func (p *FloatingIPPlugin) NewCollector() prometheus.Collector {
+	return &ipamCollector{p: p}
+}
+
+// Describe implements prometheus.Collector
+func (c *ipamCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{subnetCapacityDesc, subnetAllocatedDesc, subnetFreeDesc, subnetExcludedDesc,
+		poolCapacityDesc, poolAllocatedDesc, poolFreeDesc, orphanedDesc, unreleasedDepthDesc} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *ipamCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(unreleasedDepthDesc, prometheus.GaugeValue, float64(len(c.p.unreleased)))
+	pools, err := c.p.PoolLister.Pools(c.p.conf.PoolNamespace).List(labels.Everything())
+	if err != nil {
+		glog.Warningf("failed to list pools: %v", err)
+	}
+	for _, pool := range pools {
+		ch <- prometheus.MustNewConstMetric(poolCapacityDesc, prometheus.GaugeValue, float64(pool.Size), pool.Name)
+	}
+	for _, ipam := range c.p.configuredIPAMs() {
+		c.collectIPAM(ch, ipam)
+	}
+}
+
+func (c *ipamCollector) collectIPAM(ch chan<- prometheus.Metric, ipam floatingip.IPAM) {
+	fips, err := ipam.ByPrefix("")
+	if err != nil {
+		glog.Warningf("[%s] failed to collect metrics: %v", ipam.Name(), err)
+		return
+	}
+	// subnet name to number of total, allocated and unallocated excluded ips
+	subnets := map[string]*[3]int{}
+	// pool name to number of total and allocated ips
+	pools := map[string]*[2]int{}
+	for i := range fips {
+		if _, ok := subnets[fips[i].Subnet]; !ok {
+			subnets[fips[i].Subnet] = &[3]int{}
+		}
+		subnets[fips[i].Subnet][0]++
+		if fips[i].Key == "" {
+			if fips[i].Excluded {
+				subnets[fips[i].Subnet][2]++
+			}
+			continue
+		}
+		subnets[fips[i].Subnet][1]++
+		keyObj := util.ParseKey(fips[i].Key)
+		if keyObj.PoolName == "" {
+			continue
+		}
+		if _, ok := pools[keyObj.PoolName]; !ok {
+			pools[keyObj.PoolName] = &[2]int{}
+		}
+		pools[keyObj.PoolName][0]++
+		if keyObj.PodName != "" {
+			pools[keyObj.PoolName][1]++
+		}
+	}
+	for subnet, count := range subnets {
+		ch <- prometheus.MustNewConstMetric(subnetCapacityDesc, prometheus.GaugeValue, float64(count[0]),
+			ipam.Name(), subnet)
+		ch <- prometheus.MustNewConstMetric(subnetAllocatedDesc, prometheus.GaugeValue, float64(count[1]),
+			ipam.Name(), subnet)
+		ch <- prometheus.MustNewConstMetric(subnetFreeDesc, prometheus.GaugeValue, float64(count[0]-count[1]-count[2]),
+			ipam.Name(), subnet)
+		ch <- prometheus.MustNewConstMetric(subnetExcludedDesc, prometheus.GaugeValue, float64(count[2]),
+			ipam.Name(), subnet)
+	}
+	for pool, count := range pools {
+		ch <- prometheus.MustNewConstMetric(poolAllocatedDesc, prometheus.GaugeValue, float64(count[1]),
+			ipam.Name(), pool)
+		ch <- prometheus.MustNewConstMetric(poolFreeDesc, prometheus.GaugeValue, float64(count[0]-count[1]),
+			ipam.Name(), pool)
+	}
+	orphaned, err := ipam.Orphans()
+	if err != nil {
+		glog.Warningf("[%s] failed to collect orphaned ips: %v", ipam.Name(), err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(orphanedDesc, prometheus.GaugeValue, float64(len(orphaned)), ipam.Name())
+}
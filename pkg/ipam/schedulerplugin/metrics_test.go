@@ -0,0 +1,102 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy/v1alpha1"
+)
+
+func TestIPAMCollector(t *testing.T) {
+	fipPlugin, stopChan := createCrdPlugin(t, nil)
+	defer func() { stopChan <- struct{}{} }()
+	if _, err := fipPlugin.CrdClient.GalaxyV1alpha1().Pools("kube-system").Create(&v1alpha1.Pool{
+		ObjectMeta: v1.ObjectMeta{Name: "pool1", Namespace: "kube-system"}, Size: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 3*time.Second, func() (bool, error) {
+		_, err := fipPlugin.PoolLister.Pools("kube-system").Get("pool1")
+		return err == nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for key, ip := range map[string]string{
+		"pool__pool1_":                 "10.49.27.205",
+		"pool__pool1_dp_ns1_dp1_dp1-1": "10.49.27.216",
+		"sts_ns1_sts1_sts1-0":          "10.173.13.2",
+	} {
+		if err := fipPlugin.ipam.AllocateSpecificIP(key, net.ParseIP(ip), constant.ReleasePolicyNever,
+			""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := `
+# HELP galaxy_ipam_orphaned_ips Number of allocated ips which are kept though they are no longer configured.
+# TYPE galaxy_ipam_orphaned_ips gauge
+galaxy_ipam_orphaned_ips{ipam="ipam"} 0
+# HELP galaxy_ipam_pool_allocated_ips Number of ips of each pool which are bound to pods.
+# TYPE galaxy_ipam_pool_allocated_ips gauge
+galaxy_ipam_pool_allocated_ips{ipam="ipam",pool="pool1"} 1
+# HELP galaxy_ipam_pool_capacity_ips Size of each pool.
+# TYPE galaxy_ipam_pool_capacity_ips gauge
+galaxy_ipam_pool_capacity_ips{pool="pool1"} 3
+# HELP galaxy_ipam_pool_free_ips Number of ips reserved by each pool which are not bound to any pod.
+# TYPE galaxy_ipam_pool_free_ips gauge
+galaxy_ipam_pool_free_ips{ipam="ipam",pool="pool1"} 1
+# HELP galaxy_ipam_subnet_allocated_ips Number of allocated ips of each routable subnet.
+# TYPE galaxy_ipam_subnet_allocated_ips gauge
+galaxy_ipam_subnet_allocated_ips{ipam="ipam",subnet="10.173.13.0/24"} 1
+galaxy_ipam_subnet_allocated_ips{ipam="ipam",subnet="10.180.1.2/32"} 0
+galaxy_ipam_subnet_allocated_ips{ipam="ipam",subnet="10.180.1.3/32"} 0
+galaxy_ipam_subnet_allocated_ips{ipam="ipam",subnet="10.49.27.0/24"} 2
+# HELP galaxy_ipam_subnet_free_ips Number of unallocated ips of each routable subnet.
+# TYPE galaxy_ipam_subnet_free_ips gauge
+galaxy_ipam_subnet_free_ips{ipam="ipam",subnet="10.173.13.0/24"} 5
+galaxy_ipam_subnet_free_ips{ipam="ipam",subnet="10.180.1.2/32"} 2
+galaxy_ipam_subnet_free_ips{ipam="ipam",subnet="10.180.1.3/32"} 2
+galaxy_ipam_subnet_free_ips{ipam="ipam",subnet="10.49.27.0/24"} 2
+# HELP galaxy_ipam_unreleased_queue_depth Number of pod events waiting for releasing ips.
+# TYPE galaxy_ipam_unreleased_queue_depth gauge
+galaxy_ipam_unreleased_queue_depth 0
+`
+	expect = strings.Replace(expect, `ipam="ipam"`, `ipam="`+fipPlugin.ipam.Name()+`"`, -1)
+	if err := testutil.CollectAndCompare(fipPlugin.NewCollector(), strings.NewReader(expect),
+		"galaxy_ipam_orphaned_ips", "galaxy_ipam_pool_allocated_ips", "galaxy_ipam_pool_capacity_ips",
+		"galaxy_ipam_pool_free_ips", "galaxy_ipam_subnet_allocated_ips", "galaxy_ipam_subnet_free_ips",
+		"galaxy_ipam_unreleased_queue_depth"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReleaseReason(t *testing.T) {
+	for reason, expect := range map[string]string{
+		deletedAndIPMutablePod:                          deletedAndIPMutablePod,
+		deletedAndScaledDownDpPod + " during resyncing": deletedAndScaledDownDpPod,
+	} {
+		if got := releaseReason(reason); got != expect {
+			t.Errorf("expect %s, got %s", expect, got)
+		}
+	}
+}
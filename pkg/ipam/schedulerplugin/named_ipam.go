@@ -0,0 +1,205 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/utils/database"
+)
+
+const (
+	// SecondIPAMName is the name of the second ipam, pods labeled galaxy.io/secondip select it
+	SecondIPAMName = "second"
+	// secondIPType is the ip type of the second ipam which existing FloatingIP and FloatingIPPool objects use
+	secondIPType = "externalIP"
+)
+
+// tableRegexp matches table names which can be used in sql without quoting
+var tableRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// namedIPAM is an ipam which pods select by name
+type namedIPAM struct {
+	ipam floatingip.IPAM
+	conf NamedIPAMConf
+	// lastConf is the last floatingip config applied to the ipam
+	lastConf string
+	hasConf  atomic.Value
+}
+
+func newNamedIPAM(ipam floatingip.IPAM, conf NamedIPAMConf) *namedIPAM {
+	named := &namedIPAM{ipam: ipam, conf: conf}
+	named.hasConf.Store(false)
+	return named
+}
+
+func (n *namedIPAM) configured() bool {
+	return n.hasConf.Load().(bool)
+}
+
+// checkNamedIPAMs returns an error if names, config keys, tables or ip types of named ipams conflict with each other
+// or with the first and the ipv6 ipam
+func checkNamedIPAMs(conf *Conf) error {
+	names := sets.NewString()
+	keys := sets.NewString(conf.FloatingIPKey, conf.IPv6FloatingIPKey, conf.NamespaceQuotaKey)
+	tables := sets.NewString(database.DefaultFloatingipTableName, database.IPv6FloatingipTableName,
+		database.HistoryTableName)
+	ipTypes := sets.NewString(internalIPType, ipv6IPType)
+	for _, named := range conf.NamedIPAMs {
+		if errs := validation.IsDNS1123Label(named.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid ipam name %q: %s", named.Name, strings.Join(errs, ", "))
+		}
+		if names.Has(named.Name) {
+			return fmt.Errorf("duplicate ipam name %s", named.Name)
+		}
+		if keys.Has(named.ConfigKey) {
+			return fmt.Errorf("config key %s of ipam %s is already used", named.ConfigKey, named.Name)
+		}
+		if !tableRegexp.MatchString(named.Table) {
+			return fmt.Errorf("invalid table %q of ipam %s, it should consist of letters, digits or '_'",
+				named.Table, named.Name)
+		}
+		if tables.Has(named.Table) {
+			return fmt.Errorf("table %s of ipam %s is already used", named.Table, named.Name)
+		}
+		if errs := validation.IsValidLabelValue(named.IPType); named.IPType == "" || len(errs) > 0 {
+			return fmt.Errorf("invalid ip type %q of ipam %s: %s", named.IPType, named.Name, strings.Join(errs, ", "))
+		}
+		if ipTypes.Has(named.IPType) {
+			return fmt.Errorf("ip type %s of ipam %s is already used", named.IPType, named.Name)
+		}
+		names.Insert(named.Name)
+		keys.Insert(named.ConfigKey)
+		tables.Insert(named.Table)
+		ipTypes.Insert(named.IPType)
+	}
+	return nil
+}
+
+// ipamNames returns names of named ipams of networks which the pod attaches, or named ipams which the pod selects by
+// the ipams annotation, or the second ipam if the pod has no such annotation but is labeled galaxy.io/secondip.
+// Pods attaching networks and also selecting ipams by the annotation or the label are rejected by checkNetworks.
+func (p *FloatingIPPlugin) ipamNames(pod *corev1.Pod) []string {
+	if networks, err := p.podNetworks(pod); err == nil && len(networks) > 0 {
+		return networkIPAMs(networks)
+	}
+	if val, ok := pod.Annotations[constant.IPAMsAnnotation]; ok {
+		var names []string
+		for _, name := range strings.Split(val, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	if wantSecondIP(pod) {
+		return []string{SecondIPAMName}
+	}
+	return nil
+}
+
+// wantIPAM returns true if the pod selects the named ipam
+func (p *FloatingIPPlugin) wantIPAM(pod *corev1.Pod, name string) bool {
+	for _, selected := range p.ipamNames(pod) {
+		if selected == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ipamsReason is the failed reason of nodes if a pod selects ipams which can't allocate ips
+const ipamsReason = "FloatingIPPlugin:InvalidIPAMs"
+
+// ipamsError is returned by getSubnet if the ipams or networks annotation of a pod selects unknown, duplicate or
+// unconfigured ipams
+type ipamsError struct {
+	msg string
+}
+
+func (e *ipamsError) Error() string {
+	return fmt.Sprintf("%s %s", ipamsReason, e.msg)
+}
+
+// checkIPAMs returns an ipamsError if the pod selects ipams by the annotations which can't allocate ips. Unconfigured
+// second ipam selected by the label is skipped instead as it always is.
+func (p *FloatingIPPlugin) checkIPAMs(pod *corev1.Pod) error {
+	if err := p.checkNetworks(pod); err != nil {
+		return err
+	}
+	networks, _ := p.podNetworks(pod)
+	if _, ok := pod.Annotations[constant.IPAMsAnnotation]; !ok && len(networks) == 0 {
+		return nil
+	}
+	selected := sets.NewString()
+	for _, name := range p.ipamNames(pod) {
+		named, ok := p.namedIPAMs[name]
+		if !ok {
+			return &ipamsError{msg: fmt.Sprintf("unknown ipam %s", name)}
+		}
+		if selected.Has(name) {
+			return &ipamsError{msg: fmt.Sprintf("ipam %s is selected more than once", name)}
+		}
+		if !named.configured() {
+			return &ipamsError{msg: fmt.Sprintf("ipam %s has no floatingips", name)}
+		}
+		selected.Insert(name)
+	}
+	return nil
+}
+
+// selectedIPAMs returns configured named ipams which the pod selects, in the order of its ipinfos
+func (p *FloatingIPPlugin) selectedIPAMs(pod *corev1.Pod) []floatingip.IPAM {
+	var ipams []floatingip.IPAM
+	for _, name := range p.selectedNames(pod) {
+		ipams = append(ipams, p.namedIPAMs[name].ipam)
+	}
+	return ipams
+}
+
+// selectedNames returns names of configured named ipams which the pod selects, in the order of its ipinfos
+func (p *FloatingIPPlugin) selectedNames(pod *corev1.Pod) []string {
+	var names []string
+	for _, name := range p.ipamNames(pod) {
+		if named, ok := p.namedIPAMs[name]; ok && named.configured() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// configuredIPAMs returns the first ipam, named ipams and the ipv6 ipam which have floatingips configured
+func (p *FloatingIPPlugin) configuredIPAMs() []floatingip.IPAM {
+	ipams := []floatingip.IPAM{p.ipam}
+	for _, c := range p.conf.NamedIPAMs {
+		if named := p.namedIPAMs[c.Name]; named.configured() {
+			ipams = append(ipams, named.ipam)
+		}
+	}
+	if p.hasIPv6Conf.Load().(bool) {
+		ipams = append(ipams, p.ipv6IPAM)
+	}
+	return ipams
+}
@@ -0,0 +1,145 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	fakeV1 "k8s.io/client-go/kubernetes/typed/core/v1/fake"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/api/k8s/schedulerapi"
+	. "tkestack.io/galaxy/pkg/ipam/schedulerplugin/testing"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+)
+
+func TestCheckNamedIPAMs(t *testing.T) {
+	conf := Conf{NamedIPAMs: []NamedIPAMConf{{Name: "storage"}, {Name: "storage-net"}}}
+	conf.Validate()
+	expect := []NamedIPAMConf{
+		{Name: SecondIPAMName, ConfigKey: "second_floatingips", Table: "ip_pool1", IPType: "externalIP"},
+		{Name: "storage", ConfigKey: "storage_floatingips", Table: "ip_pool_storage", IPType: "storage"},
+		{Name: "storage-net", ConfigKey: "storage-net_floatingips", Table: "ip_pool_storage_net",
+			IPType: "storage-net"},
+	}
+	if len(conf.NamedIPAMs) != len(expect) {
+		t.Fatalf("expect %+v, real %+v", expect, conf.NamedIPAMs)
+	}
+	for i := range expect {
+		if conf.NamedIPAMs[i] != expect[i] {
+			t.Fatalf("expect %+v, real %+v", expect[i], conf.NamedIPAMs[i])
+		}
+	}
+	if err := checkNamedIPAMs(&conf); err != nil {
+		t.Fatal(err)
+	}
+	for _, named := range []NamedIPAMConf{
+		{Name: "Storage"},
+		{Name: "storage"},
+		{Name: "mgr", ConfigKey: "floatingips"},
+		{Name: "v6"},
+		{Name: "mgr", IPType: "internalIP"},
+		{Name: "mgr", Table: "ip-pool-mgr"},
+		{Name: "mgr", Table: "ip_pool_mgr;"},
+		{Name: "mgr", IPType: "mgr/ip"},
+	} {
+		invalid := Conf{NamedIPAMs: append([]NamedIPAMConf{}, conf.NamedIPAMs...)}
+		invalid.NamedIPAMs = append(invalid.NamedIPAMs, named)
+		invalid.Validate()
+		if err := checkNamedIPAMs(&invalid); err == nil {
+			t.Errorf("expect an error for %+v", named)
+		}
+	}
+}
+
+// #lizard forgives
+func TestBindNamedIPAMs(t *testing.T) {
+	node := createNode(node3, nil, "10.49.27.3")
+	pod := CreateStatefulSetPod("sts-0", "ns1", map[string]string{constant.IPAMsAnnotation: "storage, second"})
+	unknownPod := CreateStatefulSetPod("sts-1", "ns1", map[string]string{constant.IPAMsAnnotation: "storage,net2"})
+	unconfiguredPod := CreateStatefulSetPod("sts-2", "ns1", map[string]string{constant.IPAMsAnnotation: "mgr"})
+	fipPlugin, stopChan := createCrdPlugin(t, func(conf *Conf) {
+		conf.NamedIPAMs = []NamedIPAMConf{{Name: "storage"}, {Name: "mgr"}}
+	}, pod, unknownPod, unconfiguredPod, &node)
+	defer func() { stopChan <- struct{}{} }()
+	// ips of each ipam are disjoint since FloatingIP objects are named by ips
+	if err := fipPlugin.updateIPAMConfFromConfigMap(&corev1.ConfigMap{Data: map[string]string{
+		"floatingips": `[{"routableSubnet":"10.49.27.0/24","ips":["10.49.27.205"],"subnet":"10.49.27.0/24",` +
+			`"gateway":"10.49.27.1"}]`,
+		"second_floatingips": `[{"routableSubnet":"10.49.27.0/24","ips":["10.50.0.2"],"subnet":"10.50.0.0/24",` +
+			`"gateway":"10.50.0.1"}]`,
+		"storage_floatingips": `[{"routableSubnet":"10.49.27.0/24","ips":["10.60.0.2"],"subnet":"10.60.0.0/24",` +
+			`"gateway":"10.60.0.1"}]`,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 3*time.Second, func() (bool, error) {
+		_, err := fipPlugin.PodLister.Pods(pod.Namespace).Get(pod.Name)
+		return err == nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		pod    *corev1.Pod
+		reason string
+	}{
+		{pod: pod},
+		{pod: unknownPod, reason: ipamsReason + " unknown ipam net2"},
+		{pod: unconfiguredPod, reason: ipamsReason + " ipam mgr has no floatingips"},
+	} {
+		_, failed, err := fipPlugin.Filter(c.pod, []corev1.Node{node})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failed[node.Name] != c.reason {
+			t.Errorf("pod %s: expect failed reason %q, real %q", c.pod.Name, c.reason, failed[node.Name])
+		}
+	}
+	if err := fipPlugin.Bind(&schedulerapi.ExtenderBindingArgs{PodName: pod.Name, PodNamespace: pod.Namespace,
+		Node: node.Name}); err != nil {
+		t.Fatal(err)
+	}
+	binding, err := fipPlugin.Client.CoreV1().Pods(pod.Namespace).(*fakeV1.FakePods).GetBinding(pod.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipInfos, err := constant.ParseIPInfo(binding.Annotations[constant.ExtendedCNIArgsAnnotation])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ips []string
+	for i := range ipInfos {
+		ips = append(ips, ipInfos[i].IP.IP.String())
+	}
+	// one ipinfo for each network in the order of the first ipam and the annotation
+	if strings.Join(ips, ",") != "10.49.27.205,10.60.0.2,10.50.0.2" {
+		t.Fatalf("unexpected ips %v", ips)
+	}
+	// releasing ips of the pod releases ips of the ipams it selects
+	if _, err := fipPlugin.releaseIP(util.FormatKey(pod).KeyInDB, deletedAndIPMutablePod, pod); err != nil {
+		t.Fatal(err)
+	}
+	for name, ip := range map[string]string{SecondIPAMName: "10.50.0.2", "storage": "10.60.0.2"} {
+		if err := checkIPKey(fipPlugin.namedIPAMs[name].ipam, ip, ""); err != nil {
+			t.Errorf("[%s] %v", name, err)
+		}
+	}
+}
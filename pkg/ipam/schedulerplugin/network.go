@@ -0,0 +1,145 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/api/galaxy/private"
+	"tkestack.io/galaxy/pkg/api/k8s"
+)
+
+// checkNetworks returns an error if networks are duplicate or bound to unknown ipams
+func checkNetworks(conf *Conf) error {
+	ipams := sets.NewString("")
+	for _, named := range conf.NamedIPAMs {
+		ipams.Insert(named.Name)
+	}
+	names := sets.NewString()
+	for _, network := range conf.Networks {
+		if errs := validation.IsDNS1123Label(network.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid network name %q: %s", network.Name, strings.Join(errs, ", "))
+		}
+		if names.Has(network.Name) {
+			return fmt.Errorf("duplicate network %s", network.Name)
+		}
+		if !ipams.Has(network.IPAM) {
+			return fmt.Errorf("unknown ipam %s of network %s", network.IPAM, network.Name)
+		}
+		names.Insert(network.Name)
+	}
+	return nil
+}
+
+// podNetworks returns networks which the pod attaches by multus annotation and are bound to ipams, in the order of
+// the annotation. Other networks of the pod don't get ips from galaxy-ipam.
+func (p *FloatingIPPlugin) podNetworks(pod *corev1.Pod) ([]NetworkConf, error) {
+	val := pod.Annotations[constant.MultusCNIAnnotation]
+	if len(p.conf.Networks) == 0 || val == "" {
+		return nil, nil
+	}
+	selections, err := k8s.ParsePodNetworkAnnotation(val)
+	if err != nil {
+		return nil, err
+	}
+	var networks []NetworkConf
+	for _, selection := range selections {
+		for _, network := range p.conf.Networks {
+			if network.Name == selection.Name {
+				networks = append(networks, network)
+				break
+			}
+		}
+	}
+	return networks, nil
+}
+
+// checkNetworks returns an ipamsError if the multus annotation of the pod is invalid, or the pod attaches networks
+// bound to ipams but also selects ipams by the ipams annotation or the secondip label, or not exactly one of its
+// networks draws from the first ipam
+func (p *FloatingIPPlugin) checkNetworks(pod *corev1.Pod) error {
+	networks, err := p.podNetworks(pod)
+	if err != nil {
+		return &ipamsError{msg: err.Error()}
+	}
+	if len(networks) == 0 {
+		return nil
+	}
+	if _, ok := pod.Annotations[constant.IPAMsAnnotation]; ok {
+		return &ipamsError{msg: fmt.Sprintf("%s annotation conflicts with networks of %s annotation",
+			constant.IPAMsAnnotation, constant.MultusCNIAnnotation)}
+	}
+	if wantSecondIP(pod) {
+		return &ipamsError{msg: fmt.Sprintf("%s label conflicts with networks of %s annotation",
+			private.LabelKeyEnableSecondIP, constant.MultusCNIAnnotation)}
+	}
+	var first string
+	for _, network := range networks {
+		if network.IPAM != "" {
+			continue
+		}
+		if first != "" {
+			return &ipamsError{msg: fmt.Sprintf("networks %s and %s both draw from the first ipam", first,
+				network.Name)}
+		}
+		first = network.Name
+	}
+	if first == "" {
+		// the ip of the first ipam would belong to none of the networks
+		return &ipamsError{msg: "none of the networks draws from the first ipam"}
+	}
+	return nil
+}
+
+// setIPInfoNetworks sets networks of ipinfos of the pod which are in the order of the first ipam, named ipams which
+// the pod selects and then ipv6 ip. The ipv6 ip belongs to the network of the first ipam. Ipinfos are left untagged
+// if the pod doesn't attach networks bound to ipams, otherwise checkNetworks ensures all of them are tagged.
+func (p *FloatingIPPlugin) setIPInfoNetworks(pod *corev1.Pod, ipInfos []constant.IPInfo) {
+	networks, _ := p.podNetworks(pod)
+	if len(networks) == 0 {
+		return
+	}
+	// ipam name to network name
+	byIPAM := map[string]string{}
+	for _, network := range networks {
+		byIPAM[network.IPAM] = network.Name
+	}
+	names := append([]string{""}, p.selectedNames(pod)...)
+	for i := range ipInfos {
+		if i < len(names) {
+			ipInfos[i].Network = byIPAM[names[i]]
+		} else {
+			ipInfos[i].Network = byIPAM[""]
+		}
+	}
+}
+
+// networkIPAMs returns names of ipams of the networks except the first ipam
+func networkIPAMs(networks []NetworkConf) []string {
+	var names []string
+	for _, network := range networks {
+		if network.IPAM != "" {
+			names = append(names, network.IPAM)
+		}
+	}
+	return names
+}
@@ -0,0 +1,127 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	fakeV1 "k8s.io/client-go/kubernetes/typed/core/v1/fake"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/api/k8s/schedulerapi"
+	. "tkestack.io/galaxy/pkg/ipam/schedulerplugin/testing"
+)
+
+func TestCheckNetworks(t *testing.T) {
+	conf := Conf{NamedIPAMs: []NamedIPAMConf{{Name: "storage"}},
+		Networks: []NetworkConf{{Name: "galaxy-k8s-vlan"}, {Name: "galaxy-k8s-sriov", IPAM: "storage"}}}
+	conf.Validate()
+	if err := checkNetworks(&conf); err != nil {
+		t.Fatal(err)
+	}
+	for _, network := range []NetworkConf{
+		{Name: "Galaxy"},
+		{Name: "galaxy-k8s-vlan", IPAM: SecondIPAMName},
+		{Name: "galaxy-underlay", IPAM: "mgr"},
+	} {
+		invalid := conf
+		invalid.Networks = append(append([]NetworkConf{}, conf.Networks...), network)
+		if err := checkNetworks(&invalid); err == nil {
+			t.Errorf("expect an error for %+v", network)
+		}
+	}
+}
+
+// #lizard forgives
+func TestBindNetworks(t *testing.T) {
+	node := createNode(node3, nil, "10.49.27.3")
+	// galaxy-flannel is not bound to any ipam
+	pod := CreateStatefulSetPod("sts-0", "ns1", map[string]string{
+		constant.MultusCNIAnnotation: "galaxy-flannel,galaxy-k8s-sriov,galaxy-k8s-vlan"})
+	invalidPod := CreateStatefulSetPod("sts-1", "ns1", map[string]string{
+		constant.MultusCNIAnnotation: "galaxy-k8s-vlan,galaxy-underlay"})
+	annotatedPod := CreateStatefulSetPod("sts-2", "ns1", map[string]string{
+		constant.MultusCNIAnnotation: "galaxy-k8s-vlan", constant.IPAMsAnnotation: SecondIPAMName})
+	labeledPod := CreateStatefulSetPodWithLabels("sts-3", "ns1", secondIPLabel, map[string]string{
+		constant.MultusCNIAnnotation: "galaxy-k8s-vlan"})
+	noFirstPod := CreateStatefulSetPod("sts-4", "ns1", map[string]string{
+		constant.MultusCNIAnnotation: "galaxy-flannel,galaxy-k8s-sriov"})
+	fipPlugin, stopChan := createCrdPlugin(t, func(conf *Conf) {
+		conf.NamedIPAMs = []NamedIPAMConf{{Name: "storage"}}
+		conf.Networks = []NetworkConf{{Name: "galaxy-k8s-vlan"}, {Name: "galaxy-k8s-sriov", IPAM: "storage"},
+			{Name: "galaxy-underlay"}}
+	}, pod, invalidPod, annotatedPod, labeledPod, noFirstPod, &node)
+	defer func() { stopChan <- struct{}{} }()
+	if err := fipPlugin.updateIPAMConfFromConfigMap(&corev1.ConfigMap{Data: map[string]string{
+		"floatingips": `[{"routableSubnet":"10.49.27.0/24","ips":["10.49.27.205"],"subnet":"10.49.27.0/24",` +
+			`"gateway":"10.49.27.1"}]`,
+		"storage_floatingips": `[{"routableSubnet":"10.49.27.0/24","ips":["10.60.0.2"],"subnet":"10.60.0.0/24",` +
+			`"gateway":"10.60.0.1"}]`,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 3*time.Second, func() (bool, error) {
+		_, err := fipPlugin.PodLister.Pods(pod.Namespace).Get(pod.Name)
+		return err == nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		pod    *corev1.Pod
+		reason string
+	}{
+		{pod: pod},
+		{pod: invalidPod, reason: ipamsReason + " networks galaxy-k8s-vlan and galaxy-underlay both draw from the " +
+			"first ipam"},
+		{pod: annotatedPod, reason: ipamsReason + " " + constant.IPAMsAnnotation + " annotation conflicts with " +
+			"networks of " + constant.MultusCNIAnnotation + " annotation"},
+		{pod: labeledPod, reason: ipamsReason + " galaxy.io/secondip label conflicts with networks of " +
+			constant.MultusCNIAnnotation + " annotation"},
+		{pod: noFirstPod, reason: ipamsReason + " none of the networks draws from the first ipam"},
+	} {
+		_, failed, err := fipPlugin.Filter(c.pod, []corev1.Node{node})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failed[node.Name] != c.reason {
+			t.Errorf("pod %s: expect failed reason %q, real %q", c.pod.Name, c.reason, failed[node.Name])
+		}
+	}
+	if err := fipPlugin.Bind(&schedulerapi.ExtenderBindingArgs{PodName: pod.Name, PodNamespace: pod.Namespace,
+		Node: node.Name}); err != nil {
+		t.Fatal(err)
+	}
+	binding, err := fipPlugin.Client.CoreV1().Pods(pod.Namespace).(*fakeV1.FakePods).GetBinding(pod.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipInfos, err := constant.ParseIPInfo(binding.Annotations[constant.ExtendedCNIArgsAnnotation])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{"10.49.27.205": "galaxy-k8s-vlan", "10.60.0.2": "galaxy-k8s-sriov"}
+	if len(ipInfos) != len(expect) {
+		t.Fatalf("expect ipinfos of %v, real %+v", expect, ipInfos)
+	}
+	for i := range ipInfos {
+		if network := expect[ipInfos[i].IP.IP.String()]; ipInfos[i].Network != network {
+			t.Errorf("expect ip %s of network %s, real %s", ipInfos[i].IP.IP.String(), network, ipInfos[i].Network)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metaErrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+)
+
+// addNodeEventHandler invalidates and recomputes subnets of nodes once their ips or declared subnets change
+func (p *FloatingIPPlugin) addNodeEventHandler() {
+	p.NodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, ok1 := oldObj.(*corev1.Node)
+			newNode, ok2 := newObj.(*corev1.Node)
+			if !ok1 || !ok2 || nodeSubnetSource(oldNode) == nodeSubnetSource(newNode) {
+				return
+			}
+			p.refreshNodeSubnet(newNode)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			node, ok := obj.(*corev1.Node)
+			if !ok {
+				return
+			}
+			p.nodeSubnetLock.Lock()
+			defer p.nodeSubnetLock.Unlock()
+			delete(p.nodeSubnet, node.Name)
+		},
+	})
+}
+
+// refreshNodeSubnet recomputes the cached subnet of node
+func (p *FloatingIPPlugin) refreshNodeSubnet(node *corev1.Node) {
+	p.nodeSubnetLock.Lock()
+	defer p.nodeSubnetLock.Unlock()
+	delete(p.nodeSubnet, node.Name)
+	subnet, err := p.getNodeSubnetfromIPAM(node)
+	if err != nil {
+		glog.V(3).Infof("invalidated subnet of node %s: %v", node.Name, err)
+		return
+	}
+	glog.V(3).Infof("refreshed subnet of node %s to %s", node.Name, subnet.String())
+}
+
+// resetNodeSubnet clears the node subnet cache, e.g. after routable subnets of the config change
+func (p *FloatingIPPlugin) resetNodeSubnet() {
+	p.nodeSubnetLock.Lock()
+	defer p.nodeSubnetLock.Unlock()
+	p.nodeSubnet = make(map[string]*net.IPNet)
+}
+
+// nodeSubnetSource returns the declared subnet of node if any, otherwise the ip of it
+func nodeSubnetSource(node *corev1.Node) string {
+	if declared, ok := node.Annotations[constant.NodeRoutableSubnetAnnotation]; ok {
+		return declared
+	}
+	if nodeIP := getNodeIP(node); nodeIP != nil {
+		return nodeIP.String()
+	}
+	return ""
+}
+
+func getNodeIP(node *corev1.Node) net.IP {
+	for i := range node.Status.Addresses {
+		if node.Status.Addresses[i].Type == corev1.NodeInternalIP {
+			return net.ParseIP(node.Status.Addresses[i].Address)
+		}
+	}
+	return nil
+}
+
+// getNodeSubnet gets node subnet from ipam
+func (p *FloatingIPPlugin) getNodeSubnet(node *corev1.Node) (*net.IPNet, error) {
+	p.nodeSubnetLock.Lock()
+	defer p.nodeSubnetLock.Unlock()
+	if subnet, ok := p.nodeSubnet[node.Name]; ok {
+		return subnet, nil
+	}
+	return p.getNodeSubnetfromIPAM(node)
+}
+
+// queryNodeSubnet gets node subnet from ipam, the node is got from the node lister if there is one, otherwise from
+// apiserver
+func (p *FloatingIPPlugin) queryNodeSubnet(nodeName string) (*net.IPNet, error) {
+	p.nodeSubnetLock.Lock()
+	subnet, ok := p.nodeSubnet[nodeName]
+	p.nodeSubnetLock.Unlock()
+	if ok {
+		return subnet, nil
+	}
+	// don't hold the lock while querying apiserver
+	node, err := p.getNode(nodeName)
+	if err != nil {
+		return nil, err
+	}
+	return p.getNodeSubnet(node)
+}
+
+// getNode gets node from the node lister, or from apiserver if there is no lister or the lister doesn't see it yet
+func (p *FloatingIPPlugin) getNode(nodeName string) (*corev1.Node, error) {
+	if p.NodeInformer != nil {
+		node, err := p.NodeInformer.Lister().Get(nodeName)
+		if err == nil {
+			return node, nil
+		} else if !metaErrs.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	var node *corev1.Node
+	if err := wait.Poll(time.Millisecond*100, time.Minute, func() (done bool, err error) {
+		node, err = p.Client.CoreV1().Nodes().Get(nodeName, v1.GetOptions{})
+		if !metaErrs.IsServerTimeout(err) {
+			return true, err
+		}
+		return false, nil
+	}); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// getNodeSubnetfromIPAM gets node subnet from ipam by the declared subnet or the ip of node, and caches it.
+// nodeSubnetLock must be held by the caller
+func (p *FloatingIPPlugin) getNodeSubnetfromIPAM(node *corev1.Node) (*net.IPNet, error) {
+	var ipNet *net.IPNet
+	if declared, ok := node.Annotations[constant.NodeRoutableSubnetAnnotation]; ok {
+		_, declaredNet, err := net.ParseCIDR(declared)
+		if err != nil {
+			return nil, fmt.Errorf("FloatingIPPlugin:InvalidNodeSubnet %s", declared)
+		}
+		// the declared subnet must be a configured routable subnet
+		if ipNet = p.ipam.RoutableSubnet(declaredNet.IP); ipNet == nil || ipNet.String() != declaredNet.String() {
+			return nil, errors.New("FloatingIPPlugin:NoFIPConfigNode")
+		}
+		glog.V(4).Infof("node %s declares %s", node.Name, ipNet.String())
+	} else {
+		nodeIP := getNodeIP(node)
+		if nodeIP == nil {
+			return nil, errors.New("FloatingIPPlugin:UnknowNode")
+		}
+		if ipNet = p.ipam.RoutableSubnet(nodeIP); ipNet == nil {
+			return nil, errors.New("FloatingIPPlugin:NoFIPConfigNode")
+		}
+		glog.V(4).Infof("node %s %s %s", node.Name, nodeIP.String(), ipNet.String())
+	}
+	p.nodeSubnet[node.Name] = ipNet
+	return ipNet, nil
+}
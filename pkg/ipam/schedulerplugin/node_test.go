@@ -0,0 +1,117 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+)
+
+// #lizard forgives
+func TestNodeSubnetCache(t *testing.T) {
+	node := createNode(node3, nil, "10.49.27.3")
+	fipPlugin, stopChan := createCrdPlugin(t, nil, &node)
+	defer func() { stopChan <- struct{}{} }()
+	// waitSubnet waits until the cached subnet of node3 is expect, or is not cached if expect is empty
+	waitSubnet := func(expect string) {
+		if err := wait.PollImmediate(10*time.Millisecond, 3*time.Second, func() (bool, error) {
+			fipPlugin.nodeSubnetLock.Lock()
+			defer fipPlugin.nodeSubnetLock.Unlock()
+			subnet, ok := fipPlugin.nodeSubnet[node3]
+			if expect == "" {
+				return !ok, nil
+			}
+			return ok && subnet.String() == expect, nil
+		}); err != nil {
+			t.Fatalf("expect subnet %q of node %s", expect, node3)
+		}
+	}
+	if subnet, err := fipPlugin.queryNodeSubnet(node3); err != nil || subnet.String() != "10.49.27.0/24" {
+		t.Fatalf("expect 10.49.27.0/24, real %v, err %v", subnet, err)
+	}
+	nodes := fipPlugin.Client.CoreV1().Nodes()
+	update := func(mutate func(node *corev1.Node)) {
+		mutate(&node)
+		if _, err := nodes.Update(&node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// ip of the node changes
+	update(func(node *corev1.Node) {
+		node.Status.Addresses[0].Address = "10.173.13.4"
+	})
+	waitSubnet("10.173.13.0/24")
+	// the declared subnet overrides the ip of the node
+	update(func(node *corev1.Node) {
+		node.Annotations = map[string]string{constant.NodeRoutableSubnetAnnotation: "10.180.1.2/32"}
+	})
+	waitSubnet("10.180.1.2/32")
+	// subnets which are not configured can't be declared
+	update(func(node *corev1.Node) {
+		node.Annotations[constant.NodeRoutableSubnetAnnotation] = "10.180.0.0/16"
+	})
+	waitSubnet("")
+	if _, err := fipPlugin.queryNodeSubnet(node3); err == nil || err.Error() != "FloatingIPPlugin:NoFIPConfigNode" {
+		t.Fatalf("expect NoFIPConfigNode, real %v", err)
+	}
+	update(func(node *corev1.Node) {
+		node.Annotations[constant.NodeRoutableSubnetAnnotation] = "10.180.1.3/32"
+	})
+	waitSubnet("10.180.1.3/32")
+	if err := nodes.Delete(node3, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitSubnet("")
+}
+
+func TestDeclaredNodeSubnet(t *testing.T) {
+	fipPlugin, stopChan := createCrdPlugin(t, nil)
+	defer func() { stopChan <- struct{}{} }()
+	for i, c := range []struct {
+		declared, address, expect, expectErr string
+	}{
+		{address: "10.49.27.3", expect: "10.49.27.0/24"},
+		{declared: "10.173.13.0/24", address: "10.49.27.3", expect: "10.173.13.0/24"},
+		{declared: "10.173.13.0", address: "10.49.27.3", expectErr: "FloatingIPPlugin:InvalidNodeSubnet 10.173.13.0"},
+		{declared: "10.173.0.0/16", address: "10.49.27.3", expectErr: "FloatingIPPlugin:NoFIPConfigNode"},
+		{address: "10.49.28.2", expectErr: "FloatingIPPlugin:NoFIPConfigNode"},
+		{expectErr: "FloatingIPPlugin:UnknowNode"},
+	} {
+		node := createNode(node3, nil, c.address)
+		if c.address == "" {
+			node.Status.Addresses = nil
+		}
+		if c.declared != "" {
+			node.Annotations = map[string]string{constant.NodeRoutableSubnetAnnotation: c.declared}
+		}
+		fipPlugin.resetNodeSubnet()
+		subnet, err := fipPlugin.getNodeSubnet(&node)
+		if c.expectErr != "" {
+			if err == nil || err.Error() != c.expectErr {
+				t.Errorf("case %d: expect err %s, real %v", i, c.expectErr, err)
+			}
+			continue
+		}
+		if err != nil || subnet.String() != c.expect {
+			t.Errorf("case %d: expect %s, real %v, err %v", i, c.expect, subnet, err)
+		}
+	}
+}
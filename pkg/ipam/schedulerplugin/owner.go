@@ -0,0 +1,64 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	metaErrs "k8s.io/apimachinery/pkg/api/errors"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+)
+
+// registerOwnerResolvers registers resolvers of builtin app types which get apps by listers or clients of the plugin
+func (p *FloatingIPPlugin) registerOwnerResolvers() error {
+	for _, r := range []util.OwnerResolver{
+		&util.OwnerKindResolver{Type: "statefulset", Prefix: util.StatefulsetPrefixKey, Kind: "StatefulSet",
+			AppFunc: p.statefulSetApp},
+		&util.OwnerKindResolver{Type: "tapp", Prefix: util.TAppPrefixKey, Kind: "TApp", AppFunc: p.tappApp},
+		&util.OwnerKindResolver{Type: "daemonset", Prefix: util.DaemonSetPrefixKey, Kind: "DaemonSet",
+			AppFunc: p.daemonSetApp},
+		// pods of cronjobs are owned by jobs
+		&util.OwnerKindResolver{Type: "job", Prefix: util.JobPrefixKey, Kind: "Job", AppFunc: p.jobApp},
+	} {
+		if err := util.RegisterOwnerResolver(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// daemonSetApp returns whether the daemonset exists. Pod names of daemonsets have no ordinal.
+func (p *FloatingIPPlugin) daemonSetApp(namespace, name string) (bool, int32, error) {
+	ds, err := p.DaemonSetLister.DaemonSets(namespace).Get(name)
+	if err != nil {
+		if metaErrs.IsNotFound(err) {
+			return false, 0, nil
+		}
+		return false, 0, err
+	}
+	return p.hasResourceName(&ds.Spec.Template.Spec), util.NoOrdinal, nil
+}
+
+// jobApp returns whether the job exists. Pod names of jobs have no ordinal.
+func (p *FloatingIPPlugin) jobApp(namespace, name string) (bool, int32, error) {
+	job, err := p.JobLister.Jobs(namespace).Get(name)
+	if err != nil {
+		if metaErrs.IsNotFound(err) {
+			return false, 0, nil
+		}
+		return false, 0, err
+	}
+	return p.hasResourceName(&job.Spec.Template.Spec), util.NoOrdinal, nil
+}
@@ -0,0 +1,65 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"net"
+	"testing"
+
+	appv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	. "tkestack.io/galaxy/pkg/ipam/schedulerplugin/testing"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+)
+
+func TestResyncDaemonSetPod(t *testing.T) {
+	pod := CreateStatefulSetPod("ds1-x1", "ns1", immutableAnnotation)
+	pod.OwnerReferences[0].Kind = "DaemonSet"
+	neverPod := CreateStatefulSetPod("ds1-x2", "ns1", neverAnnotation)
+	neverPod.OwnerReferences[0].Kind = "DaemonSet"
+	ds := &appv1.DaemonSet{
+		ObjectMeta: v1.ObjectMeta{Name: "ds1", Namespace: "ns1"},
+		Spec:       appv1.DaemonSetSpec{Template: corev1.PodTemplateSpec{Spec: pod.Spec}},
+	}
+	fipPlugin, stopChan, _ := createPluginTestNodes(t, ds)
+	defer func() { stopChan <- struct{}{} }()
+	if !cache.WaitForCacheSync(stopChan, fipPlugin.DaemonSetSynced) {
+		t.Fatal("daemonset store is not synced")
+	}
+	keyObj, neverKeyObj := util.FormatKey(pod), util.FormatKey(neverPod)
+	if keyObj.KeyInDB != "ds_ns1_ds1_ds1-x1" {
+		t.Fatalf("unexpected key %s", keyObj.KeyInDB)
+	}
+	for ip, p := range map[string]*corev1.Pod{"10.49.27.205": pod, "10.49.27.216": neverPod} {
+		if err := fipPlugin.ipam.AllocateSpecificIP(util.FormatKey(p).KeyInDB, net.ParseIP(ip),
+			parseReleasePolicy(&p.ObjectMeta), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// daemonset pods have no ordinal, ips of deleted immutable pods are released even if the daemonset exists
+	if err := fipPlugin.resyncPod(fipPlugin.ipam); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkIPKey(fipPlugin.ipam, "10.49.27.205", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkIPKey(fipPlugin.ipam, "10.49.27.216", neverKeyObj.KeyInDB); err != nil {
+		t.Fatal(err)
+	}
+}
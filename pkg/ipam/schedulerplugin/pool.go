@@ -0,0 +1,302 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	metaErrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy/v1alpha1"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/metrics"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+	"tkestack.io/galaxy/pkg/utils/database"
+)
+
+// poolReconcileInterval is the interval of reconciling pools besides changes of Pool objects
+const poolReconcileInterval = 30 * time.Second
+
+// addPoolEventHandler triggers reconciling pools once spec of Pool objects change or they are deleted
+func (p *FloatingIPPlugin) addPoolEventHandler() {
+	p.PoolInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			p.enqueuePoolReconcile()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPool, ok1 := oldObj.(*v1alpha1.Pool)
+			newPool, ok2 := newObj.(*v1alpha1.Pool)
+			// ignore status updates
+			if ok1 && ok2 && oldPool.Size == newPool.Size && oldPool.PreAllocateIP == newPool.PreAllocateIP {
+				return
+			}
+			p.enqueuePoolReconcile()
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			pool, ok := obj.(*v1alpha1.Pool)
+			if !ok || pool.Namespace != p.conf.PoolNamespace {
+				return
+			}
+			// standby replicas don't run reconciling loop, so just remember deleted pools and leave releasing
+			// ips to the loop
+			p.deletedPoolsLock.Lock()
+			p.deletedPools.Insert(pool.Name)
+			p.deletedPoolsLock.Unlock()
+			p.enqueuePoolReconcile()
+		},
+	})
+}
+
+func (p *FloatingIPPlugin) enqueuePoolReconcile() {
+	select {
+	case p.poolReconcile <- struct{}{}:
+	default:
+		// a reconciliation is pending which will see this change
+	}
+}
+
+// poolReconcileLoop reconciles pools whenever they change
+func (p *FloatingIPPlugin) poolReconcileLoop(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-p.poolReconcile:
+			if err := p.reconcilePools(); err != nil {
+				glog.Warningf("failed to reconcile pools: %v", err)
+			}
+		}
+	}
+}
+
+// reconcilePools releases ips reserved by deleted pools and reconciles ips reserved by each pool with its size
+func (p *FloatingIPPlugin) reconcilePools() error {
+	p.deletedPoolsLock.Lock()
+	deleted := p.deletedPools
+	p.deletedPools = sets.NewString()
+	p.deletedPoolsLock.Unlock()
+	for _, name := range deleted.List() {
+		if _, err := p.PoolInformer.Lister().Pools(p.conf.PoolNamespace).Get(name); err == nil {
+			// recreated
+			continue
+		}
+		if err := p.releasePool(name); err != nil {
+			glog.Warningf("failed to release ips of deleted pool %s: %v", name, err)
+		}
+	}
+	// pools api and deployment pods only take pools in the pool namespace into account
+	pools, err := p.PoolInformer.Lister().Pools(p.conf.PoolNamespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		if err := p.reconcilePool(pool); err != nil {
+			glog.Warningf("failed to reconcile pool %s: %v", pool.Name, err)
+		}
+	}
+	return nil
+}
+
+// reconcilePool allocates ips to the pool if it pre-allocates ips and holds less ips than its size, or releases
+// unbound ips if it holds more ips than its size. Pods of the pool may use extra ipams, which are reconciled as well
+// once they hold ips of the pool. Status of the pool is updated with the ips it holds in the first ipam afterwards.
+func (p *FloatingIPPlugin) reconcilePool(pool *v1alpha1.Pool) error {
+	poolPrefix := util.NewKeyObj(util.DeploymentPrefixKey, "", "", "", pool.Name).PoolPrefix()
+	// unbindDpPod and preAllocateIP of pool api lock the same pool prefix
+	lockIndex := p.dpLockPool.GetLockIndex([]byte(poolPrefix))
+	p.dpLockPool.RawLock(lockIndex)
+	defer p.dpLockPool.RawUnlock(lockIndex)
+	for _, ipam := range p.configuredIPAMs() {
+		fips, err := ipam.ByPrefix(poolPrefix)
+		if err != nil {
+			return err
+		}
+		if ipam != p.ipam && len(fips) == 0 {
+			continue
+		}
+		if len(fips) < pool.Size && pool.PreAllocateIP {
+			if err := growPool(ipam, poolPrefix, pool.Size-len(fips)); err != nil {
+				glog.Warningf("[%s] failed to grow pool %s to size %d: %v", ipam.Name(), pool.Name, pool.Size, err)
+			}
+		} else if len(fips) > pool.Size {
+			if err := shrinkPool(ipam, poolPrefix, fips, len(fips)-pool.Size, scaledDownPool); err != nil {
+				glog.Warningf("[%s] failed to shrink pool %s to size %d: %v", ipam.Name(), pool.Name, pool.Size,
+					err)
+			}
+		}
+	}
+	fips, err := p.ipam.ByPrefix(poolPrefix)
+	if err != nil {
+		return err
+	}
+	return p.updatePoolStatus(pool, poolPrefix, fips)
+}
+
+// releasePool releases ips of the deleted pool which are not bound to any pod in all ipams, bound ones are released
+// along with their pods
+func (p *FloatingIPPlugin) releasePool(name string) error {
+	poolPrefix := util.NewKeyObj(util.DeploymentPrefixKey, "", "", "", name).PoolPrefix()
+	lockIndex := p.dpLockPool.GetLockIndex([]byte(poolPrefix))
+	p.dpLockPool.RawLock(lockIndex)
+	defer p.dpLockPool.RawUnlock(lockIndex)
+	for _, ipam := range p.configuredIPAMs() {
+		fips, err := ipam.ByPrefix(poolPrefix)
+		if err != nil {
+			return err
+		}
+		if err := shrinkPool(ipam, poolPrefix, fips, len(fips), deletedPool); err != nil {
+			return fmt.Errorf("[%s] %v", ipam.Name(), err)
+		}
+	}
+	return nil
+}
+
+// growPool allocates num ips to the pool from any subnet which has unallocated ips
+func growPool(ipam floatingip.IPAM, poolPrefix string, num int) error {
+	ipam = floatingip.WithReason(ipam, "", "reconciling pool")
+	subnets, err := ipam.QueryRoutableSubnetByKey("")
+	if err != nil {
+		return err
+	}
+	allocated := 0
+	for _, subnet := range subnets {
+		_, subnetIPNet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return err
+		}
+		for allocated < num {
+			ip, err := ipam.AllocateInSubnet(poolPrefix, subnetIPNet, constant.ReleasePolicyNever, "")
+			if err == floatingip.ErrNoEnoughIP {
+				break
+			} else if err != nil {
+				return err
+			}
+			allocated++
+			glog.Infof("[%s] allocated ip %s to %s during reconciling pool", ipam.Name(), ip.String(), poolPrefix)
+		}
+		if allocated == num {
+			return nil
+		}
+	}
+	return fmt.Errorf("no enough ips, allocated %d of %d", allocated, num)
+}
+
+// shrinkPool releases at most num ips of the pool which are not bound to any pod
+func shrinkPool(ipam floatingip.IPAM, poolPrefix string, fips []database.FloatingIP, num int, reason string) error {
+	ipam = floatingip.WithReason(ipam, "", reason)
+	released := 0
+	for i := range fips {
+		if released == num {
+			break
+		}
+		if fips[i].Key != poolPrefix {
+			continue
+		}
+		ip := net.IP(fips[i].IP)
+		if err := ipam.Release(poolPrefix, ip); err != nil {
+			return err
+		}
+		released++
+		metrics.IPReleases.WithLabelValues(ipam.Name(), reason).Inc()
+		glog.Infof("[%s] released ip %s from %s during reconciling pool", ipam.Name(), ip.String(), poolPrefix)
+	}
+	if released < num {
+		glog.V(3).Infof("[%s] %d ips of %s are still bound to pods", ipam.Name(), num-released, poolPrefix)
+	}
+	return nil
+}
+
+// poolStatus returns the number of ips the pool holds, bound ips and subnets of them
+func poolStatus(poolPrefix string, fips []database.FloatingIP) v1alpha1.PoolStatus {
+	status := v1alpha1.PoolStatus{Size: len(fips)}
+	subnets := sets.NewString()
+	for i := range fips {
+		if fips[i].Key != poolPrefix {
+			status.Bound++
+		}
+		subnets.Insert(fips[i].Subnet)
+	}
+	if subnets.Len() > 0 {
+		status.Subnets = subnets.List()
+	}
+	return status
+}
+
+// PoolUsage returns the number of ips the pool holds in ipam, bound ips and subnets of them
+func PoolUsage(ipam floatingip.IPAM, poolName string) (v1alpha1.PoolStatus, error) {
+	poolPrefix := util.NewKeyObj(util.DeploymentPrefixKey, "", "", "", poolName).PoolPrefix()
+	fips, err := ipam.ByPrefix(poolPrefix)
+	if err != nil {
+		return v1alpha1.PoolStatus{}, err
+	}
+	return poolStatus(poolPrefix, fips), nil
+}
+
+// updatePoolStatus updates the number of ips the pool holds, bound ips and subnets of them
+func (p *FloatingIPPlugin) updatePoolStatus(pool *v1alpha1.Pool, poolPrefix string,
+	fips []database.FloatingIP) error {
+	status := poolStatus(poolPrefix, fips)
+	if reflect.DeepEqual(status, pool.Status) {
+		return nil
+	}
+	updated := pool.DeepCopy()
+	updated.Status = status
+	if _, err := p.CrdClient.GalaxyV1alpha1().Pools(pool.Namespace).UpdateStatus(updated); err != nil {
+		return fmt.Errorf("failed to update status of pool %s: %v", pool.Name, err)
+	}
+	return nil
+}
+
+// poolNamespaceReason is the failed reason of nodes if a pod uses a pool which is restricted to other namespaces
+const poolNamespaceReason = "FloatingIPPlugin:PoolNamespaceForbidden"
+
+// poolNamespaceError is returned by getSubnet if the pool of a pod is restricted to other namespaces
+type poolNamespaceError struct {
+	pool, namespace string
+}
+
+func (e *poolNamespaceError) Error() string {
+	return fmt.Sprintf("%s pool %s can't be used by namespace %s", poolNamespaceReason, e.pool, e.namespace)
+}
+
+// checkPoolNamespace returns a poolNamespaceError if the pool of keyObj is restricted to other namespaces
+func (p *FloatingIPPlugin) checkPoolNamespace(keyObj *util.KeyObj) error {
+	if keyObj.PoolName == "" || p.PoolLister == nil {
+		return nil
+	}
+	pool, err := p.PoolLister.Pools(p.conf.PoolNamespace).Get(keyObj.PoolName)
+	if err != nil {
+		if metaErrs.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get pool %s: %v", keyObj.PoolName, err)
+	}
+	if len(pool.Namespaces) == 0 || sets.NewString(pool.Namespaces...).Has(keyObj.Namespace) {
+		return nil
+	}
+	return &poolNamespaceError{pool: pool.Name, namespace: keyObj.Namespace}
+}
@@ -0,0 +1,230 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/api/k8s/schedulerapi"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy/v1alpha1"
+	. "tkestack.io/galaxy/pkg/ipam/schedulerplugin/testing"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+)
+
+// #lizard forgives
+func TestReconcilePool(t *testing.T) {
+	fipPlugin, stopChan := createCrdPlugin(t, nil)
+	defer func() { stopChan <- struct{}{} }()
+	pools := fipPlugin.CrdClient.GalaxyV1alpha1().Pools("kube-system")
+	poolPrefix := "pool__pool1_"
+	// reconcile reconciles pools as soon as the pool lister sees the expected size
+	reconcile := func(size int) *v1alpha1.Pool {
+		if err := wait.PollImmediate(10*time.Millisecond, 3*time.Second, func() (bool, error) {
+			pool, err := fipPlugin.PoolLister.Pools("kube-system").Get("pool1")
+			return err == nil && pool.Size == size, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := fipPlugin.reconcilePools(); err != nil {
+			t.Fatal(err)
+		}
+		pool, err := pools.Get("pool1", v1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pool
+	}
+	pool, err := pools.Create(&v1alpha1.Pool{ObjectMeta: v1.ObjectMeta{Name: "pool1", Namespace: "kube-system"},
+		Size: 3, PreAllocateIP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = reconcile(3)
+	fips, err := fipPlugin.ipam.ByPrefix(poolPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fips) != 3 || pool.Status.Size != 3 || pool.Status.Bound != 0 || len(pool.Status.Subnets) == 0 {
+		t.Fatalf("expect pool holds 3 ips, real %d, status %+v", len(fips), pool.Status)
+	}
+	// bind an ip of the pool to a pod
+	boundKey := poolPrefix + "dp_ns1_dp1_dp1-1"
+	boundIP := net.IP(fips[0].IP)
+	if err := fipPlugin.ipam.Release(poolPrefix, boundIP); err != nil {
+		t.Fatal(err)
+	}
+	if err := fipPlugin.ipam.AllocateSpecificIP(boundKey, boundIP, constant.ReleasePolicyNever, ""); err != nil {
+		t.Fatal(err)
+	}
+	// shrink the pool, ips bound to pods are kept
+	for _, size := range []int{1, 0} {
+		pool.Size = size
+		if _, err := pools.Update(pool); err != nil {
+			t.Fatal(err)
+		}
+		pool = reconcile(size)
+		fips, err = fipPlugin.ipam.ByPrefix(poolPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fips) != 1 || fips[0].Key != boundKey {
+			t.Fatalf("expect pool holds bound ip only, real %+v", fips)
+		}
+		expect := v1alpha1.PoolStatus{Size: 1, Bound: 1, Subnets: []string{fips[0].Subnet}}
+		if !reflect.DeepEqual(pool.Status, expect) {
+			t.Fatalf("expect status %+v, real %+v", expect, pool.Status)
+		}
+	}
+	// grow the pool
+	pool.Size = 2
+	if _, err := pools.Update(pool); err != nil {
+		t.Fatal(err)
+	}
+	if pool = reconcile(2); pool.Status.Size != 2 || pool.Status.Bound != 1 {
+		t.Fatalf("unexpected status %+v", pool.Status)
+	}
+	// deleting the pool releases ips which are not bound to pods
+	if err := pools.Delete("pool1", &v1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 3*time.Second, func() (bool, error) {
+		_, err := fipPlugin.PoolLister.Pools("kube-system").Get("pool1")
+		return err != nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fipPlugin.reconcilePools(); err != nil {
+		t.Fatal(err)
+	}
+	if fips, err = fipPlugin.ipam.ByPrefix(poolPrefix); err != nil || len(fips) != 1 || fips[0].Key != boundKey {
+		t.Fatalf("expect bound ip only, real %+v, err %v", fips, err)
+	}
+}
+
+// #lizard forgives
+func TestReconcilePoolStatusOfBoundIPs(t *testing.T) {
+	node := createNode(node3, nil, "10.49.27.3")
+	pod := CreateDeploymentPod("dp-xxx-yyy", "ns1", poolAnnotation("pool1"))
+	dp := createDeployment("dp", "ns1", pod.ObjectMeta, 1)
+	fipPlugin, stopChan := createCrdPlugin(t, nil, pod, dp, &node, &v1alpha1.Pool{
+		ObjectMeta: v1.ObjectMeta{Name: "pool1", Namespace: "kube-system"}, Size: 1})
+	defer func() { stopChan <- struct{}{} }()
+	if err := wait.PollImmediate(10*time.Millisecond, 3*time.Second, func() (bool, error) {
+		_, err := fipPlugin.PoolLister.Pools("kube-system").Get("pool1")
+		return err == nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// reconcileStatus reconciles pools as the periodic trigger does and returns status of pool1
+	reconcileStatus := func() v1alpha1.PoolStatus {
+		if err := fipPlugin.reconcilePools(); err != nil {
+			t.Fatal(err)
+		}
+		pool, err := fipPlugin.CrdClient.GalaxyV1alpha1().Pools("kube-system").Get("pool1", v1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pool.Status
+	}
+	if _, _, err := fipPlugin.Filter(pod, []corev1.Node{node}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fipPlugin.Bind(&schedulerapi.ExtenderBindingArgs{PodName: pod.Name, PodNamespace: pod.Namespace,
+		Node: node.Name}); err != nil {
+		t.Fatal(err)
+	}
+	if status := reconcileStatus(); status.Size != 1 || status.Bound != 1 {
+		t.Fatalf("expect the ip of the pool is bound, real status %+v", status)
+	}
+	// the ip is reserved by the pool once the pod is deleted
+	if _, err := fipPlugin.unbind(pod); err != nil {
+		t.Fatal(err)
+	}
+	if status := reconcileStatus(); status.Size != 1 || status.Bound != 0 {
+		t.Fatalf("expect the ip of the pool is unbound, real status %+v", status)
+	}
+}
+
+func TestCheckPoolNamespace(t *testing.T) {
+	fipPlugin, stopChan := createCrdPlugin(t, func(conf *Conf) {
+		conf.PoolNamespace = "galaxy"
+	})
+	defer func() { stopChan <- struct{}{} }()
+	if _, err := fipPlugin.CrdClient.GalaxyV1alpha1().Pools("galaxy").Create(&v1alpha1.Pool{
+		ObjectMeta: v1.ObjectMeta{Name: "pool1", Namespace: "galaxy"}, Size: 3,
+		Namespaces: []string{"ns1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 3*time.Second, func() (bool, error) {
+		_, err := fipPlugin.PoolLister.Pools("galaxy").Get("pool1")
+		return err == nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		pool, namespace string
+		forbidden       bool
+	}{
+		{pool: "pool1", namespace: "ns1"},
+		{pool: "pool1", namespace: "ns2", forbidden: true},
+		{pool: "pool2", namespace: "ns2"}, // pool not found is not restricted
+		{pool: "", namespace: "ns2"},
+	} {
+		keyObj := util.NewKeyObj(util.DeploymentPrefixKey, c.namespace, "dp", "dp-x-y", c.pool)
+		err := fipPlugin.checkPoolNamespace(keyObj)
+		if _, ok := err.(*poolNamespaceError); ok != c.forbidden {
+			t.Errorf("case %+v: unexpected err %v", c, err)
+		}
+	}
+}
+
+func TestFilterSpecificIPOfForbiddenPool(t *testing.T) {
+	node := createNode(node3, nil, "10.49.27.3")
+	pod := CreateDeploymentPod("dp-xxx-yyy", "ns2", map[string]string{constant.IPPoolAnnotation: "pool1",
+		constant.IPAnnotation: "10.49.27.216"})
+	fipPlugin, stopChan := createCrdPlugin(t, func(conf *Conf) {
+		conf.PoolNamespace = "galaxy"
+	}, &v1alpha1.Pool{ObjectMeta: v1.ObjectMeta{Name: "pool1", Namespace: "galaxy"}, Size: 3,
+		Namespaces: []string{"ns1"}}, &node)
+	defer func() { stopChan <- struct{}{} }()
+	if err := wait.PollImmediate(10*time.Millisecond, 3*time.Second, func() (bool, error) {
+		_, err := fipPlugin.PoolLister.Pools("galaxy").Get("pool1")
+		return err == nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the ip is reserved by pool1 which is restricted to ns1
+	if err := fipPlugin.ipam.AllocateSpecificIP(util.FormatKey(pod).PoolPrefix(), net.ParseIP("10.49.27.216"),
+		constant.ReleasePolicyNever, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, failed, err := fipPlugin.Filter(pod, []corev1.Node{node})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(failed[node.Name], poolNamespaceReason) {
+		t.Fatalf("expect failed reason %s, real %q", poolNamespaceReason, failed[node.Name])
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+)
+
+// quarantineCheckInterval is the interval of releasing ips whose quarantine is over
+const quarantineCheckInterval = 10 * time.Second
+
+// releaseQuarantine returns the global quarantine of released ips
+func (p *FloatingIPPlugin) releaseQuarantine() time.Duration {
+	return time.Duration(p.conf.ReleaseQuarantineSeconds) * time.Second
+}
+
+func getQuarantineAttr(until time.Time) string {
+	return marshalAttr(Attr{QuarantineUntil: &until})
+}
+
+// reclaimQuarantinedIPs gives ips in quarantine back to the key which released them
+func (p *FloatingIPPlugin) reclaimQuarantinedIPs(pod *corev1.Pod, key string) error {
+	if key == "" {
+		return nil
+	}
+	quarantineKey := util.QuarantineKey(key)
+	for _, ipam := range append([]floatingip.IPAM{p.ipam}, p.extraIPAMs(pod)...) {
+		ipInfo, err := ipam.First(quarantineKey)
+		if err != nil {
+			return fmt.Errorf("[%s] failed to query floating ip of %s: %v", ipam.Name(), quarantineKey, err)
+		}
+		if ipInfo == nil {
+			continue
+		}
+		if _, err := reserveIP(quarantineKey, key, ipam, getAttr(""), "reclaimed by the same pod"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseExpiredQuarantine releases ips in quarantine of all ipams if their quarantine is over
+func (p *FloatingIPPlugin) releaseExpiredQuarantine() {
+	now := time.Now()
+	for _, ipam := range p.configuredIPAMs() {
+		if err := releaseExpiredQuarantine(ipam, now); err != nil {
+			glog.Warningf("[%s] %v", ipam.Name(), err)
+		}
+	}
+}
+
+func releaseExpiredQuarantine(ipam floatingip.IPAM, now time.Time) error {
+	fips, err := ipam.ByPrefix(util.QuarantinePrefix)
+	if err != nil {
+		return fmt.Errorf("failed to query ips in quarantine: %v", err)
+	}
+	ipam = floatingip.WithReason(ipam, "", "quarantine is over")
+	for i := range fips {
+		var attr Attr
+		if err := json.Unmarshal([]byte(fips[i].Attr), &attr); err != nil {
+			glog.Warningf("[%s] bad attr of %s: %v", ipam.Name(), fips[i].Key, err)
+		}
+		if attr.QuarantineUntil != nil && now.Before(*attr.QuarantineUntil) {
+			continue
+		}
+		ip := net.IP(fips[i].IP)
+		if err := ipam.Release(fips[i].Key, ip); err != nil {
+			glog.Warningf("[%s] failed to release floating ip %s from %s: %v", ipam.Name(), ip.String(),
+				fips[i].Key, err)
+			continue
+		}
+		glog.Infof("[%s] released floating ip %s from %s as its quarantine is over", ipam.Name(), ip.String(),
+			fips[i].Key)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	. "tkestack.io/galaxy/pkg/ipam/schedulerplugin/testing"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+)
+
+// #lizard forgives
+func TestReleaseQuarantine(t *testing.T) {
+	fipPlugin, stopChan := createCrdPlugin(t, func(conf *Conf) {
+		conf.ReleaseQuarantineSeconds = 60
+	})
+	defer func() { stopChan <- struct{}{} }()
+	pod := CreateStatefulSetPod("sts-0", "ns1", nil)
+	key := util.FormatKey(pod).KeyInDB
+	ip := net.ParseIP("10.49.27.205")
+	quarantine := func() {
+		if err := fipPlugin.ipam.AllocateSpecificIP(key, ip, constant.ReleasePolicyPodDelete, ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fipPlugin.releaseIP(key, deletedAndIPMutablePod, pod); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkIPKey(fipPlugin.ipam, ip.String(), util.QuarantineKey(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	quarantine()
+	// the ip is kept until its quarantine is over
+	if err := releaseExpiredQuarantine(fipPlugin.ipam, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkIPKey(fipPlugin.ipam, ip.String(), util.QuarantineKey(key)); err != nil {
+		t.Fatal(err)
+	}
+	if err := releaseExpiredQuarantine(fipPlugin.ipam, time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkIPKey(fipPlugin.ipam, ip.String(), ""); err != nil {
+		t.Fatal(err)
+	}
+	// the same pod takes back the ip in quarantine
+	quarantine()
+	if err := fipPlugin.reclaimQuarantinedIPs(pod, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkIPKey(fipPlugin.ipam, ip.String(), key); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+)
+
+// quotaExceededReason is the failed reason of nodes if the namespace of a pod has run out of its floating ip quota
+const quotaExceededReason = "FloatingIPPlugin:NamespaceQuotaExceeded"
+
+// quotaExceededError is returned by getSubnet if a pod can't get a new ip because of namespace quota
+type quotaExceededError struct {
+	namespace   string
+	used, quota int
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("%s namespace %s has used %d of its %d floating ips", quotaExceededReason, e.namespace,
+		e.used, e.quota)
+}
+
+// NamespaceQuotas returns a copy of the current namespace floating ip quotas
+func (p *FloatingIPPlugin) NamespaceQuotas() map[string]int {
+	quotas := p.namespaceQuotas.Load().(map[string]int)
+	ret := make(map[string]int, len(quotas))
+	for ns, quota := range quotas {
+		ret[ns] = quota
+	}
+	return ret
+}
+
+// ensureNamespaceQuotas updates namespace quotas if its config changes
+func (p *FloatingIPPlugin) ensureNamespaceQuotas(newConf string) error {
+	if newConf == p.lastQuotaConf {
+		return nil
+	}
+	quotas := map[string]int{}
+	if newConf != "" {
+		if err := json.Unmarshal([]byte(newConf), &quotas); err != nil {
+			return fmt.Errorf("failed to unmarshal configmap val %s to namespace quotas", newConf)
+		}
+	}
+	for ns, quota := range quotas {
+		if quota < 0 {
+			return fmt.Errorf("invalid quota %d of namespace %s", quota, ns)
+		}
+	}
+	glog.Infof("updated namespace quota conf from (%s) to (%s)", p.lastQuotaConf, newConf)
+	p.lastQuotaConf = newConf
+	p.namespaceQuotas.Store(quotas)
+	return nil
+}
+
+// checkNamespaceQuota returns a quotaExceededError if namespace has less than num ips left in its quota
+func (p *FloatingIPPlugin) checkNamespaceQuota(namespace string, num int) error {
+	quota, ok := p.namespaceQuotas.Load().(map[string]int)[namespace]
+	if !ok {
+		return nil
+	}
+	used, err := p.NamespaceUsage(namespace)
+	if err != nil {
+		return err
+	}
+	if used+num > quota {
+		return &quotaExceededError{namespace: namespace, used: used, quota: quota}
+	}
+	return nil
+}
+
+// NamespaceUsage returns the number of ips of all configured ipams allocated or reserved to apps of the namespace
+func (p *FloatingIPPlugin) NamespaceUsage(namespace string) (int, error) {
+	var used int
+	for _, ipam := range p.configuredIPAMs() {
+		n, err := NamespaceUsage(ipam, namespace)
+		if err != nil {
+			return 0, fmt.Errorf("[%s] failed to query used ips of namespace %s: %v", ipam.Name(), namespace, err)
+		}
+		used += n
+	}
+	return used, nil
+}
+
+// lockNamespaceQuota locks the namespace if it has a quota, the returned func unlocks it
+func (p *FloatingIPPlugin) lockNamespaceQuota(namespace string) func() {
+	if _, ok := p.namespaceQuotas.Load().(map[string]int)[namespace]; !ok {
+		return func() {}
+	}
+	lockIndex := p.quotaLockPool.GetLockIndex([]byte(namespace))
+	p.quotaLockPool.RawLock(lockIndex)
+	return func() { p.quotaLockPool.RawUnlock(lockIndex) }
+}
+
+// recheckNamespaceQuota returns a quotaExceededError if namespace has no quota left for a new ip of ipam, the
+// namespace should be locked. A specific ip which is held already, e.g. reserved by the deployment, is not new.
+func (p *FloatingIPPlugin) recheckNamespaceQuota(ipam floatingip.IPAM, namespace string, specificIP net.IP) error {
+	if specificIP != nil {
+		if fip, err := ipam.ByIP(specificIP); err == nil && fip.Key != "" {
+			return nil
+		}
+	}
+	return p.checkNamespaceQuota(namespace, 1)
+}
+
+// NamespaceUsage returns the number of ips allocated or reserved to apps of the namespace
+func NamespaceUsage(ipam floatingip.IPAM, namespace string) (int, error) {
+	// keys are joined by "_", while "_" is not valid in k8s names, so this keyword matches namespace part of
+	// keys. It may also match app or pod names which equal to namespace, filter them by parsing key.
+	fips, err := ipam.ByKeyword(fmt.Sprintf("_%s_", namespace))
+	if err != nil {
+		return 0, err
+	}
+	var used int
+	for i := range fips {
+		if util.ParseKey(fips[i].Key).Namespace == namespace {
+			used++
+		}
+	}
+	return used, nil
+}
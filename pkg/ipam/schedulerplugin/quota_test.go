@@ -0,0 +1,141 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/api/k8s/schedulerapi"
+	. "tkestack.io/galaxy/pkg/ipam/schedulerplugin/testing"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+)
+
+// #lizard forgives
+func TestFilterNamespaceQuota(t *testing.T) {
+	fipPlugin, stopChan, nodes := createPluginTestNodes(t)
+	defer func() { stopChan <- struct{}{} }()
+	if err := fipPlugin.ensureNamespaceQuotas(`{"ns1":1}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := fipPlugin.ensureNamespaceQuotas(`{"ns1":-1}`); err == nil {
+		t.Fatal("expect an error for negative quota")
+	}
+	if quotas := fipPlugin.NamespaceQuotas(); len(quotas) != 1 || quotas["ns1"] != 1 {
+		t.Fatalf("unexpected quotas %v", quotas)
+	}
+	filtered, failed, err := fipPlugin.Filter(pod, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFilterResult(filtered, failed, []string{node3, node4}, []string{drainedNode, nodeHasNoIP}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fipPlugin.ipam.AllocateSpecificIP(podKey.KeyInDB, net.ParseIP("10.173.13.2"),
+		constant.ReleasePolicyPodDelete, ""); err != nil {
+		t.Fatal(err)
+	}
+	if used, err := NamespaceUsage(fipPlugin.ipam, "ns1"); err != nil || used != 1 {
+		t.Fatalf("expect ns1 used 1 ip, got %d, err %v", used, err)
+	}
+	// pod which already has an ip is not limited by quota
+	if filtered, failed, err = fipPlugin.Filter(pod, nodes); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFilterResult(filtered, failed, []string{node4}, []string{drainedNode, nodeHasNoIP, node3}); err != nil {
+		t.Fatal(err)
+	}
+	// ns1 has run out of its quota
+	if filtered, failed, err = fipPlugin.Filter(CreateStatefulSetPod("pod2-1", "ns1", immutableAnnotation), nodes); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFilterResult(filtered, failed, []string{}, []string{drainedNode, nodeHasNoIP, node3, node4}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(failed[node3], quotaExceededReason) {
+		t.Fatalf("unexpected failed reason %q", failed[node3])
+	}
+	// ns2 has no quota
+	if filtered, failed, err = fipPlugin.Filter(CreateStatefulSetPod("pod2-1", "ns2", immutableAnnotation), nodes); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFilterResult(filtered, failed, []string{node3, node4}, []string{drainedNode, nodeHasNoIP}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBindNamespaceQuota(t *testing.T) {
+	pod2 := CreateStatefulSetPod("pod2-0", "ns1", immutableAnnotation)
+	fipPlugin, stopChan, nodes := createPluginTestNodes(t, pod, pod2)
+	defer func() { stopChan <- struct{}{} }()
+	if err := fipPlugin.ensureNamespaceQuotas(`{"ns1":1}`); err != nil {
+		t.Fatal(err)
+	}
+	// both pods pass filter before any of them is bound
+	for _, p := range []*corev1.Pod{pod, pod2} {
+		if _, failed, err := fipPlugin.Filter(p, nodes); err != nil || failed[node3] != "" {
+			t.Fatalf("pod %s: failed %v, err %v", p.Name, failed, err)
+		}
+	}
+	bind := func(p *corev1.Pod) error {
+		return fipPlugin.Bind(&schedulerapi.ExtenderBindingArgs{PodName: p.Name, PodNamespace: p.Namespace,
+			Node: node3})
+	}
+	if err := bind(pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := bind(pod2); err == nil || !strings.Contains(err.Error(), quotaExceededReason) {
+		t.Fatalf("expect quota exceeded error, got %v", err)
+	}
+}
+
+func TestFilterDeploymentReservedIPAtQuota(t *testing.T) {
+	deadPod := CreateDeploymentPod("dp-aaa-bbb", "ns1", immutableAnnotation)
+	pod := CreateDeploymentPod("dp-xxx-yyy", "ns1", immutableAnnotation)
+	dp := createDeployment("dp", "ns1", pod.ObjectMeta, 1)
+	fipPlugin, stopChan, nodes := createPluginTestNodes(t, pod, deadPod, dp)
+	defer func() { stopChan <- struct{}{} }()
+	deadPodKey := util.FormatKey(deadPod)
+	if _, _, err := fipPlugin.allocateIP(fipPlugin.ipam, deadPodKey.KeyInDB, node3, deadPod); err != nil {
+		t.Fatal(err)
+	}
+	// the ip is reserved for the deployment after deadPod is deleted
+	if _, err := fipPlugin.unbind(deadPod); err != nil {
+		t.Fatal(err)
+	}
+	if err := fipPlugin.ensureNamespaceQuotas(`{"ns1":1}`); err != nil {
+		t.Fatal(err)
+	}
+	// the replacement pod reuses the reserved ip though ns1 is at its quota
+	filtered, failed, err := fipPlugin.Filter(pod, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFilterResult(filtered, failed, []string{node3}, []string{drainedNode, nodeHasNoIP, node4}); err != nil {
+		t.Fatal(err)
+	}
+	// other pods of ns1 need new ips
+	if _, failed, err = fipPlugin.Filter(CreateStatefulSetPod("pod2-1", "ns1", immutableAnnotation), nodes); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(failed[node3], quotaExceededReason) {
+		t.Fatalf("unexpected failed reason %q", failed[node3])
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+)
+
+// reasons of events recorded on pods, so that app owners can tell what happened to floating ips of their pods by
+// kubectl describe pod
+const (
+	eventAllocated               = "FloatingIPAllocated"
+	eventReused                  = "FloatingIPReused"
+	eventNoFIPLeft               = "NoFloatingIPLeft"
+	eventFilterFailed            = "FloatingIPFilterFailed"
+	eventCloudProviderAssignIP   = "CloudProviderAssignIPFailed"
+	eventCloudProviderUnAssignIP = "CloudProviderUnAssignIPFailed"
+	eventReleased                = "FloatingIPReleased"
+	eventReleaseFailed           = "FloatingIPReleaseFailed"
+	eventBindRollback            = "BindRollback"
+)
+
+// recordPodEvent records an event on the pod if event recorder is configured
+func (p *FloatingIPPlugin) recordPodEvent(pod *corev1.Pod, eventType, reason, message string) {
+	if p.EventRecorder == nil {
+		return
+	}
+	p.EventRecorder.Event(pod, eventType, reason, message)
+}
+
+// recordNoFIPLeft records a warning event on the pod if no node passes filtering because subnets of all nodes have no
+// floating ips left
+func (p *FloatingIPPlugin) recordNoFIPLeft(pod *corev1.Pod, nodes int, subnets sets.String) {
+	p.recordPodEvent(pod, corev1.EventTypeWarning, eventNoFIPLeft, fmt.Sprintf(
+		"No floating ip left for the pod in subnets %v of %d nodes", subnets.List(), nodes))
+}
+
+// recordUnbound records what happened to floating ips of the deleted pod, i.e. released, reserved or quarantined
+func (p *FloatingIPPlugin) recordUnbound(pod *corev1.Pod, outcomes []string) {
+	if len(outcomes) == 0 {
+		p.recordPodEvent(pod, corev1.EventTypeNormal, eventReleased, fmt.Sprintf(
+			"No floating ip released or reserved according to release policy %s",
+			releasePolicyName(parseReleasePolicy(&pod.ObjectMeta))))
+		return
+	}
+	p.recordPodEvent(pod, corev1.EventTypeNormal, eventReleased, strings.Join(outcomes, ", "))
+}
+
+// recordDeletedPodEvent records an event on the deleted pod of keyObj after resync released or reserved its ip.
+// Events can be recorded on a reference to the pod which no longer exists, and they are shown by kubectl get events.
+func (p *FloatingIPPlugin) recordDeletedPodEvent(keyObj *util.KeyObj, outcome string) {
+	if p.EventRecorder == nil || outcome == "" || keyObj.PodName == "" {
+		return
+	}
+	p.EventRecorder.Event(&corev1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: keyObj.Namespace,
+		Name: keyObj.PodName}, corev1.EventTypeNormal, eventReleased, outcome)
+}
+
+// releasePolicyName returns the name of release policy as it is in the release policy annotation
+func releasePolicyName(policy constant.ReleasePolicy) string {
+	switch policy {
+	case constant.ReleasePolicyImmutable:
+		return constant.Immutable
+	case constant.ReleasePolicyNever:
+		return constant.Never
+	case constant.ReleasePolicyTTL:
+		return constant.TTL
+	default:
+		return "podDelete"
+	}
+}
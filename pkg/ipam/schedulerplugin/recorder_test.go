@@ -0,0 +1,89 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	. "tkestack.io/galaxy/pkg/ipam/schedulerplugin/testing"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+)
+
+func TestPodEvents(t *testing.T) {
+	pod := CreateStatefulSetPod("sts-0", "ns1", immutableAnnotation)
+	fipPlugin, stopChan, nodes := createPluginTestNodes(t, pod)
+	defer func() { stopChan <- struct{}{} }()
+	recorder := fipPlugin.EventRecorder.(*record.FakeRecorder)
+	// filtering on the drained node only
+	if _, _, err := fipPlugin.Filter(pod, []corev1.Node{nodes[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEvent(recorder, "Warning NoFloatingIPLeft No floating ip left for the pod in subnets "+
+		"[10.180.1.3/32] of 1 nodes"); err != nil {
+		t.Fatal(err)
+	}
+	keyObj := util.FormatKey(pod)
+	if _, err := checkBind(fipPlugin, pod, node3, keyObj.KeyInDB, "10.49.27.205"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEvent(recorder, "Normal FloatingIPAllocated ["+fipPlugin.ipam.Name()+
+		"] Allocated ip 10.49.27.205 on node "+node3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkBind(fipPlugin, pod, node3, keyObj.KeyInDB, "10.49.27.205"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEvent(recorder, "Normal FloatingIPReused"); err != nil {
+		t.Fatal(err)
+	}
+	// statefulset of the pod doesn't exist, so its ip is released
+	outcomes, err := fipPlugin.unbind(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fipPlugin.recordUnbound(pod, outcomes)
+	if err := checkEvent(recorder, "Normal FloatingIPReleased ["+fipPlugin.ipam.Name()+"] released 10.49.27.205 "+
+		"because of "+deletedAndParentAppNotExistPod); err != nil {
+		t.Fatal(err)
+	}
+	fipPlugin.recordUnbound(pod, nil)
+	if err := checkEvent(recorder, "Normal FloatingIPReleased No floating ip released or reserved according to "+
+		"release policy immutable"); err != nil {
+		t.Fatal(err)
+	}
+	// resync records events on deleted pods
+	fipPlugin.recordDeletedPodEvent(keyObj, "released")
+	if err := checkEvent(recorder, "Normal FloatingIPReleased released"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReleasePolicyName(t *testing.T) {
+	for policy, expect := range map[constant.ReleasePolicy]string{
+		constant.ReleasePolicyPodDelete: "podDelete",
+		constant.ReleasePolicyImmutable: constant.Immutable,
+		constant.ReleasePolicyNever:     constant.Never,
+		constant.ReleasePolicyTTL:       constant.TTL,
+	} {
+		if got := releasePolicyName(policy); got != expect {
+			t.Errorf("expect %s, got %s", expect, got)
+		}
+	}
+}
@@ -17,10 +17,12 @@
 package schedulerplugin
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	appv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -32,7 +34,6 @@ import (
 	"tkestack.io/galaxy/pkg/ipam/floatingip"
 	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
 	"tkestack.io/galaxy/pkg/utils/database"
-	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
 )
 
 func (p *FloatingIPPlugin) storeReady() bool {
@@ -48,6 +49,14 @@ func (p *FloatingIPPlugin) storeReady() bool {
 		glog.V(3).Infof("the deployment store has not been synced yet")
 		return false
 	}
+	if !p.DaemonSetSynced() {
+		glog.V(3).Infof("the daemonset store has not been synced yet")
+		return false
+	}
+	if !p.JobSynced() {
+		glog.V(3).Infof("the job store has not been synced yet")
+		return false
+	}
 	if _, err := p.ExtClient.ApiextensionsV1beta1().CustomResourceDefinitions().Get("tapps.tke.cloud.tencent.com",
 		v1.GetOptions{}); err == nil {
 		//If TApp CRD created, waits for tapp
@@ -74,6 +83,7 @@ type resyncObj struct {
 // 3. deleted pods whose parent deployment no need so many ips
 // 4. deleted pods whose parent statefulset/tapp exist but pod index > .spec.replica
 // 5. existing pods but its status is evicted
+// 6. deleted pods of ttl release policy whose ttl has expired
 func (p *FloatingIPPlugin) resyncPod(ipam floatingip.IPAM) error {
 	glog.V(4).Infof("resync pods+")
 	defer glog.V(4).Infof("resync pods-")
@@ -99,8 +109,6 @@ type resyncMeta struct {
 	allocatedIPs map[string]resyncObj // allocated ips from galaxy pool
 	existPods    map[string]*corev1.Pod
 	dpMap        map[string]*appv1.Deployment
-	tappMap      map[string]*tappv1.TApp
-	ssMap        map[string]*appv1.StatefulSet
 }
 
 func (p *FloatingIPPlugin) fetchChecklist(ipam floatingip.IPAM, meta *resyncMeta) error {
@@ -114,6 +122,13 @@ func (p *FloatingIPPlugin) fetchChecklist(ipam floatingip.IPAM, meta *resyncMeta
 			continue
 		}
 		keyObj := util.ParseKey(fip.Key)
+		if fip.Policy == uint16(constant.ReleasePolicyTTL) && keyObj.PodName == "" {
+			// ips of ttl policy reserved by deployments are released once ttl expires as well
+			if _, ok := util.ParseQuarantineKey(fip.Key); !ok && keyObj.AppName != "" {
+				meta.allocatedIPs[fip.Key] = resyncObj{keyObj: keyObj, fip: fip}
+			}
+			continue
+		}
 		if keyObj.PodName == "" {
 			continue
 		}
@@ -146,18 +161,10 @@ func (p *FloatingIPPlugin) fetchAppAndPodMeta(meta *resyncMeta) error {
 	if err != nil {
 		return err
 	}
-	meta.ssMap, err = p.getSSMap()
-	if err != nil {
-		return err
-	}
 	meta.dpMap, err = p.getDPMap()
 	if err != nil {
 		return err
 	}
-	meta.tappMap, err = p.getTAppMap()
-	if err != nil {
-		return err
-	}
 	return nil
 }
 
@@ -167,39 +174,34 @@ func (p *FloatingIPPlugin) resyncAllocatedIPs(ipam floatingip.IPAM, meta *resync
 		if _, ok := meta.existPods[key]; ok {
 			continue
 		}
+		if obj.fip.Policy == uint16(constant.ReleasePolicyTTL) {
+			p.resyncTTLIP(ipam, key, obj)
+			continue
+		}
 		// check with apiserver to confirm it really not exist
 		if p.podExist(obj.keyObj.PodName, obj.keyObj.Namespace) {
 			continue
 		}
 		appFullName := util.Join(obj.keyObj.AppName, obj.keyObj.Namespace)
 		releasePolicy := constant.ReleasePolicy(obj.fip.Policy)
-		// we can't get labels of not exist pod, so get them from it's ss or deployment
+		// we can't get labels of not exist pod, so get them from it's app or deployment
 		if !obj.keyObj.Deployment() {
-			var appExist bool
-			var replicas int32
-			if obj.keyObj.StatefulSet() {
-				ss, ok := meta.ssMap[appFullName]
-				if ok {
-					appExist = true
-					replicas = 1
-					if ss.Spec.Replicas != nil {
-						replicas = *ss.Spec.Replicas
-					}
-				}
-			} else if obj.keyObj.TApp() {
-				tapp, ok := meta.tappMap[appFullName]
-				if ok {
-					appExist = true
-					replicas = tapp.Spec.Replicas
-				}
-			} else {
+			resolver := obj.keyObj.OwnerResolver()
+			if resolver == nil {
 				glog.Warningf("unknow app type of key %s", obj.keyObj.KeyInDB)
 				continue
 			}
+			appExist, replicas, err := resolver.App(obj.keyObj.Namespace, obj.keyObj.AppName)
+			if err != nil {
+				glog.Warningf("failed to get %s %s: %v", resolver.AppType(), appFullName, err)
+				continue
+			}
 			if should, reason := p.shouldReleaseDuringResync(obj.keyObj, releasePolicy, appExist, replicas); should {
-				if err := releaseIP(ipam, key, fmt.Sprintf("%s during resyncing", reason)); err != nil {
+				outcome, err := releaseIP(ipam, key, fmt.Sprintf("%s during resyncing", reason), p.releaseQuarantine())
+				if err != nil {
 					glog.Warningf("[%s] %v", ipam.Name(), err)
 				}
+				p.recordDeletedPodEvent(obj.keyObj, outcome)
 			}
 			continue
 		}
@@ -208,11 +210,39 @@ func (p *FloatingIPPlugin) resyncAllocatedIPs(ipam floatingip.IPAM, meta *resync
 		if ok {
 			replicas = int(*dp.Spec.Replicas)
 		}
-		if err := unbindDpPod(key, obj.keyObj.PoolPrefix(), ipam, p.dpLockPool, replicas, releasePolicy,
-			"during resyncing"); err != nil {
+		outcome, err := unbindDpPod(key, obj.keyObj.PoolPrefix(), ipam, p.dpLockPool, replicas, releasePolicy,
+			getAttr(""), p.releaseQuarantine(), "during resyncing")
+		if err != nil {
 			glog.Error(err)
 		}
+		p.recordDeletedPodEvent(obj.keyObj, outcome)
+	}
+}
+
+// resyncTTLIP releases the ip of ttl policy if its pod is gone and ttl has expired since it was updated
+func (p *FloatingIPPlugin) resyncTTLIP(ipam floatingip.IPAM, key string, obj resyncObj) {
+	if obj.keyObj.PodName != "" && p.podExist(obj.keyObj.PodName, obj.keyObj.Namespace) {
+		return
+	}
+	var attr Attr
+	if err := json.Unmarshal([]byte(obj.fip.Attr), &attr); err != nil || attr.TTL == "" {
+		glog.Warningf("[%s] no ttl in attr %q of %s, keep it", ipam.Name(), obj.fip.Attr, key)
+		return
+	}
+	ttl, err := time.ParseDuration(attr.TTL)
+	if err != nil {
+		glog.Warningf("[%s] invalid ttl %s of %s: %v", ipam.Name(), attr.TTL, key, err)
+		return
+	}
+	if time.Since(obj.fip.UpdatedAt) < ttl {
+		return
+	}
+	outcome, err := releaseIP(ipam, key, fmt.Sprintf("%s %v during resyncing", expiredTTL, ttl),
+		p.releaseQuarantine())
+	if err != nil {
+		glog.Warningf("[%s] %v", ipam.Name(), err)
 	}
+	p.recordDeletedPodEvent(obj.keyObj, outcome)
 }
 
 func (p *FloatingIPPlugin) podExist(podName, namespace string) bool {
@@ -299,12 +329,12 @@ func (p *FloatingIPPlugin) syncPodIP(pod *corev1.Pod) error {
 	if err := p.syncIP(p.ipam, keyObj.KeyInDB, ipInfos[0].IP.IP, pod); err != nil {
 		return fmt.Errorf("[%s] %v", p.ipam.Name(), err)
 	}
-	if p.enabledSecondIP(pod) {
-		if len(ipInfos) == 1 || ipInfos[1].IP == nil {
-			return fmt.Errorf("none second ipinfo for pod %s", keyObj.KeyInDB)
+	for i, ipam := range p.extraIPAMs(pod) {
+		if len(ipInfos) <= i+1 || ipInfos[i+1].IP == nil {
+			return fmt.Errorf("none ipinfo of %s for pod %s", ipam.Name(), keyObj.KeyInDB)
 		}
-		if err := p.syncIP(p.secondIPAM, keyObj.KeyInDB, ipInfos[1].IP.IP, pod); err != nil {
-			return fmt.Errorf("[%s] %v", p.secondIPAM.Name(), err)
+		if err := p.syncIP(ipam, keyObj.KeyInDB, ipInfos[i+1].IP.IP, pod); err != nil {
+			return fmt.Errorf("[%s] %v", ipam.Name(), err)
 		}
 	}
 	return nil
@@ -321,8 +351,9 @@ func (p *FloatingIPPlugin) syncIP(ipam floatingip.IPAM, key string, ip net.IP, p
 			return fmt.Errorf("conflict ip %s found for both %s and %s", ip.String(), key, storedKey)
 		}
 	} else {
-		if err := ipam.AllocateSpecificIP(key, ip, parseReleasePolicy(&pod.ObjectMeta),
-			getAttr(pod.Spec.NodeName)); err != nil {
+		if err := floatingip.WithReason(ipam, "", "resync").AllocateSpecificIP(key, ip,
+			parseReleasePolicy(&pod.ObjectMeta),
+			getPodAttr(pod, pod.Spec.NodeName)); err != nil {
 			return err
 		}
 		glog.Infof("[%s] updated floatingip %s to key %s", ipam.Name(), ip.String(), key)
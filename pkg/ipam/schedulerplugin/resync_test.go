@@ -19,7 +19,9 @@ package schedulerplugin
 import (
 	"net"
 	"testing"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
 	. "tkestack.io/galaxy/pkg/ipam/schedulerplugin/testing"
 	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
 )
@@ -47,3 +49,46 @@ func TestResyncAppNotExist(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestResyncTTL(t *testing.T) {
+	fipPlugin, stopChan, _ := createPluginTestNodes(t)
+	defer func() { stopChan <- struct{}{} }()
+	pod1 := CreateStatefulSetPod("sts1-0", "ns1", ttlAnnotation("1h"))
+	pod2 := CreateStatefulSetPod("sts2-0", "ns1", ttlAnnotation("10ms"))
+	pod3 := CreateDeploymentPod("dp-xxx-yyy", "ns1", ttlAnnotation("10ms"))
+	pod1Key, pod2Key, pod3Key := util.FormatKey(pod1), util.FormatKey(pod2), util.FormatKey(pod3)
+	for key, ip := range map[string]string{
+		pod1Key.KeyInDB:      "10.49.27.205",
+		pod2Key.KeyInDB:      "10.49.27.216",
+		pod3Key.PoolPrefix(): "10.49.27.217",
+	} {
+		if err := fipPlugin.ipam.AllocateSpecificIP(key, net.ParseIP(ip), parseReleasePolicy(&pod1.ObjectMeta),
+			""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// reserve ips as unbinding pods does
+	for _, pod := range []*corev1.Pod{pod1, pod2} {
+		keyObj := util.FormatKey(pod)
+		if _, err := fipPlugin.reserveIP(keyObj.KeyInDB, keyObj.KeyInDB, "ttl policy", pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fipPlugin.ipam.ReserveIP(pod3Key.PoolPrefix(), pod3Key.PoolPrefix(), getPodAttr(pod3, "")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := fipPlugin.resyncPod(fipPlugin.ipam); err != nil {
+		t.Fatal(err)
+	}
+	// ips of deleted pods are kept until ttl expires
+	for ip, key := range map[string]string{
+		"10.49.27.205": pod1Key.KeyInDB,
+		"10.49.27.216": "",
+		"10.49.27.217": "",
+	} {
+		if err := checkIPKey(fipPlugin.ipam, ip, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/cloudprovider/rpc"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/metrics"
+)
+
+// allocation records what allocateIP has done to an ip during binding so that it can be undone
+type allocation struct {
+	ipam     floatingip.IPAM
+	key      string
+	ip       net.IP
+	nodeName string
+	// reused is true if the ip was allocated to key before binding, its previous policy and attr are restored on
+	// undo, otherwise it is released
+	reused bool
+	// reservedBy is the key which reserved the ip before it was allocated to key, e.g. the deployment of the pod,
+	// the ip is given back to it on undo with its previous policy and attr
+	reservedBy string
+	policy     constant.ReleasePolicy
+	attr       string
+	// assigned is true if the ip has been assigned to the node by cloud provider during binding
+	assigned bool
+}
+
+// undo unassigns the ip from the node if it was assigned during binding, and then restores or releases it
+func (a *allocation) undo(p *FloatingIPPlugin) error {
+	ipam := floatingip.WithReason(a.ipam, "", rolledBackBind)
+	if a.assigned {
+		if err := p.cloudProviderUnAssignIP(&rpc.UnAssignIPRequest{
+			NodeName:  a.nodeName,
+			IPAddress: a.ip.String(),
+		}); err != nil {
+			return fmt.Errorf("failed to unassign ip %s from %s: %v", a.ip.String(), a.nodeName, err)
+		}
+	}
+	if a.reused {
+		if err := ipam.UpdatePolicy(a.key, a.ip, a.policy, a.attr); err != nil {
+			return fmt.Errorf("failed to restore policy %v attr %s of ip %s: %v", a.policy, a.attr, a.ip.String(),
+				err)
+		}
+		return nil
+	}
+	if err := ipam.Release(a.key, a.ip); err != nil {
+		return fmt.Errorf("failed to release ip %s: %v", a.ip.String(), err)
+	}
+	if a.reservedBy != "" {
+		if err := ipam.AllocateSpecificIP(a.reservedBy, a.ip, a.policy, a.attr); err != nil {
+			return fmt.Errorf("failed to give ip %s back to %s: %v", a.ip.String(), a.reservedBy, err)
+		}
+		return nil
+	}
+	metrics.IPReleases.WithLabelValues(a.ipam.Name(), rolledBackBind).Inc()
+	return nil
+}
+
+// rollbackBind undoes allocations of a failed binding in the reverse order and records an event on the pod
+func (p *FloatingIPPlugin) rollbackBind(pod *corev1.Pod, allocations []*allocation, bindErr error) {
+	var undone, failed []string
+	for i := len(allocations) - 1; i >= 0; i-- {
+		alloc := allocations[i]
+		if err := alloc.undo(p); err != nil {
+			// leave it to resync
+			glog.Errorf("[%s] failed to roll back ip %s of %s: %v", alloc.ipam.Name(), alloc.ip.String(), alloc.key,
+				err)
+			failed = append(failed, alloc.ip.String())
+			continue
+		}
+		glog.Infof("[%s] rolled back ip %s of %s, reused %v", alloc.ipam.Name(), alloc.ip.String(), alloc.key,
+			alloc.reused)
+		undone = append(undone, alloc.ip.String())
+	}
+	msg := fmt.Sprintf("Rolled back ips [%s] as binding failed: %v", strings.Join(undone, ","), bindErr)
+	if len(failed) > 0 {
+		msg += fmt.Sprintf(", failed to roll back ips [%s] which are left to resync", strings.Join(failed, ","))
+	}
+	p.recordPodEvent(pod, corev1.EventTypeWarning, eventBindRollback, msg)
+}
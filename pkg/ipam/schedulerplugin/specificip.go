@@ -0,0 +1,146 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+)
+
+// specificIPUnavailableReason is the failed reason of nodes if a pod asks for an ip which it can't get
+const specificIPUnavailableReason = "FloatingIPPlugin:SpecificIPUnavailable"
+
+// specificIPError is returned by getSubnet if a pod asks for an invalid or unavailable ip
+type specificIPError struct {
+	pod    string
+	reason string
+}
+
+func (e *specificIPError) Error() string {
+	return fmt.Sprintf("%s pod %s %s", specificIPUnavailableReason, e.pod, e.reason)
+}
+
+// getSpecificIP returns the ip which the pod asks for by annotation, or nil if it doesn't ask for one
+func getSpecificIP(pod *corev1.Pod) (net.IP, error) {
+	val := pod.Annotations[constant.IPAnnotation]
+	if val == "" {
+		return nil, nil
+	}
+	ips := strings.Split(val, ",")
+	var idx int
+	if len(ips) > 1 {
+		keyObj := util.FormatKey(pod)
+		if !keyObj.StatefulSet() && !keyObj.TApp() {
+			return nil, &specificIPError{pod: util.PodName(pod),
+				reason: fmt.Sprintf("asks for ip list %s which is supported by statefulset and tapp pods only", val)}
+		}
+		ordinal, err := strconv.Atoi(pod.Name[strings.LastIndex(pod.Name, "-")+1:])
+		if err != nil {
+			return nil, &specificIPError{pod: util.PodName(pod), reason: "has no valid ordinal"}
+		}
+		if ordinal >= len(ips) {
+			return nil, &specificIPError{pod: util.PodName(pod),
+				reason: fmt.Sprintf("of ordinal %d asks for ip list %s which is too short", ordinal, val)}
+		}
+		idx = ordinal
+	}
+	ip := net.ParseIP(strings.TrimSpace(ips[idx]))
+	if ip == nil {
+		return nil, &specificIPError{pod: util.PodName(pod), reason: fmt.Sprintf("asks for invalid ip %s", ips[idx])}
+	}
+	return ip, nil
+}
+
+// getSpecificIPSubnet returns the routable subnet of the specific ip if the pod can get it, i.e. it is unallocated,
+// allocated to the pod or reserved by the deployment of the pod
+func (p *FloatingIPPlugin) getSpecificIPSubnet(keyObj *util.KeyObj, ip net.IP) (sets.String, error) {
+	podName := util.Join(keyObj.PodName, keyObj.Namespace)
+	ipInfo, err := p.ipam.First(keyObj.KeyInDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query by key %s: %v", keyObj.KeyInDB, err)
+	}
+	if ipInfo != nil && !ipInfo.IPInfo.IP.IP.Equal(ip) {
+		return nil, &specificIPError{pod: podName, reason: fmt.Sprintf("holds ip %s other than the specified ip %s",
+			ipInfo.IPInfo.IP.IP.String(), ip.String())}
+	}
+	fip, err := p.ipam.ByIP(ip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ip %s: %v", ip.String(), err)
+	}
+	if fip.Subnet == "" {
+		return nil, &specificIPError{pod: podName, reason: fmt.Sprintf("asks for ip %s which is not configured",
+			ip.String())}
+	}
+	if fip.Key != "" && fip.Key != keyObj.KeyInDB && !(keyObj.Deployment() && fip.Key == keyObj.PoolPrefix()) {
+		return nil, &specificIPError{pod: podName, reason: fmt.Sprintf("asks for ip %s which is held by %s",
+			ip.String(), fip.Key)}
+	}
+	if fip.Key == "" {
+		if err := p.checkNamespaceQuota(keyObj.Namespace, 1); err != nil {
+			return nil, err
+		}
+	}
+	return sets.NewString(fip.Subnet), nil
+}
+
+// allocateSpecificIP allocates the specific ip within subnet to the pod. If the ip is reserved by the deployment of
+// the pod, the returned allocation gives it back to the deployment on undo.
+func (p *FloatingIPPlugin) allocateSpecificIP(ipam floatingip.IPAM, keyObj *util.KeyObj, ip net.IP,
+	subnet *net.IPNet, policy constant.ReleasePolicy, attr string) (*allocation, error) {
+	fip, err := ipam.ByIP(ip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ip %s: %v", ip.String(), err)
+	}
+	ipam = floatingip.WithReason(ipam, "", "specified ip")
+	if fip.Subnet != subnet.String() {
+		return nil, fmt.Errorf("specified ip %s of subnet %q is not routable in subnet %s", ip.String(),
+			fip.Subnet, subnet.String())
+	}
+	alloc := &allocation{ipam: ipam, key: keyObj.KeyInDB, ip: ip}
+	if keyObj.Deployment() && fip.Key != "" && fip.Key == keyObj.PoolPrefix() {
+		// lock the same pool prefix as getSubnet and unbindDpPod
+		lockIndex := p.dpLockPool.GetLockIndex([]byte(fip.Key))
+		p.dpLockPool.RawLock(lockIndex)
+		defer p.dpLockPool.RawUnlock(lockIndex)
+		if err := ipam.Release(fip.Key, ip); err != nil {
+			return nil, fmt.Errorf("failed to release ip %s from %s: %v", ip.String(), fip.Key, err)
+		}
+		alloc.reservedBy, alloc.policy, alloc.attr = fip.Key, constant.ReleasePolicy(fip.Policy), fip.Attr
+	} else if fip.Key != "" {
+		return nil, fmt.Errorf("specified ip %s is held by %s", ip.String(), fip.Key)
+	}
+	if err := ipam.AllocateSpecificIP(keyObj.KeyInDB, ip, policy, attr); err != nil {
+		if alloc.reservedBy != "" {
+			if err := ipam.AllocateSpecificIP(alloc.reservedBy, ip, alloc.policy, alloc.attr); err != nil {
+				glog.Errorf("[%s] failed to give ip %s back to %s: %v", ipam.Name(), ip.String(), alloc.reservedBy,
+					err)
+			}
+		}
+		return nil, fmt.Errorf("failed to allocate specified ip %s: %v", ip.String(), err)
+	}
+	glog.Infof("[%s] allocated specified ip %s to pod %s during bind", ipam.Name(), ip.String(), keyObj.KeyInDB)
+	return alloc, nil
+}
@@ -0,0 +1,118 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	. "tkestack.io/galaxy/pkg/ipam/schedulerplugin/testing"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+)
+
+func ipAnnotation(ips string) map[string]string {
+	return map[string]string{constant.IPAnnotation: ips}
+}
+
+func TestGetSpecificIP(t *testing.T) {
+	for i, testCase := range []struct {
+		pod       *corev1.Pod
+		expect    string
+		expectErr bool
+	}{
+		{pod: CreateStatefulSetPod("sts-1", "ns1", nil)},
+		{pod: CreateDeploymentPod("dp-xxx-yyy", "ns1", ipAnnotation("10.49.27.205")), expect: "10.49.27.205"},
+		{pod: CreateStatefulSetPod("sts-1", "ns1", ipAnnotation("10.49.27.205, 10.49.27.216")),
+			expect: "10.49.27.216"},
+		{pod: CreateTAppPod("tapp-0", "ns1", ipAnnotation("10.49.27.205,10.49.27.216")), expect: "10.49.27.205"},
+		{pod: CreateStatefulSetPod("sts-2", "ns1", ipAnnotation("10.49.27.205,10.49.27.216")), expectErr: true},
+		{pod: CreateDeploymentPod("dp-xxx-yyy", "ns1", ipAnnotation("10.49.27.205,10.49.27.216")),
+			expectErr: true},
+		{pod: CreateStatefulSetPod("sts-0", "ns1", ipAnnotation("10.49.27.2.5")), expectErr: true},
+	} {
+		ip, err := getSpecificIP(testCase.pod)
+		if testCase.expectErr {
+			if _, ok := err.(*specificIPError); !ok {
+				t.Errorf("case %d: expect specificIPError, real %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+		} else if testCase.expect == "" && ip != nil || testCase.expect != "" && ip.String() != testCase.expect {
+			t.Errorf("case %d: expect %q, real %v", i, testCase.expect, ip)
+		}
+	}
+}
+
+// #lizard forgives
+func TestFilterAndBindSpecificIP(t *testing.T) {
+	stsPod := CreateStatefulSetPod("sts-1", "ns1", ipAnnotation("10.173.13.2,10.173.13.3"))
+	heldPod := CreateStatefulSetPod("sts2-0", "ns1", ipAnnotation("10.173.13.4"))
+	dpPod := CreateDeploymentPod("dp-xxx-yyy", "ns1", ipAnnotation("10.49.27.216"))
+	fipPlugin, stopChan, nodes := createPluginTestNodes(t, stsPod, heldPod, dpPod)
+	defer func() { stopChan <- struct{}{} }()
+	// only node4 is in the subnet of 10.173.13.3
+	filtered, failed, err := fipPlugin.Filter(stsPod, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFilterResult(filtered, failed, []string{node4}, []string{drainedNode, nodeHasNoIP, node3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkBind(fipPlugin, stsPod, node4, util.FormatKey(stsPod).KeyInDB, "10.173.13.3"); err != nil {
+		t.Fatal(err)
+	}
+	// an ip held by another pod fails all nodes
+	if err := fipPlugin.ipam.AllocateSpecificIP("sts_ns1_sts3_sts3-0", net.ParseIP("10.173.13.4"),
+		constant.ReleasePolicyNever, ""); err != nil {
+		t.Fatal(err)
+	}
+	filtered, failed, err = fipPlugin.Filter(heldPod, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFilterResult(filtered, failed, []string{}, []string{drainedNode, nodeHasNoIP, node3,
+		node4}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(failed[node4], "held by sts_ns1_sts3_sts3-0") {
+		t.Fatalf("unexpected failed reason %q", failed[node4])
+	}
+	if _, err := checkBind(fipPlugin, heldPod, node4, util.FormatKey(heldPod).KeyInDB, "10.173.13.4"); err == nil ||
+		!strings.Contains(err.Error(), "held by") {
+		t.Fatalf("expect bind fails as ip is held by another pod, real %v", err)
+	}
+	// an ip reserved by the deployment of the pod is given to it
+	dpKey := util.FormatKey(dpPod)
+	if err := fipPlugin.ipam.AllocateSpecificIP(dpKey.PoolPrefix(), net.ParseIP("10.49.27.216"),
+		constant.ReleasePolicyNever, ""); err != nil {
+		t.Fatal(err)
+	}
+	if filtered, failed, err = fipPlugin.Filter(dpPod, nodes); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFilterResult(filtered, failed, []string{node3}, []string{drainedNode, nodeHasNoIP, node4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkBind(fipPlugin, dpPod, node3, dpKey.KeyInDB, "10.49.27.216"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -19,73 +19,70 @@ package schedulerplugin
 import (
 	"fmt"
 
-	appv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metaErrs "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/labels"
 	glog "k8s.io/klog"
 	"tkestack.io/galaxy/pkg/api/galaxy/constant"
 	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
 )
 
+// unbindStsOrTappPod releases or reserves ips of a pod keyed by its name according to policy and returns outcomes of
+// its ips
 func (p *FloatingIPPlugin) unbindStsOrTappPod(pod *corev1.Pod, keyObj *util.KeyObj,
-	policy constant.ReleasePolicy) error {
+	policy constant.ReleasePolicy) ([]string, error) {
 	key := keyObj.KeyInDB
 	if policy == constant.ReleasePolicyPodDelete {
 		return p.releaseIP(key, deletedAndIPMutablePod, pod)
 	} else if policy == constant.ReleasePolicyNever {
-		return p.reserveIP(key, key, "never policy", p.enabledSecondIP(pod))
+		return p.reserveIP(key, key, "never policy", pod)
+	} else if policy == constant.ReleasePolicyTTL {
+		// resyncing releases the ip once ttl expires
+		return p.reserveIP(key, key, "ttl policy", pod)
 	} else if policy == constant.ReleasePolicyImmutable {
-		appExist, replicas, err := p.checkAppAndReplicas(pod, keyObj)
+		appExist, replicas, err := p.checkAppAndReplicas(keyObj)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		shouldReserve, reason, err := p.shouldReserve(pod, keyObj, appExist, replicas)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if shouldReserve {
-			return p.reserveIP(key, key, "immutable policy", p.enabledSecondIP(pod))
+			return p.reserveIP(key, key, "immutable policy", pod)
 		} else {
 			return p.releaseIP(key, reason, pod)
 		}
 	}
-	return nil
+	return nil, nil
 }
 
-func (p *FloatingIPPlugin) checkAppAndReplicas(pod *corev1.Pod,
-	keyObj *util.KeyObj) (appExist bool, replicas int32, retErr error) {
-	if keyObj.StatefulSet() {
-		return p.getStsReplicas(pod, keyObj)
-	} else if keyObj.TApp() {
-		return p.getTAppReplicas(pod, keyObj)
-	} else {
+func (p *FloatingIPPlugin) checkAppAndReplicas(keyObj *util.KeyObj) (appExist bool, replicas int32, retErr error) {
+	resolver := keyObj.OwnerResolver()
+	if resolver == nil {
 		retErr = fmt.Errorf("Unknown app")
 		return
 	}
-	return
+	return resolver.App(keyObj.Namespace, keyObj.AppName)
 }
 
-func (p *FloatingIPPlugin) getStsReplicas(pod *corev1.Pod,
-	keyObj *util.KeyObj) (appExist bool, replicas int32, retErr error) {
-	statefulSet, err := p.StatefulSetLister.GetPodStatefulSets(pod)
+// statefulSetApp returns whether the statefulset exists and its replicas, a statefulset whose pods don't ask for
+// floating ips is regarded as not existing
+func (p *FloatingIPPlugin) statefulSetApp(namespace, name string) (bool, int32, error) {
+	ss, err := p.StatefulSetLister.StatefulSets(namespace).Get(name)
 	if err != nil {
-		if !metaErrs.IsNotFound(err) {
-			retErr = err
-			return
-		}
-	} else {
-		appExist = true
-		if len(statefulSet) > 1 {
-			glog.Warningf("multiple ss found for pod %s", util.PodName(pod))
-		}
-		ss := statefulSet[0]
-		replicas = 1
-		if ss.Spec.Replicas != nil {
-			replicas = *ss.Spec.Replicas
+		if metaErrs.IsNotFound(err) {
+			return false, 0, nil
 		}
+		return false, 0, err
 	}
-	return
+	if !p.hasResourceName(&ss.Spec.Template.Spec) {
+		return false, 0, nil
+	}
+	var replicas int32 = 1
+	if ss.Spec.Replicas != nil {
+		replicas = *ss.Spec.Replicas
+	}
+	return true, replicas, nil
 }
 
 func (p *FloatingIPPlugin) shouldReserve(pod *corev1.Pod, keyObj *util.KeyObj,
@@ -93,6 +90,10 @@ func (p *FloatingIPPlugin) shouldReserve(pod *corev1.Pod, keyObj *util.KeyObj,
 	if !appExist {
 		return false, deletedAndParentAppNotExistPod, nil
 	}
+	if replicas == util.NoOrdinal {
+		// pod names of the app have no ordinal, a deleted pod is never recreated with the same name
+		return false, deletedNonOrdinalPod, nil
+	}
 	index, err := parsePodIndex(pod.Name)
 	if err != nil {
 		return false, "", fmt.Errorf("invalid pod name %s of key %s: %v", util.PodName(pod), keyObj.KeyInDB, err)
@@ -117,6 +118,10 @@ func (p *FloatingIPPlugin) shouldReleaseDuringResync(keyObj *util.KeyObj, releas
 		// 2. deleted pods whose parent statefulset or tapp exist but is not ip immutable
 		return true, deletedAndIPMutablePod
 	}
+	if replicas == util.NoOrdinal {
+		// pod names of the app have no ordinal, a deleted pod is never recreated with the same name
+		return true, deletedNonOrdinalPod
+	}
 	index, err := parsePodIndex(keyObj.KeyInDB)
 	if err != nil {
 		glog.Errorf("invalid pod name of key %s: %v", keyObj.KeyInDB, err)
@@ -127,19 +132,3 @@ func (p *FloatingIPPlugin) shouldReleaseDuringResync(keyObj *util.KeyObj, releas
 	}
 	return false, ""
 }
-
-func (p *FloatingIPPlugin) getSSMap() (map[string]*appv1.StatefulSet, error) {
-	sss, err := p.StatefulSetLister.List(labels.Everything())
-	if err != nil {
-		return nil, err
-	}
-	key2App := make(map[string]*appv1.StatefulSet)
-	for i := range sss {
-		if !p.hasResourceName(&sss[i].Spec.Template.Spec) {
-			continue
-		}
-		key2App[util.StatefulsetName(sss[i])] = sss[i]
-	}
-	glog.V(5).Infof("%v", key2App)
-	return key2App, nil
-}
@@ -17,50 +17,24 @@
 package schedulerplugin
 
 import (
-	"fmt"
-
-	corev1 "k8s.io/api/core/v1"
 	metaErrs "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/labels"
-	glog "k8s.io/klog"
-	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
-	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
 )
 
-func tAppFullName(tapp *tappv1.TApp) string {
-	return fmt.Sprintf("%s_%s", tapp.Namespace, tapp.Name)
-}
-
-func (p *FloatingIPPlugin) getTAppMap() (map[string]*tappv1.TApp, error) {
+// tappApp returns whether the tapp exists and its replicas, a tapp whose pods don't ask for floating ips is regarded
+// as not existing
+func (p *FloatingIPPlugin) tappApp(namespace, name string) (bool, int32, error) {
 	if p.TAppLister == nil {
-		return map[string]*tappv1.TApp{}, nil
+		return false, 0, nil
 	}
-	tApps, err := p.TAppLister.List(labels.Everything())
+	tapp, err := p.TAppLister.TApps(namespace).Get(name)
 	if err != nil {
-		return nil, err
-	}
-	key2App := make(map[string]*tappv1.TApp)
-	for i := range tApps {
-		if !p.hasResourceName(&tApps[i].Spec.Template.Spec) {
-			continue
+		if metaErrs.IsNotFound(err) {
+			return false, 0, nil
 		}
-		key2App[tAppFullName(tApps[i])] = tApps[i]
+		return false, 0, err
 	}
-	glog.V(5).Infof("%v", key2App)
-	return key2App, nil
-}
-
-func (p *FloatingIPPlugin) getTAppReplicas(pod *corev1.Pod,
-	keyObj *util.KeyObj) (appExist bool, replicas int32, retErr error) {
-	tapp, err := p.TAppLister.TApps(pod.Namespace).Get(keyObj.AppName)
-	if err != nil {
-		if !metaErrs.IsNotFound(err) {
-			retErr = err
-			return
-		}
-	} else {
-		appExist = true
-		replicas = tapp.Spec.Replicas
+	if !p.hasResourceName(&tapp.Spec.Template.Spec) {
+		return false, 0, nil
 	}
-	return
+	return true, tapp.Spec.Replicas, nil
 }
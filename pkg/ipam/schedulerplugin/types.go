@@ -17,11 +17,17 @@
 package schedulerplugin
 
 import (
+	"strings"
+
 	extensionClient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	coreInformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	appv1 "k8s.io/client-go/listers/apps/v1"
+	batchv1 "k8s.io/client-go/listers/batch/v1"
 	corev1lister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
 	crd_clientset "tkestack.io/galaxy/pkg/ipam/client/clientset/versioned"
+	crdInformers "tkestack.io/galaxy/pkg/ipam/client/informers/externalversions/galaxy/v1alpha1"
 	list "tkestack.io/galaxy/pkg/ipam/client/listers/galaxy/v1alpha1"
 	"tkestack.io/galaxy/pkg/ipam/floatingip"
 	"tkestack.io/galaxy/pkg/utils/database"
@@ -36,14 +42,28 @@ type PluginFactoryArgs struct {
 	StatefulSetLister appv1.StatefulSetLister
 	DeploymentLister  appv1.DeploymentLister
 	TAppLister        v1.TAppLister
+	DaemonSetLister   appv1.DaemonSetLister
+	JobLister         batchv1.JobLister
 	PoolLister        list.PoolLister
 	PodHasSynced      func() bool
 	StatefulSetSynced func() bool
 	DeploymentSynced  func() bool
 	TAppHasSynced     func() bool
+	DaemonSetSynced   func() bool
+	JobSynced         func() bool
 	PoolSynced        func() bool
 	CrdClient         crd_clientset.Interface
 	ExtClient         extensionClient.Interface
+	// FloatingIPInformer keeps caches of k8s-crd storage driver up to date if it is not nil
+	FloatingIPInformer crdInformers.FloatingIPInformer
+	// FloatingIPPoolInformer is required if floating ips are configured by FloatingIPPool objects
+	FloatingIPPoolInformer crdInformers.FloatingIPPoolInformer
+	// PoolInformer reconciles size and status of Pool objects if it is not nil
+	PoolInformer crdInformers.PoolInformer
+	// EventRecorder records events on pods if it is not nil
+	EventRecorder record.EventRecorder
+	// NodeInformer keeps the node subnet cache up to date and saves querying apiserver for nodes if it is not nil
+	NodeInformer coreInformers.NodeInformer
 }
 
 const (
@@ -51,6 +71,11 @@ const (
 	deletedAndParentAppNotExistPod = "deletedAndParentAppNotExistPod"
 	deletedAndScaledDownAppPod     = "deletedAndScaledDownAppPod"
 	deletedAndScaledDownDpPod      = "deletedAndScaledDownDpPod"
+	deletedNonOrdinalPod           = "deletedNonOrdinalPod"
+	scaledDownPool                 = "scaledDownPool"
+	deletedPool                    = "deletedPool"
+	rolledBackBind                 = "rolledBackBind"
+	expiredTTL                     = "expiredTTL"
 )
 
 type Conf struct {
@@ -61,11 +86,56 @@ type Conf struct {
 	ConfigMapNamespace    string                   `json:"configMapNamespace"`
 	FloatingIPKey         string                   `json:"floatingipKey"`       // configmap floatingip data key
 	SecondFloatingIPKey   string                   `json:"secondFloatingipKey"` // configmap second floatingip data key
+	IPv6FloatingIPKey     string                   `json:"ipv6FloatingipKey"`   // configmap ipv6 floatingip data key
+	NamespaceQuotaKey     string                   `json:"namespaceQuotaKey"`   // configmap namespace quota data key
 	CloudProviderGRPCAddr string                   `json:"cloudProviderGrpcAddr"`
 	StorageDriver         string                   `json:"storageDriver"`
+	BoltDBPath            string                   `json:"boltDBPath"` // db file path of bolt storage driver
+	// NamespaceQuotas limits the number of floating ips of each namespace, overridden by configmap if it has
+	// NamespaceQuotaKey data
+	NamespaceQuotas map[string]int `json:"namespaceQuotas,omitempty"`
+	// UseFloatingIPPoolCRD configures floating ips by FloatingIPPool objects instead of FloatingIPs or configmap
+	UseFloatingIPPoolCRD bool `json:"useFloatingIPPoolCRD,omitempty"`
+	// AllocationStrategy decides which unallocated ip of a subnet is allocated, one of lowest-ip (default),
+	// round-robin, random and least-recently-released
+	AllocationStrategy string `json:"allocationStrategy,omitempty"`
+	// ReleaseQuarantineSeconds is how long ips released from pods stay unallocatable unless the same pod takes them
+	// back, overridden by quarantineSeconds of floatingip ranges
+	ReleaseQuarantineSeconds uint `json:"releaseQuarantineSeconds,omitempty"`
+	// HistoryRetentionDays is how long history records of floating ips are kept, 0 disables recording history
+	HistoryRetentionDays uint `json:"historyRetentionDays,omitempty"`
+	// PoolNamespace is the namespace of Pool objects, defaults to kube-system
+	PoolNamespace string `json:"poolNamespace,omitempty"`
+	// NamedIPAMs are ipams which pods select by name to get ips of other networks besides the first ipam. The
+	// second ipam is always defined as the one named second.
+	NamedIPAMs []NamedIPAMConf `json:"namedIPAMs,omitempty"`
+	// Networks bind multus networks to ipams, pods attaching these networks by k8s.v1.cni.cncf.io/networks
+	// annotation get an ip of each network from its ipam
+	Networks []NetworkConf `json:"networks,omitempty"`
+}
+
+// NetworkConf binds a multus network to the ipam it draws ips from
+type NetworkConf struct {
+	// Name is the network name of k8s.v1.cni.cncf.io/networks annotation, i.e. the type of galaxy NetworkConf
+	Name string `json:"name"`
+	// IPAM is the name of the named ipam of the network, empty for the first ipam
+	IPAM string `json:"ipam,omitempty"`
 }
 
-func (conf *Conf) validate() {
+// NamedIPAMConf is the config of a named ipam
+type NamedIPAMConf struct {
+	Name string `json:"name"`
+	// ConfigKey is the configmap data key of floatingips of the ipam, defaults to <name>_floatingips
+	ConfigKey string `json:"configKey,omitempty"`
+	// Table is the mysql table or bolt bucket of the ipam, defaults to ip_pool_<name> with "-" replaced by "_"
+	Table string `json:"table,omitempty"`
+	// IPType is the ipType label of FloatingIP objects and the ipType of FloatingIPPool objects of the ipam,
+	// defaults to name
+	IPType string `json:"ipType,omitempty"`
+}
+
+// Validate fills default values of conf
+func (conf *Conf) Validate() {
 	if conf.ResyncInterval < 1 {
 		conf.ResyncInterval = 1
 	}
@@ -75,13 +145,61 @@ func (conf *Conf) validate() {
 	if conf.ConfigMapNamespace == "" {
 		conf.ConfigMapNamespace = "kube-system"
 	}
+	if conf.PoolNamespace == "" {
+		conf.PoolNamespace = "kube-system"
+	}
 	if conf.FloatingIPKey == "" {
 		conf.FloatingIPKey = "floatingips"
 	}
 	if conf.SecondFloatingIPKey == "" {
 		conf.SecondFloatingIPKey = "second_floatingips"
 	}
+	if conf.IPv6FloatingIPKey == "" {
+		conf.IPv6FloatingIPKey = "ipv6_floatingips"
+	}
+	if conf.NamespaceQuotaKey == "" {
+		conf.NamespaceQuotaKey = "namespace_quotas"
+	}
 	if conf.StorageDriver == "" {
 		conf.StorageDriver = "mysql"
 	}
+	if conf.BoltDBPath == "" {
+		conf.BoltDBPath = "/var/lib/galaxy-ipam/galaxy-ipam.db"
+	}
+	conf.validateNamedIPAMs()
+}
+
+// validateNamedIPAMs fills default values of named ipams, the second ipam keeps its config key, table and ip type
+func (conf *Conf) validateNamedIPAMs() {
+	var hasSecond bool
+	for i := range conf.NamedIPAMs {
+		named := &conf.NamedIPAMs[i]
+		if named.Name == SecondIPAMName {
+			hasSecond = true
+			if named.ConfigKey == "" {
+				named.ConfigKey = conf.SecondFloatingIPKey
+			}
+			if named.Table == "" {
+				named.Table = database.SecondFloatingipTableName
+			}
+			if named.IPType == "" {
+				named.IPType = secondIPType
+			}
+			continue
+		}
+		if named.ConfigKey == "" {
+			named.ConfigKey = named.Name + "_floatingips"
+		}
+		if named.Table == "" {
+			// mysql tables are not quoted in sql, so "-" which dns labels allow is not allowed in tables
+			named.Table = "ip_pool_" + strings.Replace(named.Name, "-", "_", -1)
+		}
+		if named.IPType == "" {
+			named.IPType = named.Name
+		}
+	}
+	if !hasSecond {
+		conf.NamedIPAMs = append([]NamedIPAMConf{{Name: SecondIPAMName, ConfigKey: conf.SecondFloatingIPKey,
+			Table: database.SecondFloatingipTableName, IPType: secondIPType}}, conf.NamedIPAMs...)
+	}
 }
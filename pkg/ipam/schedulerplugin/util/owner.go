@@ -0,0 +1,148 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package util
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// OwnerResolver resolves apps of pods owned by a kind of workload. IPs of these pods are keyed by pod names, so that a
+// pod recreated with the same name, e.g. a statefulset pod, is able to get its ip back if the app is ip immutable.
+// Deployment pods share ips of their deployment instead and are not resolved by OwnerResolvers.
+type OwnerResolver interface {
+	// AppType returns the app type used by apis, e.g. statefulset
+	AppType() string
+	// KeyPrefix returns the key prefix of ips of the app type, e.g. sts_
+	KeyPrefix() string
+	// AppName returns the name of the app which owns the pod, or an empty string if the pod is not owned by the app type
+	AppName(pod *corev1.Pod) string
+	// App returns whether the app exists and its replicas. A deleted pod whose name ends with an ordinal not less than
+	// replicas is regarded as scaled down. Apps whose pod names have no ordinal should return NoOrdinal.
+	App(namespace, name string) (exist bool, replicas int32, err error)
+}
+
+// NoOrdinal is the replicas returned by OwnerResolver.App for apps whose pod names have no ordinal. Since a deleted pod
+// of these apps is never recreated with the same name, its ip is released even if the app is ip immutable.
+const NoOrdinal int32 = math.MaxInt32
+
+// OwnerKindResolver resolves pods whose owner is of Kind
+type OwnerKindResolver struct {
+	Type   string
+	Prefix string
+	Kind   string
+	// AppFunc returns whether the app exists and its replicas
+	AppFunc func(namespace, name string) (bool, int32, error)
+}
+
+// AppType returns the app type used by apis
+func (r *OwnerKindResolver) AppType() string {
+	return r.Type
+}
+
+// KeyPrefix returns the key prefix of ips of the app type
+func (r *OwnerKindResolver) KeyPrefix() string {
+	return r.Prefix
+}
+
+// AppName returns the owner name if the owner is of Kind
+func (r *OwnerKindResolver) AppName(pod *corev1.Pod) string {
+	if len(pod.OwnerReferences) > 0 && pod.OwnerReferences[0].Kind == r.Kind {
+		return pod.OwnerReferences[0].Name
+	}
+	return ""
+}
+
+// App returns whether the app exists and its replicas by AppFunc
+func (r *OwnerKindResolver) App(namespace, name string) (bool, int32, error) {
+	if r.AppFunc == nil {
+		return false, 0, fmt.Errorf("no way to get %s %s", r.Type, Join(name, namespace))
+	}
+	return r.AppFunc(namespace, name)
+}
+
+var (
+	ownerResolverLock sync.RWMutex
+	// ownerResolvers resolve pods in order, the builtin ones are replaced by schedulerplugin with ones which are able
+	// to get apps
+	ownerResolvers = []OwnerResolver{
+		&OwnerKindResolver{Type: "statefulset", Prefix: StatefulsetPrefixKey, Kind: "StatefulSet"},
+		&OwnerKindResolver{Type: "tapp", Prefix: TAppPrefixKey, Kind: "TApp"},
+	}
+	validKeyPrefix = regexp.MustCompile(`^[a-z0-9]+_$`)
+)
+
+// RegisterOwnerResolver registers the resolver, which replaces the registered one of the same key prefix. Key prefix
+// must be lowercase letters and digits ending with "_" since "_" splits keys.
+func RegisterOwnerResolver(r OwnerResolver) error {
+	prefix, appType := r.KeyPrefix(), r.AppType()
+	if !validKeyPrefix.MatchString(prefix) {
+		return fmt.Errorf("invalid key prefix %q of app type %s", prefix, appType)
+	}
+	if prefix == DeploymentPrefixKey || strings.HasPrefix(poolPrefix, prefix) ||
+		strings.HasPrefix(QuarantinePrefix, prefix) {
+		return fmt.Errorf("key prefix %q is reserved", prefix)
+	}
+	if appType == "" || appType == "deployment" {
+		return fmt.Errorf("invalid app type %q", appType)
+	}
+	ownerResolverLock.Lock()
+	defer ownerResolverLock.Unlock()
+	for i := range ownerResolvers {
+		if ownerResolvers[i].KeyPrefix() == prefix {
+			ownerResolvers[i] = r
+			return nil
+		}
+		if ownerResolvers[i].AppType() == appType {
+			return fmt.Errorf("app type %s is registered with key prefix %s", appType, ownerResolvers[i].KeyPrefix())
+		}
+	}
+	ownerResolvers = append(ownerResolvers, r)
+	return nil
+}
+
+// OwnerResolvers returns registered resolvers
+func OwnerResolvers() []OwnerResolver {
+	ownerResolverLock.RLock()
+	defer ownerResolverLock.RUnlock()
+	return append([]OwnerResolver(nil), ownerResolvers...)
+}
+
+// OwnerResolverByPrefix returns the resolver of the key prefix, or nil if not registered
+func OwnerResolverByPrefix(prefix string) OwnerResolver {
+	for _, r := range OwnerResolvers() {
+		if r.KeyPrefix() == prefix {
+			return r
+		}
+	}
+	return nil
+}
+
+// OwnerResolverByAppType returns the resolver of the app type, or nil if not registered
+func OwnerResolverByAppType(appType string) OwnerResolver {
+	for _, r := range OwnerResolvers() {
+		if r.AppType() == appType {
+			return r
+		}
+	}
+	return nil
+}
@@ -84,6 +84,14 @@ func (k *KeyObj) TApp() bool {
 	return k.AppTypePrefix == TAppPrefixKey
 }
 
+// OwnerResolver returns the resolver of the app type, or nil if it is a deployment key or the app type is unknown
+func (k *KeyObj) OwnerResolver() OwnerResolver {
+	if k.AppTypePrefix == "" {
+		return nil
+	}
+	return OwnerResolverByPrefix(k.AppTypePrefix)
+}
+
 func (k *KeyObj) genKey() {
 	var prefix string
 	if k.PoolName != "" {
@@ -124,6 +132,8 @@ const (
 	DeploymentPrefixKey  = "dp_"
 	StatefulsetPrefixKey = "sts_"
 	TAppPrefixKey        = "tapp_"
+	DaemonSetPrefixKey   = "ds_"
+	JobPrefixKey         = "job_"
 )
 
 func FormatKey(pod *corev1.Pod) *KeyObj {
@@ -135,21 +145,21 @@ func FormatKey(pod *corev1.Pod) *KeyObj {
 	if len(pod.OwnerReferences) == 0 {
 		return keyObj
 	}
-	if pod.OwnerReferences[0].Kind == "StatefulSet" {
-		keyObj.AppName = pod.OwnerReferences[0].Name
-		keyObj.AppTypePrefix = StatefulsetPrefixKey
-	} else if pod.OwnerReferences[0].Kind == "TApp" {
-		keyObj.AppName = pod.OwnerReferences[0].Name
-		keyObj.AppTypePrefix = TAppPrefixKey
-	} else {
-		deploymentName := resolveDeploymentName(pod)
-		if deploymentName == "" {
+	for _, r := range OwnerResolvers() {
+		if appName := r.AppName(pod); appName != "" {
+			keyObj.AppName = appName
+			keyObj.AppTypePrefix = r.KeyPrefix()
+			keyObj.genKey()
 			return keyObj
 		}
-		keyObj.AppName = deploymentName
-		keyObj.IsDeployment = true
-		keyObj.AppTypePrefix = DeploymentPrefixKey
 	}
+	deploymentName := resolveDeploymentName(pod)
+	if deploymentName == "" {
+		return keyObj
+	}
+	keyObj.AppName = deploymentName
+	keyObj.IsDeployment = true
+	keyObj.AppTypePrefix = DeploymentPrefixKey
 	keyObj.genKey()
 	return keyObj
 }
@@ -171,10 +181,8 @@ func ParseKey(key string) *KeyObj {
 	if strings.HasPrefix(removedPoolKey, DeploymentPrefixKey) {
 		keyObj.AppTypePrefix = DeploymentPrefixKey
 		keyObj.IsDeployment = true
-	} else if strings.HasPrefix(removedPoolKey, StatefulsetPrefixKey) {
-		keyObj.AppTypePrefix = StatefulsetPrefixKey
-	} else if strings.HasPrefix(removedPoolKey, TAppPrefixKey) {
-		keyObj.AppTypePrefix = TAppPrefixKey
+	} else if r := OwnerResolverByPrefix(removedPoolKey[:strings.Index(removedPoolKey, "_")+1]); r != nil {
+		keyObj.AppTypePrefix = r.KeyPrefix()
 	}
 	keyObj.AppName, keyObj.PodName, keyObj.Namespace = resolvePodKey(removedPoolKey)
 	return keyObj
@@ -191,6 +199,23 @@ func resolvePodKey(key string) (string, string, string) {
 	return "", "", ""
 }
 
+// QuarantinePrefix is the key prefix of released ips in quarantine
+const QuarantinePrefix = "quarantine__"
+
+// QuarantineKey returns the key of ips released from key which are in quarantine,
+// e.g. quarantine__sts_ns1_demo_demo-1
+func QuarantineKey(key string) string {
+	return QuarantinePrefix + key
+}
+
+// ParseQuarantineKey returns the key which released the ip and true if key is a quarantine key
+func ParseQuarantineKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, QuarantinePrefix) {
+		return key, false
+	}
+	return key[len(QuarantinePrefix):], true
+}
+
 func Join(name, namespace string) string {
 	return fmt.Sprintf("%s_%s", namespace, name)
 }
@@ -404,3 +404,54 @@ func TestNewKeyObj(t *testing.T) {
 		t.Fatal(keyObj.KeyInDB)
 	}
 }
+
+func TestQuarantineKey(t *testing.T) {
+	for _, key := range []string{"sts_ns1_demo_demo-1", "pool__pool1_dp_ns1_dp1_dp1-x1", "dp_ns1_dp1_dp1-x1"} {
+		quarantineKey := QuarantineKey(key)
+		if parsed, ok := ParseQuarantineKey(quarantineKey); !ok || parsed != key {
+			t.Fatalf("expect %s, real %s %v", key, parsed, ok)
+		}
+		// resyncing must not take quarantine keys as pod keys
+		if keyObj := ParseKey(quarantineKey); keyObj.PodName != "" || keyObj.PoolName != "" {
+			t.Fatalf("expect no pod or pool of %s, real %+v", quarantineKey, keyObj)
+		}
+	}
+	if _, ok := ParseQuarantineKey("sts_ns1_demo_demo-1"); ok {
+		t.Fatal("expect not a quarantine key")
+	}
+}
+
+func TestRegisterOwnerResolver(t *testing.T) {
+	defer func(resolvers []OwnerResolver) { ownerResolvers = resolvers }(OwnerResolvers())
+	for _, r := range []*OwnerKindResolver{
+		{Type: "cron", Prefix: "cron"},
+		{Type: "cron", Prefix: "Cron_"},
+		{Type: "cron", Prefix: DeploymentPrefixKey},
+		{Type: "cron", Prefix: "pool_"},
+		{Type: "cron", Prefix: "quarantine_"},
+		{Type: "deployment", Prefix: "cron_"},
+		{Type: "tapp", Prefix: "cron_"},
+	} {
+		if err := RegisterOwnerResolver(r); err == nil {
+			t.Errorf("expect an error registering %+v", r)
+		}
+	}
+	if err := RegisterOwnerResolver(&OwnerKindResolver{Type: "cron", Prefix: "cron_", Kind: "CronJob"}); err != nil {
+		t.Fatal(err)
+	}
+	pod := CreateStatefulSetPod("cron1-x1", "ns1", nil)
+	pod.OwnerReferences[0].Kind = "CronJob"
+	keyObj := FormatKey(pod)
+	if keyObj.KeyInDB != "cron_ns1_cron1_cron1-x1" || keyObj.OwnerResolver() == nil ||
+		keyObj.OwnerResolver().AppType() != "cron" {
+		t.Fatalf("unexpected key %+v", keyObj)
+	}
+	expect := KeyObj{KeyInDB: "pool__pl1_cron_ns1_cron1_cron1-x1", AppTypePrefix: "cron_", AppName: "cron1",
+		PodName: "cron1-x1", Namespace: "ns1", PoolName: "pl1"}
+	if got := ParseKey(expect.KeyInDB); !reflect.DeepEqual(*got, expect) {
+		t.Fatalf("expect %+v, got %+v", expect, *got)
+	}
+	if keyObj := ParseKey("dp_ns1_dp1_dp1-x1"); keyObj.OwnerResolver() != nil {
+		t.Fatal("expect no resolver of deployment keys")
+	}
+}
@@ -23,10 +23,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/emicklei/go-restful"
 	"github.com/emicklei/go-restful-swagger12"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	corev1 "k8s.io/api/core/v1"
 	extensionClient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -47,6 +50,7 @@ import (
 	"tkestack.io/galaxy/pkg/ipam/client/clientset/versioned"
 	crdInformer "tkestack.io/galaxy/pkg/ipam/client/informers/externalversions"
 	"tkestack.io/galaxy/pkg/ipam/crd"
+	"tkestack.io/galaxy/pkg/ipam/metrics"
 	"tkestack.io/galaxy/pkg/ipam/schedulerplugin"
 	"tkestack.io/galaxy/pkg/ipam/server/options"
 	"tkestack.io/galaxy/pkg/utils/httputil"
@@ -73,7 +77,10 @@ type Server struct {
 	crdInformerFactory   crdInformer.SharedInformerFactory
 	tappInformerFactory  tappInformers.SharedInformerFactory
 	stopChan             chan struct{}
+	recorder             record.EventRecorder
 	leaderElectionConfig *leaderelection.LeaderElectionConfig
+	// leading is set to 1 once the server starts running as the leader
+	leading int32
 }
 
 func NewServer() *Server {
@@ -99,32 +106,45 @@ func (s *Server) init() error {
 	podInformer := s.informerFactory.Core().V1().Pods()
 	statefulsetInformer := s.informerFactory.Apps().V1().StatefulSets()
 	deploymentInformer := s.informerFactory.Apps().V1().Deployments()
+	daemonSetInformer := s.informerFactory.Apps().V1().DaemonSets()
+	jobInformer := s.informerFactory.Batch().V1().Jobs()
+	nodeInformer := s.informerFactory.Core().V1().Nodes()
 	s.crdInformerFactory = crdInformer.NewSharedInformerFactory(s.crdClient, 0)
 	poolInformer := s.crdInformerFactory.Galaxy().V1alpha1().Pools()
+	fipInformer := s.crdInformerFactory.Galaxy().V1alpha1().FloatingIPs()
+	fipPoolInformer := s.crdInformerFactory.Galaxy().V1alpha1().FloatingIPPools()
 	s.tappInformerFactory = tappInformers.NewSharedInformerFactory(s.tappClient, time.Minute)
 	tappInformer := s.tappInformerFactory.Tappcontroller().V1().TApps()
 
 	pluginArgs := &schedulerplugin.PluginFactoryArgs{
-		PodLister:         podInformer.Lister(),
-		StatefulSetLister: statefulsetInformer.Lister(),
-		DeploymentLister:  deploymentInformer.Lister(),
-		TAppLister:        tappInformer.Lister(),
-		Client:            s.client,
-		TAppClient:        s.tappClient,
-		PodHasSynced:      podInformer.Informer().HasSynced,
-		TAppHasSynced:     tappInformer.Informer().HasSynced,
-		StatefulSetSynced: statefulsetInformer.Informer().HasSynced,
-		DeploymentSynced:  deploymentInformer.Informer().HasSynced,
-		PoolLister:        poolInformer.Lister(),
-		PoolSynced:        poolInformer.Informer().HasSynced,
-		CrdClient:         s.crdClient,
-		ExtClient:         s.extensionClient,
+		PodLister:              podInformer.Lister(),
+		StatefulSetLister:      statefulsetInformer.Lister(),
+		DeploymentLister:       deploymentInformer.Lister(),
+		TAppLister:             tappInformer.Lister(),
+		DaemonSetLister:        daemonSetInformer.Lister(),
+		JobLister:              jobInformer.Lister(),
+		Client:                 s.client,
+		TAppClient:             s.tappClient,
+		PodHasSynced:           podInformer.Informer().HasSynced,
+		TAppHasSynced:          tappInformer.Informer().HasSynced,
+		StatefulSetSynced:      statefulsetInformer.Informer().HasSynced,
+		DeploymentSynced:       deploymentInformer.Informer().HasSynced,
+		DaemonSetSynced:        daemonSetInformer.Informer().HasSynced,
+		JobSynced:              jobInformer.Informer().HasSynced,
+		PoolLister:             poolInformer.Lister(),
+		PoolSynced:             poolInformer.Informer().HasSynced,
+		CrdClient:              s.crdClient,
+		ExtClient:              s.extensionClient,
+		FloatingIPInformer:     fipInformer,
+		FloatingIPPoolInformer: fipPoolInformer,
+		PoolInformer:           poolInformer,
+		NodeInformer:           nodeInformer,
+		EventRecorder:          s.recorder,
 	}
 	s.plugin, err = schedulerplugin.NewFloatingIPPlugin(s.SchedulePluginConf, pluginArgs)
 	if err != nil {
 		return err
 	}
-	podInformer.Informer().AddEventHandler(eventhandler.NewPodEventHandler(s.plugin))
 	return nil
 }
 
@@ -133,6 +153,10 @@ func (s *Server) Start() error {
 		return fmt.Errorf("init server: %v", err)
 	}
 	if s.LeaderElection.LeaderElect && s.leaderElectionConfig != nil {
+		// standby replicas keep caches warm by informers and serve reading api requests, so that they are able to
+		// take over quickly
+		s.startInformers()
+		go s.startAPIServer()
 		leaderelection.RunOrDie(context.Background(), *s.leaderElectionConfig)
 		return nil
 	}
@@ -140,9 +164,9 @@ func (s *Server) Start() error {
 }
 
 func (s *Server) Run() error {
-	go s.informerFactory.Start(s.stopChan)
-	go s.crdInformerFactory.Start(s.stopChan)
-	go s.tappInformerFactory.Start(s.stopChan)
+	// only the leader handles pod events
+	s.informerFactory.Core().V1().Pods().Informer().AddEventHandler(eventhandler.NewPodEventHandler(s.plugin))
+	s.startInformers()
 	if err := crd.EnsureCRDCreated(s.extensionClient); err != nil {
 		return err
 	}
@@ -150,11 +174,21 @@ func (s *Server) Run() error {
 		return err
 	}
 	s.plugin.Run(s.stopChan)
-	go s.startAPIServer()
+	atomic.StoreInt32(&s.leading, 1)
+	if !s.LeaderElection.LeaderElect {
+		go s.startAPIServer()
+	}
 	s.startServer()
 	return nil
 }
 
+// startInformers starts informers which are not started yet
+func (s *Server) startInformers() {
+	go s.informerFactory.Start(s.stopChan)
+	go s.crdInformerFactory.Start(s.stopChan)
+	go s.tappInformerFactory.Start(s.stopChan)
+}
+
 // #lizard forgives
 func (s *Server) initk8sClient() {
 	cfg, err := clientcmd.BuildConfigFromFlags(s.Master, s.KubeConf)
@@ -191,7 +225,7 @@ func (s *Server) initk8sClient() {
 	// add a uniquifier so that two processes on the same host don't accidentally both become active
 	id = id + "_" + string(uuid.NewUUID())
 
-	recorder, err := newRecoder(cfg)
+	s.recorder, err = newRecoder(cfg)
 	if err != nil {
 		glog.Fatalf("failed init event recorder: %v", err)
 	}
@@ -204,7 +238,7 @@ func (s *Server) initk8sClient() {
 			leaderElectionClient.CoordinationV1(),
 			resourcelock.ResourceLockConfig{
 				Identity:      id,
-				EventRecorder: recorder,
+				EventRecorder: s.recorder,
 			})
 		if err != nil {
 			glog.Fatalf("error creating lock: %v", err)
@@ -257,6 +291,9 @@ func (s *Server) startServer() {
 	container := restful.NewContainer()
 	container.Add(ws)
 	container.Add(health)
+	metrics.Register()
+	prometheus.MustRegister(s.plugin.NewCollector())
+	container.Handle("/metrics", promhttp.Handler())
 	if err := http.ListenAndServe(fmt.Sprintf("%s:%d", s.Bind, s.Port), container); err != nil {
 		glog.Fatalf("unable to listen: %v.", err)
 	}
@@ -267,8 +304,10 @@ func (s *Server) startAPIServer() {
 	ws.
 		Path("/v1").
 		Consumes(restful.MIME_JSON).
-		Produces(restful.MIME_JSON)
-	c := api.NewController(s.plugin.GetIpam(), s.plugin.GetSecondIpam(), s.plugin.PodLister)
+		Produces(restful.MIME_JSON).
+		Filter(s.leaderFilter)
+	c := api.NewController(s.plugin.GetIpam(), s.plugin.GetNamedIpams(), s.plugin.GetIPv6Ipam(),
+		s.plugin.PodLister)
 	ws.Route(ws.GET("/ip").To(c.ListIPs).
 		Doc("List ips by keyword or params").
 		Param(ws.QueryParameter("keyword", "keyword").DataType("string")).
@@ -278,7 +317,9 @@ func (s *Server) startAPIServer() {
 		Param(ws.QueryParameter("namespace", "namespace").DataType("string")).
 		Param(ws.QueryParameter("isDeployment", "listing deployments or statefulsets. Deprecated, please set appType").
 			DataType("boolean")).
-		Param(ws.QueryParameter("appType", "app type, deployment, statefulset or tapp").DataType("string")).
+		Param(ws.QueryParameter("appType", "app type, deployment, statefulset, tapp, daemonset or job").DataType("string")).
+		Param(ws.QueryParameter("excluded", "listing all ips excluded from allocation, other params except "+
+			"paging and sorting ones are ignored if true").DataType("boolean")).
 		Param(ws.QueryParameter("page", "page number, valid range [0,99999]").DataType("integer")).
 		Param(ws.QueryParameter("size", "page size, valid range (0,9999]").DataType("integer").DefaultValue("10")).
 		Param(ws.QueryParameter("sort", "sort by which field, supports ip/namespace/podname/policy asc/desc").
@@ -306,8 +347,90 @@ func (s *Server) startAPIServer() {
 		Returns(http.StatusOK, "request succeed", api.ReleaseIPResp{Resp: httputil.Resp{Code: http.StatusOK}}).
 		Writes(api.ReleaseIPResp{Resp: httputil.Resp{Code: http.StatusOK}}))
 
+	ws.Route(ws.POST("/ip/exclude").To(c.ExcludeIPs).
+		Doc("Exclude ips from allocation").
+		Reads(api.ExcludeIPReq{}).
+		Returns(http.StatusBadRequest, "10.0.0 is not a valid ip", nil).
+		Returns(http.StatusBadRequest, "10.0.0.2 is not in pool", nil).
+		Returns(http.StatusInternalServerError, "internal server error", nil).
+		Returns(http.StatusOK, "request succeed", api.ExcludeIPResp{Resp: httputil.Resp{Code: http.StatusOK},
+			Allocated: []api.FloatingIP{{IP: "10.0.70.118", Namespace: "default", AppName: "app",
+				PodName: "app-0", Policy: 2, UpdateTime: time.Unix(1555924279, 0), Status: "Running",
+				AppType: "statefulset", Excluded: true}}}).
+		Writes(api.ExcludeIPResp{Resp: httputil.Resp{Code: http.StatusOK}}))
+
+	ws.Route(ws.DELETE("/ip/exclude").To(c.IncludeIPs).
+		Doc("Include excluded ips back to allocation").
+		Reads(api.ExcludeIPReq{}).
+		Returns(http.StatusBadRequest, "10.0.0 is not a valid ip", nil).
+		Returns(http.StatusBadRequest, "10.0.0.2 is not in pool", nil).
+		Returns(http.StatusInternalServerError, "internal server error", nil).
+		Returns(http.StatusOK, "request succeed", api.ExcludeIPResp{Resp: httputil.Resp{Code: http.StatusOK}}).
+		Writes(api.ExcludeIPResp{Resp: httputil.Resp{Code: http.StatusOK}}))
+
+	ws.Route(ws.POST("/ip/config/diff").To(c.DiffConfig).
+		Doc("Show ips a proposed floating ip config adds, removes and orphans without applying it").
+		Reads(api.ConfigDiffReq{}).
+		Returns(http.StatusBadRequest, "invalid floating ip config", nil).
+		Returns(http.StatusInternalServerError, "internal server error", nil).
+		Returns(http.StatusOK, "request succeed", api.ConfigDiffResp{Resp: httputil.Resp{Code: http.StatusOK},
+			Added: []string{"10.0.70.120"}, Removed: []string{"10.0.70.94"},
+			Orphaned: []api.FloatingIP{{IP: "10.0.70.118", Namespace: "default", AppName: "app",
+				PodName: "app-0", Policy: 2, UpdateTime: time.Unix(1555924279, 0), Status: "Running",
+				AppType: "statefulset"}}}).
+		Writes(api.ConfigDiffResp{Resp: httputil.Resp{Code: http.StatusOK}}))
+
+	historyController := api.HistoryController{History: s.plugin.GetHistory()}
+	ws.Route(ws.GET("/ip/{ip}/history").To(historyController.GetIPHistory).
+		Doc("List changes of the ip in time order").
+		Param(ws.PathParameter("ip", "ip").DataType("string").Required(true)).
+		Returns(http.StatusBadRequest, "10.0.0 is not a valid ip", nil).
+		Returns(http.StatusBadRequest, "history is disabled", nil).
+		Returns(http.StatusInternalServerError, "internal server error", nil).
+		Returns(http.StatusOK, "request succeed", api.ListHistoryResp{Resp: httputil.NewResp(http.StatusOK, ""),
+			Content: []api.HistoryRecord{{IP: "10.0.70.93", IPAM: "ip_pool", Action: "allocate",
+				Key: "sts_default_app_app-0", Namespace: "default", AppName: "app", NodeName: "node1",
+				Reason: "bind", Policy: 2, Time: time.Unix(1555924386, 0)}}}).
+		Writes(api.ListHistoryResp{}))
+
+	ws.Route(ws.GET("/app/{namespace}/{name}/history").To(historyController.GetAppHistory).
+		Doc("List changes of ips of the app in time order").
+		Param(ws.PathParameter("namespace", "namespace").DataType("string").Required(true)).
+		Param(ws.PathParameter("name", "app name").DataType("string").Required(true)).
+		Returns(http.StatusBadRequest, "history is disabled", nil).
+		Returns(http.StatusInternalServerError, "internal server error", nil).
+		Returns(http.StatusOK, "request succeed", api.ListHistoryResp{Resp: httputil.NewResp(http.StatusOK, ""),
+			Content: []api.HistoryRecord{{IP: "10.0.70.93", IPAM: "ip_pool", Action: "release",
+				Key: "sts_default_app_app-0", Namespace: "default", AppName: "app", NodeName: "node1",
+				Reason: "deletedAndIPMutablePod", Policy: 0, Time: time.Unix(1555924386, 0)}}}).
+		Writes(api.ListHistoryResp{}))
+
+	quotaController := api.QuotaController{Quotas: s.plugin.NamespaceQuotas,
+		Usage: s.plugin.NamespaceUsage}
+	ws.Route(ws.GET("/quota").To(quotaController.ListQuotas).
+		Doc("List floating ip quotas and usages of namespaces").
+		Param(ws.QueryParameter("namespace", "namespace, lists all namespaces which have quotas if empty").
+			DataType("string")).
+		Returns(http.StatusInternalServerError, "internal server error", nil).
+		Returns(http.StatusOK, "request succeed", api.ListQuotaResp{Resp: httputil.NewResp(http.StatusOK, ""),
+			Content: []api.NamespaceQuota{{Namespace: "default", Quota: 10, Used: 3}}}).
+		Writes(api.ListQuotaResp{}))
+
 	poolController := api.PoolController{PoolLister: s.plugin.PoolLister, Client: s.crdClient,
-		LockPool: s.plugin.GetLockPool(), IPAM: s.plugin.GetIpam(), SecondIPAM: s.plugin.GetSecondIpam()}
+		LockPool: s.plugin.GetLockPool(), IPAM: s.plugin.GetIpam(), SecondIPAM: s.plugin.GetSecondIpam(),
+		Namespace: s.plugin.PoolNamespace()}
+	ws.Route(ws.GET("/pool").To(poolController.List).
+		Doc("List pools sorted by name with their usage").
+		Param(ws.QueryParameter("page", "page number, valid range [0,99999]").DataType("integer")).
+		Param(ws.QueryParameter("size", "page size, valid range (0,9999]").DataType("integer").DefaultValue("10")).
+		Returns(http.StatusInternalServerError, "internal server error", nil).
+		Returns(http.StatusOK, "request succeed", api.ListPoolResp{
+			Page: pageutil.Page{Last: true, TotalElements: 1, TotalPages: 1, First: true, NumberOfElements: 1,
+				Size: 10, Number: 0},
+			Content: []api.Pool{{Name: "sample-pool", Size: 4, Namespaces: []string{"default"},
+				Usage: &api.PoolUsage{Size: 4, Bound: 3, Free: 1, Subnets: []string{"10.0.0.0/16"}}}}}).
+		Writes(api.ListPoolResp{}))
+
 	ws.Route(ws.GET("/pool/{name}").To(poolController.Get).
 		Doc("Get pool by name").
 		Param(ws.PathParameter("name", "pool name").DataType("string").Required(true)).
@@ -345,6 +468,16 @@ func (s *Server) startAPIServer() {
 	}
 }
 
+// leaderFilter rejects requests except reading ones until the server becomes the leader, as standby replicas
+// don't configure pools and their changes would be overridden by the leader
+func (s *Server) leaderFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if req.Request.Method != http.MethodGet && atomic.LoadInt32(&s.leading) == 0 {
+		httputil.ServiceUnavailable(resp, fmt.Errorf("not the leader, please retry on the leader replica"))
+		return
+	}
+	chain.ProcessFilter(req, resp)
+}
+
 func addSwaggerUISupport(container *restful.Container) {
 	config := swagger.Config{
 		WebServices:     restful.RegisteredWebServices(),
@@ -367,6 +500,7 @@ func (s *Server) filter(request *restful.Request, response *restful.Response) {
 	start := time.Now()
 	glog.V(3).Infof("filtering %s_%s, start at %d+", args.Pod.Name, args.Pod.Namespace, start.UnixNano())
 	filteredNodes, failedNodesMap, err := s.plugin.Filter(&args.Pod, args.Nodes.Items)
+	metrics.FilterLatency.Observe(time.Since(start).Seconds())
 	glog.V(3).Infof("filtering %s_%s, start at %d-", args.Pod.Name, args.Pod.Namespace, start.UnixNano())
 	args.Nodes.Items = filteredNodes
 	errStr := ""
@@ -406,6 +540,7 @@ func (s *Server) bind(request *restful.Request, response *restful.Response) {
 	start := time.Now()
 	glog.V(3).Infof("binding %s_%s to %s, start at %d+", args.PodName, args.PodNamespace, args.Node, start.UnixNano())
 	err := s.plugin.Bind(args)
+	metrics.BindLatency.Observe(time.Since(start).Seconds())
 	glog.V(3).Infof("binding %s_%s to %s, start at %d-", args.PodName, args.PodNamespace, args.Node, start.UnixNano())
 	var result schedulerapi.ExtenderBindingResult
 	if err != nil {
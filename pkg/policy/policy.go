@@ -43,6 +43,7 @@ import (
 	utilexec "k8s.io/utils/exec"
 	"tkestack.io/galaxy/pkg/api/k8s"
 	"tkestack.io/galaxy/pkg/api/k8s/eventhandler"
+	"tkestack.io/galaxy/pkg/galaxy/metrics"
 	"tkestack.io/galaxy/pkg/utils/ipset"
 	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
 )
@@ -143,6 +144,10 @@ func (p *PolicyManager) startPodInformerFactory() {
 
 func (p *PolicyManager) Run() {
 	glog.Infof("start resyncing network policies")
+	start := time.Now()
+	defer func() {
+		metrics.PolicySyncLatency.Observe(time.Since(start).Seconds())
+	}()
 	p.syncNetworkPolices()
 	p.syncNetworkPolicyRules()
 	p.syncPods()
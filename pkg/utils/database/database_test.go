@@ -23,7 +23,6 @@ import (
 	"testing"
 
 	"github.com/jinzhu/gorm"
-	"tkestack.io/galaxy/pkg/utils/nets"
 )
 
 // #lizard forgives
@@ -34,7 +33,7 @@ func TestDB(t *testing.T) {
 	}
 	defer db.Shutdown()
 
-	fip := FloatingIP{Key: fmt.Sprintf("pod1"), IP: nets.IPToInt(net.IPv4(10, 0, 0, 1))}
+	fip := FloatingIP{Key: fmt.Sprintf("pod1"), IP: IP(net.IPv4(10, 0, 0, 1))}
 	if err := db.GetConn().Debug().Create(&fip).Error; err != nil {
 		t.Fatal(err)
 	}
@@ -50,7 +49,7 @@ func TestDB(t *testing.T) {
 	if len(fips) != 1 {
 		t.Fatalf("%v", fips)
 	}
-	if fips[0].Key != fip.Key || fips[0].IP != fip.IP {
+	if fips[0].Key != fip.Key || !fips[0].IP.Equal(fip.IP) {
 		t.Fatalf("%v %v", fips[0], fip)
 	}
 	// test rollback
@@ -61,7 +60,7 @@ func TestDB(t *testing.T) {
 		}
 	}
 	if err := db.Transaction(
-		createOp(&FloatingIP{Key: "pod2", IP: nets.IPToInt(net.IPv4(10, 0, 0, 2))}),
+		createOp(&FloatingIP{Key: "pod2", IP: IP(net.IPv4(10, 0, 0, 2))}),
 		createOp(&fip),
 	); err == nil {
 		t.Fatal(err)
@@ -98,3 +97,36 @@ func dbInit(t *testing.T) *DBRecorder {
 	}
 	return db
 }
+
+func TestIPValueAndScan(t *testing.T) {
+	for _, c := range []struct {
+		ip    string
+		value interface{}
+	}{
+		{"10.0.0.1", int64(167772161)},
+		{"2001:db8::1", []byte(net.ParseIP("2001:db8::1"))},
+	} {
+		v, err := IP(net.ParseIP(c.ip)).Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%v", v) != fmt.Sprintf("%v", c.value) {
+			t.Fatalf("expect value of %s is %v, real %v", c.ip, c.value, v)
+		}
+		var ip IP
+		if err := ip.Scan(v); err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != c.ip {
+			t.Fatalf("expect %s, real %s", c.ip, ip.String())
+		}
+	}
+	// mysql text protocol returns int column as decimal text
+	var ip IP
+	if err := ip.Scan([]byte("167772161")); err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.1" {
+		t.Fatal(ip.String())
+	}
+}
@@ -17,12 +17,19 @@
 package database
 
 import (
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"strconv"
 	"time"
+
+	"tkestack.io/galaxy/pkg/utils/nets"
 )
 
 var (
 	DefaultFloatingipTableName = "ip_pool"
 	SecondFloatingipTableName  = "ip_pool1"
+	IPv6FloatingipTableName    = "ip_pool_v6"
 )
 
 // select concat((ip>>24)%256,".",(ip>>16)%256,".",(ip>>8)%256,".",ip%256) as ip,`key` from ip_pool
@@ -31,9 +38,75 @@ type FloatingIP struct {
 	Key       string `gorm:"type:varchar(255)"`
 	Subnet    string `gorm:"type:varchar(50)"` // node subnet, not container ip's subnet
 	Attr      string `gorm:"type:varchar(1000)"`
-	IP        uint32 `gorm:"primary_key;not null"`
+	IP        IP     `gorm:"type:int unsigned;primary_key;not null"`
 	Policy    uint16
 	UpdatedAt time.Time
+	// Excluded ips are never allocated, ips which are allocated when excluded are kept until they are released
+	Excluded bool `gorm:"not null;default:false"`
+}
+
+// IP is the ip column of floating ip tables. IPv4 is stored as int unsigned which keeps compatible with
+// existing tables, while ipv6 is stored as varbinary(16) in tables created by CreateIPv6TableIfNotExist.
+type IP net.IP
+
+// Value implements driver.Valuer
+func (ip IP) Value() (driver.Value, error) {
+	if ip4 := net.IP(ip).To4(); ip4 != nil {
+		return int64(nets.IPToInt(ip4)), nil
+	}
+	if ip16 := net.IP(ip).To16(); ip16 != nil {
+		return []byte(ip16), nil
+	}
+	return nil, fmt.Errorf("invalid ip %v", []byte(ip))
+}
+
+// Scan implements sql.Scanner
+func (ip *IP) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*ip = nil
+	case int64:
+		*ip = IP(nets.IntToIP(uint32(v)))
+	case []byte:
+		if len(v) == net.IPv6len {
+			// the driver may reuse the buffer
+			*ip = IP(append(net.IP(nil), v...))
+			return nil
+		}
+		// int unsigned column returns decimal text in mysql text protocol
+		i, err := strconv.ParseUint(string(v), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid ip column value %v: %v", v, err)
+		}
+		*ip = IP(nets.IntToIP(uint32(i)))
+	default:
+		return fmt.Errorf("unsupported ip column type %T", src)
+	}
+	return nil
+}
+
+// String returns the string form of ip
+func (ip IP) String() string {
+	if len(ip) == 0 {
+		return ""
+	}
+	return net.IP(ip).String()
+}
+
+// Equal reports whether ip and x are the same ip address
+func (ip IP) Equal(x IP) bool {
+	return net.IP(ip).Equal(net.IP(x))
+}
+
+// CreateIPv6TableIfNotExist creates floating ip table whose ip column is able to store ipv6 addresses
+func (db *DBRecorder) CreateIPv6TableIfNotExist(fip *FloatingIP) error {
+	if err := db.CreateTableIfNotExist(fip); err != nil {
+		return err
+	}
+	if err := db.conn.Table(fip.TableName()).ModifyColumn("ip", "varbinary(16) NOT NULL").Error; err != nil {
+		return fmt.Errorf("Failed to modify ip column of table %s, error(%v)", fip.TableName(), err)
+	}
+	return nil
 }
 
 func (f FloatingIP) TableName() string {
@@ -0,0 +1,41 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package database
+
+import "time"
+
+// HistoryTableName is the append-only table which records changes of floating ips of all ipams
+var HistoryTableName = "ip_history"
+
+// FloatingIPHistory is a row of the floating ip history table
+type FloatingIPHistory struct {
+	ID        uint64 `gorm:"primary_key;auto_increment"`
+	IP        string `gorm:"type:varchar(50);index"`
+	IPAM      string `gorm:"type:varchar(50)"`
+	Action    string `gorm:"type:varchar(20)"`
+	Key       string `gorm:"type:varchar(255)"`
+	Namespace string `gorm:"type:varchar(255);index:idx_app"`
+	AppName   string `gorm:"type:varchar(255);index:idx_app"`
+	NodeName  string `gorm:"type:varchar(255)"`
+	Reason    string `gorm:"type:varchar(255)"`
+	Policy    uint16
+	Time      time.Time `gorm:"index"`
+}
+
+func (FloatingIPHistory) TableName() string {
+	return HistoryTableName
+}
@@ -47,6 +47,11 @@ func BadRequest(resp *restful.Response, err error) {
 		fmt.Sprintf("bad request: %v", err))) // nolint: errcheck
 }
 
+func ServiceUnavailable(resp *restful.Response, err error) {
+	resp.WriteHeaderAndEntity(http.StatusServiceUnavailable, NewResp(http.StatusServiceUnavailable,
+		fmt.Sprintf("service unavailable: %v", err))) // nolint: errcheck
+}
+
 func ItemNotFound(resp *restful.Response, err error) {
 	resp.WriteHeaderAndEntity(http.StatusNotFound, NewResp(http.StatusNotFound,
 		fmt.Sprintf("not found: %v", err))) // nolint: errcheck
@@ -17,9 +17,12 @@
 package nets
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
+	"math/big"
 	"net"
 	"strings"
 )
@@ -100,16 +103,39 @@ type IPRange struct {
 	First, Last net.IP
 }
 
+// Size returns the number of ips in the range, ipv6 ranges larger than math.MaxUint32 are truncated
 func (ipr IPRange) Size() uint32 {
 	if len(ipr.First) == 0 || len(ipr.Last) == 0 {
 		return 0
 	}
-	return IPToInt(ipr.Last) - IPToInt(ipr.First) + 1
+	if IsIPv4(ipr.First) {
+		return IPToInt(ipr.Last) - IPToInt(ipr.First) + 1
+	}
+	size := new(big.Int).Sub(IPToBigInt(ipr.Last), IPToBigInt(ipr.First))
+	size.Add(size, big.NewInt(1))
+	if !size.IsUint64() || size.Uint64() > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(size.Uint64())
 }
 
 func (ipr IPRange) Contains(ip net.IP) bool {
-	ipInt := IPToInt(ip)
-	return ipInt >= IPToInt(ipr.First) && ipInt <= IPToInt(ipr.Last)
+	if IsIPv4(ip) != IsIPv4(ipr.First) {
+		return false
+	}
+	return CompareIP(ip, ipr.First) >= 0 && CompareIP(ip, ipr.Last) <= 0
+}
+
+// ForEachIP calls fn with every ip in the range in ascending order until fn returns false
+func (ipr IPRange) ForEachIP(fn func(ip net.IP) bool) {
+	if len(ipr.First) == 0 || len(ipr.Last) == 0 {
+		return
+	}
+	for ip := ipr.First; ; ip = NextIP(ip) {
+		if !fn(ip) || ip.Equal(ipr.Last) {
+			return
+		}
+	}
 }
 
 func (ipr IPRange) String() string {
@@ -136,7 +162,7 @@ func ParseIPRange(ipr string) *IPRange {
 		if last == nil {
 			return nil
 		}
-		if IPToInt(first) > IPToInt(last) {
+		if IsIPv4(first) != IsIPv4(last) || CompareIP(first, last) > 0 {
 			return nil
 		}
 		return &IPRange{first, last}
@@ -176,8 +202,8 @@ func (subnet SparseSubnet) Size() uint32 {
 	return size
 }
 
-// IPv4ToInt convert ip to uint32
-// returns 0 if it's an invalid ip
+// IPToInt convert ipv4 to uint32
+// returns 0 if it's an invalid ip, use IPToBigInt for ipv6
 func IPToInt(ip net.IP) uint32 {
 	if len(ip) == net.IPv6len {
 		return binary.BigEndian.Uint32(ip[12:16])
@@ -209,3 +235,65 @@ func LastIPV4(ipNet *net.IPNet) net.IP {
 func FirstAndLastIP(ipNet *net.IPNet) (uint32, uint32) {
 	return IPToInt(ipNet.IP.Mask(ipNet.Mask)), IPToInt(LastIPV4(ipNet))
 }
+
+// IsIPv4 returns true if ip is an ipv4 address or an ipv4-mapped ipv6 address
+func IsIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// IPToBigInt convert ipv4 or ipv6 to big.Int, ipv4 is converted in its 4 bytes form so that it
+// equals to IPToInt
+func IPToBigInt(ip net.IP) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil {
+		return new(big.Int).SetBytes(ip4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+// CompareIP returns an integer comparing two ips of the same family. The result will be 0 if a==b,
+// -1 if a < b, and +1 if a > b.
+func CompareIP(a, b net.IP) int {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil && b4 != nil {
+		return bytes.Compare(a4, b4)
+	}
+	return bytes.Compare(a.To16(), b.To16())
+}
+
+// NextIP returns ip + 1, it wraps around to the zero address of the same family on overflow
+func NextIP(ip net.IP) net.IP {
+	return addIP(ip, 1)
+}
+
+// PrevIP returns ip - 1, it wraps around to the broadcast address of the same family on underflow
+func PrevIP(ip net.IP) net.IP {
+	return addIP(ip, -1)
+}
+
+func addIP(ip net.IP, delta int) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return IntToIP(IPToInt(ip4) + uint32(delta))
+	}
+	ret := make(net.IP, net.IPv6len)
+	copy(ret, ip.To16())
+	for i := len(ret) - 1; i >= 0; i-- {
+		old := ret[i]
+		ret[i] = byte(int(old) + delta)
+		if delta > 0 && ret[i] > old || delta < 0 && ret[i] < old {
+			break
+		}
+	}
+	return ret
+}
+
+// LastIP returns the broadcast address of ipNet for both ipv4 and ipv6
+func LastIP(ipNet *net.IPNet) net.IP {
+	if IsIPv4(ipNet.IP) {
+		return LastIPV4(ipNet)
+	}
+	ip := ipNet.IP.To16()
+	p := make(net.IP, net.IPv6len)
+	for i := range ip {
+		p[i] = ip[i] | (ipNet.Mask[i] ^ 255)
+	}
+	return p
+}
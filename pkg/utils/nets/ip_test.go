@@ -18,6 +18,7 @@ package nets
 
 import (
 	"encoding/json"
+	"math"
 	"net"
 	"testing"
 )
@@ -182,3 +183,77 @@ func TestFirstAndLastIP(t *testing.T) {
 		t.Fatal(last)
 	}
 }
+
+func TestIPv6Range(t *testing.T) {
+	ipr := ParseIPRange("2001:db8::fffe~2001:db8::1:1")
+	if ipr == nil {
+		t.Fatal()
+	}
+	if ipr.Size() != 4 {
+		t.Fatal(ipr.Size())
+	}
+	if !ipr.Contains(net.ParseIP("2001:db8::ffff")) || !ipr.Contains(net.ParseIP("2001:db8::1:0")) {
+		t.Fatal()
+	}
+	if ipr.Contains(net.ParseIP("2001:db8::1:2")) || ipr.Contains(net.IPv4(10, 0, 0, 1)) {
+		t.Fatal()
+	}
+	var ips []string
+	ipr.ForEachIP(func(ip net.IP) bool {
+		ips = append(ips, ip.String())
+		return true
+	})
+	if len(ips) != 4 || ips[0] != "2001:db8::fffe" || ips[3] != "2001:db8::1:1" {
+		t.Fatal(ips)
+	}
+	if ParseIPRange("2001:db8::2~2001:db8::1") != nil {
+		t.Fatal()
+	}
+	if ParseIPRange("10.0.0.1~2001:db8::1") != nil {
+		t.Fatal()
+	}
+	if ipr := ParseIPRange("2001:db8::~2001:db9::"); ipr.Size() != math.MaxUint32 {
+		t.Fatal(ipr.Size())
+	}
+}
+
+func TestNextAndPrevIP(t *testing.T) {
+	for _, c := range []struct {
+		ip, next string
+	}{
+		{"10.0.0.255", "10.0.1.0"},
+		{"255.255.255.255", "0.0.0.0"},
+		{"2001:db8::ffff", "2001:db8::1:0"},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "::"},
+	} {
+		if next := NextIP(net.ParseIP(c.ip)); next.String() != c.next {
+			t.Errorf("expect next ip of %s is %s, real %s", c.ip, c.next, next.String())
+		}
+		if prev := PrevIP(net.ParseIP(c.next)); prev.String() != c.ip {
+			t.Errorf("expect prev ip of %s is %s, real %s", c.next, c.ip, prev.String())
+		}
+	}
+}
+
+func TestCompareIP(t *testing.T) {
+	if CompareIP(net.IPv4(10, 0, 0, 1), net.IP{10, 0, 0, 1}) != 0 {
+		t.Fatal()
+	}
+	if CompareIP(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")) != -1 {
+		t.Fatal()
+	}
+	if CompareIP(net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1)) != 1 {
+		t.Fatal()
+	}
+}
+
+func TestLastIP(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("2001:db8::/120")
+	if LastIP(ipNet).String() != "2001:db8::ff" {
+		t.Fatal(LastIP(ipNet).String())
+	}
+	_, ipNet, _ = net.ParseCIDR("10.149.27.112/26")
+	if LastIP(ipNet).String() != "10.149.27.127" {
+		t.Fatal(LastIP(ipNet).String())
+	}
+}